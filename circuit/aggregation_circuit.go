@@ -0,0 +1,484 @@
+package circuit
+
+import (
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	fposeidon "github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16_bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/std/algebra/emulated/fields_bn254"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bn254"
+	"github.com/consensys/gnark/std/commitments/pedersen"
+	"github.com/consensys/gnark/std/hash/poseidon"
+	"github.com/consensys/gnark/std/math/emulated"
+	stdgroth16 "github.com/consensys/gnark/std/recursion/groth16"
+)
+
+type (
+	RecursiveProof        = stdgroth16.Proof[sw_bn254.G1Affine, sw_bn254.G2Affine]
+	RecursiveVerifyingKey = stdgroth16.VerifyingKey[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl]
+	RecursiveWitness      = stdgroth16.Witness[sw_bn254.ScalarField]
+)
+
+// Batch proofs are aggregated by a tree of fixed arity proofs, so the keys
+// don't depend on the batch counts of a round:
+//   - AggregateLeafCircuit verifies up to arity batch proofs of one tier
+//   - AggregateNodeCircuit verifies up to arity leaf or node proofs
+//
+// Both have one public input, the poseidon hash of the account tree roots and
+// cex assets commitments before the first and after the last aggregated
+// batch. The node hashes the digest of its own verifying key as well, so that
+// the child nodes are verified against the key the verifier checks the root with.
+
+// AggregatedBatch is a batch proof verified by AggregateLeafCircuit. The
+// inactive batches pad the leaf, their proofs are verified but they aren't
+// part of the chain.
+type AggregatedBatch struct {
+	Active                    Variable
+	Proof                     RecursiveProof
+	BeforeAccountTreeRoot     Variable
+	AfterAccountTreeRoot      Variable
+	BeforeCEXAssetsCommitment Variable
+	AfterCEXAssetsCommitment  Variable
+}
+
+// AggregateLeafCircuit verifies the batch create user proofs of one tier and
+// the chaining of their account tree roots and cex assets commitments
+type AggregateLeafCircuit struct {
+	Commitment Variable `gnark:",public"`
+	Batches    []AggregatedBatch
+
+	// the verifying key of the tier is a circuit constant, so that the prover
+	// can't choose the circuit the batch proofs are verified against
+	verifyingKey RecursiveVerifyingKey `gnark:"-"`
+}
+
+// AggregatedChild is a leaf or node proof verified by AggregateNodeCircuit,
+// the inactive children pad the node like the inactive batches of a leaf
+type AggregatedChild struct {
+	Active                    Variable
+	IsNode                    Variable
+	VerifyingKey              RecursiveVerifyingKey
+	Proof                     RecursiveProof
+	BeforeAccountTreeRoot     Variable
+	AfterAccountTreeRoot      Variable
+	BeforeCEXAssetsCommitment Variable
+	AfterCEXAssetsCommitment  Variable
+}
+
+// AggregateNodeCircuit verifies leaf proofs of any tier and node proofs, and
+// the chaining of their account tree roots and cex assets commitments
+type AggregateNodeCircuit struct {
+	Commitment Variable `gnark:",public"`
+	// NodeKeyDigest is the digest of the verifying key of this circuit
+	NodeKeyDigest Variable
+	Children      []AggregatedChild
+
+	// the digests of the leaf verifying keys of every tier
+	leafKeyDigests []*big.Int `gnark:"-"`
+}
+
+// RecursionProverOptions returns the options with which batch proofs must be
+// generated in order to be verified inside the aggregation circuits, the
+// aggregate proofs are generated with them as well.
+func RecursionProverOptions() backend.ProverOption {
+	return stdgroth16.GetNativeProverOptions(ecc.BN254.ScalarField(), ecc.BN254.ScalarField())
+}
+
+// RecursionVerifierOptions returns the options to natively verify proofs
+// generated with RecursionProverOptions.
+func RecursionVerifierOptions() backend.VerifierOption {
+	return stdgroth16.GetNativeVerifierOptions(ecc.BN254.ScalarField(), ecc.BN254.ScalarField())
+}
+
+func NewAggregateLeafCircuit(arity int, vk groth16.VerifyingKey) (*AggregateLeafCircuit, error) {
+	if arity < 2 {
+		return nil, fmt.Errorf("aggregation arity must be at least 2")
+	}
+	recursiveVk, err := valueOfVerifyingKey(vk, true)
+	if err != nil {
+		return nil, fmt.Errorf("convert batch verifying key failed: %s", err.Error())
+	}
+	// BatchCreateUserCircuit only has the batch commitment as public input
+	if len(recursiveVk.G1.K)-len(recursiveVk.PublicAndCommitmentCommitted) != 2 {
+		return nil, fmt.Errorf("batch verifying key has unexpected public inputs")
+	}
+	circuit := AggregateLeafCircuit{
+		Commitment:   0,
+		Batches:      make([]AggregatedBatch, arity),
+		verifyingKey: recursiveVk,
+	}
+	for i := range circuit.Batches {
+		circuit.Batches[i] = AggregatedBatch{
+			Active: 0,
+			Proof: RecursiveProof{
+				Commitments: make([]pedersen.Commitment[sw_bn254.G1Affine], len(recursiveVk.CommitmentKeys)),
+			},
+			BeforeAccountTreeRoot:     0,
+			AfterAccountTreeRoot:      0,
+			BeforeCEXAssetsCommitment: 0,
+			AfterCEXAssetsCommitment:  0,
+		}
+	}
+	return &circuit, nil
+}
+
+// NewAggregateNodeCircuit returns the node circuit of the leaf verifying keys
+// of every tier. The verifying key of the node must have the shape of the
+// leaf verifying keys, see CheckAggregateNodeVerifyingKey.
+func NewAggregateNodeCircuit(arity int, leafVks []groth16.VerifyingKey) (*AggregateNodeCircuit, error) {
+	if arity < 2 {
+		return nil, fmt.Errorf("aggregation arity must be at least 2")
+	}
+	if len(leafVks) == 0 {
+		return nil, fmt.Errorf("there is no leaf verifying key")
+	}
+	circuit := AggregateNodeCircuit{
+		Commitment:     0,
+		NodeKeyDigest:  0,
+		Children:       make([]AggregatedChild, arity),
+		leafKeyDigests: make([]*big.Int, len(leafVks)),
+	}
+	var shape RecursiveVerifyingKey
+	for i, vk := range leafVks {
+		recursiveVk, err := valueOfVerifyingKey(vk, false)
+		if err != nil {
+			return nil, fmt.Errorf("convert leaf verifying key failed: %s", err.Error())
+		}
+		if i == 0 {
+			shape = recursiveVk
+		} else if !sameVerifyingKeyShape(shape, recursiveVk) {
+			return nil, fmt.Errorf("the leaf verifying keys have different shapes")
+		}
+		circuit.leafKeyDigests[i] = verifyingKeyDigest(recursiveVk)
+	}
+	for i := range circuit.Children {
+		circuit.Children[i] = AggregatedChild{
+			Active: 0,
+			IsNode: 0,
+			VerifyingKey: RecursiveVerifyingKey{
+				G1:                           struct{ K []sw_bn254.G1Affine }{K: make([]sw_bn254.G1Affine, len(shape.G1.K))},
+				CommitmentKeys:               make([]pedersen.VerifyingKey[sw_bn254.G2Affine], len(shape.CommitmentKeys)),
+				PublicAndCommitmentCommitted: shape.PublicAndCommitmentCommitted,
+			},
+			Proof: RecursiveProof{
+				Commitments: make([]pedersen.Commitment[sw_bn254.G1Affine], len(shape.CommitmentKeys)),
+			},
+			BeforeAccountTreeRoot:     0,
+			AfterAccountTreeRoot:      0,
+			BeforeCEXAssetsCommitment: 0,
+			AfterCEXAssetsCommitment:  0,
+		}
+	}
+	return &circuit, nil
+}
+
+// CheckAggregateNodeVerifyingKey checks that the node verifying key has the
+// shape of the leaf verifying key, so that nodes can verify nodes
+func CheckAggregateNodeVerifyingKey(nodeVk, leafVk groth16.VerifyingKey) error {
+	node, err := valueOfVerifyingKey(nodeVk, false)
+	if err != nil {
+		return fmt.Errorf("convert node verifying key failed: %s", err.Error())
+	}
+	leaf, err := valueOfVerifyingKey(leafVk, false)
+	if err != nil {
+		return fmt.Errorf("convert leaf verifying key failed: %s", err.Error())
+	}
+	if !sameVerifyingKeyShape(node, leaf) {
+		return fmt.Errorf("the node verifying key doesn't have the shape of the leaf verifying keys")
+	}
+	return nil
+}
+
+// valueOfVerifyingKey converts the verifying key to a constant of the circuit
+// if fixed, else to a witness value. The std conversions leave out the public
+// inputs the commitments are derived from, AssertProof needs them.
+func valueOfVerifyingKey(vk groth16.VerifyingKey, fixed bool) (RecursiveVerifyingKey, error) {
+	tVk, ok := vk.(*groth16_bn254.VerifyingKey)
+	if !ok {
+		return RecursiveVerifyingKey{}, fmt.Errorf("expected a bn254 verifying key, got %T", vk)
+	}
+	var recursiveVk RecursiveVerifyingKey
+	var err error
+	if fixed {
+		recursiveVk, err = stdgroth16.ValueOfVerifyingKeyFixed[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](vk)
+	} else {
+		recursiveVk, err = stdgroth16.ValueOfVerifyingKey[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](vk)
+	}
+	if err != nil {
+		return recursiveVk, err
+	}
+	recursiveVk.PublicAndCommitmentCommitted = tVk.PublicAndCommitmentCommitted
+	return recursiveVk, nil
+}
+
+func sameVerifyingKeyShape(a, b RecursiveVerifyingKey) bool {
+	return len(a.G1.K) == len(b.G1.K) && len(a.CommitmentKeys) == len(b.CommitmentKeys) &&
+		slices.EqualFunc(a.PublicAndCommitmentCommitted, b.PublicAndCommitmentCommitted, slices.Equal[[]int])
+}
+
+func (c AggregateLeafCircuit) Define(api API) error {
+	verifier, err := stdgroth16.NewVerifier[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](api)
+	if err != nil {
+		return err
+	}
+	scalarField, err := emulated.NewField[sw_bn254.ScalarField](api)
+	if err != nil {
+		return err
+	}
+	chain := make([]aggregatedChain, len(c.Batches))
+	for i, b := range c.Batches {
+		chain[i] = aggregatedChain{b.Active, b.BeforeAccountTreeRoot, b.AfterAccountTreeRoot, b.BeforeCEXAssetsCommitment, b.AfterCEXAssetsCommitment}
+		// the public input of the batch proof is recomputed from the chained values
+		batchCommitment := poseidon.Poseidon(api, b.BeforeAccountTreeRoot, b.AfterAccountTreeRoot, b.BeforeCEXAssetsCommitment, b.AfterCEXAssetsCommitment)
+		err = verifier.AssertProof(c.verifyingKey, b.Proof, recursiveWitness(api, scalarField, batchCommitment))
+		if err != nil {
+			return err
+		}
+	}
+	api.AssertIsEqual(c.Commitment, poseidon.Poseidon(api, assertChain(api, chain)...))
+	return nil
+}
+
+func (c AggregateNodeCircuit) Define(api API) error {
+	verifier, err := stdgroth16.NewVerifier[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](api)
+	if err != nil {
+		return err
+	}
+	scalarField, err := emulated.NewField[sw_bn254.ScalarField](api)
+	if err != nil {
+		return err
+	}
+	chain := make([]aggregatedChain, len(c.Children))
+	for i, child := range c.Children {
+		chain[i] = aggregatedChain{child.Active, child.BeforeAccountTreeRoot, child.AfterAccountTreeRoot, child.BeforeCEXAssetsCommitment, child.AfterCEXAssetsCommitment}
+		// a node child is verified against the key of this node, a leaf child
+		// against the key of one of the tiers
+		api.AssertIsBoolean(child.IsNode)
+		digest := poseidon.Poseidon(api, verifyingKeyLimbs(child.VerifyingKey)...)
+		leafKeyCheck := Variable(1)
+		for _, leafKeyDigest := range c.leafKeyDigests {
+			leafKeyCheck = api.Mul(leafKeyCheck, api.Sub(digest, leafKeyDigest))
+		}
+		api.AssertIsEqual(api.Select(child.IsNode, api.Sub(digest, c.NodeKeyDigest), leafKeyCheck), 0)
+
+		leafCommitment := poseidon.Poseidon(api, child.BeforeAccountTreeRoot, child.AfterAccountTreeRoot, child.BeforeCEXAssetsCommitment, child.AfterCEXAssetsCommitment)
+		nodeCommitment := poseidon.Poseidon(api, child.BeforeAccountTreeRoot, child.AfterAccountTreeRoot, child.BeforeCEXAssetsCommitment, child.AfterCEXAssetsCommitment, c.NodeKeyDigest)
+		childCommitment := api.Select(child.IsNode, nodeCommitment, leafCommitment)
+		err = verifier.AssertProof(child.VerifyingKey, child.Proof, recursiveWitness(api, scalarField, childCommitment))
+		if err != nil {
+			return err
+		}
+	}
+	api.AssertIsEqual(c.Commitment, poseidon.Poseidon(api, append(assertChain(api, chain), c.NodeKeyDigest)...))
+	return nil
+}
+
+// aggregatedChain is the active flag and the chained values of a batch or child
+type aggregatedChain struct {
+	active                    Variable
+	beforeAccountTreeRoot     Variable
+	afterAccountTreeRoot      Variable
+	beforeCEXAssetsCommitment Variable
+	afterCEXAssetsCommitment  Variable
+}
+
+// assertChain checks that the active slots come first and chain, and returns
+// the roots and commitments before the first slot and after the last active one
+func assertChain(api API, chain []aggregatedChain) []Variable {
+	api.AssertIsEqual(chain[0].active, 1)
+	afterAccountTreeRoot := chain[0].afterAccountTreeRoot
+	afterCEXAssetsCommitment := chain[0].afterCEXAssetsCommitment
+	for i := 1; i < len(chain); i++ {
+		api.AssertIsBoolean(chain[i].active)
+		// an active slot follows an active slot
+		api.AssertIsEqual(api.Mul(chain[i].active, api.Sub(1, chain[i-1].active)), 0)
+		api.AssertIsEqual(api.Mul(chain[i].active, api.Sub(chain[i].beforeAccountTreeRoot, afterAccountTreeRoot)), 0)
+		api.AssertIsEqual(api.Mul(chain[i].active, api.Sub(chain[i].beforeCEXAssetsCommitment, afterCEXAssetsCommitment)), 0)
+		afterAccountTreeRoot = api.Select(chain[i].active, chain[i].afterAccountTreeRoot, afterAccountTreeRoot)
+		afterCEXAssetsCommitment = api.Select(chain[i].active, chain[i].afterCEXAssetsCommitment, afterCEXAssetsCommitment)
+	}
+	return []Variable{chain[0].beforeAccountTreeRoot, afterAccountTreeRoot, chain[0].beforeCEXAssetsCommitment, afterCEXAssetsCommitment}
+}
+
+func recursiveWitness(api API, scalarField *emulated.Field[sw_bn254.ScalarField], commitment Variable) RecursiveWitness {
+	// the native field is the scalar field of bn254, so the commitment is a canonical emulated element
+	return RecursiveWitness{
+		Public: []emulated.Element[sw_bn254.ScalarField]{*scalarField.FromBits(api.ToBinary(commitment)...)},
+	}
+}
+
+// verifyingKeyLimbs returns the limbs of the points of the verifying key, the
+// limbs are variables in the circuit and big integers in a witness value
+func verifyingKeyLimbs(vk RecursiveVerifyingKey) []Variable {
+	var limbs []Variable
+	appendE2 := func(e fields_bn254.E2) {
+		limbs = append(limbs, e.A0.Limbs...)
+		limbs = append(limbs, e.A1.Limbs...)
+	}
+	appendG2 := func(p sw_bn254.G2Affine) {
+		appendE2(p.P.X)
+		appendE2(p.P.Y)
+	}
+	for _, e6 := range []fields_bn254.E6{vk.E.C0, vk.E.C1} {
+		appendE2(e6.B0)
+		appendE2(e6.B1)
+		appendE2(e6.B2)
+	}
+	for _, k := range vk.G1.K {
+		limbs = append(limbs, k.X.Limbs...)
+		limbs = append(limbs, k.Y.Limbs...)
+	}
+	appendG2(vk.G2.GammaNeg)
+	appendG2(vk.G2.DeltaNeg)
+	for _, k := range vk.CommitmentKeys {
+		appendG2(k.G)
+		appendG2(k.GSigma)
+	}
+	return limbs
+}
+
+// verifyingKeyDigest is the poseidon hash of the limbs of a witness value
+func verifyingKeyDigest(vk RecursiveVerifyingKey) *big.Int {
+	limbs := verifyingKeyLimbs(vk)
+	elements := make([]*fr.Element, len(limbs))
+	for i, limb := range limbs {
+		elements[i] = new(fr.Element).SetBigInt(limb.(*big.Int))
+	}
+	return fposeidon.Poseidon(elements...).BigInt(new(big.Int))
+}
+
+// VerifyingKeyDigest returns the digest of a leaf or node verifying key the
+// node circuit computes
+func VerifyingKeyDigest(vk groth16.VerifyingKey) ([]byte, error) {
+	recursiveVk, err := valueOfVerifyingKey(vk, false)
+	if err != nil {
+		return nil, err
+	}
+	return verifyingKeyDigest(recursiveVk).Bytes(), nil
+}
+
+// AggregateLeafCommitment returns the public input of a leaf proof
+func AggregateLeafCommitment(beforeAccountTreeRoot, afterAccountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment []byte) []byte {
+	return fposeidon.PoseidonBytes(beforeAccountTreeRoot, afterAccountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment)
+}
+
+// AggregateNodeCommitment returns the public input of a node proof, the
+// digest is the one of the node verifying key
+func AggregateNodeCommitment(beforeAccountTreeRoot, afterAccountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment, nodeKeyDigest []byte) []byte {
+	return fposeidon.PoseidonBytes(beforeAccountTreeRoot, afterAccountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment, nodeKeyDigest)
+}
+
+// AggregatedBatchInfo is the native information of one batch to aggregate
+type AggregatedBatchInfo struct {
+	Proof                     groth16.Proof
+	BeforeAccountTreeRoot     []byte
+	AfterAccountTreeRoot      []byte
+	BeforeCEXAssetsCommitment []byte
+	AfterCEXAssetsCommitment  []byte
+}
+
+// AggregatedProofInfo is the native information of a leaf or node proof, the
+// roots and commitments are the ones before its first and after its last batch
+type AggregatedProofInfo struct {
+	Proof                     groth16.Proof
+	VerifyingKey              groth16.VerifyingKey
+	IsNode                    bool
+	BeforeAccountTreeRoot     []byte
+	AfterAccountTreeRoot      []byte
+	BeforeCEXAssetsCommitment []byte
+	AfterCEXAssetsCommitment  []byte
+}
+
+// SetAggregateLeafCircuitWitness assigns up to arity consecutive batches of one
+// tier, the first batch pads the leaf
+func SetAggregateLeafCircuitWitness(arity int, batches []AggregatedBatchInfo) (witness *AggregateLeafCircuit, err error) {
+	if len(batches) == 0 || len(batches) > arity {
+		return nil, fmt.Errorf("a leaf aggregates 1 to %d batches, got %d", arity, len(batches))
+	}
+	last := batches[len(batches)-1]
+	witness = &AggregateLeafCircuit{
+		Commitment: AggregateLeafCommitment(batches[0].BeforeAccountTreeRoot, last.AfterAccountTreeRoot,
+			batches[0].BeforeCEXAssetsCommitment, last.AfterCEXAssetsCommitment),
+		Batches: make([]AggregatedBatch, arity),
+	}
+	for i := range witness.Batches {
+		b, active := batches[0], 0
+		if i < len(batches) {
+			b, active = batches[i], 1
+		}
+		proof, err := stdgroth16.ValueOfProof[sw_bn254.G1Affine, sw_bn254.G2Affine](b.Proof)
+		if err != nil {
+			return nil, fmt.Errorf("convert proof of batch %d failed: %s", i, err.Error())
+		}
+		witness.Batches[i] = AggregatedBatch{
+			Active:                    active,
+			Proof:                     proof,
+			BeforeAccountTreeRoot:     b.BeforeAccountTreeRoot,
+			AfterAccountTreeRoot:      b.AfterAccountTreeRoot,
+			BeforeCEXAssetsCommitment: b.BeforeCEXAssetsCommitment,
+			AfterCEXAssetsCommitment:  b.AfterCEXAssetsCommitment,
+		}
+	}
+	return witness, nil
+}
+
+// SetAggregateNodeCircuitWitness assigns up to arity consecutive leaf or node
+// proofs, the first child pads the node
+func SetAggregateNodeCircuitWitness(arity int, nodeVk groth16.VerifyingKey, children []AggregatedProofInfo) (witness *AggregateNodeCircuit, err error) {
+	if len(children) == 0 || len(children) > arity {
+		return nil, fmt.Errorf("a node aggregates 1 to %d proofs, got %d", arity, len(children))
+	}
+	nodeKeyDigest, err := VerifyingKeyDigest(nodeVk)
+	if err != nil {
+		return nil, fmt.Errorf("convert node verifying key failed: %s", err.Error())
+	}
+	last := children[len(children)-1]
+	witness = &AggregateNodeCircuit{
+		Commitment: AggregateNodeCommitment(children[0].BeforeAccountTreeRoot, last.AfterAccountTreeRoot,
+			children[0].BeforeCEXAssetsCommitment, last.AfterCEXAssetsCommitment, nodeKeyDigest),
+		NodeKeyDigest: nodeKeyDigest,
+		Children:      make([]AggregatedChild, arity),
+	}
+	for i := range witness.Children {
+		child, active := children[0], 0
+		if i < len(children) {
+			child, active = children[i], 1
+		}
+		isNode := 0
+		if child.IsNode {
+			isNode = 1
+		}
+		vk, err := valueOfVerifyingKey(child.VerifyingKey, false)
+		if err != nil {
+			return nil, fmt.Errorf("convert verifying key of child %d failed: %s", i, err.Error())
+		}
+		proof, err := stdgroth16.ValueOfProof[sw_bn254.G1Affine, sw_bn254.G2Affine](child.Proof)
+		if err != nil {
+			return nil, fmt.Errorf("convert proof of child %d failed: %s", i, err.Error())
+		}
+		witness.Children[i] = AggregatedChild{
+			Active:                    active,
+			IsNode:                    isNode,
+			VerifyingKey:              vk,
+			Proof:                     proof,
+			BeforeAccountTreeRoot:     child.BeforeAccountTreeRoot,
+			AfterAccountTreeRoot:      child.AfterAccountTreeRoot,
+			BeforeCEXAssetsCommitment: child.BeforeCEXAssetsCommitment,
+			AfterCEXAssetsCommitment:  child.AfterCEXAssetsCommitment,
+		}
+	}
+	return witness, nil
+}
+
+// NewVerifyAggregateCircuit returns the public witness of a leaf or node proof
+func NewVerifyAggregateCircuit(commitment []byte) *AggregateNodeCircuit {
+	return &AggregateNodeCircuit{
+		Commitment: commitment,
+	}
+}
@@ -0,0 +1,152 @@
+package circuit
+
+import (
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	poseidon2 "github.com/consensys/gnark/std/hash/poseidon"
+	"github.com/consensys/gnark/test"
+)
+
+// MockBatchCircuit has the same public input as BatchCreateUserCircuit,
+// it is used to make the inner proofs cheap to generate
+type MockBatchCircuit struct {
+	BatchCommitment           Variable `gnark:",public"`
+	BeforeAccountTreeRoot     Variable
+	AfterAccountTreeRoot      Variable
+	BeforeCEXAssetsCommitment Variable
+	AfterCEXAssetsCommitment  Variable
+}
+
+func (c MockBatchCircuit) Define(api API) error {
+	commitment := poseidon2.Poseidon(api, c.BeforeAccountTreeRoot, c.AfterAccountTreeRoot, c.BeforeCEXAssetsCommitment, c.AfterCEXAssetsCommitment)
+	api.AssertIsEqual(c.BatchCommitment, commitment)
+	return nil
+}
+
+func TestAggregateCircuits(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets up and proves a leaf aggregation circuit")
+	}
+	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &MockBatchCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := [][]byte{{1}, {2}, {3}, {4}, {5}, {6}}
+	batches := make([]AggregatedBatchInfo, 2)
+	for i := 0; i < len(batches); i++ {
+		assignment := &MockBatchCircuit{
+			BatchCommitment:           poseidon.PoseidonBytes(values[i], values[i+1], values[i+3], values[i+4]),
+			BeforeAccountTreeRoot:     values[i],
+			AfterAccountTreeRoot:      values[i+1],
+			BeforeCEXAssetsCommitment: values[i+3],
+			AfterCEXAssetsCommitment:  values[i+4],
+		}
+		w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := groth16.Prove(ccs, pk, w, RecursionProverOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches[i] = AggregatedBatchInfo{
+			Proof:                     proof,
+			BeforeAccountTreeRoot:     values[i],
+			AfterAccountTreeRoot:      values[i+1],
+			BeforeCEXAssetsCommitment: values[i+3],
+			AfterCEXAssetsCommitment:  values[i+4],
+		}
+	}
+
+	// the 2 batches are proved by a leaf of arity 2
+	leafCircuit, err := NewAggregateLeafCircuit(2, vk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafCcs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, leafCircuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafPk, leafVk, err := groth16.Setup(leafCcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := SetAggregateLeafCircuitWitness(2, batches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafProof, err := groth16.Prove(leafCcs, leafPk, w, RecursionProverOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafCommitment := AggregateLeafCommitment(values[0], values[2], values[3], values[5])
+	publicWitness, err := frontend.NewWitness(NewVerifyAggregateCircuit(leafCommitment), ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = groth16.Verify(leafProof, leafVk, publicWitness, RecursionVerifierOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// broken chaining between the two batches
+	brokenBatches := []AggregatedBatchInfo{batches[0], batches[0]}
+	assignment, err = SetAggregateLeafCircuitWitness(2, brokenBatches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = leafCcs.IsSolved(w); err == nil {
+		t.Fatal("aggregation with broken chaining should fail")
+	}
+
+	// a node verifies the leaf proof, the second child pads the node
+	leaf := AggregatedProofInfo{
+		Proof:                     leafProof,
+		VerifyingKey:              leafVk,
+		BeforeAccountTreeRoot:     values[0],
+		AfterAccountTreeRoot:      values[2],
+		BeforeCEXAssetsCommitment: values[3],
+		AfterCEXAssetsCommitment:  values[5],
+	}
+	nodeCircuit, err := NewAggregateNodeCircuit(2, []groth16.VerifyingKey{leafVk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the node has no node child, so the leaf key stands in for the node key
+	nodeAssignment, err := SetAggregateNodeCircuitWitness(2, leafVk, []AggregatedProofInfo{leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = test.IsSolved(nodeCircuit, nodeAssignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaf proof can't be passed off as a node proof
+	leaf.IsNode = true
+	nodeAssignment, err = SetAggregateNodeCircuitWitness(2, vk, []AggregatedProofInfo{leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = test.IsSolved(nodeCircuit, nodeAssignment, ecc.BN254.ScalarField())
+	if err == nil {
+		t.Fatal("a leaf proof verified as a node proof should fail")
+	}
+}
@@ -37,6 +37,8 @@ func NewBatchCreateUserCircuit(userAssetCounts uint32, allAssetCounts uint32, ba
 			TotalEquity:               0,
 			TotalDebt:                 0,
 			BasePrice:                 0,
+			AmountDecimals:            0,
+			PriceDecimals:             0,
 			LoanCollateral:            0,
 			MarginCollateral:          0,
 			PortfolioMarginCollateral: 0,
@@ -44,7 +46,7 @@ func NewBatchCreateUserCircuit(userAssetCounts uint32, allAssetCounts uint32, ba
 			MarginRatios:              make([]TierRatio, utils.TierCount),
 			PortfolioMarginRatios:     make([]TierRatio, utils.TierCount),
 		}
-		for j := uint32(0); j < utils.TierCount; j++ {
+		for j := 0; j < utils.TierCount; j++ {
 			circuit.BeforeCexAssets[i].LoanRatios[j] = TierRatio{
 				BoundaryValue:    0,
 				Ratio:            0,
@@ -71,7 +73,10 @@ func NewBatchCreateUserCircuit(userAssetCounts uint32, allAssetCounts uint32, ba
 			AssetsForUpdateCex:    make([]UserAssetMeta, allAssetCounts),
 			AccountIndex:          0,
 			AccountIdHash:         0,
-			AccountProof:          [utils.AccountTreeDepth]Variable{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			AccountProof:          make([]Variable, utils.AccountTreeDepth),
+		}
+		for j := 0; j < utils.AccountTreeDepth; j++ {
+			circuit.CreateUserOps[i].AccountProof[j] = 0
 		}
 		for j := uint32(0); j < allAssetCounts; j++ {
 			circuit.CreateUserOps[i].AssetsForUpdateCex[j].Debt = 0
@@ -113,6 +118,10 @@ func (b BatchCreateUserCircuit) Define(api API) error {
 		r.Check(b.BeforeCexAssets[i].LoanCollateral, 64)
 		r.Check(b.BeforeCexAssets[i].MarginCollateral, 64)
 		r.Check(b.BeforeCexAssets[i].PortfolioMarginCollateral, 64)
+		// the usdt values of all the assets have the same decimals
+		r.Check(b.BeforeCexAssets[i].AmountDecimals, 8)
+		r.Check(b.BeforeCexAssets[i].PriceDecimals, 8)
+		api.AssertIsEqual(api.Add(b.BeforeCexAssets[i].AmountDecimals, b.BeforeCexAssets[i].PriceDecimals), utils.AssetValueDecimals)
 
 		fillCexAssetCommitment(api, b.BeforeCexAssets[i], i, cexAssets)
 		generateRapidArithmeticForCollateral(api, r, b.BeforeCexAssets[i].LoanRatios)
@@ -136,7 +145,7 @@ func (b BatchCreateUserCircuit) Define(api API) error {
 	userAssetsQueries := make([][]Variable, len(b.CreateUserOps))
 
 	for i := 0; i < len(b.CreateUserOps); i++ {
-		accountIndexHelper := accountIdToMerkleHelper(api, b.CreateUserOps[i].AccountIndex)
+		accountIndexHelper := accountIdToMerkleHelper(api, b.CreateUserOps[i].AccountIndex, len(b.CreateUserOps[i].AccountProof))
 		verifyMerkleProof(api, b.CreateUserOps[i].BeforeAccountTreeRoot, EmptyAccountLeafNodeHash, b.CreateUserOps[i].AccountProof[:], accountIndexHelper)
 		var totalUserEquity Variable = 0
 		var totalUserDebt Variable = 0
@@ -339,6 +348,8 @@ func SetBatchCreateUserCircuitWitness(batchWitness *utils.BatchCreateUserWitness
 		witness.BeforeCexAssets[i].TotalEquity = batchWitness.BeforeCexAssets[i].TotalEquity
 		witness.BeforeCexAssets[i].TotalDebt = batchWitness.BeforeCexAssets[i].TotalDebt
 		witness.BeforeCexAssets[i].BasePrice = batchWitness.BeforeCexAssets[i].BasePrice
+		witness.BeforeCexAssets[i].AmountDecimals = batchWitness.BeforeCexAssets[i].AmountDecimals
+		witness.BeforeCexAssets[i].PriceDecimals = batchWitness.BeforeCexAssets[i].PriceDecimals
 		witness.BeforeCexAssets[i].LoanCollateral = batchWitness.BeforeCexAssets[i].LoanCollateral
 		witness.BeforeCexAssets[i].MarginCollateral = batchWitness.BeforeCexAssets[i].MarginCollateral
 		witness.BeforeCexAssets[i].PortfolioMarginCollateral = batchWitness.BeforeCexAssets[i].PortfolioMarginCollateral
@@ -422,6 +433,7 @@ func SetBatchCreateUserCircuitWitness(batchWitness *utils.BatchCreateUserWitness
 		}
 		witness.CreateUserOps[i].AccountIdHash = batchWitness.CreateUserOps[i].AccountIdHash
 		witness.CreateUserOps[i].AccountIndex = batchWitness.CreateUserOps[i].AccountIndex
+		witness.CreateUserOps[i].AccountProof = make([]Variable, len(batchWitness.CreateUserOps[i].AccountProof))
 		for j := 0; j < len(witness.CreateUserOps[i].AccountProof); j++ {
 			witness.CreateUserOps[i].AccountProof[j] = batchWitness.CreateUserOps[i].AccountProof[j]
 		}
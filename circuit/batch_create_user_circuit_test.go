@@ -83,6 +83,42 @@ func TestBatchCreateUserCircuit(t *testing.T) {
 	}
 }
 
+func TestBatchCreateUserCircuitWithTierManifest(t *testing.T) {
+	// a small test deployment compiles in seconds
+	manifestFile := t.TempDir() + "/tiers.json"
+	err := os.WriteFile(manifestFile, []byte(`{"AccountTreeDepth": 8, "AssetCounts": 20, "TierCount": 4,
+		"Tiers": [{"AssetsCount": 10, "BatchCreateUserOpsCount": 2}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := utils.LoadTierManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Apply()
+	defer utils.DefaultTierManifest().Apply()
+
+	solver.RegisterHint(IntegerDivision)
+	emptyUserCircuit := NewBatchCreateUserCircuit(10, uint32(utils.AssetCounts), 2)
+	oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, emptyUserCircuit, frontend.IgnoreUnconstrainedInputs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("batch create user constraints number is ", oR1cs.GetNbConstraints())
+	userCircuit := ConstructValidBatch(10, utils.AssetCounts, 2)
+	if len(userCircuit.CreateUserOps[0].AccountProof) != 8 {
+		t.Fatalf("account proof has %d nodes", len(userCircuit.CreateUserOps[0].AccountProof))
+	}
+	witness, err := frontend.NewWitness(userCircuit, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = oR1cs.IsSolved(witness)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestBatchCreateUserCircuitFromKeySetup(t *testing.T) {
 	oR1cs, witness, err := ConstructR1csAndWitness("groth16")
 	if err != nil {
@@ -301,8 +337,13 @@ func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch
 	cexAssets := make([]utils.CexAssetInfo, totalAssetsCount)
 	for i := 0; i < totalAssetsCount; i++ {
 		u := utils.CexAssetInfo{
-			BasePrice: 1,
-			Index:     uint32(i),
+			BasePrice:             1,
+			AmountDecimals:        utils.DefaultAmountDecimals,
+			PriceDecimals:         utils.DefaultPriceDecimals,
+			Index:                 uint32(i),
+			LoanRatios:            make([]utils.TierRatio, utils.TierCount),
+			MarginRatios:          make([]utils.TierRatio, utils.TierCount),
+			PortfolioMarginRatios: make([]utils.TierRatio, utils.TierCount),
 		}
 		avgRatio := 100 / utils.TierCount
 		for j := 0; j < utils.TierCount; j++ {
@@ -390,7 +431,11 @@ func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch
 		if err != nil {
 			panic(err.Error())
 		}
-		accountTree.Set(uint64(accounts[i].AccountIndex), utils.AccountInfoToHash(&accounts[i], &poseidonHasher))
+		accountHash, err := utils.AccountInfoToHash(&accounts[i], &poseidonHasher)
+		if err != nil {
+			panic(err.Error())
+		}
+		accountTree.Set(uint64(accounts[i].AccountIndex), accountHash)
 		accountAfterRoot := accountTree.Root()
 		batchCreateUserWit.CreateUserOps[i] = utils.CreateUserOperation{
 			BeforeAccountTreeRoot: accountBeforeRoot,
@@ -398,8 +443,9 @@ func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch
 			Assets:                accounts[i].Assets,
 			AccountIndex:          accounts[i].AccountIndex,
 			AccountIdHash:         accounts[i].AccountId,
+			AccountProof:          make([][]byte, utils.AccountTreeDepth),
 		}
-		copy(batchCreateUserWit.CreateUserOps[i].AccountProof[:], accountProof[:])
+		copy(batchCreateUserWit.CreateUserOps[i].AccountProof, accountProof)
 
 	}
 
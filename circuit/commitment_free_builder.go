@@ -0,0 +1,72 @@
+package circuit
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash/poseidon"
+)
+
+// commitmentFreeBuilder compiles the batch create user circuit without bsb22
+// commitments, which the mpcsetup of gnark can't set up:
+//   - the range checks decompose the variables into bits, since the builder
+//     passed to Define isn't a committer
+//   - the lookups get their challenge from a poseidon hash of the table and
+//     the queries, which is computed in-circuit once the witness fixes them
+//
+// The circuit gets larger, but the keys can be set up by a ceremony.
+type commitmentFreeBuilder struct {
+	frontend.Builder
+}
+
+// poseidonCommitter is the compiler of commitmentFreeBuilder, the lookups ask
+// the compiler for a committer
+type poseidonCommitter struct {
+	frontend.Compiler
+	api frontend.API
+}
+
+// the interfaces of the builder the std gadgets look for
+type (
+	keyValueStore interface {
+		SetKeyValue(key, value any)
+		GetKeyValue(key any) any
+	}
+	bitsComparatorConstant interface {
+		MustBeLessOrEqCst(aBits []frontend.Variable, bound *big.Int, aForDebug frontend.Variable)
+	}
+)
+
+func newCommitmentFreeBuilder(newBuilder frontend.NewBuilder) frontend.NewBuilder {
+	return func(field *big.Int, config frontend.CompileConfig) (frontend.Builder, error) {
+		builder, err := newBuilder(field, config)
+		if err != nil {
+			return nil, err
+		}
+		return &commitmentFreeBuilder{Builder: builder}, nil
+	}
+}
+
+func (b *commitmentFreeBuilder) Compiler() frontend.Compiler {
+	return &poseidonCommitter{Compiler: b.Builder.Compiler(), api: b}
+}
+
+func (b *commitmentFreeBuilder) SetKeyValue(key, value any) {
+	b.Builder.(keyValueStore).SetKeyValue(key, value)
+}
+
+func (b *commitmentFreeBuilder) GetKeyValue(key any) any {
+	return b.Builder.(keyValueStore).GetKeyValue(key)
+}
+
+func (c *poseidonCommitter) Commit(v ...frontend.Variable) (frontend.Variable, error) {
+	if len(v) == 0 {
+		return nil, errors.New("no variables to commit to")
+	}
+	return poseidon.Poseidon(c.api, v...), nil
+}
+
+func (c *poseidonCommitter) MustBeLessOrEqCst(aBits []frontend.Variable, bound *big.Int, aForDebug frontend.Variable) {
+	c.Compiler.(bitsComparatorConstant).MustBeLessOrEqCst(aBits, bound, aForDebug)
+}
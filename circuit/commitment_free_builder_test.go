@@ -0,0 +1,50 @@
+package circuit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/constraint/solver"
+	"github.com/consensys/gnark/frontend"
+)
+
+func TestCommitmentFreeBuilder(t *testing.T) {
+	manifestFile := t.TempDir() + "/tiers.json"
+	err := os.WriteFile(manifestFile, []byte(`{"AccountTreeDepth": 8, "AssetCounts": 20, "TierCount": 4, "CommitmentFree": true,
+		"Tiers": [{"AssetsCount": 10, "BatchCreateUserOpsCount": 2}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := utils.LoadTierManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Apply()
+	defer utils.DefaultTierManifest().Apply()
+
+	solver.RegisterHint(IntegerDivision)
+	provingSystem, err := NewProvingSystem(ProvingSystemGroth16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), provingSystem.NewBuilder(), NewBatchCreateUserCircuit(10, uint32(utils.AssetCounts), 2), frontend.IgnoreUnconstrainedInputs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lookups hash their challenge in-circuit and the range checks decompose into bits
+	if len(oR1cs.GetCommitments().CommitmentIndexes()) != 0 {
+		t.Fatal("expected a circuit without commitments")
+	}
+
+	userCircuit := ConstructValidBatch(10, utils.AssetCounts, 2)
+	witness, err := frontend.NewWitness(userCircuit, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = oR1cs.IsSolved(witness)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
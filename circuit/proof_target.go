@@ -0,0 +1,49 @@
+package circuit
+
+import (
+	"fmt"
+
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/solidity"
+)
+
+// The batch create user circuit uses a commitment for its range checks and
+// lookups, and the hash of the commitment to the field differs between the
+// verifiers, so batch proofs are generated for one verifier target.
+const (
+	// ProofTargetNative proofs are verified by the verifier service
+	ProofTargetNative = "native"
+	// ProofTargetRecursion proofs can also be aggregated by AggregateLeafCircuit
+	ProofTargetRecursion = "recursion"
+	// ProofTargetSolidity proofs can also be verified by the exported Solidity verifier
+	ProofTargetSolidity = "solidity"
+)
+
+// ProverOptions returns the groth16 prover options of the proof target, an
+// empty target is ProofTargetNative.
+func ProverOptions(target string) ([]backend.ProverOption, error) {
+	switch target {
+	case "", ProofTargetNative:
+		return nil, nil
+	case ProofTargetRecursion:
+		return []backend.ProverOption{RecursionProverOptions()}, nil
+	case ProofTargetSolidity:
+		return []backend.ProverOption{solidity.WithProverTargetSolidityVerifier(backend.GROTH16)}, nil
+	default:
+		return nil, fmt.Errorf("unknown proof target %s", target)
+	}
+}
+
+// VerifierOptions returns the groth16 verifier options of the proof target
+func VerifierOptions(target string) ([]backend.VerifierOption, error) {
+	switch target {
+	case "", ProofTargetNative:
+		return nil, nil
+	case ProofTargetRecursion:
+		return []backend.VerifierOption{RecursionVerifierOptions()}, nil
+	case ProofTargetSolidity:
+		return []backend.VerifierOption{solidity.WithVerifierTargetSolidityVerifier(backend.GROTH16)}, nil
+	default:
+		return nil, fmt.Errorf("unknown proof target %s", target)
+	}
+}
@@ -0,0 +1,233 @@
+package circuit
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	kzg_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/kzg"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/plonk"
+	"github.com/consensys/gnark/backend/solidity"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+	gnarkio "github.com/consensys/gnark/io"
+)
+
+const (
+	ProvingSystemGroth16 = "groth16"
+	ProvingSystemPlonk   = "plonk"
+)
+
+// ProvingKey, VerifyingKey and Proof are the methods shared by the keys and
+// proofs of all the proving systems
+type (
+	ProvingKey interface {
+		io.WriterTo
+		io.ReaderFrom
+		gnarkio.UnsafeReaderFrom
+	}
+	VerifyingKey interface {
+		io.WriterTo
+		io.ReaderFrom
+		ExportSolidity(w io.Writer, exportOpts ...solidity.ExportOption) error
+	}
+	Proof interface {
+		io.WriterTo
+		io.ReaderFrom
+		gnarkio.WriterRawTo
+	}
+)
+
+// ProvingSystem hides whether the batch create user circuit is proved with
+// groth16 or plonk from keygen, prover and verifier
+type ProvingSystem interface {
+	Name() string
+	NewBuilder() frontend.NewBuilder
+	NewCS() constraint.ConstraintSystem
+	NewProvingKey() ProvingKey
+	NewVerifyingKey() VerifyingKey
+	NewProof() Proof
+	// Setup ignores the srs for groth16, plonk needs the canonical and
+	// lagrange srs returned by NewPlonkSRS
+	Setup(ccs constraint.ConstraintSystem, srs, srsLagrange kzg.SRS) (ProvingKey, VerifyingKey, error)
+	Prove(ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness, opts ...backend.ProverOption) (Proof, error)
+	Verify(proof Proof, vk VerifyingKey, publicWitness witness.Witness, opts ...backend.VerifierOption) error
+	// ProverOptions and VerifierOptions return the options of the proof target
+	ProverOptions(target string) ([]backend.ProverOption, error)
+	VerifierOptions(target string) ([]backend.VerifierOption, error)
+}
+
+// NewProvingSystem returns the proving system of the name, an empty name is groth16
+func NewProvingSystem(name string) (ProvingSystem, error) {
+	switch name {
+	case "", ProvingSystemGroth16:
+		return groth16System{}, nil
+	case ProvingSystemPlonk:
+		return plonkSystem{}, nil
+	default:
+		return nil, fmt.Errorf("unknown proving system %s", name)
+	}
+}
+
+type groth16System struct{}
+
+func (groth16System) Name() string {
+	return ProvingSystemGroth16
+}
+
+// NewBuilder hashes the commitments of the circuit in-circuit when the tier
+// manifest is commitment free, so that the keys can be set up by mpcsetup
+func (groth16System) NewBuilder() frontend.NewBuilder {
+	if utils.CommitmentFreeCircuits {
+		return newCommitmentFreeBuilder(r1cs.NewBuilder)
+	}
+	return r1cs.NewBuilder
+}
+
+func (groth16System) NewCS() constraint.ConstraintSystem {
+	return groth16.NewCS(ecc.BN254)
+}
+
+func (groth16System) NewProvingKey() ProvingKey {
+	return groth16.NewProvingKey(ecc.BN254)
+}
+
+func (groth16System) NewVerifyingKey() VerifyingKey {
+	return groth16.NewVerifyingKey(ecc.BN254)
+}
+
+func (groth16System) NewProof() Proof {
+	return groth16.NewProof(ecc.BN254)
+}
+
+func (groth16System) Setup(ccs constraint.ConstraintSystem, _, _ kzg.SRS) (ProvingKey, VerifyingKey, error) {
+	return groth16.Setup(ccs)
+}
+
+func (groth16System) Prove(ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness, opts ...backend.ProverOption) (Proof, error) {
+	groth16Pk, ok := pk.(groth16.ProvingKey)
+	if !ok {
+		return nil, fmt.Errorf("proving key is not a groth16 proving key")
+	}
+	return groth16.Prove(ccs, groth16Pk, fullWitness, opts...)
+}
+
+func (groth16System) Verify(proof Proof, vk VerifyingKey, publicWitness witness.Witness, opts ...backend.VerifierOption) error {
+	groth16Proof, ok := proof.(groth16.Proof)
+	if !ok {
+		return fmt.Errorf("proof is not a groth16 proof")
+	}
+	groth16Vk, ok := vk.(groth16.VerifyingKey)
+	if !ok {
+		return fmt.Errorf("verifying key is not a groth16 verifying key")
+	}
+	return groth16.Verify(groth16Proof, groth16Vk, publicWitness, opts...)
+}
+
+func (groth16System) ProverOptions(target string) ([]backend.ProverOption, error) {
+	return ProverOptions(target)
+}
+
+func (groth16System) VerifierOptions(target string) ([]backend.VerifierOption, error) {
+	return VerifierOptions(target)
+}
+
+type plonkSystem struct{}
+
+func (plonkSystem) Name() string {
+	return ProvingSystemPlonk
+}
+
+func (plonkSystem) NewBuilder() frontend.NewBuilder {
+	return scs.NewBuilder
+}
+
+func (plonkSystem) NewCS() constraint.ConstraintSystem {
+	return plonk.NewCS(ecc.BN254)
+}
+
+func (plonkSystem) NewProvingKey() ProvingKey {
+	return plonk.NewProvingKey(ecc.BN254)
+}
+
+func (plonkSystem) NewVerifyingKey() VerifyingKey {
+	return plonk.NewVerifyingKey(ecc.BN254)
+}
+
+func (plonkSystem) NewProof() Proof {
+	return plonk.NewProof(ecc.BN254)
+}
+
+func (plonkSystem) Setup(ccs constraint.ConstraintSystem, srs, srsLagrange kzg.SRS) (ProvingKey, VerifyingKey, error) {
+	if srs == nil || srsLagrange == nil {
+		return nil, nil, fmt.Errorf("plonk setup needs a kzg srs")
+	}
+	return plonk.Setup(ccs, srs, srsLagrange)
+}
+
+func (plonkSystem) Prove(ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness, opts ...backend.ProverOption) (Proof, error) {
+	plonkPk, ok := pk.(plonk.ProvingKey)
+	if !ok {
+		return nil, fmt.Errorf("proving key is not a plonk proving key")
+	}
+	return plonk.Prove(ccs, plonkPk, fullWitness, opts...)
+}
+
+func (plonkSystem) Verify(proof Proof, vk VerifyingKey, publicWitness witness.Witness, opts ...backend.VerifierOption) error {
+	plonkProof, ok := proof.(plonk.Proof)
+	if !ok {
+		return fmt.Errorf("proof is not a plonk proof")
+	}
+	plonkVk, ok := vk.(plonk.VerifyingKey)
+	if !ok {
+		return fmt.Errorf("verifying key is not a plonk verifying key")
+	}
+	return plonk.Verify(plonkProof, plonkVk, publicWitness, opts...)
+}
+
+func (plonkSystem) ProverOptions(target string) ([]backend.ProverOption, error) {
+	switch target {
+	case "", ProofTargetNative:
+		return nil, nil
+	case ProofTargetSolidity:
+		return []backend.ProverOption{solidity.WithProverTargetSolidityVerifier(backend.PLONK)}, nil
+	default:
+		return nil, fmt.Errorf("proof target %s is not supported by plonk", target)
+	}
+}
+
+func (plonkSystem) VerifierOptions(target string) ([]backend.VerifierOption, error) {
+	switch target {
+	case "", ProofTargetNative:
+		return nil, nil
+	case ProofTargetSolidity:
+		return []backend.VerifierOption{solidity.WithVerifierTargetSolidityVerifier(backend.PLONK)}, nil
+	default:
+		return nil, fmt.Errorf("proof target %s is not supported by plonk", target)
+	}
+}
+
+// NewPlonkSRS cuts the canonical srs of a universal setup ceremony to the size
+// of the constraint system and computes its lagrange form
+func NewPlonkSRS(ccs constraint.ConstraintSystem, ceremonySRS *kzg_bn254.SRS) (srs, srsLagrange kzg.SRS, err error) {
+	sizeLagrange := ecc.NextPowerOfTwo(uint64(ccs.GetNbConstraints() + ccs.GetNbPublicVariables()))
+	sizeCanonical := sizeLagrange + 3
+	if uint64(len(ceremonySRS.Pk.G1)) < sizeCanonical {
+		return nil, nil, fmt.Errorf("srs has %d points, the circuit needs %d", len(ceremonySRS.Pk.G1), sizeCanonical)
+	}
+	canonical := &kzg_bn254.SRS{Vk: ceremonySRS.Vk}
+	canonical.Pk.G1 = ceremonySRS.Pk.G1[:sizeCanonical]
+	lagrange := &kzg_bn254.SRS{Vk: ceremonySRS.Vk}
+	lagrange.Pk.G1, err = kzg_bn254.ToLagrangeG1(ceremonySRS.Pk.G1[:sizeLagrange])
+	if err != nil {
+		return nil, nil, err
+	}
+	return canonical, lagrange, nil
+}
@@ -1,7 +1,6 @@
 package circuit
 
 import (
-	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/consensys/gnark/frontend"
 )
 
@@ -21,6 +20,10 @@ type CexAssetInfo struct {
 	TotalEquity Variable
 	TotalDebt   Variable
 	BasePrice   Variable
+	// the decimals of the balances and of BasePrice are committed with the
+	// asset, they add up to utils.AssetValueDecimals
+	AmountDecimals Variable
+	PriceDecimals  Variable
 
 	LoanCollateral            Variable
 	MarginCollateral          Variable
@@ -60,5 +63,6 @@ type CreateUserOperation struct {
 	AssetsForUpdateCex    []UserAssetMeta
 	AccountIndex          Variable
 	AccountIdHash         Variable
-	AccountProof          [utils.AccountTreeDepth]Variable
+	// AccountProof has utils.AccountTreeDepth nodes
+	AccountProof []Variable
 }
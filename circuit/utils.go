@@ -31,8 +31,8 @@ func updateMerkleProof(api API, node Variable, proofSet, helper []Variable) (roo
 	return root
 }
 
-func accountIdToMerkleHelper(api API, accountId Variable) []Variable {
-	merkleHelpers := api.ToBinary(accountId, utils.AccountTreeDepth)
+func accountIdToMerkleHelper(api API, accountId Variable, accountTreeDepth int) []Variable {
+	merkleHelpers := api.ToBinary(accountId, accountTreeDepth)
 	return merkleHelpers
 }
 
@@ -56,7 +56,7 @@ func computeUserAssetsCommitment(api API, flattenAssets []Variable) Variable {
 	return commitment
 }
 
-// one variable: TotalEquity + TotalDebt + BasePrice
+// one variable: AmountDecimals + PriceDecimals + TotalEquity + TotalDebt + BasePrice
 // one variable: LoanCollateral + MarginCollateral + PortfolioMarginCollateral
 // one variable contain two TierRatios and the length of TierRatios is even
 func getVariableCountOfCexAsset(cexAsset CexAssetInfo) int {
@@ -77,7 +77,8 @@ func convertTierRatiosToVariables(api API, ratios []TierRatio, res []Variable) {
 
 func fillCexAssetCommitment(api API, asset CexAssetInfo, currentIndex int, commitments []Variable) {
 	counts := getVariableCountOfCexAsset(asset)
-	commitments[currentIndex*counts] = api.Add(api.Mul(asset.TotalEquity, utils.Uint64MaxValueFrSquare),
+	decimals := api.Add(api.Mul(asset.AmountDecimals, 256), asset.PriceDecimals)
+	commitments[currentIndex*counts] = api.Add(api.Mul(decimals, utils.Uint64MaxValueFrCube), api.Mul(asset.TotalEquity, utils.Uint64MaxValueFrSquare),
 		api.Mul(asset.TotalDebt, utils.Uint64MaxValueFr), asset.BasePrice)
 
 	commitments[currentIndex*counts+1] = api.Add(api.Mul(asset.LoanCollateral, utils.Uint64MaxValueFrSquare),
@@ -7,6 +7,7 @@ import (
 
 	"math/big"
 
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/consensys/gnark-crypto/ecc"
 	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/constraint/solver"
@@ -97,6 +98,8 @@ func TestMockCollateralCircuit(t *testing.T) {
 		circuit2.CAssetInfo[i].TotalEquity = 0
 		circuit2.CAssetInfo[i].TotalDebt = 0
 		circuit2.CAssetInfo[i].BasePrice = 1
+		circuit2.CAssetInfo[i].AmountDecimals = utils.DefaultAmountDecimals
+		circuit2.CAssetInfo[i].PriceDecimals = utils.DefaultPriceDecimals
 		circuit2.CAssetInfo[i].LoanCollateral = 0
 		circuit2.CAssetInfo[i].MarginCollateral = 0
 		circuit2.CAssetInfo[i].PortfolioMarginCollateral = 0
@@ -0,0 +1,91 @@
+package por
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+// Dataset is the accounts and cex assets of a round
+type Dataset struct {
+	// Accounts are the accounts of every assets count tier, in memory or on disk
+	Accounts  utils.AccountSource
+	CexAssets []utils.CexAssetInfo
+	// TierManifest is the tiers the accounts are grouped by
+	TierManifest *utils.TierManifest
+	// Rounded are the amounts the rounding policy dropped from the valid
+	// accounts of the assets which were rounded, negative if rounded up
+	Rounded []utils.AssetRounding
+}
+
+// ParseDataset parses cex_assets_info.csv and the user files of the
+// directory into memory, nil tierManifest means the built-in tiers. If some
+// rows are invalid the dataset of the valid accounts is returned with
+// *utils.ErrInvalidAccounts, the caller decides whether to go on without them.
+func ParseDataset(ctx context.Context, dir string, tierManifest *utils.TierManifest) (*Dataset, error) {
+	tierManifest, release, err := activateTierManifest(tierManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	startTime := time.Now().UnixMilli()
+	accounts, cexAssets, rounded, err := utils.ParseUserDataSetWithRounding(ctx, dir)
+	if accounts == nil {
+		return nil, err
+	}
+	endTime := time.Now().UnixMilli()
+	slog.Info("user data is handled", "cost_ms", endTime-startTime)
+	return &Dataset{
+		Accounts:     utils.AccountsMap(accounts),
+		CexAssets:    cexAssets,
+		TierManifest: tierManifest,
+		Rounded:      rounded,
+	}, err
+}
+
+// IngestDataset is ParseDataset for datasets which don't fit in memory. The
+// accounts are written to accountsDir while the user files are read row by
+// row, and the dataset reads them from there. The accounts of a previous
+// ingestion of the same files, tiers and rounding policy are reused.
+func IngestDataset(ctx context.Context, dir string, accountsDir string, tierManifest *utils.TierManifest) (*Dataset, error) {
+	tierManifest, release, err := activateTierManifest(tierManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	accounts, cexAssets, err := utils.IngestUserDataSet(ctx, dir, accountsDir)
+	if accounts == nil {
+		return nil, err
+	}
+	return &Dataset{
+		Accounts:     accounts,
+		CexAssets:    cexAssets,
+		TierManifest: tierManifest,
+		Rounded:      accounts.Rounded(),
+	}, err
+}
+
+// AccountsCount returns the number of accounts of all the tiers
+func (d *Dataset) AccountsCount() int {
+	return utils.CountAccounts(d.Accounts)
+}
+
+// LintDataset checks every row of the dataset against the tiers and reports
+// all its problems at once, before any witness work starts. An error is only
+// returned if the dataset can't be read.
+func LintDataset(ctx context.Context, dir string, tierManifest *utils.TierManifest) (*utils.LintReport, error) {
+	_, release, err := activateTierManifest(tierManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	startTime := time.Now().UnixMilli()
+	report, err := utils.LintUserDataSet(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("dataset is linted", "accounts", report.ValidAccounts, "issues", len(report.Issues), "cost_ms", time.Now().UnixMilli()-startTime)
+	return report, nil
+}
@@ -0,0 +1,82 @@
+package por
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/prover"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/verifier"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
+	"github.com/gocarina/gocsv"
+)
+
+// ExportProofTable writes the proofs of the store to the csv file the
+// verifier reads as its ProofTable
+func ExportProofTable(store *Store, name string) error {
+	proofModel := prover.NewProofModel(store.DB, store.Suffix)
+	latest, err := proofModel.GetLatestProof()
+	if err != nil {
+		return fmt.Errorf("get latest proof failed: %s", err.Error())
+	}
+	rows, err := proofModel.GetProofsBetween(0, latest.BatchNumber)
+	if err != nil {
+		return fmt.Errorf("get proofs failed: %s", err.Error())
+	}
+	proofs := make([]*verifier.Proof, len(rows))
+	for i, row := range rows {
+		proofs[i] = &verifier.Proof{
+			BatchNumber:      row.BatchNumber,
+			ZkProof:          row.ProofInfo,
+			BatchCommitment:  row.BatchCommitment,
+			AssetsCount:      row.AssetsCount,
+			ProvingSystem:    row.ProvingSystem,
+			TierManifestHash: row.TierManifestHash,
+		}
+		// the commitments and roots are stored as json lists of base64 strings
+		err = json.Unmarshal([]byte(row.CexAssetListCommitments), &proofs[i].CexAssetCommitment)
+		if err != nil {
+			return fmt.Errorf("decode cex asset list commitments of batch %d failed: %s", row.BatchNumber, err.Error())
+		}
+		err = json.Unmarshal([]byte(row.AccountTreeRoots), &proofs[i].AccountTreeRoots)
+		if err != nil {
+			return fmt.Errorf("decode account tree roots of batch %d failed: %s", row.BatchNumber, err.Error())
+		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = gocsv.MarshalFile(&proofs, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RoundCexAssets returns the cex assets info after the last witness of the
+// store, which the verifier is configured with. The padding assets without a
+// price are left out.
+func RoundCexAssets(store *Store) ([]utils.CexAssetInfo, error) {
+	latestWitness, err := witness.NewWitnessModel(store.DB, store.Suffix).GetLatestBatchWitness()
+	if err != nil {
+		return nil, fmt.Errorf("get latest witness failed: %s", err.Error())
+	}
+	batchWitness := utils.DecodeBatchWitness(latestWitness.WitnessData)
+	if batchWitness == nil {
+		return nil, fmt.Errorf("decode witness of height %d failed", latestWitness.Height)
+	}
+	cexAssets, err := utils.RecoverAfterCexAssets(batchWitness)
+	if err != nil {
+		return nil, err
+	}
+	var publishedAssets []utils.CexAssetInfo
+	for _, asset := range cexAssets {
+		if asset.BasePrice != 0 {
+			publishedAssets = append(publishedAssets, asset)
+		}
+	}
+	return publishedAssets, nil
+}
@@ -0,0 +1,114 @@
+package por
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test/unsafekzg"
+)
+
+// KeygenOptions are the options of the batch create user keys generation
+type KeygenOptions struct {
+	// TierManifest is the tiers the keys are generated for, nil means the built-in tiers
+	TierManifest *utils.TierManifest
+	// ZkKeyDir is the directory the keys are written to, it must exist
+	ZkKeyDir string
+	// ProvingSystem is groth16 (default) or plonk. The plonk keys are set up
+	// with a kzg srs of a known toxic waste, use keygen with a ceremony srs
+	// for a real round.
+	ProvingSystem string
+}
+
+// GenerateKeys compiles the batch create user circuit of every tier and
+// writes its r1cs, proving key and verifying key, the tiers whose keys are
+// already in ZkKeyDir are skipped
+func GenerateKeys(opts KeygenOptions) error {
+	tierManifest, release, err := activateTierManifest(opts.TierManifest)
+	if err != nil {
+		return err
+	}
+	defer release()
+	provingSystem, err := circuit.NewProvingSystem(opts.ProvingSystem)
+	if err != nil {
+		return err
+	}
+	zkKeyNames := tierManifest.ZkKeyNames(opts.ZkKeyDir)
+	for i, t := range tierManifest.Tiers {
+		if keysExist(zkKeyNames[i]) {
+			slog.Info("keys of the tier exist", utils.LogKeyAssetsCount, t.AssetsCount, "name", zkKeyNames[i])
+			continue
+		}
+		batchCircuit := circuit.NewBatchCreateUserCircuit(uint32(t.AssetsCount), uint32(utils.AssetCounts), uint32(t.BatchCreateUserOpsCount))
+		startTime := time.Now()
+		oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), provingSystem.NewBuilder(), batchCircuit, frontend.IgnoreUnconstrainedInputs())
+		if err != nil {
+			return fmt.Errorf("compile circuit of %d assets tier failed: %s", t.AssetsCount, err.Error())
+		}
+		slog.Info("batch create user r1cs is generated", utils.LogKeyAssetsCount, t.AssetsCount, "cost", time.Since(startTime), "constraints", oR1cs.GetNbConstraints())
+		var srs, srsLagrange kzg.SRS
+		if provingSystem.Name() == circuit.ProvingSystemPlonk {
+			srs, srsLagrange, err = unsafekzg.NewSRS(oR1cs)
+			if err != nil {
+				return err
+			}
+		}
+		err = writeKeys(zkKeyNames[i], provingSystem, oR1cs, srs, srsLagrange)
+		if err != nil {
+			return fmt.Errorf("set up keys of %d assets tier failed: %s", t.AssetsCount, err.Error())
+		}
+	}
+	return nil
+}
+
+func keysExist(zkKeyName string) bool {
+	for _, ext := range []string{".r1cs", ".pk", ".vk"} {
+		_, err := os.Stat(zkKeyName + ext)
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// writeKeys writes the verifying key last, so that an interrupted setup is
+// done again by the next run
+func writeKeys(zkKeyName string, provingSystem circuit.ProvingSystem, oR1cs constraint.ConstraintSystem, srs, srsLagrange kzg.SRS) error {
+	pk, vk, err := provingSystem.Setup(oR1cs, srs, srsLagrange)
+	if err != nil {
+		return err
+	}
+	err = writeToFile(zkKeyName+".r1cs", oR1cs)
+	if err != nil {
+		return err
+	}
+	err = writeToFile(zkKeyName+".pk", pk)
+	if err != nil {
+		return err
+	}
+	return writeToFile(zkKeyName+".vk", vk)
+}
+
+func writeToFile(name string, content interface {
+	WriteTo(w io.Writer) (int64, error)
+}) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	n, err := content.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	slog.Info("key file is written", "file", name, "size", n)
+	return f.Close()
+}
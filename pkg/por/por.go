@@ -0,0 +1,59 @@
+// Package por drives a proof of solvency round from go: parse the dataset,
+// build the batch witnesses, prove the batches, generate the user proofs and
+// verify the round. The witness, prover, userproof and verifier commands are
+// thin wrappers of it.
+//
+// The tier manifest of a round is applied to the circuit parameters of the
+// process while a function of the package runs. The rounds of one process run
+// at the same time only if they share the manifest, a call with another
+// manifest fails with utils.ErrTierManifestActive until the running calls
+// return.
+package por
+
+import (
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"gorm.io/gorm"
+)
+
+// Store is the database of the witness, proof and user proof tables of a
+// round, the table names end with Suffix
+type Store struct {
+	DB     *gorm.DB
+	Suffix string
+}
+
+// OpenStore opens the mysql database of the data source
+func OpenStore(dataSource string, suffix string) (*Store, error) {
+	return OpenStoreWithDriver(utils.DbDriverMysql, dataSource, suffix)
+}
+
+// OpenSQLiteStore opens the sqlite database file, which is created if it
+// doesn't exist. It holds a single round for local runs and tests, the
+// services of a real round share a mysql or postgres database.
+func OpenSQLiteStore(name string, suffix string) (*Store, error) {
+	return OpenStoreWithDriver(utils.DbDriverSqlite, name, suffix)
+}
+
+// OpenStoreWithDriver opens the database of the driver, see utils.OpenDB
+func OpenStoreWithDriver(driver string, dataSource string, suffix string) (*Store, error) {
+	db, err := utils.OpenDB(driver, dataSource, &gorm.Config{
+		Logger: utils.NewGormLogger(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{DB: db, Suffix: suffix}, nil
+}
+
+// activateTierManifest holds the manifest until release is called, nil means
+// the built-in tiers
+func activateTierManifest(tierManifest *utils.TierManifest) (activated *utils.TierManifest, release func(), err error) {
+	if tierManifest == nil {
+		tierManifest = utils.DefaultTierManifest()
+	}
+	release, err = tierManifest.Activate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return tierManifest, release, nil
+}
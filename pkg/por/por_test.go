@@ -0,0 +1,139 @@
+package por
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/userproof/model"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+func TestParseDataset(t *testing.T) {
+	// the sample users have 170 valid accounts and 30 invalid accounts
+	dataset, err := ParseDataset(context.Background(), "../../src/sampledata", nil)
+	var invalidAccounts *utils.ErrInvalidAccounts
+	if !errors.As(err, &invalidAccounts) {
+		t.Fatalf("expected invalid accounts error, got %v", err)
+	}
+	if dataset.AccountsCount() != 170 {
+		t.Errorf("expected 170 accounts, got %d", dataset.AccountsCount())
+	}
+	if dataset.TierManifest.Hash != utils.DefaultTierManifest().Hash {
+		t.Errorf("the built-in tiers aren't used")
+	}
+
+	root, err := ComputeAccountTreeRoot(context.Background(), dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataset.AccountsCount() != 170 {
+		t.Errorf("the dataset is padded, got %d accounts", dataset.AccountsCount())
+	}
+	again, err := ComputeAccountTreeRoot(context.Background(), dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, again) || bytes.Equal(root, utils.EmptyAccountTreeRoot()) {
+		t.Errorf("account tree root %x isn't stable, got %x", root, again)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ComputeAccountTreeRoot(ctx, dataset)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+}
+
+func TestIngestDataset(t *testing.T) {
+	parsed, _ := ParseDataset(context.Background(), "../../src/sampledata", nil)
+	expectedRoot, err := ComputeAccountTreeRoot(context.Background(), parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dataset, err := IngestDataset(context.Background(), "../../src/sampledata", filepath.Join(dir, "accounts"), nil)
+	var invalidAccounts *utils.ErrInvalidAccounts
+	if !errors.As(err, &invalidAccounts) {
+		t.Fatalf("expected invalid accounts error, got %v", err)
+	}
+	if dataset.AccountsCount() != 170 {
+		t.Errorf("expected 170 accounts, got %d", dataset.AccountsCount())
+	}
+	root, err := ComputeAccountTreeRoot(context.Background(), dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, expectedRoot) {
+		t.Errorf("expected account tree root %x, got %x", expectedRoot, root)
+	}
+
+	// the witness and userproof services read the accounts batch by batch
+	store, err := OpenSQLiteStore(filepath.Join(dir, "por.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := utils.NewAccountTree("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = BuildWitnesses(context.Background(), store, tree, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tree.Root(), expectedRoot) {
+		t.Errorf("expected witness account tree root %x, got %x", expectedRoot, tree.Root())
+	}
+	err = GenerateUserProofs(context.Background(), store, tree, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := model.NewUserProofModel(store.DB, store.Suffix).GetUserCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 170 {
+		t.Errorf("expected 170 user proofs, got %d", count)
+	}
+}
+
+func TestTierManifestIsHeldByTheRound(t *testing.T) {
+	other := &utils.TierManifest{AccountTreeDepth: 8, AssetCounts: 20, TierCount: 4,
+		Tiers: []utils.TierInfo{{AssetsCount: 10, BatchCreateUserOpsCount: 2}}}
+	otherFile := filepath.Join(t.TempDir(), "tiers.json")
+	content, err := json.Marshal(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(otherFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	other, err = utils.LoadTierManifest(otherFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := other.Activate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a round of the built-in tiers can't run while the other round holds its manifest
+	_, err = ParseDataset(context.Background(), "../../src/sampledata", nil)
+	if !errors.Is(err, utils.ErrTierManifestActive) {
+		t.Fatalf("expected the active manifest error, got %v", err)
+	}
+	if utils.AccountTreeDepth != 8 {
+		t.Fatalf("the parameters of the running round are changed")
+	}
+	release()
+	defer utils.DefaultTierManifest().Apply()
+	_, err = ParseDataset(context.Background(), "../../src/sampledata", nil)
+	var invalidAccounts *utils.ErrInvalidAccounts
+	if !errors.As(err, &invalidAccounts) {
+		t.Fatalf("expected invalid accounts error, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package por
+
+import (
+	"context"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/config"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/prover"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+// ProverOptions are the options of the batch prover
+type ProverOptions struct {
+	// TierManifest is the tiers of the witnesses, nil means the built-in tiers
+	TierManifest *utils.TierManifest
+	// ZkKeyDir is the directory of the keys generated by keygen for the tiers of the manifest
+	ZkKeyDir string
+	// ProvingSystem is groth16 (default) or plonk
+	ProvingSystem string
+	// ProofTarget is native, recursion or solidity, see circuit.ProverOptions
+	ProofTarget string
+	// TaskQueue is redis (default), mysql or memory
+	TaskQueue     string
+	RedisAddr     string
+	RedisPassword string
+	// LeaseDuration is how long a received witness stays leased without a
+	// heartbeat, prover.DefaultLeaseDuration if it is zero
+	LeaseDuration time.Duration
+	// ProvingWorkers is the number of proofs generated at the same time, 1 by default
+	ProvingWorkers int
+	// PrefetchCount is the number of batches decoded and assigned ahead of the proving workers
+	PrefetchCount int
+	// MemoryBudgetGB is the memory the r1cs and keys of the resident tiers may take,
+	// only the tier in use stays resident if it is zero
+	MemoryBudgetGB int
+	// AggregationKeyName is the prefix of the aggregation keys and
+	// AggregationArity their arity, see keygen -aggregation
+	AggregationKeyName  string
+	AggregationArity    int
+	AggregatedProofFile string
+}
+
+// NewProver creates the prover of the witnesses in the store. It is driven
+// by ProveBatch and ProveBatches, which hold its tier manifest while proving.
+func NewProver(store *Store, opts ProverOptions) (*prover.Prover, error) {
+	tierManifest, release, err := activateTierManifest(opts.TierManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	proverConfig := &config.Config{
+		DbSuffix:            store.Suffix,
+		TaskQueue:           opts.TaskQueue,
+		LeaseSeconds:        int(opts.LeaseDuration / time.Second),
+		ProvingWorkers:      opts.ProvingWorkers,
+		PrefetchCount:       opts.PrefetchCount,
+		MemoryBudgetGB:      opts.MemoryBudgetGB,
+		ZkKeyDir:            opts.ZkKeyDir,
+		ProvingSystem:       opts.ProvingSystem,
+		ProofTarget:         opts.ProofTarget,
+		AggregationKeyName:  opts.AggregationKeyName,
+		AggregationArity:    opts.AggregationArity,
+		AggregatedProofFile: opts.AggregatedProofFile,
+	}
+	proverConfig.Redis.Host = opts.RedisAddr
+	proverConfig.Redis.Password = opts.RedisPassword
+	return prover.NewProverWithDB(store.DB, tierManifest, proverConfig)
+}
+
+// ProveBatch receives the published witness of the height and writes its
+// proof to the store, so that a scheduler hands out the batches itself. ctx is
+// checked before the witness is received, a started proof isn't interrupted.
+// utils.DbErrNotFound is returned if the witness isn't published.
+func ProveBatch(ctx context.Context, p *prover.Prover, height int64) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	_, release, err := activateTierManifest(p.TierManifest)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return p.ProveBatch(height)
+}
+
+// ProveBatches proves the batches of the task queue until it is drained, or
+// the batches received by the crashed provers with rerun. When ctx is
+// canceled no more batch is taken and it returns after the in-flight proofs
+// are finished, the prover's HandBack returns them to the queue if the caller
+// can't wait.
+func ProveBatches(ctx context.Context, p *prover.Prover, rerun bool) error {
+	_, release, err := activateTierManifest(p.TierManifest)
+	if err != nil {
+		return err
+	}
+	defer release()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(rerun)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		p.Stop()
+	}
+	err = <-done
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
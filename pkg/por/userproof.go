@@ -0,0 +1,32 @@
+package por
+
+import (
+	"context"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/userproof/model"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/userproof/userproof"
+	bsmt "github.com/bnb-chain/zkbnb-smt"
+)
+
+// GenerateUserProofs writes the merkle proof of every account of the dataset
+// to the store, resuming after the proofs written so far. tree is the account
+// tree built by BuildWitnesses.
+func GenerateUserProofs(ctx context.Context, store *Store, tree bsmt.SparseMerkleTree, dataset *Dataset) error {
+	_, release, err := activateTierManifest(dataset.TierManifest)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return userproof.Generate(ctx, tree, dataset.Accounts, model.NewUserProofModel(store.DB, store.Suffix), dataset.TierManifest)
+}
+
+// ComputeAccountTreeRoot builds the account tree of the dataset in memory and
+// returns its root, which BuildWitnesses must end with
+func ComputeAccountTreeRoot(ctx context.Context, dataset *Dataset) ([]byte, error) {
+	_, release, err := activateTierManifest(dataset.TierManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return userproof.ComputeAccountTreeRoot(ctx, dataset.Accounts)
+}
@@ -0,0 +1,58 @@
+package por
+
+import (
+	"context"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/verifier"
+)
+
+// VerifyOptions are the options of the batch proofs verification
+type VerifyOptions struct {
+	// TierManifest is the tiers of the proofs, nil means the built-in tiers
+	TierManifest *utils.TierManifest
+	// ZkKeyDir is the directory of the verifying keys of the tiers of the manifest
+	ZkKeyDir string
+	// ProvingSystem is groth16 (default) or plonk
+	ProvingSystem string
+	// ProofTarget must match the prover options the batch proofs were generated with
+	ProofTarget string
+	// CexAssets is the cex assets info published with the round, the last
+	// batch must end with its commitment
+	CexAssets []utils.CexAssetInfo
+}
+
+// VerifyRound verifies the batch proofs of a round and the chain of their
+// account tree roots and cex assets commitments. The failed checks are
+// reported in the report, whose ProofTable is left to the caller, an error is
+// returned only if the verification can't run.
+func VerifyRound(ctx context.Context, proofs []*verifier.Proof, opts VerifyOptions) (*verifier.Report, error) {
+	tierManifest, release, err := activateTierManifest(opts.TierManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	emptyAccountTreeRoot, emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm, err := verifier.ExpectedCommitments(opts.CexAssets)
+	if err != nil {
+		return nil, err
+	}
+	provingSystem, err := circuit.NewProvingSystem(opts.ProvingSystem)
+	if err != nil {
+		return nil, err
+	}
+	v, err := verifier.NewVerifier(provingSystem, tierManifest.ZkKeyNames(opts.ZkKeyDir), tierManifest.AssetsCountTiers())
+	if err != nil {
+		return nil, err
+	}
+	v.TierManifest = tierManifest
+	v.VerifierOptions, err = provingSystem.VerifierOptions(opts.ProofTarget)
+	if err != nil {
+		return nil, err
+	}
+	result, err := v.VerifyBatchProofsContext(ctx, proofs, emptyAccountTreeRoot, emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm)
+	if err != nil {
+		return nil, err
+	}
+	return verifier.NewReport(result, "", v.VerifyingKeyInfo), nil
+}
@@ -0,0 +1,30 @@
+package por
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
+	bsmt "github.com/bnb-chain/zkbnb-smt"
+)
+
+// BuildWitnesses creates the accounts of the dataset in the account tree and
+// writes the witness of every batch to the store. It resumes from the latest
+// witness of the store, the tree is rolled back to it if it is ahead. The tree
+// is opened with utils.NewAccountTree.
+func BuildWitnesses(ctx context.Context, store *Store, tree bsmt.SparseMerkleTree, dataset *Dataset) error {
+	_, release, err := activateTierManifest(dataset.TierManifest)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for k, v := range dataset.Accounts.TierCounts() {
+		slog.Info("users of the tier are loaded", utils.LogKeyAssetsCount, k, "ops", v)
+	}
+	// the witness sums up the cex assets, the dataset is kept as parsed
+	cexAssets := append([]utils.CexAssetInfo{}, dataset.CexAssets...)
+	w := witness.NewWitness(tree, uint32(dataset.AccountsCount()), dataset.Accounts, cexAssets,
+		dataset.TierManifest, witness.NewWitnessModel(store.DB, store.Suffix))
+	return w.Run(ctx)
+}
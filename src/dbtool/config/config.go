@@ -1,6 +1,8 @@
 package config
 
 type Config struct {
+	// DbDriver is mysql (default), postgres or sqlite, MysqlDataSource is the data source of the driver
+	DbDriver        string
 	MysqlDataSource string
 	DbSuffix        string
 	TreeDB          struct {
@@ -16,7 +16,6 @@ import (
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
 	"github.com/redis/go-redis/v9"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
@@ -32,7 +31,7 @@ func main() {
 		panic(err.Error())
 	}
 
-	onlyFlushKvrocks := flag.Bool("only_delete_kvrocks", false, "only delete kvrocks")
+	onlyFlushKvrocks := flag.Bool("only_delete_kvrocks", false, "only delete kvrocks, or the leveldb directory of the leveldb tree db")
 	deleteAllData := flag.Bool("delete_all", false, "delete kvrocks and mysql data")
 	checkProverStatus := flag.Bool("check_prover_status", false, "check prover status")
 	remotePasswdConfig := flag.String("remote_password_config", "", "fetch password from aws secretsmanager")
@@ -61,7 +60,7 @@ func main() {
 		dbtoolConfig.MysqlDataSource = s
 	}
 	if *deleteAllData {
-		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource))
+		db, err := utils.OpenDB(dbtoolConfig.DbDriver, dbtoolConfig.MysqlDataSource)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -98,7 +97,13 @@ func main() {
 		fmt.Println("redis data drop successfully")
 	}
 
-	if *deleteAllData || *onlyFlushKvrocks {
+	if (*deleteAllData || *onlyFlushKvrocks) && dbtoolConfig.TreeDB.Driver == "leveldb" {
+		err = os.RemoveAll(dbtoolConfig.TreeDB.Option.Addr)
+		if err != nil {
+			panic(err.Error())
+		}
+		fmt.Println("leveldb data drop successfully")
+	} else if *deleteAllData || *onlyFlushKvrocks {
 		client := redis.NewClient(&redis.Options{
 			Addr:            dbtoolConfig.TreeDB.Option.Addr,
 			PoolSize:        500,
@@ -115,7 +120,7 @@ func main() {
 	}
 
 	if *checkProverStatus {
-		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource), &gorm.Config{
+		db, err := utils.OpenDB(dbtoolConfig.DbDriver, dbtoolConfig.MysqlDataSource, &gorm.Config{
 			Logger: newLogger,
 		})
 		if err != nil {
@@ -156,7 +161,7 @@ func main() {
 	}
 
 	if *queryCexAssetsConfig {
-		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource))
+		db, err := utils.OpenDB(dbtoolConfig.DbDriver, dbtoolConfig.MysqlDataSource)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -169,7 +174,10 @@ func main() {
 		if witness == nil {
 			panic("decode invalid witness data")
 		}
-		cexAssetsInfo := utils.RecoverAfterCexAssets(witness)
+		cexAssetsInfo, err := utils.RecoverAfterCexAssets(witness)
+		if err != nil {
+			panic(err.Error())
+		}
 		var newAssetsInfo []utils.CexAssetInfo
 		for i := 0; i < len(cexAssetsInfo); i++ {
 			if cexAssetsInfo[i].BasePrice != 0 {
@@ -181,7 +189,7 @@ func main() {
 	}
 
 	if *queryWitnessData != -1 {
-		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource), &gorm.Config{
+		db, err := utils.OpenDB(dbtoolConfig.DbDriver, dbtoolConfig.MysqlDataSource, &gorm.Config{
 			Logger: newLogger,
 		})
 		if err != nil {
@@ -197,7 +205,7 @@ func main() {
 	}
 
 	if *queryAccountData != -1 {
-		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource), &gorm.Config{
+		db, err := utils.OpenDB(dbtoolConfig.DbDriver, dbtoolConfig.MysqlDataSource, &gorm.Config{
 			Logger: newLogger,
 		})
 		if err != nil {
@@ -213,48 +221,20 @@ func main() {
 	}
 
 	if *pushTaskToRedis {
-		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource), &gorm.Config{
+		db, err := utils.OpenDB(dbtoolConfig.DbDriver, dbtoolConfig.MysqlDataSource, &gorm.Config{
 			Logger: newLogger,
 		})
 		if err != nil {
 			panic(err.Error())
 		}
 		witnessModel := witness.NewWitnessModel(db, dbtoolConfig.DbSuffix)
-		limit := 1024
-		offset := 0
-		witessStatusList := []int64{witness.StatusPublished}
-		taskQueueName := "por_batch_task_queue_" + dbtoolConfig.DbSuffix
-		ctx := context.Background()
 		redisCli := redis.NewClient(&redis.Options{
 			Addr: dbtoolConfig.Redis.Host,
 			Password: dbtoolConfig.Redis.Password,
 		})
-		for _, status := range witessStatusList {
-			offset = 0
-			for {
-				witnessHeights, err := witnessModel.GetAllBatchHeightsByStatus(status, limit, offset)
-				if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
-					fmt.Println("get witness heights timeout, retry...:", err.Error())
-					time.Sleep(1 * time.Second)
-					continue
-				}
-				if err == utils.DbErrNotFound {
-					fmt.Printf("no more witness data with status %d\n", status)
-					break
-				}
-
-				redisPipe := redisCli.Pipeline()
-				for _, height := range witnessHeights {
-					redisPipe.LPush(ctx, taskQueueName, height)
-				}
-				_, err = redisPipe.Exec(ctx)
-				if err != nil {
-					panic(err.Error())
-				} else {
-					fmt.Printf("push %d task to redis, offset: %d\n", len(witnessHeights), offset)
-				}
-				offset += len(witnessHeights)
-			}
+		err = prover.PushPublishedTasks(witnessModel, prover.NewRedisTaskQueue(witnessModel, redisCli, dbtoolConfig.DbSuffix))
+		if err != nil {
+			panic(err.Error())
 		}
 		fmt.Println("push task to redis successfully")
 	}
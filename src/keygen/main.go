@@ -1,68 +1,233 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
+	"flag"
+	"io"
+	"log/slog"
 	"os"
 
 	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/consensys/gnark-crypto/ecc"
+	kzg_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/kzg"
+	"github.com/consensys/gnark-crypto/kzg"
 
 	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
 	"runtime"
 	"time"
 
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/frontend/cs/r1cs"
-	"strconv"
+	"github.com/consensys/gnark/test/unsafekzg"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mpcsetup" {
+		runMPCSetup(os.Args[2:])
+		return
+	}
+	aggregation := flag.Int("aggregation", 0, "generate the aggregation keys of the arity, e.g. 4, instead of the batch keys")
+	provingSystemName := flag.String("proving_system", circuit.ProvingSystemGroth16, "groth16 or plonk")
+	srsFile := flag.String("srs", "", "kzg srs file of a universal setup ceremony, which plonk needs")
+	unsafeSRS := flag.Bool("unsafe_srs", false, "generate a kzg srs with a known toxic waste for plonk, only for test")
+	exportSolidity := flag.Bool("solidity", false, "export a Solidity verifier contract for the verifying key of every tier")
+	tierManifest := flag.String("tiers", "", "tier manifest file, the built-in tiers are used if it is empty")
+	logLevel := flag.String("log_level", "info", "debug, info, warn or error")
+	logFormat := flag.String("log_format", "text", "text or json")
+	flag.Parse()
+	err := utils.InitLogger("keygen", "", utils.LogConfig{Level: *logLevel, Format: *logFormat})
+	if err != nil {
+		panic(err.Error())
+	}
+	applyTierManifest(*tierManifest)
 	go func() {
 		for {
 			time.Sleep(time.Second * 10)
 			runtime.GC()
 		}
 	}()
+	provingSystem, err := circuit.NewProvingSystem(*provingSystemName)
+	if err != nil {
+		panic(err)
+	}
+	if *exportSolidity {
+		exportSolidityVerifiers(provingSystem)
+		return
+	}
+	if *aggregation != 0 {
+		generateAggregationKeys(*aggregation)
+		return
+	}
+	isPlonk := provingSystem.Name() == circuit.ProvingSystemPlonk
 	for k, v := range utils.BatchCreateUserOpsCountsTiers {
-		circuit := circuit.NewBatchCreateUserCircuit(uint32(k), utils.AssetCounts, uint32(v))
-		startTime := time.Now()
-		oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit, frontend.IgnoreUnconstrainedInputs())
+		oR1cs, err := compileBatchCreateUserCircuit(provingSystem, k)
 		if err != nil {
 			panic(err)
 		}
-		endTime := time.Now()
-		fmt.Println("R1CS generation tims is ", endTime.Sub(startTime))
-		fmt.Println("batch create user constraints number is ", oR1cs.GetNbConstraints())
-		zkKeyName := "zkpor" + strconv.FormatInt(int64(k), 10) + "_" + strconv.FormatInt(int64(v), 10)
-		pkFile, err := os.Create(zkKeyName + ".pk")
+		zkKeyName := utils.ZkKeyName(k, v)
+		var srs, srsLagrange kzg.SRS
+		if isPlonk {
+			srs, srsLagrange = loadPlonkSRS(oR1cs, *srsFile, *unsafeSRS)
+		}
+		setupAndWriteKeys(zkKeyName, provingSystem, oR1cs, srs, srsLagrange)
+	}
+}
+
+// applyTierManifest makes the tiers of the manifest file the tiers keys are
+// generated for. The other services must be configured with the same file.
+func applyTierManifest(name string) {
+	manifest, err := utils.LoadTierManifest(name)
+	if err != nil {
+		panic(err.Error())
+	}
+	manifest.Apply()
+	slog.Info("tier manifest is loaded", "hash", manifest.Hash)
+}
+
+// generateAggregationKeys generates the keys of the leaf aggregation circuit
+// of every tier and of the node aggregation circuit. The batch create user
+// verifying keys of the tiers are read from the current directory. The keys
+// don't depend on the batch counts, so they are reused by every round.
+func generateAggregationKeys(arity int) {
+	prefix := utils.AggregationKeyPrefix(arity)
+	// the aggregation circuits verify groth16 batch proofs with groth16
+	groth16System, _ := circuit.NewProvingSystem(circuit.ProvingSystemGroth16)
+	var leafVks []groth16.VerifyingKey
+	for _, k := range utils.AssetCountsTiers {
+		vkName := utils.ZkKeyName(k, utils.BatchCreateUserOpsCountsTiers[k]) + ".vk"
+		vkFromFile, err := os.ReadFile(vkName)
 		if err != nil {
-			panic(err)
+			panic("verifyingKey file load error:" + err.Error())
 		}
-		pk, vk, err := groth16.Setup(oR1cs)
+		vk := groth16.NewVerifyingKey(ecc.BN254)
+		_, err = vk.ReadFrom(bytes.NewReader(vkFromFile))
+		if err != nil {
+			panic("verifyingKey loading error:" + err.Error())
+		}
+		leafCircuit, err := circuit.NewAggregateLeafCircuit(arity, vk)
 		if err != nil {
 			panic(err)
 		}
-		n, err := pk.WriteTo(pkFile)
+		startTime := time.Now()
+		oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, leafCircuit)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("pk size is ", n)
-		vkFile, err := os.Create(zkKeyName + ".vk")
+		endTime := time.Now()
+		slog.Info("leaf aggregation r1cs is generated", utils.LogKeyAssetsCount, k, "cost", endTime.Sub(startTime), "constraints", oR1cs.GetNbConstraints())
+		leafVk := setupAndWriteKeys(utils.AggregationLeafKeyName(prefix, k), groth16System, oR1cs, nil, nil)
+		leafVks = append(leafVks, leafVk.(groth16.VerifyingKey))
+	}
+	nodeCircuit, err := circuit.NewAggregateNodeCircuit(arity, leafVks)
+	if err != nil {
+		panic(err)
+	}
+	startTime := time.Now()
+	oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, nodeCircuit)
+	if err != nil {
+		panic(err)
+	}
+	endTime := time.Now()
+	slog.Info("node aggregation r1cs is generated", "cost", endTime.Sub(startTime), "constraints", oR1cs.GetNbConstraints())
+	nodeVk := setupAndWriteKeys(utils.AggregationNodeKeyName(prefix), groth16System, oR1cs, nil, nil)
+	err = circuit.CheckAggregateNodeVerifyingKey(nodeVk.(groth16.VerifyingKey), leafVks[0])
+	if err != nil {
+		panic(err)
+	}
+}
+
+// exportSolidityVerifiers writes a Solidity verifier contract next to the
+// verifying key of every tier in the current directory. Batch proofs must be
+// generated with the solidity proof target to be verified by the contracts.
+func exportSolidityVerifiers(provingSystem circuit.ProvingSystem) {
+	for k, v := range utils.BatchCreateUserOpsCountsTiers {
+		zkKeyName := utils.ZkKeyName(k, v)
+		vkFromFile, err := os.ReadFile(zkKeyName + ".vk")
+		if err != nil {
+			panic("verifyingKey file load error:" + err.Error())
+		}
+		vk := provingSystem.NewVerifyingKey()
+		_, err = vk.ReadFrom(bytes.NewReader(vkFromFile))
+		if err != nil {
+			panic("verifyingKey loading error:" + err.Error())
+		}
+		solFile, err := os.Create(zkKeyName + ".sol")
 		if err != nil {
 			panic(err)
 		}
-		n, err = vk.WriteTo(vkFile)
+		err = vk.ExportSolidity(solFile)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("pk size is ", n)
+		solFile.Close()
+		slog.Info("solidity verifier is written", "file", zkKeyName+".sol")
+	}
+}
 
-		r1csFile, _ := os.Create(zkKeyName + ".r1cs")
-		n, err = oR1cs.WriteTo(r1csFile)
+// loadPlonkSRS returns the kzg srs of the circuit size, plonk keys only need a
+// universal setup so every tier shares the same ceremony srs file
+func loadPlonkSRS(oR1cs constraint.ConstraintSystem, srsFile string, unsafeSRS bool) (kzg.SRS, kzg.SRS) {
+	if unsafeSRS {
+		srs, srsLagrange, err := unsafekzg.NewSRS(oR1cs)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("r1cs size is ", n)
+		return srs, srsLagrange
+	}
+	if srsFile == "" {
+		panic("plonk needs a kzg srs, use -srs or -unsafe_srs")
+	}
+	srsFromFile, err := os.ReadFile(srsFile)
+	if err != nil {
+		panic("srs file load error:" + err.Error())
+	}
+	var ceremonySRS kzg_bn254.SRS
+	_, err = ceremonySRS.ReadFrom(bytes.NewReader(srsFromFile))
+	if err != nil {
+		panic("srs loading error:" + err.Error())
+	}
+	srs, srsLagrange, err := circuit.NewPlonkSRS(oR1cs, &ceremonySRS)
+	if err != nil {
+		panic(err)
+	}
+	return srs, srsLagrange
+}
+
+// compileBatchCreateUserCircuit compiles the batch create user circuit of the tier
+func compileBatchCreateUserCircuit(provingSystem circuit.ProvingSystem, assetsCount int) (constraint.ConstraintSystem, error) {
+	batchCircuit := circuit.NewBatchCreateUserCircuit(uint32(assetsCount), uint32(utils.AssetCounts), uint32(utils.BatchCreateUserOpsCountsTiers[assetsCount]))
+	startTime := time.Now()
+	oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), provingSystem.NewBuilder(), batchCircuit, frontend.IgnoreUnconstrainedInputs())
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("batch create user r1cs is generated", utils.LogKeyAssetsCount, assetsCount, "cost", time.Since(startTime), "constraints", oR1cs.GetNbConstraints())
+	return oR1cs, nil
+}
+
+func setupAndWriteKeys(zkKeyName string, provingSystem circuit.ProvingSystem, oR1cs constraint.ConstraintSystem, srs, srsLagrange kzg.SRS) circuit.VerifyingKey {
+	pk, vk, err := provingSystem.Setup(oR1cs, srs, srsLagrange)
+	if err != nil {
+		panic(err)
+	}
+	writeZkFile("proving key", zkKeyName+".pk", pk)
+	writeZkFile("verifying key", zkKeyName+".vk", vk)
+	writeZkFile("r1cs", zkKeyName+".r1cs", oR1cs)
+	return vk
+}
+
+// writeZkFile writes the r1cs, key or ceremony contribution to the file
+func writeZkFile(what string, name string, w io.WriterTo) {
+	f, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	n, err := w.WriteTo(f)
+	if err != nil {
+		panic(err)
 	}
+	slog.Info(what+" is written", "file", name, "size", n)
 }
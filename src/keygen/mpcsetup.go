@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	curve "github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	groth16_bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	cs "github.com/consensys/gnark/constraint/bn254"
+)
+
+const mpcSetupUsage = `usage: keygen mpcsetup <command> [arguments]
+
+phase2-init and finalise read the tiers from the manifest file of -tiers, which
+must be CommitmentFree since gnark mpcsetup doesn't set up commitments.
+
+commands:
+  phase1-init       -power n -out file              start the circuit independent powers of tau
+  phase1-contribute -in file -out file              add a random contribution to phase 1
+  phase1-verify     file0 file1 ...                 verify the chain of phase 1 contributions
+  phase2-init       -phase1 file -tier assetsCount  start phase 2 of a tier from the last phase 1 contribution
+  phase2-contribute -in file -out file              add a random contribution to phase 2
+  phase2-verify     file0 file1 ...                 verify the chain of phase 2 contributions
+  finalise          -phase1 file -phase2 file -tier assetsCount
+                                                    extract the .r1cs, .pk and .vk of a tier
+`
+
+// runMPCSetup runs the multi-party groth16 setup ceremony of the batch create
+// user circuits. Phase 1 is shared by all the tiers, phase 2 is run per tier,
+// and the toxic waste is safe as long as one contributor destroys their randomness.
+func runMPCSetup(args []string) {
+	if len(args) == 0 {
+		fmt.Print(mpcSetupUsage)
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("mpcsetup "+args[0], flag.ExitOnError)
+	power := fs.Int("power", 0, "the phase 1 supports circuits of up to 2^power constraints")
+	in := fs.String("in", "", "the last contribution")
+	out := fs.String("out", "", "the file the new contribution is written to")
+	phase1File := fs.String("phase1", "", "the verified last phase 1 contribution")
+	phase2File := fs.String("phase2", "", "the verified last phase 2 contribution")
+	tier := fs.Int("tier", 0, "the assets count of the tier")
+	tierManifest := fs.String("tiers", "", "tier manifest file, the built-in tiers are used if it is empty")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		panic(err)
+	}
+	applyTierManifest(*tierManifest)
+
+	switch args[0] {
+	case "phase1-init":
+		if *power <= 0 || *out == "" {
+			panic("phase1-init needs -power and -out")
+		}
+		phase1 := mpcsetup.InitPhase1(*power)
+		writeZkFile("phase 1", *out, &phase1)
+	case "phase1-contribute":
+		var phase1 mpcsetup.Phase1
+		readCeremonyFile(*in, &phase1)
+		phase1.Contribute()
+		writeZkFile("phase 1", *out, &phase1)
+		fmt.Printf("contribution hash is %x\n", phase1.Hash)
+	case "phase1-verify":
+		contributions := make([]*mpcsetup.Phase1, fs.NArg())
+		for i := 0; i < fs.NArg(); i++ {
+			contributions[i] = new(mpcsetup.Phase1)
+			readCeremonyFile(fs.Arg(i), contributions[i])
+		}
+		if len(contributions) < 2 {
+			panic("phase1-verify needs at least two contributions")
+		}
+		err = mpcsetup.VerifyPhase1(contributions[0], contributions[1], contributions[2:]...)
+		if err != nil {
+			fmt.Println("phase 1 verification failed:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("phase 1 contributions verify passed")
+	case "phase2-init":
+		var phase1 mpcsetup.Phase1
+		readCeremonyFile(*phase1File, &phase1)
+		_, phase2, _, err := initTierPhase2(&phase1, *tier)
+		if err != nil {
+			panic(err)
+		}
+		writeZkFile("phase 2", tierKeyName(*tier)+".ph2", phase2)
+	case "phase2-contribute":
+		var phase2 mpcsetup.Phase2
+		readCeremonyFile(*in, &phase2)
+		phase2.Contribute()
+		writeZkFile("phase 2", *out, &phase2)
+		fmt.Printf("contribution hash is %x\n", phase2.Hash)
+	case "phase2-verify":
+		contributions := make([]*mpcsetup.Phase2, fs.NArg())
+		for i := 0; i < fs.NArg(); i++ {
+			contributions[i] = new(mpcsetup.Phase2)
+			readCeremonyFile(fs.Arg(i), contributions[i])
+		}
+		if len(contributions) < 2 {
+			panic("phase2-verify needs at least two contributions")
+		}
+		err = mpcsetup.VerifyPhase2(contributions[0], contributions[1], contributions[2:]...)
+		if err != nil {
+			fmt.Println("phase 2 verification failed:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("phase 2 contributions verify passed")
+	case "finalise":
+		var phase1 mpcsetup.Phase1
+		readCeremonyFile(*phase1File, &phase1)
+		var phase2 mpcsetup.Phase2
+		readCeremonyFile(*phase2File, &phase2)
+		oR1cs, pk, vk, err := finaliseTier(&phase1, &phase2, *tier)
+		if err != nil {
+			panic(err)
+		}
+		zkKeyName := tierKeyName(*tier)
+		writeZkFile("r1cs", zkKeyName+".r1cs", oR1cs)
+		writeZkFile("proving key", zkKeyName+".pk", pk)
+		writeZkFile("verifying key", zkKeyName+".vk", vk)
+	default:
+		fmt.Print(mpcSetupUsage)
+		os.Exit(2)
+	}
+}
+
+func tierKeyName(assetsCount int) string {
+	opsCount, ok := utils.BatchCreateUserOpsCountsTiers[assetsCount]
+	if !ok {
+		panic("the assets count is not in the tiers: " + strconv.Itoa(assetsCount))
+	}
+	return utils.ZkKeyName(assetsCount, opsCount)
+}
+
+func compileTierCircuit(assetsCount int) (*cs.R1CS, error) {
+	zkKeyName := tierKeyName(assetsCount)
+	provingSystem, err := circuit.NewProvingSystem(circuit.ProvingSystemGroth16)
+	if err != nil {
+		return nil, err
+	}
+	oR1cs, err := compileBatchCreateUserCircuit(provingSystem, assetsCount)
+	if err != nil {
+		return nil, err
+	}
+	// the mpcsetup of gnark doesn't generate the pedersen keys of the
+	// commitments, the keys would have to be set up with local randomness
+	if len(oR1cs.GetCommitments().CommitmentIndexes()) > 0 {
+		return nil, fmt.Errorf("the circuit of %s has commitments which gnark mpcsetup doesn't support, set CommitmentFree in the tier manifest", zkKeyName)
+	}
+	return oR1cs.(*cs.R1CS), nil
+}
+
+// initTierPhase2 compiles the circuit of the tier and derives its initial
+// phase 2 and evaluations from the last phase 1 contribution
+func initTierPhase2(phase1 *mpcsetup.Phase1, assetsCount int) (*cs.R1CS, *mpcsetup.Phase2, *mpcsetup.Phase2Evaluations, error) {
+	oR1cs, err := compileTierCircuit(assetsCount)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = truncatePhase1(phase1, oR1cs.GetNbConstraints())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	phase2, evals := mpcsetup.InitPhase2(oR1cs, phase1)
+	return oR1cs, &phase2, &evals, nil
+}
+
+// finaliseTier extracts the keys of the tier from the last contributions. The
+// circuit and its evaluations are derived again, so the keys can't be
+// extracted from the phase 2 of another circuit.
+func finaliseTier(phase1 *mpcsetup.Phase1, phase2 *mpcsetup.Phase2, assetsCount int) (*cs.R1CS, *groth16_bn254.ProvingKey, *groth16_bn254.VerifyingKey, error) {
+	oR1cs, initialPhase2, evals, err := initTierPhase2(phase1, assetsCount)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = checkPhase2(initialPhase2, phase2)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("the phase 2 doesn't belong to the circuit of %s: %s", tierKeyName(assetsCount), err.Error())
+	}
+	pk, vk := mpcsetup.ExtractKeys(phase1, phase2, evals, oR1cs.GetNbConstraints())
+	return oR1cs, &pk, &vk, nil
+}
+
+// checkPhase2 checks that the contribution is derived from the initial phase 2
+// of the circuit: [δ]₁ and [δ]₂ are the same δ, and L and Z are the ones of the
+// circuit divided by δ. The contributions in between are checked by phase2-verify.
+func checkPhase2(initial, contribution *mpcsetup.Phase2) error {
+	if len(contribution.Parameters.G1.L) != len(initial.Parameters.G1.L) ||
+		len(contribution.Parameters.G1.Z) != len(initial.Parameters.G1.Z) {
+		return errors.New("L or Z have the size of another circuit")
+	}
+	_, _, g1, g2 := curve.Generators()
+	g1.Neg(&g1)
+	ok, err := curve.PairingCheck([]curve.G1Affine{contribution.Parameters.G1.Delta, g1},
+		[]curve.G2Affine{g2, contribution.Parameters.G2.Delta})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("[δ]₁ and [δ]₂ don't match")
+	}
+	for _, p := range []struct {
+		name                 string
+		initial, contributed []curve.G1Affine
+	}{
+		{"L", initial.Parameters.G1.L, contribution.Parameters.G1.L},
+		{"Z", initial.Parameters.G1.Z, contribution.Parameters.G1.Z},
+	} {
+		// a random linear combination of the points checks all of them with one pairing
+		scalars := make([]fr.Element, len(p.initial))
+		for i := range scalars {
+			if _, err = scalars[i].SetRandom(); err != nil {
+				return err
+			}
+		}
+		var initialSum, contributedSum curve.G1Affine
+		if _, err = initialSum.MultiExp(p.initial, scalars, ecc.MultiExpConfig{}); err != nil {
+			return err
+		}
+		if _, err = contributedSum.MultiExp(p.contributed, scalars, ecc.MultiExpConfig{}); err != nil {
+			return err
+		}
+		initialSum.Neg(&initialSum)
+		ok, err = curve.PairingCheck([]curve.G1Affine{contributedSum, initialSum},
+			[]curve.G2Affine{contribution.Parameters.G2.Delta, initial.Parameters.G2.Delta})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s isn't the one of the circuit", p.name)
+		}
+	}
+	return nil
+}
+
+// truncatePhase1 cuts the powers of tau to the fft domain of the circuit, so
+// that a single phase 1 can serve the circuits of all the tiers
+func truncatePhase1(phase1 *mpcsetup.Phase1, nbConstraints int) error {
+	n := int(ecc.NextPowerOfTwo(uint64(nbConstraints)))
+	if len(phase1.Parameters.G1.AlphaTau) < n {
+		return fmt.Errorf("phase 1 supports %d constraints, the circuit needs %d", len(phase1.Parameters.G1.AlphaTau), n)
+	}
+	phase1.Parameters.G1.Tau = phase1.Parameters.G1.Tau[:2*n-1]
+	phase1.Parameters.G1.AlphaTau = phase1.Parameters.G1.AlphaTau[:n]
+	phase1.Parameters.G1.BetaTau = phase1.Parameters.G1.BetaTau[:n]
+	phase1.Parameters.G2.Tau = phase1.Parameters.G2.Tau[:n]
+	return nil
+}
+
+func readCeremonyFile(name string, r io.ReaderFrom) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		panic(name + " load error:" + err.Error())
+	}
+	_, err = r.ReadFrom(bytes.NewReader(content))
+	if err != nil {
+		panic(name + " read error:" + err.Error())
+	}
+}
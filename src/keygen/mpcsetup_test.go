@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/pkg/por"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/prover"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/verifier"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+)
+
+// copyCeremonyFile sends the contribution through its file format like the
+// participants of a ceremony do
+func copyCeremonyFile(t *testing.T, src io.WriterTo, dst io.ReaderFrom) {
+	var buf bytes.Buffer
+	if _, err := src.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMPCSetup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a ceremony and proves a circuit")
+	}
+	dir := t.TempDir()
+	manifestFile := filepath.Join(dir, "tiers.json")
+	err := os.WriteFile(manifestFile, []byte(`{"AccountTreeDepth": 4, "AssetCounts": 4, "TierCount": 2, "CommitmentFree": true,
+		"Tiers": [{"AssetsCount": 4, "BatchCreateUserOpsCount": 1}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tierManifest, err := utils.LoadTierManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tierManifest.Apply()
+	defer utils.DefaultTierManifest().Apply()
+
+	// the powers of tau cover the 2^16 constraints of the tier
+	phase1 := mpcsetup.InitPhase1(16)
+	var prevPhase1 mpcsetup.Phase1
+	copyCeremonyFile(t, &phase1, &prevPhase1)
+	phase1.Contribute()
+	if err = mpcsetup.VerifyPhase1(&prevPhase1, &phase1); err != nil {
+		t.Fatal(err)
+	}
+
+	_, phase2, _, err := initTierPhase2(&phase1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contribution mpcsetup.Phase2
+	copyCeremonyFile(t, phase2, &contribution)
+	contribution.Contribute()
+	if err = mpcsetup.VerifyPhase2(phase2, &contribution); err != nil {
+		t.Fatal(err)
+	}
+
+	// a phase 2 whose L isn't the one of the circuit is refused
+	var tampered mpcsetup.Phase2
+	copyCeremonyFile(t, &contribution, &tampered)
+	tampered.Parameters.G1.L[0], tampered.Parameters.G1.L[1] = tampered.Parameters.G1.L[1], tampered.Parameters.G1.L[0]
+	if err = checkPhase2(phase2, &tampered); err == nil {
+		t.Fatal("expected the phase 2 of another circuit to be refused")
+	}
+
+	oR1cs, pk, vk, err := finaliseTier(&phase1, &contribution, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zkKeyDir := filepath.Join(dir, "keys")
+	os.Mkdir(zkKeyDir, 0755)
+	zkKeyName := tierManifest.ZkKeyNames(zkKeyDir)[0]
+	for ext, content := range map[string]io.WriterTo{".r1cs": oR1cs, ".pk": pk, ".vk": vk} {
+		var buf bytes.Buffer
+		if _, err = content.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(zkKeyName+ext, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first users of the sample dataset are proved and verified with the
+	// keys, the assets get 2 collateral ratio tiers and the invalid users are left out
+	dataDir := filepath.Join(dir, "data")
+	os.Mkdir(dataDir, 0755)
+	cexAssetsInfo, err := os.ReadFile("../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cexAssetsInfo = regexp.MustCompile(`\[[^\]]*\]`).ReplaceAll(cexAssetsInfo, []byte("[0-10000:100,10000-100000:90]"))
+	os.WriteFile(filepath.Join(dataDir, utils.CexAssetsInfoFile), cexAssetsInfo, 0644)
+	f, err := os.Open("../sampledata/sample_users0.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users bytes.Buffer
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 5 && scanner.Scan(); i++ {
+		users.WriteString(scanner.Text() + "\n")
+	}
+	f.Close()
+	os.WriteFile(filepath.Join(dataDir, "users0.csv"), users.Bytes(), 0644)
+
+	ctx := context.Background()
+	dataset, err := por.ParseDataset(ctx, dataDir, tierManifest)
+	var invalidAccounts *utils.ErrInvalidAccounts
+	if err != nil && !errors.As(err, &invalidAccounts) {
+		t.Fatal(err)
+	}
+	store, err := por.OpenSQLiteStore(filepath.Join(dir, "por.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountTree, err := utils.NewAccountTree("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = por.BuildWitnesses(ctx, store, accountTree, dataset); err != nil {
+		t.Fatal(err)
+	}
+	p, err := por.NewProver(store, por.ProverOptions{
+		TierManifest: tierManifest,
+		ZkKeyDir:     zkKeyDir,
+		TaskQueue:    prover.TaskQueueMemory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = por.ProveBatches(ctx, p, false); err != nil {
+		t.Fatal(err)
+	}
+	proofTable := filepath.Join(dir, "proof.csv")
+	if err = por.ExportProofTable(store, proofTable); err != nil {
+		t.Fatal(err)
+	}
+	cexAssets, err := por.RoundCexAssets(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofs, err := verifier.ReadProofTable(proofTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := por.VerifyRound(ctx, proofs, por.VerifyOptions{
+		TierManifest: tierManifest,
+		ZkKeyDir:     zkKeyDir,
+		CexAssets:    cexAssets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Passed() || len(proofs) != 2 {
+		t.Fatalf("%d proofs failed to verify: %v", len(report.Failures), report.Failures)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/pkg/por"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+const datasetUsage = `usage: porctl dataset <command> [flags]
+
+commands:
+  lint   check every row of a dataset and write a report of all its problems`
+
+func runDataset(args []string) {
+	if len(args) < 1 {
+		fmt.Println(datasetUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "lint":
+		runDatasetLint(args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Println(datasetUsage)
+	default:
+		fmt.Println("unknown dataset command " + args[0])
+		fmt.Println(datasetUsage)
+		os.Exit(2)
+	}
+}
+
+// runDatasetLint checks the dataset before any witness work starts and
+// writes the report, a .csv report has one row per issue and any other
+// extension gets the whole report in json. It exits with 1 if there are issues.
+func runDatasetLint(args []string) {
+	flags := flag.NewFlagSet("dataset lint", flag.ExitOnError)
+	dataDir := flags.String("data", "src/sampledata", "directory of cex_assets_info.csv and the user files")
+	tierManifestFile := flags.String("tiers", "", "tier manifest file, the built-in tiers are used if it is empty")
+	reportFile := flags.String("report", "lint_report.json", "report file, .json or .csv")
+	logLevel := flags.String("log_level", "info", "debug, info, warn or error")
+	flags.Parse(args)
+
+	err := utils.InitLogger("porctl", "", utils.LogConfig{Level: *logLevel})
+	if err != nil {
+		panic(err.Error())
+	}
+	var tierManifest *utils.TierManifest
+	if *tierManifestFile != "" {
+		tierManifest, err = utils.LoadTierManifest(*tierManifestFile)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	report, err := por.LintDataset(ctx, *dataDir, tierManifest)
+	if err != nil {
+		fmt.Println("dataset lint failed:", err.Error())
+		os.Exit(1)
+	}
+	if strings.EqualFold(filepath.Ext(*reportFile), ".csv") {
+		err = report.WriteCSV(*reportFile)
+	} else {
+		err = report.WriteJSON(*reportFile)
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	fmt.Println("valid accounts:", report.ValidAccounts)
+	if len(report.Rounding) > 0 {
+		fmt.Println("assets with rounded amounts:", len(report.Rounding))
+	}
+	for _, kind := range report.SortedIssueKinds() {
+		fmt.Printf("%s: %d\n", kind, report.IssueCounts[kind])
+	}
+	for _, kind := range report.SortedWarningKinds() {
+		fmt.Printf("%s warnings: %d\n", kind, report.WarningCounts[kind])
+	}
+	fmt.Println("the report is written to", *reportFile)
+	if !report.Passed() {
+		fmt.Println("Dataset lint failed!!!")
+		os.Exit(1)
+	}
+	fmt.Println("Dataset lint passed!!!")
+}
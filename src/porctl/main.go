@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: porctl <command> [flags]
+
+commands:
+  run-local   run every stage of a round on a dataset in one process, with an
+              in-memory account tree, a sqlite store and an in-process task queue
+  dataset     lint a dataset before a round
+
+run "porctl <command> -h" for the flags of a command`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "run-local":
+		runLocal(os.Args[2:])
+	case "dataset":
+		runDataset(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Println(usage)
+	default:
+		fmt.Println("unknown command " + os.Args[1])
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/pkg/por"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/prover"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/userproof/model"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/config"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/verifier"
+)
+
+// localTierManifest is small enough to set up and prove the sample dataset in
+// minutes: at most 4096 accounts owning at most 4 of 4 assets
+var localTierManifest = utils.TierManifest{
+	AccountTreeDepth: 12,
+	AssetCounts:      4,
+	TierCount:        utils.DefaultTierCount,
+	Tiers:            []utils.TierInfo{{AssetsCount: 4, BatchCreateUserOpsCount: 8}},
+}
+
+// runLocal runs keygen, witness, prover, userproof and verifier on the
+// dataset. The output directory gets the artifacts of the round:
+//
+//	tiers.json              the tier manifest if -tiers isn't set
+//	keys/                   the keys of the tiers, reused by the next runs
+//	accounts/               the ingested user files, reused by the next runs
+//	por.db                  the sqlite store of the witnesses, proofs and user proofs
+//	proof.csv               the exported proof table
+//	config/config.json      the verifier config of the round
+//	config/user_config.json the user proof of the first account for verifier -user
+//	report.json             the verification report
+func runLocal(args []string) {
+	flags := flag.NewFlagSet("run-local", flag.ExitOnError)
+	dataDir := flags.String("data", "src/sampledata", "directory of cex_assets_info.csv and the user files")
+	outDir := flags.String("out", "local_round", "directory the artifacts of the round are written to")
+	tierManifestFile := flags.String("tiers", "", "tier manifest file, a small manifest for the sample dataset is used if it is empty")
+	provingSystem := flags.String("proving_system", "groth16", "groth16 or plonk, plonk keys are set up with an unsafe srs")
+	provingWorkers := flags.Int("proving_workers", 1, "number of proofs generated at the same time")
+	logLevel := flags.String("log_level", "info", "debug, info, warn or error")
+	logFormat := flags.String("log_format", "text", "text or json")
+	flags.Parse(args)
+
+	err := utils.InitLogger("porctl", "", utils.LogConfig{Level: *logLevel, Format: *logFormat})
+	if err != nil {
+		panic(err.Error())
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	report, err := runLocalRound(ctx, localRoundOptions{
+		DataDir:          *dataDir,
+		OutDir:           *outDir,
+		TierManifestFile: *tierManifestFile,
+		ProvingSystem:    *provingSystem,
+		ProvingWorkers:   *provingWorkers,
+	})
+	if err != nil {
+		fmt.Println("local round failed:", err.Error())
+		os.Exit(1)
+	}
+	if !report.Passed() {
+		fmt.Println("the following", len(report.Failures), "checks failed:")
+		for _, failure := range report.Failures {
+			fmt.Println(failure.Error())
+		}
+		fmt.Println("Proofs verify failed!!!")
+		os.Exit(1)
+	}
+	fmt.Printf("account merkle tree root is %s\n", report.AccountTreeRoot)
+	fmt.Println("All proofs verify passed!!!")
+	fmt.Println("the artifacts of the round are in", *outDir)
+}
+
+type localRoundOptions struct {
+	DataDir          string
+	OutDir           string
+	TierManifestFile string
+	ProvingSystem    string
+	ProvingWorkers   int
+}
+
+func runLocalRound(ctx context.Context, opts localRoundOptions) (*verifier.Report, error) {
+	outDir, err := filepath.Abs(opts.OutDir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Join(outDir, "config"), 0755)
+	if err != nil {
+		return nil, err
+	}
+	tierManifestFile := opts.TierManifestFile
+	if tierManifestFile == "" {
+		tierManifestFile = filepath.Join(outDir, "tiers.json")
+		err = writeJSON(tierManifestFile, &localTierManifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tierManifestFile, err = filepath.Abs(tierManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	tierManifest, err := utils.LoadTierManifest(tierManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("tier manifest is loaded", "hash", tierManifest.Hash)
+
+	// the key names only depend on the tiers, so the keys of another manifest
+	// or proving system are kept in another directory
+	provingSystem := opts.ProvingSystem
+	if provingSystem == "" {
+		provingSystem = "groth16"
+	}
+	zkKeyDir := filepath.Join(outDir, "keys", provingSystem+"_"+tierManifest.Hash[:16])
+	err = os.MkdirAll(zkKeyDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = por.GenerateKeys(por.KeygenOptions{
+		TierManifest:  tierManifest,
+		ZkKeyDir:      zkKeyDir,
+		ProvingSystem: provingSystem,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("keygen failed: %s", err.Error())
+	}
+
+	dataset, err := por.IngestDataset(ctx, opts.DataDir, filepath.Join(outDir, "accounts"), tierManifest)
+	var invalidAccounts *utils.ErrInvalidAccounts
+	if errors.As(err, &invalidAccounts) {
+		slog.Warn("invalid accounts are left out", "count", len(invalidAccounts.Errors), "err", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("parse dataset failed: %s", err.Error())
+	}
+
+	// the memory tree starts empty, so the witnesses of a previous run can't be resumed
+	storeFile := filepath.Join(outDir, "por.db")
+	for _, name := range []string{storeFile, storeFile + "-wal", storeFile + "-shm"} {
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	store, err := por.OpenSQLiteStore(storeFile, "")
+	if err != nil {
+		return nil, err
+	}
+	accountTree, err := utils.NewAccountTree("memory", "")
+	if err != nil {
+		return nil, err
+	}
+	err = por.BuildWitnesses(ctx, store, accountTree, dataset)
+	if err != nil {
+		return nil, fmt.Errorf("witness failed: %s", err.Error())
+	}
+
+	p, err := por.NewProver(store, por.ProverOptions{
+		TierManifest:   tierManifest,
+		ZkKeyDir:       zkKeyDir,
+		ProvingSystem:  provingSystem,
+		TaskQueue:      prover.TaskQueueMemory,
+		ProvingWorkers: opts.ProvingWorkers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create prover failed: %s", err.Error())
+	}
+	err = por.ProveBatches(ctx, p, false)
+	if err != nil {
+		return nil, fmt.Errorf("prover failed: %s", err.Error())
+	}
+
+	err = por.GenerateUserProofs(ctx, store, accountTree, dataset)
+	if err != nil {
+		return nil, fmt.Errorf("userproof failed: %s", err.Error())
+	}
+	userProof, err := model.NewUserProofModel(store.DB, store.Suffix).GetUserProofByIndex(0)
+	if err != nil {
+		return nil, fmt.Errorf("get user proof failed: %s", err.Error())
+	}
+	err = os.WriteFile(filepath.Join(outDir, "config", "user_config.json"), []byte(userProof.Config), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	proofTable := filepath.Join(outDir, "proof.csv")
+	err = por.ExportProofTable(store, proofTable)
+	if err != nil {
+		return nil, fmt.Errorf("export proof table failed: %s", err.Error())
+	}
+	cexAssets, err := por.RoundCexAssets(store)
+	if err != nil {
+		return nil, fmt.Errorf("get cex assets failed: %s", err.Error())
+	}
+	verifierConfig := &config.Config{
+		ProofTable:    proofTable,
+		TierManifest:  tierManifestFile,
+		ZkKeyDir:      zkKeyDir,
+		CexAssetsInfo: cexAssets,
+		ProvingSystem: provingSystem,
+	}
+	err = writeJSON(filepath.Join(outDir, "config", "config.json"), verifierConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// the exported table is verified, so the verifier would pass with the same artifacts
+	proofs, err := verifier.ReadProofTable(proofTable)
+	if err != nil {
+		return nil, err
+	}
+	report, err := por.VerifyRound(ctx, proofs, por.VerifyOptions{
+		TierManifest:  tierManifest,
+		ZkKeyDir:      zkKeyDir,
+		ProvingSystem: provingSystem,
+		CexAssets:     cexAssets,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verifier failed: %s", err.Error())
+	}
+	report.ProofTable = proofTable
+	err = report.WriteToFile(filepath.Join(outDir, "report.json"))
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func writeJSON(name string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, content, 0644)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunLocalRound(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs every stage of a round, which takes minutes")
+	}
+	report, err := runLocalRound(context.Background(), localRoundOptions{
+		DataDir: "../sampledata",
+		OutDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Passed() {
+		t.Fatalf("the round failed: %v", report.Failures)
+	}
+}
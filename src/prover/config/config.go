@@ -1,12 +1,46 @@
 package config
 
+import "github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+
 type Config struct {
+	// DbDriver is mysql (default), postgres or sqlite, MysqlDataSource is the data source of the driver
+	DbDriver        string
 	MysqlDataSource string
 	DbSuffix        string
 	Redis           struct {
 		Host     	string
 		Password  	string
 	}
-	ZkKeyName []string
-	AssetsCountTiers []int
+	// TaskQueue is redis (default), mysql or memory, mysql hands out the witnesses
+	// from the witness table of any DbDriver
+	TaskQueue string
+	// LeaseSeconds is how long a received witness stays leased without a heartbeat, 300 by default
+	LeaseSeconds int
+	// ShutdownTimeoutSeconds is how long the in-flight proof may take after SIGTERM or SIGINT, 60 by default
+	ShutdownTimeoutSeconds int
+	// ProvingWorkers is the number of proofs generated at the same time, 1 by default
+	ProvingWorkers int
+	// PrefetchCount is the number of batches decoded and assigned ahead of the proving workers
+	PrefetchCount int
+	// MemoryBudgetGB is the memory the r1cs and keys of the resident tiers may take,
+	// only the tier in use stays resident if it is zero
+	MemoryBudgetGB int
+	// TierManifest is the tier manifest file shared by all the services
+	TierManifest string
+	// MetricsAddr is the address the prometheus metrics are served on, e.g. :9100, nothing is served if it is empty
+	MetricsAddr string
+	// Log is the level and format of the logs
+	Log utils.LogConfig
+	// ZkKeyDir is the directory of the keys generated by keygen for the tiers of the manifest
+	ZkKeyDir string
+	// ProvingSystem is groth16 (default) or plonk
+	ProvingSystem string
+	// ProofTarget is native, recursion or solidity, see circuit.ProverOptions
+	ProofTarget string
+	// AggregationKeyName is the prefix of the aggregation keys generated by
+	// keygen -aggregation, e.g. zkporagg4
+	AggregationKeyName string
+	// AggregationArity is the arity keygen -aggregation was run with
+	AggregationArity int
+	AggregatedProofFile string
 }
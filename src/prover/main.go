@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/binance/zkmerkle-proof-of-solvency/pkg/por"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/config"
-	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/prover"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 )
 
+// defaultShutdownTimeout is how long the in-flight proofs may take after SIGTERM or SIGINT
+const defaultShutdownTimeout = 60 * time.Second
+
 func main() {
 	proverConfig := &config.Config{}
 	content, err := ioutil.ReadFile("config/config.json")
@@ -20,11 +29,9 @@ func main() {
 	if err != nil {
 		panic(err.Error())
 	}
-	if len(proverConfig.AssetsCountTiers) != len(proverConfig.ZkKeyName) {
-		panic("asset tiers and asset tier names should have the same length")
-	}
 	remotePasswdConfig := flag.String("remote_password_config", "", "fetch password from aws secretsmanager")
 	rerun := flag.Bool("rerun", false, "flag which indicates rerun proof generation")
+	aggregate := flag.Bool("aggregate", false, "aggregate all the batch proofs into one proof")
 	flag.Parse()
 	if *remotePasswdConfig != "" {
 		s, err := utils.GetMysqlSource(proverConfig.MysqlDataSource, *remotePasswdConfig)
@@ -33,6 +40,87 @@ func main() {
 		}
 		proverConfig.MysqlDataSource = s
 	}
-	prover := prover.NewProver(proverConfig)
-	prover.Run(*rerun)
+	err = utils.InitLogger("prover", proverConfig.DbSuffix, proverConfig.Log)
+	if err != nil {
+		panic(err.Error())
+	}
+	utils.ServeMetrics(proverConfig.MetricsAddr)
+	tierManifest, err := utils.LoadTierManifest(proverConfig.TierManifest)
+	if err != nil {
+		panic(err.Error())
+	}
+	store, err := por.OpenStoreWithDriver(proverConfig.DbDriver, proverConfig.MysqlDataSource, proverConfig.DbSuffix)
+	if err != nil {
+		panic(err.Error())
+	}
+	prover, err := por.NewProver(store, por.ProverOptions{
+		TierManifest:        tierManifest,
+		ZkKeyDir:            proverConfig.ZkKeyDir,
+		ProvingSystem:       proverConfig.ProvingSystem,
+		ProofTarget:         proverConfig.ProofTarget,
+		TaskQueue:           proverConfig.TaskQueue,
+		RedisAddr:           proverConfig.Redis.Host,
+		RedisPassword:       proverConfig.Redis.Password,
+		LeaseDuration:       time.Duration(proverConfig.LeaseSeconds) * time.Second,
+		ProvingWorkers:      proverConfig.ProvingWorkers,
+		PrefetchCount:       proverConfig.PrefetchCount,
+		MemoryBudgetGB:      proverConfig.MemoryBudgetGB,
+		AggregationKeyName:  proverConfig.AggregationKeyName,
+		AggregationArity:    proverConfig.AggregationArity,
+		AggregatedProofFile: proverConfig.AggregatedProofFile,
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	if *aggregate {
+		err = prover.Aggregate()
+		if err != nil {
+			slog.Error("aggregate proofs failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- por.ProveBatches(ctx, prover, *rerun)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err = <-done:
+		exitOnError(err)
+		return
+	case sig := <-signals:
+		slog.Info("received signal, wait for the in-flight proofs", "signal", sig.String())
+		cancel()
+	}
+	shutdownTimeout := defaultShutdownTimeout
+	if proverConfig.ShutdownTimeoutSeconds > 0 {
+		shutdownTimeout = time.Duration(proverConfig.ShutdownTimeoutSeconds) * time.Second
+	}
+	select {
+	case err = <-done:
+		if err != context.Canceled {
+			exitOnError(err)
+		}
+		return
+	case <-time.After(shutdownTimeout):
+		slog.Warn("the in-flight proofs aren't finished in the shutdown timeout", "timeout", shutdownTimeout)
+	case <-signals:
+		slog.Warn("received signal again")
+	}
+	err = prover.HandBack()
+	if err != nil {
+		slog.Error("hand back the in-flight witnesses failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		slog.Error("prover run failed", "err", err)
+		os.Exit(1)
+	}
 }
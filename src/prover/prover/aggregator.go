@@ -0,0 +1,274 @@
+package prover
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+)
+
+// aggregationTier is a run of consecutive batches of one tier
+type aggregationTier struct {
+	AssetsCount int
+	BatchCount  int
+}
+
+// aggregationKeys are the keys of a leaf or node aggregation circuit
+type aggregationKeys struct {
+	r1cs constraint.ConstraintSystem
+	pk   groth16.ProvingKey
+	vk   groth16.VerifyingKey
+}
+
+// Aggregate generates one proof which verifies all the batch proofs in the
+// proof table, and writes it to AggregatedProofFile. The batch proofs must
+// have been generated with the recursion proof target. The batches of every
+// tier are proved by leaf proofs of AggregationArity batches, then the leaf
+// proofs are proved by levels of node proofs until one node proof is left.
+func (p *Prover) Aggregate() error {
+	if p.ProvingSystem.Name() != circuit.ProvingSystemGroth16 {
+		return fmt.Errorf("only groth16 batch proofs can be aggregated")
+	}
+	arity := p.AggregationArity
+	if arity < 2 {
+		return fmt.Errorf("aggregation arity must be at least 2, got %d", arity)
+	}
+	count, err := p.proofModel.GetRowCounts()
+	if err != nil {
+		return fmt.Errorf("get proof counts failed: %s", err.Error())
+	}
+	if count == 0 {
+		return fmt.Errorf("there is no proof to aggregate")
+	}
+	proofs, err := p.proofModel.GetProofsBetween(0, count-1)
+	if err != nil {
+		return fmt.Errorf("get proofs failed: %s", err.Error())
+	}
+	if int64(len(proofs)) != count {
+		return fmt.Errorf("the proof table has %d rows but only %d proofs are numbered from 0 to %d", count, len(proofs), count-1)
+	}
+
+	batches := make([]circuit.AggregatedBatchInfo, len(proofs))
+	var tiers []aggregationTier
+	for i, row := range proofs {
+		if row.BatchNumber != int64(i) {
+			return fmt.Errorf("batch %d proof is missing", i)
+		}
+		err = p.TierManifest.Check(row.TierManifestHash)
+		if err != nil {
+			return fmt.Errorf("batch %d proof: %s", i, err.Error())
+		}
+		batches[i], err = decodeAggregatedBatchInfo(row)
+		if err != nil {
+			return fmt.Errorf("decode batch %d proof failed: %s", i, err.Error())
+		}
+		if len(tiers) > 0 && tiers[len(tiers)-1].AssetsCount == row.AssetsCount {
+			tiers[len(tiers)-1].BatchCount++
+			continue
+		}
+		// batches are ordered by asset counts tier, so every tier is one run of batches
+		for _, t := range tiers {
+			if t.AssetsCount == row.AssetsCount {
+				return fmt.Errorf("the batches of %d assets tier are not consecutive", row.AssetsCount)
+			}
+		}
+		tiers = append(tiers, aggregationTier{AssetsCount: row.AssetsCount, BatchCount: 1})
+	}
+
+	startTime := time.Now()
+	var children []circuit.AggregatedProofInfo
+	start := 0
+	for _, t := range tiers {
+		slog.Info("aggregate the batches of the tier", utils.LogKeyAssetsCount, t.AssetsCount, "batches", t.BatchCount)
+		// only the keys of one circuit are loaded at a time
+		leaf, err := loadAggregationKeys(utils.AggregationLeafKeyName(p.AggregationKeyName, t.AssetsCount))
+		if err != nil {
+			return err
+		}
+		end := start + t.BatchCount
+		for i := start; i < end; i += arity {
+			leafBatches := batches[i:min(i+arity, end)]
+			assignment, err := circuit.SetAggregateLeafCircuitWitness(arity, leafBatches)
+			if err != nil {
+				return err
+			}
+			last := leafBatches[len(leafBatches)-1]
+			commitment := circuit.AggregateLeafCommitment(leafBatches[0].BeforeAccountTreeRoot, last.AfterAccountTreeRoot,
+				leafBatches[0].BeforeCEXAssetsCommitment, last.AfterCEXAssetsCommitment)
+			proof, err := proveAggregate(leaf, assignment, commitment)
+			if err != nil {
+				return fmt.Errorf("aggregate batches %d to %d failed: %s", i, i+len(leafBatches)-1, err.Error())
+			}
+			children = append(children, circuit.AggregatedProofInfo{
+				Proof:                     proof,
+				VerifyingKey:              leaf.vk,
+				BeforeAccountTreeRoot:     leafBatches[0].BeforeAccountTreeRoot,
+				AfterAccountTreeRoot:      last.AfterAccountTreeRoot,
+				BeforeCEXAssetsCommitment: leafBatches[0].BeforeCEXAssetsCommitment,
+				AfterCEXAssetsCommitment:  last.AfterCEXAssetsCommitment,
+			})
+		}
+		start = end
+	}
+
+	node, err := loadAggregationKeys(utils.AggregationNodeKeyName(p.AggregationKeyName))
+	if err != nil {
+		return err
+	}
+	nodeKeyDigest, err := circuit.VerifyingKeyDigest(node.vk)
+	if err != nil {
+		return err
+	}
+	// the root is a node proof even if there is only one leaf, so that the
+	// verifier only needs the node verifying key
+	for level := 1; level == 1 || len(children) > 1; level++ {
+		slog.Info("aggregate the proofs of the level", "level", level, "proofs", len(children))
+		var parents []circuit.AggregatedProofInfo
+		for i := 0; i < len(children); i += arity {
+			nodeChildren := children[i:min(i+arity, len(children))]
+			assignment, err := circuit.SetAggregateNodeCircuitWitness(arity, node.vk, nodeChildren)
+			if err != nil {
+				return err
+			}
+			last := nodeChildren[len(nodeChildren)-1]
+			commitment := circuit.AggregateNodeCommitment(nodeChildren[0].BeforeAccountTreeRoot, last.AfterAccountTreeRoot,
+				nodeChildren[0].BeforeCEXAssetsCommitment, last.AfterCEXAssetsCommitment, nodeKeyDigest)
+			proof, err := proveAggregate(node, assignment, commitment)
+			if err != nil {
+				return fmt.Errorf("aggregate proofs %d to %d of level %d failed: %s", i, i+len(nodeChildren)-1, level, err.Error())
+			}
+			parents = append(parents, circuit.AggregatedProofInfo{
+				Proof:                     proof,
+				VerifyingKey:              node.vk,
+				IsNode:                    true,
+				BeforeAccountTreeRoot:     nodeChildren[0].BeforeAccountTreeRoot,
+				AfterAccountTreeRoot:      last.AfterAccountTreeRoot,
+				BeforeCEXAssetsCommitment: nodeChildren[0].BeforeCEXAssetsCommitment,
+				AfterCEXAssetsCommitment:  last.AfterCEXAssetsCommitment,
+			})
+		}
+		children = parents
+	}
+	root := children[0]
+	slog.Info("aggregated proof is generated", "batches", len(batches), "cost", time.Since(startTime))
+
+	var buf bytes.Buffer
+	_, err = root.Proof.WriteRawTo(&buf)
+	if err != nil {
+		return err
+	}
+	aggregatedProof := utils.AggregatedProof{
+		ProofInfo:                 base64.StdEncoding.EncodeToString(buf.Bytes()),
+		BeforeAccountTreeRoot:     root.BeforeAccountTreeRoot,
+		AfterAccountTreeRoot:      root.AfterAccountTreeRoot,
+		BeforeCEXAssetsCommitment: root.BeforeCEXAssetsCommitment,
+		AfterCEXAssetsCommitment:  root.AfterCEXAssetsCommitment,
+		TierManifestHash:          p.TierManifest.Hash,
+	}
+	for _, t := range tiers {
+		aggregatedProof.AssetsCountTiers = append(aggregatedProof.AssetsCountTiers, t.AssetsCount)
+		aggregatedProof.BatchCounts = append(aggregatedProof.BatchCounts, t.BatchCount)
+	}
+	content, err := json.MarshalIndent(aggregatedProof, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(p.AggregatedProofFile, content, 0644)
+	if err != nil {
+		return err
+	}
+	slog.Info("aggregated proof is written", "file", p.AggregatedProofFile)
+	return nil
+}
+
+func loadAggregationKeys(zkKeyName string) (*aggregationKeys, error) {
+	keys := &aggregationKeys{
+		r1cs: groth16.NewCS(ecc.BN254),
+		pk:   groth16.NewProvingKey(ecc.BN254),
+		vk:   groth16.NewVerifyingKey(ecc.BN254),
+	}
+	if err := readFromFile(zkKeyName+".r1cs", keys.r1cs.ReadFrom); err != nil {
+		return nil, err
+	}
+	if err := readFromFile(zkKeyName+".pk", keys.pk.UnsafeReadFrom); err != nil {
+		return nil, err
+	}
+	if err := readFromFile(zkKeyName+".vk", keys.vk.ReadFrom); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// proveAggregate proves the leaf or node assignment and verifies the proof
+// against the commitment, so that a wrong aggregation fails at its level
+func proveAggregate(keys *aggregationKeys, assignment frontend.Circuit, commitment []byte) (groth16.Proof, error) {
+	witness, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		return nil, err
+	}
+	proof, err := groth16.Prove(keys.r1cs, keys.pk, witness, circuit.RecursionProverOptions())
+	if err != nil {
+		return nil, err
+	}
+	vWitness, err := frontend.NewWitness(circuit.NewVerifyAggregateCircuit(commitment), ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return nil, err
+	}
+	err = groth16.Verify(proof, keys.vk, vWitness, circuit.RecursionVerifierOptions())
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+func decodeAggregatedBatchInfo(row *Proof) (info circuit.AggregatedBatchInfo, err error) {
+	proofBytes, err := base64.StdEncoding.DecodeString(row.ProofInfo)
+	if err != nil {
+		return info, err
+	}
+	info.Proof = groth16.NewProof(ecc.BN254)
+	_, err = info.Proof.ReadFrom(bytes.NewReader(proofBytes))
+	if err != nil {
+		return info, err
+	}
+	var accountTreeRoots, cexAssetListCommitments [][]byte
+	err = json.Unmarshal([]byte(row.AccountTreeRoots), &accountTreeRoots)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal([]byte(row.CexAssetListCommitments), &cexAssetListCommitments)
+	if err != nil {
+		return info, err
+	}
+	if len(accountTreeRoots) != 2 || len(cexAssetListCommitments) != 2 {
+		return info, fmt.Errorf("expect 2 account tree roots and 2 cex assets commitments")
+	}
+	info.BeforeAccountTreeRoot = accountTreeRoots[0]
+	info.AfterAccountTreeRoot = accountTreeRoots[1]
+	info.BeforeCEXAssetsCommitment = cexAssetListCommitments[0]
+	info.AfterCEXAssetsCommitment = cexAssetListCommitments[1]
+	return info, nil
+}
+
+func readFromFile(name string, readFrom func(r io.Reader) (int64, error)) error {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("%s load error: %s", name, err.Error())
+	}
+	_, err = readFrom(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("%s read error: %s", name, err.Error())
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package prover
 
 import (
+	"time"
+
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
 	"gorm.io/gorm"
 )
 
@@ -14,6 +17,7 @@ type (
 		CreateProofTable() error
 		DropProofTable() error
 		CreateProof(row *Proof) error
+		CreateProofOfLease(row *Proof, leaseOwner string) error
 		GetProofsBetween(start int64, end int64) (proofs []*Proof, err error)
 		GetLatestProof() (p *Proof, err error)
 		GetLatestConfirmedProof() (p *Proof, err error)
@@ -23,7 +27,9 @@ type (
 
 	defaultProofModel struct {
 		table string
-		DB    *gorm.DB
+		// witnessTable is the witness table of the same suffix
+		witnessTable string
+		DB           *gorm.DB
 	}
 
 	Proof struct {
@@ -33,6 +39,10 @@ type (
 		AccountTreeRoots        string
 		BatchCommitment         string
 		AssetsCount				int
+		// ProvingSystem is groth16 or plonk, it is empty for proofs generated before plonk is supported
+		ProvingSystem           string
+		// TierManifestHash is the hash of the tier manifest the batch is proved with
+		TierManifestHash        string
 		BatchNumber             int64 `gorm:"index:idx_number,unique"`
 	}
 )
@@ -43,8 +53,9 @@ func (m *defaultProofModel) TableName() string {
 
 func NewProofModel(db *gorm.DB, suffix string) ProofModel {
 	return &defaultProofModel{
-		table: TableNamePrefix + suffix,
-		DB:    db,
+		table:        TableNamePrefix + suffix,
+		witnessTable: witness.TableNamePrefix + suffix,
+		DB:           db,
 	}
 }
 
@@ -67,15 +78,40 @@ func (m *defaultProofModel) CreateProof(row *Proof) error {
 	return nil
 }
 
+// CreateProofOfLease creates the proof and finishes its witness in one
+// transaction, if the witness is no longer received by leaseOwner nothing is
+// written and utils.ErrLeaseLost is returned
+func (m *defaultProofModel) CreateProofOfLease(row *Proof, leaseOwner string) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		dbTx := tx.Table(m.witnessTable).Where("height = ? and status = ? and lease_owner = ?", row.BatchNumber, witness.StatusReceived, leaseOwner).Updates(map[string]interface{}{
+			"status":     witness.StatusFinished,
+			"updated_at": time.Now(),
+		})
+		if dbTx.Error != nil {
+			return utils.ConvertDbErr(dbTx.Error)
+		} else if dbTx.RowsAffected == 0 {
+			return utils.ErrLeaseLost
+		}
+		dbTx = tx.Table(m.table).Create(row)
+		if dbTx.Error != nil {
+			return dbTx.Error
+		}
+		if dbTx.RowsAffected == 0 {
+			return utils.DbErrSqlOperation
+		}
+		return nil
+	})
+}
+
 func (m *defaultProofModel) GetProofsBetween(start int64, end int64) (proofs []*Proof, err error) {
-	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Debug().Table(m.table).Where("batch_number >= ? AND batch_number <= ?",
+	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("batch_number >= ? AND batch_number <= ?",
 		start,
 		end).
 		Order("batch_number").
 		Find(&proofs)
 
 	if dbTx.Error != nil {
-		return proofs, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return proofs, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	}
@@ -87,7 +123,7 @@ func (m *defaultProofModel) GetLatestProof() (p *Proof, err error) {
 	var row *Proof
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Order("batch_number desc").Limit(1).Find(&row)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	} else {
@@ -99,7 +135,7 @@ func (m *defaultProofModel) GetLatestConfirmedProof() (p *Proof, err error) {
 	var row *Proof
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Order("batch_number desc").Limit(1).Find(&row)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	} else {
@@ -111,7 +147,7 @@ func (m *defaultProofModel) GetProofByBatchNumber(num int64) (p *Proof, err erro
 	var row *Proof
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("batch_number = ?", num).Find(&row)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	} else {
@@ -122,7 +158,7 @@ func (m *defaultProofModel) GetProofByBatchNumber(num int64) (p *Proof, err erro
 func (m *defaultProofModel) GetRowCounts() (count int64, err error) {
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Count(&count)
 	if dbTx.Error != nil {
-		return 0, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return 0, utils.ConvertDbErr(dbTx.Error)
 	}
 	return count, nil
 }
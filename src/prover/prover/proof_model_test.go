@@ -0,0 +1,54 @@
+package prover
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestCreateProofOfLease(t *testing.T) {
+	db, err := utils.OpenDB(utils.DbDriverSqlite, filepath.Join(t.TempDir(), "por.db"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	witnessModel := witness.NewWitnessModel(db, "_test")
+	proofModel := NewProofModel(db, "_test")
+	if err = witnessModel.CreateBatchWitnessTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err = proofModel.CreateProofTable(); err != nil {
+		t.Fatal(err)
+	}
+	err = witnessModel.CreateBatchWitness([]witness.BatchWitness{{Height: 0, Status: witness.StatusPublished}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = witnessModel.GetAndUpdateBatchesWitnessByHeight(0, witness.StatusPublished, witness.StatusReceived, witness.Lease{Owner: "prover-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a prover whose lease is taken over writes nothing
+	if err = proofModel.CreateProofOfLease(&Proof{BatchNumber: 0}, "prover-b"); err != utils.ErrLeaseLost {
+		t.Fatalf("expected lease lost, got %v", err)
+	}
+	if _, err = proofModel.GetProofByBatchNumber(0); err != utils.DbErrNotFound {
+		t.Fatalf("the proof of a lost lease is written: %v", err)
+	}
+	if err = proofModel.CreateProofOfLease(&Proof{BatchNumber: 0}, "prover-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = proofModel.GetProofByBatchNumber(0); err != nil {
+		t.Fatal(err)
+	}
+	w, err := witnessModel.GetBatchWitnessByHeight(0)
+	if err != nil || w.Status != witness.StatusFinished {
+		t.Fatalf("the witness isn't finished with its proof: %v", err)
+	}
+}
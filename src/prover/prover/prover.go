@@ -2,14 +2,17 @@ package prover
 
 import (
 	"bytes"
-	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
@@ -17,90 +20,256 @@ import (
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
 	"github.com/consensys/gnark-crypto/ecc"
-	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend"
+	backend_witness "github.com/consensys/gnark/backend/witness"
 	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/constraint/solver"
 	"github.com/consensys/gnark/frontend"
 	"github.com/redis/go-redis/v9"
 
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
+// DefaultLeaseDuration is how long a received witness stays leased to its prover without a heartbeat
+const DefaultLeaseDuration = 5 * time.Minute
+
+var proverCount int64
+
 type Prover struct {
 	witnessModel witness.WitnessModel
 	proofModel   ProofModel
-	redisCli     *redis.Client
 
-	VerifyingKey groth16.VerifyingKey
-	ProvingKey   groth16.ProvingKey
+	ProvingSystem circuit.ProvingSystem
 	SessionName   []string
 	AssetsCountTiers    []int
-	R1cs          constraint.ConstraintSystem
+	TierManifest  *utils.TierManifest
+
+	// MemoryBudget is the bytes the r1cs and keys of the resident tiers may
+	// take, the least recently used tiers are evicted to load another tier.
+	// Only the tier in use stays resident if it is zero.
+	MemoryBudget  int64
+	residentTiers []int
+	residentParams map[int]*snarkParams
+	// loadingParams is the tiers being loaded, the workers of a tier wait
+	// for the one which loads it
+	loadingParams map[int]*snarkParamsLoad
+	// residentLock guards residentTiers, residentParams and loadingParams,
+	// it isn't held while the keys are loaded
+	residentLock sync.Mutex
+	// loadLock serialises the loading of different tiers, so that the
+	// evictions keep the resident tiers in MemoryBudget
+	loadLock sync.Mutex
+	TaskQueue     TaskQueue
+	// LeaseOwner identifies the prover in the leases of the witnesses it received
+	LeaseOwner    string
+	LeaseDuration time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	// inFlight is the witnesses being prepared or proved, they are handed
+	// back if the prover is stopped before the proofs are finished
+	inFlight     map[int64]*witness.BatchWitness
+	inFlightLock sync.Mutex
 
-	CurrentSnarkParamsInUse int
-	TaskQueueName string
+	// ProvingWorkers is the number of proofs generated at the same time
+	ProvingWorkers int
+	// PrefetchCount is the number of prepared batches waiting for a worker
+	PrefetchCount int
+
+	ProverOptions       []backend.ProverOption
+	VerifierOptions     []backend.VerifierOption
+	AggregationKeyName  string
+	AggregationArity    int
+	AggregatedProofFile string
 }
 
 func NewProver(config *config.Config) *Prover {
-	db, err := gorm.Open(mysql.Open(config.MysqlDataSource))
+	db, err := utils.OpenDB(config.DbDriver, config.MysqlDataSource, &gorm.Config{
+		Logger: utils.NewGormLogger(),
+	})
 	if err != nil {
 		panic(err.Error())
 	}
-	// Set up the redis client.
-	redisCli := redis.NewClient(&redis.Options{
-		Addr:    config.Redis.Host,
-		Password: config.Redis.Password,
-	})
-	taskQueueName := "por_batch_task_queue_" + config.DbSuffix
+	tierManifest, err := utils.LoadTierManifest(config.TierManifest)
+	if err != nil {
+		panic(err.Error())
+	}
+	prover, err := NewProverWithDB(db, tierManifest, config)
+	if err != nil {
+		panic(err.Error())
+	}
+	return prover
+}
 
+// NewProverWithDB creates the prover of the witness and proof tables in db,
+// the MysqlDataSource and TierManifest of the config are ignored
+func NewProverWithDB(db *gorm.DB, tierManifest *utils.TierManifest, config *config.Config) (*Prover, error) {
+	var err error
 	prover := Prover{
 		witnessModel: witness.NewWitnessModel(db, config.DbSuffix),
 		proofModel:   NewProofModel(db, config.DbSuffix),
-		redisCli:     redisCli,
-		SessionName:  config.ZkKeyName,
-		AssetsCountTiers:  config.AssetsCountTiers,
-		CurrentSnarkParamsInUse: 0,
-		TaskQueueName: taskQueueName,
+		LeaseOwner:    newLeaseOwner(),
+		LeaseDuration: DefaultLeaseDuration,
+		stop:          make(chan struct{}),
+		inFlight:      make(map[int64]*witness.BatchWitness),
+		ProvingWorkers: config.ProvingWorkers,
+		PrefetchCount:  config.PrefetchCount,
+		MemoryBudget:  int64(config.MemoryBudgetGB) << 30,
+		residentParams: make(map[int]*snarkParams),
+		loadingParams:  make(map[int]*snarkParamsLoad),
+		AggregationKeyName:  config.AggregationKeyName,
+		AggregationArity:    config.AggregationArity,
+		AggregatedProofFile: config.AggregatedProofFile,
 	}
 
-	// std.RegisterHints()
-	solver.RegisterHint(circuit.IntegerDivision)
-	return &prover
-}
-
-func (p *Prover) fetchTasksByRedis() (int, error) {
-	var ctx = context.Background()
-	batchHeightStr, err := p.redisCli.BRPop(ctx, 10*time.Second, p.TaskQueueName).Result()
+	if config.LeaseSeconds > 0 {
+		prover.LeaseDuration = time.Duration(config.LeaseSeconds) * time.Second
+	}
+	var redisCli *redis.Client
+	if config.TaskQueue == "" || config.TaskQueue == TaskQueueRedis {
+		// Set up the redis client.
+		redisCli = redis.NewClient(&redis.Options{
+			Addr:    config.Redis.Host,
+			Password: config.Redis.Password,
+		})
+	}
+	prover.TaskQueue, err = NewTaskQueue(config.TaskQueue, prover.witnessModel, redisCli, config.DbSuffix)
 	if err != nil {
-		return -1, err
+		return nil, err
+	}
+	if config.TaskQueue == TaskQueueMemory {
+		// nobody else fills the queue of this process
+		err = PushPublishedTasks(prover.witnessModel, prover.TaskQueue)
+		if err != nil {
+			return nil, fmt.Errorf("push published tasks failed: %s", err.Error())
+		}
 	}
 
-	batchHeight, err := strconv.Atoi(batchHeightStr[1])
+	prover.TierManifest = tierManifest
+	prover.TierManifest.Apply()
+	prover.SessionName = prover.TierManifest.ZkKeyNames(config.ZkKeyDir)
+	prover.AssetsCountTiers = prover.TierManifest.AssetsCountTiers()
+	slog.Info("tier manifest is loaded", "hash", prover.TierManifest.Hash)
+
+	prover.ProvingSystem, err = circuit.NewProvingSystem(config.ProvingSystem)
+	if err != nil {
+		return nil, err
+	}
+	prover.ProverOptions, err = prover.ProvingSystem.ProverOptions(config.ProofTarget)
+	if err != nil {
+		return nil, err
+	}
+	prover.VerifierOptions, err = prover.ProvingSystem.VerifierOptions(config.ProofTarget)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	return batchHeight, nil
+
+	// std.RegisterHints()
+	solver.RegisterHint(circuit.IntegerDivision)
+	return &prover, nil
 }
 
+// FetchBatchWitness reclaims a witness whose lease expired, which means its
+// prover crashed, or fetches the next task from the task queue
 func (p *Prover) FetchBatchWitness() ([]*witness.BatchWitness, error) {
-	batchHeight, err := p.fetchTasksByRedis()
+	lease, err := p.newLease()
 	if err != nil {
 		return nil, err
 	}
+	batchWitness, err := p.witnessModel.GetAndUpdateExpiredBatchWitness(lease.Heartbeat, lease)
+	if err == nil {
+		slog.Info("reclaim witness whose lease expired", utils.LogKeyHeight, batchWitness.Height, utils.LogKeyAssetsCount, batchWitness.AssetsCount)
+		return []*witness.BatchWitness{batchWitness}, nil
+	}
+	if err != utils.DbErrNotFound {
+		return nil, err
+	}
+	tiers := p.tierPreference()
+	batchWitnesses, err := p.TaskQueue.Fetch(tiers, lease)
+	p.updateTaskQueueDepth(tiers)
+	return batchWitnesses, err
+}
 
-	// Fetch unproved block witness.
-	for {
-		blockWitnesses, err := p.witnessModel.GetAndUpdateBatchesWitnessByHeight(batchHeight, witness.StatusPublished, witness.StatusReceived)
-		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
-			fmt.Println("get batch witness timeout, retry...:", err.Error())
-			time.Sleep(1 * time.Second)
-			continue
-		}
+func (p *Prover) updateTaskQueueDepth(tiers []int) {
+	for _, assetsCount := range tiers {
+		depth, err := p.TaskQueue.Len(assetsCount)
 		if err != nil {
-			return nil, err
+			slog.Warn("get task queue depth failed", utils.LogKeyAssetsCount, assetsCount, "err", err)
+			return
+		}
+		utils.TaskQueueDepth.WithLabelValues(strconv.Itoa(assetsCount)).Set(float64(depth))
+	}
+}
+
+// tierPreference is the order the prover takes the tasks of the tiers in. The
+// resident tiers go first, the most recently used one first, so the prover
+// keeps draining the tiers whose keys are loaded.
+func (p *Prover) tierPreference() []int {
+	p.residentLock.Lock()
+	defer p.residentLock.Unlock()
+	tiers := append([]int{}, p.residentTiers...)
+	for _, assetsCount := range p.AssetsCountTiers {
+		if _, ok := p.residentParams[assetsCount]; !ok {
+			tiers = append(tiers, assetsCount)
+		}
+	}
+	// the witnesses of former releases have no tier
+	return append(tiers, 0)
+}
+
+func newLeaseOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), atomic.AddInt64(&proverCount, 1))
+}
+
+// newLease stamps the lease by the database clock, the provers compare the
+// expiry with it too, so their own clocks don't need to be in sync
+func (p *Prover) newLease() (witness.Lease, error) {
+	now, err := p.witnessModel.DbNow()
+	if err != nil {
+		return witness.Lease{}, fmt.Errorf("get database clock failed: %s", err.Error())
+	}
+	return witness.Lease{
+		Owner:     p.LeaseOwner,
+		Heartbeat: now,
+		Expiry:    now + int64(p.LeaseDuration/time.Second),
+	}, nil
+}
+
+// keepLease renews the lease of the witness every third of the lease duration
+// until stop is called. The lost channel is closed once the lease is lost,
+// which means another prover took the witness over, and the renewal stops.
+func (p *Prover) keepLease(height int64) (lost <-chan struct{}, stop func()) {
+	done := make(chan struct{})
+	lostChan := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(p.LeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				lease, err := p.newLease()
+				if err == nil {
+					err = p.witnessModel.RenewBatchWitnessLease(height, lease)
+				}
+				if errors.Is(err, utils.ErrLeaseLost) {
+					slog.Warn("the lease of witness is lost", utils.LogKeyHeight, height)
+					close(lostChan)
+					return
+				}
+				if err != nil {
+					slog.Warn("renew the lease of witness failed", utils.LogKeyHeight, height, "err", err)
+				}
+			}
 		}
-		return blockWitnesses, nil
+	}()
+	var stopOnce sync.Once
+	return lostChan, func() {
+		stopOnce.Do(func() {
+			close(done)
+		})
 	}
 }
 
@@ -110,7 +279,8 @@ func (p *Prover) FetchBatchWitnessForRerun() ([]*witness.BatchWitness, error) {
 	for {
 		blockWitness, err = p.witnessModel.GetLatestBatchWitnessByStatus(witness.StatusReceived)
 		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
-			fmt.Println("get latest batch witness by status timeout, retry...:", err.Error())
+			slog.Warn("get latest batch witness by status timeout, retry", "err", err)
+			utils.DbRetries.WithLabelValues("get_latest_batch_witness_by_status").Inc()
 			time.Sleep(1 * time.Second)
 			continue
 		}
@@ -121,7 +291,8 @@ func (p *Prover) FetchBatchWitnessForRerun() ([]*witness.BatchWitness, error) {
 		for {
 			blockWitness, err = p.witnessModel.GetLatestBatchWitnessByStatus(witness.StatusPublished)
 			if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
-				fmt.Println("get latest batch witness by status timeout, retry...:", err.Error())
+				slog.Warn("get latest batch witness by status timeout, retry", "err", err)
+				utils.DbRetries.WithLabelValues("get_latest_batch_witness_by_status").Inc()
 				time.Sleep(1 * time.Second)
 				continue
 			}
@@ -131,161 +302,528 @@ func (p *Prover) FetchBatchWitnessForRerun() ([]*witness.BatchWitness, error) {
 	if err != nil {
 		return nil, err
 	}
-	blockWitnesses := make([]*witness.BatchWitness, 1)
-	blockWitnesses[0] = blockWitness
-	return blockWitnesses, nil
+	// the rerun takes the lease over, the proof is written under it
+	lease, err := p.newLease()
+	if err != nil {
+		return nil, err
+	}
+	return p.witnessModel.GetAndUpdateBatchesWitnessByHeight(int(blockWitness.Height), blockWitness.Status, witness.StatusReceived, lease)
+}
+
+// preparedBatch is a fetched batch witness whose circuit assignment is built
+// while the proofs of the former batches are generated
+type preparedBatch struct {
+	batchWitness      *witness.BatchWitness
+	witnessForCircuit *utils.BatchCreateUserWitness
+	assignment        *circuitAssignment
+	// leaseLost is closed if another prover took the witness over
+	leaseLost <-chan struct{}
+	stopLease func()
+}
+
+func (batch *preparedBatch) isLeaseLost() bool {
+	select {
+	case <-batch.leaseLost:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run fetches and prepares the batches in one goroutine and proves them in
+// ProvingWorkers goroutines, which share the r1cs and keys of the resident
+// tiers. At most PrefetchCount prepared batches wait for a worker. The prover
+// is stopped by the first failed batch, whose error is returned.
+//
+// The proveLock of a tier serialises the proving with its r1cs, so
+// ProvingWorkers > 1 only overlaps the witness preparation with the proving
+// and proves the batches of different tiers in parallel.
+func (p *Prover) Run(flag bool) error {
+	err := p.createTables()
+	if err != nil {
+		return err
+	}
+	workers := p.ProvingWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	prefetchCount := p.PrefetchCount
+	if prefetchCount <= 0 {
+		prefetchCount = 1
+	}
+	// the batch being prepared waits for a worker too
+	prepared := make(chan *preparedBatch, prefetchCount-1)
+	var wg sync.WaitGroup
+	var proveErr error
+	var proveErrOnce sync.Once
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range prepared {
+				if p.isStopped() {
+					// the batches prefetched before the prover is stopped are handed back
+					p.handBackBatch(batch)
+					continue
+				}
+				err := p.proveBatch(batch)
+				if errors.Is(err, utils.ErrLeaseLost) {
+					// another prover proves the batch
+					slog.Warn("the batch is dropped", utils.LogKeyHeight, batch.batchWitness.Height, "err", err)
+					continue
+				}
+				if err != nil {
+					slog.Error("prove batch failed", utils.LogKeyHeight, batch.batchWitness.Height, utils.LogKeyAssetsCount, batch.batchWitness.AssetsCount, "err", err)
+					proveErrOnce.Do(func() {
+						proveErr = fmt.Errorf("prove batch of height %d failed: %w", batch.batchWitness.Height, err)
+					})
+					p.Stop()
+				}
+			}
+		}()
+	}
+	err = p.fetchBatches(flag, prepared)
+	close(prepared)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return proveErr
+}
+
+func (p *Prover) createTables() error {
+	err := p.proofModel.CreateProofTable()
+	if err != nil {
+		return fmt.Errorf("create proof table failed: %s", err.Error())
+	}
+	// add the lease columns to the witness table of former releases
+	err = p.witnessModel.CreateBatchWitnessTable()
+	if err != nil {
+		return fmt.Errorf("migrate witness table failed: %s", err.Error())
+	}
+	return nil
 }
 
-func (p *Prover) Run(flag bool) {
-	p.proofModel.CreateProofTable()
+// fetchBatches prepares the batches until the task queue is drained or the
+// prover is stopped
+func (p *Prover) fetchBatches(flag bool, prepared chan<- *preparedBatch) error {
 	for {
+		if p.isStopped() {
+			slog.Info("prover is stopped, no more task is taken")
+			return nil
+		}
 		var batchWitnesses []*witness.BatchWitness
 		var err error
 		if !flag {
-			// when the task is removed from redis queue,
-			// 1. if prover crash before updating witness status to pending, or
-			// 2. if prover crash before generating proof,
-			// then the offline rerun mechanism will be triggered to handle this situation.
+			// when the task is removed from the task queue and the prover
+			// crashes before generating proof, the lease of the witness expires
+			// and another prover reclaims it.
 			batchWitnesses, err = p.FetchBatchWitness()
 			if errors.Is(err, utils.DbErrNotFound) {
-				fmt.Println("there is no published status witness in db, so quit")
-				fmt.Println("prover run finish...")
-				return
+				slog.Info("there is no published status witness in db, prover run finish")
+				return nil
 			}
-			if errors.Is(err, redis.Nil) {
-				fmt.Println("There is no task left in task queue")
-				fmt.Println("prover run finish...")
-				return
+			if errors.Is(err, utils.ErrNoTask) {
+				// the witnesses received by other provers are reclaimed if their leases expire
+				receivedCount, err := p.witnessModel.GetReceivedBatchWitnessCount()
+				if err == nil && receivedCount > int64(p.inFlightCount()) {
+					slog.Info("wait for the leases of received witnesses", "received", receivedCount)
+					time.Sleep(10 * time.Second)
+					continue
+				}
+				slog.Info("there is no task left in task queue, prover run finish")
+				return nil
 			}
 			if err != nil {
-				fmt.Println("get batch witness failed: ", err.Error())
+				slog.Warn("get batch witness failed", "err", err)
 				time.Sleep(10 * time.Second)
 				continue
 			}
 		} else {
 			batchWitnesses, err = p.FetchBatchWitnessForRerun()
 			if errors.Is(err, utils.DbErrNotFound) {
-				fmt.Println("there is no received status witness in db, so quit")
-				fmt.Println("prover rerun finish...")
-				return
+				slog.Info("there is no received status witness in db, prover rerun finish")
+				return nil
 			}
 			if err != nil {
-				fmt.Println("something wrong happened, err is ", err.Error())
-				return
+				return fmt.Errorf("get batch witness for rerun failed: %w", err)
 			}
 		}
 
 		for _, batchWitness := range batchWitnesses {
-			witnessForCircuit := utils.DecodeBatchWitness(batchWitness.WitnessData)
-			cexAssetListCommitments := make([][]byte, 2)
-			cexAssetListCommitments[0] = witnessForCircuit.BeforeCEXAssetsCommitment
-			cexAssetListCommitments[1] = witnessForCircuit.AfterCEXAssetsCommitment
-			accountTreeRoots := make([][]byte, 2)
-			accountTreeRoots[0] = witnessForCircuit.BeforeAccountTreeRoot
-			accountTreeRoots[1] = witnessForCircuit.AfterAccountTreeRoot
-			cexAssetListCommitmentsSerial, err := json.Marshal(cexAssetListCommitments)
-			if err != nil {
-				fmt.Println("marshal cex asset list failed: ", err.Error())
-				return
-			}
-			accountTreeRootsSerial, err := json.Marshal(accountTreeRoots)
-			if err != nil {
-				fmt.Println("marshal account tree root failed: ", err.Error())
-				return
-			}
-			proof, assetsCount, err := p.GenerateAndVerifyProof(witnessForCircuit, batchWitness.Height)
-			if err != nil {
-				fmt.Println("generate and verify proof error:", err.Error())
-				return
-			}
-			var buf bytes.Buffer
-			_, err = proof.WriteRawTo(&buf)
+			batch, err := p.prepareBatch(batchWitness)
 			if err != nil {
-				fmt.Println("proof serialize failed")
-				return
+				return err
 			}
-			proofBytes := buf.Bytes()
-
-			// Check the existence of block proof.
-			for {
-				_, err = p.proofModel.GetProofByBatchNumber(batchWitness.Height)
-				if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
-					fmt.Println("get proof by batch number timeout, retry...:", err.Error())
-					time.Sleep(1 * time.Second)
-					continue
-				}
-				break
+			select {
+			case prepared <- batch:
+			case <-p.stop:
+				p.handBackBatch(batch)
 			}
-			if err == nil {
-				fmt.Printf("blockProof of height %d exists\n", batchWitness.Height)
-				err = p.witnessModel.UpdateBatchWitnessStatus(batchWitness, witness.StatusFinished)
-				if err != nil {
-					fmt.Println("update witness error:", err.Error())
-				}
-				continue
+		}
+		// rerun proves one batch after another
+		if flag {
+			for p.inFlightCount() > 0 && !p.isStopped() {
+				time.Sleep(time.Second)
 			}
+		}
+	}
+}
 
-			var row = &Proof{
-				ProofInfo:               base64.StdEncoding.EncodeToString(proofBytes),
-				BatchNumber:             batchWitness.Height,
-				CexAssetListCommitments: string(cexAssetListCommitmentsSerial),
-				AccountTreeRoots:        string(accountTreeRootsSerial),
-				BatchCommitment:         base64.StdEncoding.EncodeToString(witnessForCircuit.BatchCommitment),
-				AssetsCount:             assetsCount,
-			}
-			err = p.proofModel.CreateProof(row)
-			if err != nil {
-				fmt.Printf("create blockProof of height %d failed\n", batchWitness.Height)
-				return
-			}
-			err = p.witnessModel.UpdateBatchWitnessStatus(batchWitness, witness.StatusFinished)
-			if err != nil {
-				fmt.Println("update witness error:", err.Error())
-			}
+// prepareBatch keeps the lease of the received witness and builds its circuit
+// assignment, the witness is handed back if the assignment fails
+func (p *Prover) prepareBatch(batchWitness *witness.BatchWitness) (*preparedBatch, error) {
+	// refuse the witnesses batched with the tiers of another manifest
+	err := p.TierManifest.Check(batchWitness.TierManifestHash)
+	if err != nil {
+		return nil, fmt.Errorf("witness of height %d is refused: %w", batchWitness.Height, err)
+	}
+	p.addInFlight(batchWitness)
+	batch := &preparedBatch{batchWitness: batchWitness}
+	batch.leaseLost, batch.stopLease = p.keepLease(batchWitness.Height)
+	batch.witnessForCircuit = utils.DecodeBatchWitness(batchWitness.WitnessData)
+	if batch.witnessForCircuit == nil {
+		p.handBackBatch(batch)
+		return nil, fmt.Errorf("decode invalid witness data of height %d", batchWitness.Height)
+	}
+	batch.assignment, err = newCircuitAssignment(batch.witnessForCircuit)
+	if err != nil {
+		p.handBackBatch(batch)
+		return nil, fmt.Errorf("generate circuit assignment of height %d failed: %s", batchWitness.Height, err.Error())
+	}
+	return batch, nil
+}
+
+// ProveBatch receives the published witness of the height and proves it, so
+// that a scheduler can hand out the batches to the provers itself. It returns
+// utils.DbErrNotFound if the witness isn't published, e.g. another prover
+// received it.
+func (p *Prover) ProveBatch(height int64) error {
+	err := p.createTables()
+	if err != nil {
+		return err
+	}
+	lease, err := p.newLease()
+	if err != nil {
+		return err
+	}
+	batchWitnesses, err := fetchBatchWitnessByHeight(p.witnessModel, int(height), lease)
+	if err != nil {
+		return err
+	}
+	batch, err := p.prepareBatch(batchWitnesses[0])
+	if err != nil {
+		return err
+	}
+	return p.proveBatch(batch)
+}
+
+// proveBatch generates the proof of the batch and writes it to the proof table.
+// The proof is written only while the prover holds the lease of the witness,
+// otherwise the batch is dropped and utils.ErrLeaseLost is returned.
+func (p *Prover) proveBatch(batch *preparedBatch) error {
+	defer p.removeInFlight(batch.batchWitness.Height)
+	defer batch.stopLease()
+	batchWitness := batch.batchWitness
+	if batch.isLeaseLost() {
+		return fmt.Errorf("%w: witness of height %d", utils.ErrLeaseLost, batchWitness.Height)
+	}
+	witnessForCircuit := batch.witnessForCircuit
+	cexAssetListCommitments := make([][]byte, 2)
+	cexAssetListCommitments[0] = witnessForCircuit.BeforeCEXAssetsCommitment
+	cexAssetListCommitments[1] = witnessForCircuit.AfterCEXAssetsCommitment
+	accountTreeRoots := make([][]byte, 2)
+	accountTreeRoots[0] = witnessForCircuit.BeforeAccountTreeRoot
+	accountTreeRoots[1] = witnessForCircuit.AfterAccountTreeRoot
+	cexAssetListCommitmentsSerial, err := json.Marshal(cexAssetListCommitments)
+	if err != nil {
+		return fmt.Errorf("marshal cex asset list failed: %s", err.Error())
+	}
+	accountTreeRootsSerial, err := json.Marshal(accountTreeRoots)
+	if err != nil {
+		return fmt.Errorf("marshal account tree root failed: %s", err.Error())
+	}
+	proof, err := p.proveAssignment(batch.assignment, batchWitness.Height)
+	if err != nil {
+		return fmt.Errorf("generate and verify proof error: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	_, err = proof.WriteRawTo(&buf)
+	if err != nil {
+		return fmt.Errorf("proof serialize failed")
+	}
+	proofBytes := buf.Bytes()
+	if batch.isLeaseLost() {
+		return fmt.Errorf("%w: witness of height %d", utils.ErrLeaseLost, batchWitness.Height)
+	}
+
+	// Check the existence of block proof.
+	for {
+		_, err = p.proofModel.GetProofByBatchNumber(batchWitness.Height)
+		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
+			slog.Warn("get proof by batch number timeout, retry", utils.LogKeyHeight, batchWitness.Height, "err", err)
+			utils.DbRetries.WithLabelValues("get_proof_by_batch_number").Inc()
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		break
+	}
+	if err == nil {
+		slog.Info("blockProof exists", utils.LogKeyHeight, batchWitness.Height)
+		err = p.witnessModel.FinishBatchWitness(batchWitness.Height, p.LeaseOwner)
+		if err != nil {
+			slog.Error("update witness failed", utils.LogKeyHeight, batchWitness.Height, "err", err)
 		}
+		return nil
+	}
+
+	var row = &Proof{
+		ProofInfo:               base64.StdEncoding.EncodeToString(proofBytes),
+		BatchNumber:             batchWitness.Height,
+		CexAssetListCommitments: string(cexAssetListCommitmentsSerial),
+		AccountTreeRoots:        string(accountTreeRootsSerial),
+		BatchCommitment:         base64.StdEncoding.EncodeToString(witnessForCircuit.BatchCommitment),
+		AssetsCount:             batch.assignment.assetsCount,
+		ProvingSystem:           p.ProvingSystem.Name(),
+		TierManifestHash:        p.TierManifest.Hash,
+	}
+	// the witness is finished with the proof, both are written only under the lease
+	err = p.proofModel.CreateProofOfLease(row, p.LeaseOwner)
+	if errors.Is(err, utils.ErrLeaseLost) {
+		return fmt.Errorf("%w: witness of height %d", utils.ErrLeaseLost, batchWitness.Height)
 	}
+	if err != nil {
+		return fmt.Errorf("create blockProof of height %d failed: %s", batchWitness.Height, err.Error())
+	}
+	utils.ProofsGenerated.WithLabelValues(strconv.Itoa(batch.assignment.assetsCount)).Inc()
+	return nil
 }
 
-func (p *Prover) GenerateAndVerifyProof(
-	batchWitness *utils.BatchCreateUserWitness,
-	batchNumber int64,
-) (proof groth16.Proof, assetsCount int, err error) {
-	startTime := time.Now().UnixMilli()
-	fmt.Println("begin to generate proof for batch: ", batchNumber)
+// Stop makes Run return after the in-flight proofs are finished
+func (p *Prover) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *Prover) isStopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Prover) addInFlight(batchWitness *witness.BatchWitness) {
+	p.inFlightLock.Lock()
+	defer p.inFlightLock.Unlock()
+	p.inFlight[batchWitness.Height] = batchWitness
+}
+
+func (p *Prover) removeInFlight(height int64) {
+	p.inFlightLock.Lock()
+	defer p.inFlightLock.Unlock()
+	delete(p.inFlight, height)
+}
+
+func (p *Prover) inFlightCount() int {
+	p.inFlightLock.Lock()
+	defer p.inFlightLock.Unlock()
+	return len(p.inFlight)
+}
+
+func (p *Prover) handBackBatch(batch *preparedBatch) {
+	batch.stopLease()
+	err := p.handBack(batch.batchWitness)
+	if errors.Is(err, utils.ErrLeaseLost) {
+		slog.Info("witness is taken over by another prover", utils.LogKeyHeight, batch.batchWitness.Height)
+	} else if err != nil {
+		slog.Error("hand back witness failed", utils.LogKeyHeight, batch.batchWitness.Height, "err", err)
+	}
+	p.removeInFlight(batch.batchWitness.Height)
+}
+
+// HandBack returns the in-flight witnesses to the published status and pushes
+// their heights to the task queue again, so that other provers prove them. It
+// is called when the in-flight proofs don't finish in the shutdown timeout.
+// Every witness is tried, the errors of the failed ones are joined. A witness
+// whose lease is lost is taken over by another prover, so it counts as handed
+// back.
+func (p *Prover) HandBack() error {
+	p.inFlightLock.Lock()
+	batchWitnesses := make([]*witness.BatchWitness, 0, len(p.inFlight))
+	for _, batchWitness := range p.inFlight {
+		batchWitnesses = append(batchWitnesses, batchWitness)
+	}
+	p.inFlightLock.Unlock()
+	var errs []error
+	for _, batchWitness := range batchWitnesses {
+		err := p.handBack(batchWitness)
+		if errors.Is(err, utils.ErrLeaseLost) {
+			slog.Info("witness is taken over by another prover", utils.LogKeyHeight, batchWitness.Height)
+			err = nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p.removeInFlight(batchWitness.Height)
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Prover) handBack(batchWitness *witness.BatchWitness) error {
+	height := batchWitness.Height
+	err := p.witnessModel.ReleaseBatchWitness(height, p.LeaseOwner)
+	if err != nil {
+		return fmt.Errorf("release witness of height %d failed: %w", height, err)
+	}
+	err = p.TaskQueue.Push(int(batchWitness.AssetsCount), []int64{height})
+	if err != nil {
+		return fmt.Errorf("push witness of height %d to task queue failed: %s", height, err.Error())
+	}
+	slog.Info("witness is handed back", utils.LogKeyHeight, height, utils.LogKeyAssetsCount, batchWitness.AssetsCount)
+	return nil
+}
+
+// circuitAssignment is the gnark witnesses of a batch
+type circuitAssignment struct {
+	assetsCount   int
+	fullWitness   backend_witness.Witness
+	publicWitness backend_witness.Witness
+}
+
+func newCircuitAssignment(batchWitness *utils.BatchCreateUserWitness) (*circuitAssignment, error) {
 	circuitWitness, _ := circuit.SetBatchCreateUserCircuitWitness(batchWitness)
-	// Lazy load r1cs, proving key and verifying key.
-	p.LoadSnarkParamsOnce(len(circuitWitness.CreateUserOps[0].Assets))
 	verifyWitness := circuit.NewVerifyBatchCreateUserCircuit(batchWitness.BatchCommitment)
-	witness, err := frontend.NewWitness(circuitWitness, ecc.BN254.ScalarField())
+	fullWitness, err := frontend.NewWitness(circuitWitness, ecc.BN254.ScalarField())
 	if err != nil {
-		return proof, 0, err
+		return nil, err
 	}
+	publicWitness, err := frontend.NewWitness(verifyWitness, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return nil, err
+	}
+	return &circuitAssignment{
+		assetsCount:   len(circuitWitness.CreateUserOps[0].Assets),
+		fullWitness:   fullWitness,
+		publicWitness: publicWitness,
+	}, nil
+}
 
-	vWitness, err := frontend.NewWitness(verifyWitness, ecc.BN254.ScalarField(), frontend.PublicOnly())
+func (p *Prover) GenerateAndVerifyProof(
+	batchWitness *utils.BatchCreateUserWitness,
+	batchNumber int64,
+) (proof circuit.Proof, assetsCount int, err error) {
+	assignment, err := newCircuitAssignment(batchWitness)
 	if err != nil {
 		return proof, 0, err
 	}
-	proof, err = groth16.Prove(p.R1cs, p.ProvingKey, witness)
+	proof, err = p.proveAssignment(assignment, batchNumber)
 	if err != nil {
 		return proof, 0, err
 	}
+	return proof, assignment.assetsCount, nil
+}
+
+func (p *Prover) proveAssignment(assignment *circuitAssignment, batchNumber int64) (proof circuit.Proof, err error) {
+	startTime := time.Now().UnixMilli()
+	slog.Info("begin to generate proof", utils.LogKeyHeight, batchNumber, utils.LogKeyAssetsCount, assignment.assetsCount)
+	// Lazy load r1cs, proving key and verifying key.
+	params, err := p.snarkParamsOf(assignment.assetsCount)
+	if err != nil {
+		return proof, err
+	}
+	// the lookup tables of the r1cs keep the entries of the witness being
+	// solved, so the proofs of a tier are generated one at a time
+	params.proveLock.Lock()
+	proof, err = p.ProvingSystem.Prove(params.r1cs, params.provingKey, assignment.fullWitness, p.ProverOptions...)
+	params.proveLock.Unlock()
+	if err != nil {
+		return proof, err
+	}
 	endTime := time.Now().UnixMilli()
-	fmt.Println("proof generation cost ", endTime-startTime, " ms")
+	slog.Info("proof is generated", utils.LogKeyHeight, batchNumber, utils.LogKeyAssetsCount, assignment.assetsCount, "cost_ms", endTime-startTime)
+	utils.ProofDuration.WithLabelValues(strconv.Itoa(assignment.assetsCount)).Observe(float64(endTime-startTime) / 1000)
 
-	err = groth16.Verify(proof, p.VerifyingKey, vWitness)
+	err = p.ProvingSystem.Verify(proof, params.verifyingKey, assignment.publicWitness, p.VerifierOptions...)
 	if err != nil {
-		return proof, 0, err
+		return proof, err
 	}
 	endTime2 := time.Now().UnixMilli()
-	fmt.Println("proof verification cost ", endTime2-endTime, " ms")
-	return proof, len(circuitWitness.CreateUserOps[0].Assets), nil
+	slog.Info("proof is verified", utils.LogKeyHeight, batchNumber, utils.LogKeyAssetsCount, assignment.assetsCount, "cost_ms", endTime2-endTime)
+	return proof, nil
 }
 
-func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
-	if targerAssetsCount == p.CurrentSnarkParamsInUse {
-		return
+// snarkParamsOf returns the r1cs and keys of the tier, they are shared by the
+// proving workers. The resident tiers are returned at once, the first worker
+// of a missing tier loads it while the others of the tier wait for it. A
+// worker keeps the params of an evicted tier until its proof is finished, so
+// the memory may exceed MemoryBudget for a while.
+func (p *Prover) snarkParamsOf(assetsCount int) (*snarkParams, error) {
+	p.residentLock.Lock()
+	if params, ok := p.residentParams[assetsCount]; ok {
+		p.useSnarkParams(assetsCount)
+		p.residentLock.Unlock()
+		return params, nil
 	}
-	
+	if p.loadingParams == nil {
+		p.loadingParams = make(map[int]*snarkParamsLoad)
+	}
+	load, ok := p.loadingParams[assetsCount]
+	if ok {
+		p.residentLock.Unlock()
+		<-load.done
+		return load.params, load.err
+	}
+	load = &snarkParamsLoad{done: make(chan struct{})}
+	p.loadingParams[assetsCount] = load
+	p.residentLock.Unlock()
+
+	p.loadLock.Lock()
+	load.params, load.err = p.loadSnarkParams(assetsCount)
+	p.loadLock.Unlock()
+
+	p.residentLock.Lock()
+	delete(p.loadingParams, assetsCount)
+	if load.err == nil {
+		p.residentParams[assetsCount] = load.params
+		p.useSnarkParams(assetsCount)
+	}
+	p.residentLock.Unlock()
+	close(load.done)
+	return load.params, load.err
+}
+
+// snarkParams is the r1cs and keys of a tier
+type snarkParams struct {
+	r1cs         constraint.ConstraintSystem
+	provingKey   circuit.ProvingKey
+	verifyingKey circuit.VerifyingKey
+	// size is the size of the files, which approximates the memory they take
+	size int64
+	// proveLock is held while the r1cs is solved
+	proveLock sync.Mutex
+}
+
+// snarkParamsLoad is the loading of a tier, done is closed once params or
+// err is set
+type snarkParamsLoad struct {
+	done   chan struct{}
+	params *snarkParams
+	err    error
+}
+
+// LoadSnarkParamsOnce loads the r1cs and keys of the tier unless they are resident
+func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) error {
+	_, err := p.snarkParamsOf(targerAssetsCount)
+	return err
+}
+
+// loadSnarkParams reads the r1cs and keys of the tier from the files, the
+// least recently used tiers are evicted to make room for them first
+func (p *Prover) loadSnarkParams(targerAssetsCount int) (*snarkParams, error) {
 	index := -1
 	for i, v :=  range p.AssetsCountTiers {
 		if targerAssetsCount == v {
@@ -294,18 +832,31 @@ func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
 		}
 	}
 	if index == -1 {
-		panic("the assets count is not in the config file")
+		return nil, fmt.Errorf("the assets count %d is not in the tier manifest", targerAssetsCount)
+	}
+	var size int64
+	for _, ext := range []string{".r1cs", ".pk", ".vk"} {
+		info, err := os.Stat(p.SessionName[index] + ext)
+		if err != nil {
+			return nil, err
+		}
+		size += info.Size()
 	}
+	p.evictSnarkParams(size)
+
 	// Load r1cs, proving key and verifying key.
+	loadStart := time.Now()
 	s := time.Now()
-	fmt.Println("begin loading r1cs of ", targerAssetsCount, " assets")
-	loadR1csChan := make(chan bool)
+	slog.Info("begin loading r1cs", utils.LogKeyAssetsCount, targerAssetsCount)
+	// the gc loop quits when the r1cs is read or fails
+	loadR1csChan := make(chan bool, 1)
+	defer close(loadR1csChan)
 	go func() {
 		for {
 
 			select {
 			case <-loadR1csChan:
-				fmt.Println("load r1cs finished...... quit")
+				slog.Debug("load r1cs finished, quit the gc loop")
 				return
 			case <-time.After(time.Second * 10):
 				runtime.GC()
@@ -313,54 +864,92 @@ func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
 		}
 	}()
 
-	p.R1cs = groth16.NewCS(ecc.BN254)
+	params := &snarkParams{size: size}
+	params.r1cs = p.ProvingSystem.NewCS()
 
 	r1csFromFile, err := os.ReadFile(p.SessionName[index] + ".r1cs")
 	if err != nil {
-		panic("r1cs file load error..." + err.Error())
+		return nil, fmt.Errorf("r1cs file load error: %s", err.Error())
 	}
 	buf := bytes.NewBuffer(r1csFromFile)
-	n, err := p.R1cs.ReadFrom(buf)
+	n, err := params.r1cs.ReadFrom(buf)
 	if err != nil {
-		panic("r1cs read error..." + err.Error())
+		return nil, fmt.Errorf("r1cs read error: %s", err.Error())
 	}
-	fmt.Println("r1cs read size is ", n)
+	slog.Debug("r1cs is read", utils.LogKeyAssetsCount, targerAssetsCount, "size", n)
 	loadR1csChan <- true
 	runtime.GC()
 	et := time.Now()
-	fmt.Println("finish loading r1cs.... the time cost is ", et.Sub(s))
+	slog.Info("finish loading r1cs", utils.LogKeyAssetsCount, targerAssetsCount, "cost", et.Sub(s))
 	
 	// read proving and verifying keys
-	fmt.Println("begin loading proving key of ", targerAssetsCount, " assets")
+	slog.Info("begin loading proving key", utils.LogKeyAssetsCount, targerAssetsCount)
 	s = time.Now()
 	pkFromFile, err := os.ReadFile(p.SessionName[index] + ".pk")
 	if err != nil {
-		panic("provingKey file load error:" + err.Error())
+		return nil, fmt.Errorf("provingKey file load error: %s", err.Error())
 	}
 	buf = bytes.NewBuffer(pkFromFile)
-	p.ProvingKey = groth16.NewProvingKey(ecc.BN254)
-	n, err = p.ProvingKey.UnsafeReadFrom(buf)
+	params.provingKey = p.ProvingSystem.NewProvingKey()
+	n, err = params.provingKey.UnsafeReadFrom(buf)
 	if err != nil {
-		panic("provingKey loading error:" + err.Error())
+		return nil, fmt.Errorf("provingKey loading error: %s", err.Error())
 	}
-	fmt.Println("proving key read size is ", n)
+	slog.Debug("proving key is read", utils.LogKeyAssetsCount, targerAssetsCount, "size", n)
 	et = time.Now()
-	fmt.Println("finish loading proving key... the time cost is ", et.Sub(s))
+	slog.Info("finish loading proving key", utils.LogKeyAssetsCount, targerAssetsCount, "cost", et.Sub(s))
 	
-	fmt.Println("begin loading verifying key of ", targerAssetsCount, " assets")
+	slog.Info("begin loading verifying key", utils.LogKeyAssetsCount, targerAssetsCount)
 	s = time.Now()
 	vkFromFile, err := os.ReadFile(p.SessionName[index] + ".vk")
 	if err != nil {
-		panic("verifyingKey file load error:" + err.Error())
+		return nil, fmt.Errorf("verifyingKey file load error: %s", err.Error())
 	}
 	buf = bytes.NewBuffer(vkFromFile)
-	p.VerifyingKey = groth16.NewVerifyingKey(ecc.BN254)
-	n, err = p.VerifyingKey.ReadFrom(buf)
+	params.verifyingKey = p.ProvingSystem.NewVerifyingKey()
+	n, err = params.verifyingKey.ReadFrom(buf)
 	if err != nil {
-		panic("verifyingKey loading error:" + err.Error())
+		return nil, fmt.Errorf("verifyingKey loading error: %s", err.Error())
 	}
-	fmt.Println("verifying key read size is ", n)
+	slog.Debug("verifying key is read", utils.LogKeyAssetsCount, targerAssetsCount, "size", n)
 	et = time.Now()
-	fmt.Println("finish loading verifying key.. the time cost is ", et.Sub(s))
-	p.CurrentSnarkParamsInUse = targerAssetsCount
+	slog.Info("finish loading verifying key", utils.LogKeyAssetsCount, targerAssetsCount, "cost", et.Sub(s))
+	utils.KeyLoadDuration.WithLabelValues(strconv.Itoa(targerAssetsCount)).Observe(et.Sub(loadStart).Seconds())
+	return params, nil
+}
+
+// useSnarkParams makes the resident tier the most recently used one,
+// residentLock must be held
+func (p *Prover) useSnarkParams(assetsCount int) {
+	tiers := []int{assetsCount}
+	for _, t := range p.residentTiers {
+		if t != assetsCount {
+			tiers = append(tiers, t)
+		}
+	}
+	p.residentTiers = tiers
+}
+
+// evictSnarkParams evicts the least recently used tiers until the tier of
+// size fits in the memory budget
+func (p *Prover) evictSnarkParams(size int64) {
+	p.residentLock.Lock()
+	var total int64
+	for _, params := range p.residentParams {
+		total += params.size
+	}
+	evicted := false
+	for len(p.residentTiers) > 0 && total+size > p.MemoryBudget {
+		assetsCount := p.residentTiers[len(p.residentTiers)-1]
+		p.residentTiers = p.residentTiers[:len(p.residentTiers)-1]
+		total -= p.residentParams[assetsCount].size
+		delete(p.residentParams, assetsCount)
+		slog.Info("evict the r1cs and keys", utils.LogKeyAssetsCount, assetsCount)
+		evicted = true
+	}
+	p.residentLock.Unlock()
+	if evicted {
+		runtime.GC()
+		debug.FreeOSMemory()
+	}
 }
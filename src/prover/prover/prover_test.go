@@ -140,7 +140,7 @@ func TestMockProver(t *testing.T) {
 					fmt.Println("prover run finish...")
 					return
 				}
-				if errors.Is(err, redis.Nil) {
+				if errors.Is(err, utils.ErrNoTask) {
 					fmt.Println("There is no task left in task queue")
 					fmt.Println("prover run finish...")
 					return
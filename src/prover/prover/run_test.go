@@ -0,0 +1,291 @@
+package prover
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/config"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/frontend"
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// runFixture is a tier of one account per batch with its keys
+type runFixture struct {
+	t            *testing.T
+	dir          string
+	tierManifest *utils.TierManifest
+	zkKeyDir     string
+	accounts     utils.AccountsMap
+	cexAssets    []utils.CexAssetInfo
+}
+
+func newRunFixture(t *testing.T) *runFixture {
+	dir := t.TempDir()
+	manifestFile := filepath.Join(dir, "tiers.json")
+	err := os.WriteFile(manifestFile, []byte(`{"AccountTreeDepth": 8, "AssetCounts": 4,
+		"Tiers": [{"AssetsCount": 4, "BatchCreateUserOpsCount": 1}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tierManifest, err := utils.LoadTierManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tierManifest.Apply()
+	t.Cleanup(utils.DefaultTierManifest().Apply)
+
+	// the first users of the sample dataset, 6 of them are valid
+	dataDir := filepath.Join(dir, "data")
+	os.Mkdir(dataDir, 0755)
+	cexAssetsInfo, err := os.ReadFile("../../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dataDir, utils.CexAssetsInfoFile), cexAssetsInfo, 0644)
+	f, err := os.Open("../../sampledata/sample_users0.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users bytes.Buffer
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 17 && scanner.Scan(); i++ {
+		users.WriteString(scanner.Text() + "\n")
+	}
+	f.Close()
+	os.WriteFile(filepath.Join(dataDir, "users0.csv"), users.Bytes(), 0644)
+	accounts, cexAssets, err := utils.ParseUserDataSet(dataDir)
+	var invalidAccounts *utils.ErrInvalidAccounts
+	if err != nil && !errors.As(err, &invalidAccounts) {
+		t.Fatal(err)
+	}
+	return &runFixture{
+		t:            t,
+		dir:          dir,
+		tierManifest: tierManifest,
+		accounts:     accounts,
+		cexAssets:    cexAssets,
+	}
+}
+
+func (f *runFixture) setupKeys() {
+	t := f.t
+
+	provingSystem, err := circuit.NewProvingSystem(circuit.ProvingSystemGroth16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchCircuit := circuit.NewBatchCreateUserCircuit(4, uint32(utils.AssetCounts), 1)
+	oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), provingSystem.NewBuilder(), batchCircuit, frontend.IgnoreUnconstrainedInputs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := provingSystem.Setup(oR1cs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.zkKeyDir = filepath.Join(f.dir, "keys")
+	os.Mkdir(f.zkKeyDir, 0755)
+	zkKeyName := f.tierManifest.ZkKeyNames(f.zkKeyDir)[0]
+	for ext, content := range map[string]io.WriterTo{".r1cs": oR1cs, ".pk": pk, ".vk": vk} {
+		var buf bytes.Buffer
+		if _, err = content.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(zkKeyName+ext, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newWitnesses writes the witnesses of the accounts to a new sqlite store
+func (f *runFixture) newWitnesses(name string) (*gorm.DB, witness.WitnessModel) {
+	// the index names of sqlite are global, so every store is another file
+	db, err := utils.OpenDB(utils.DbDriverSqlite, filepath.Join(f.dir, name+".db"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	accountTree, err := utils.NewAccountTree("memory", "")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	witnessModel := witness.NewWitnessModel(db, "")
+	accountsCount := 0
+	for _, accounts := range f.accounts {
+		accountsCount += len(accounts)
+	}
+	w := witness.NewWitness(accountTree, uint32(accountsCount), f.accounts,
+		append([]utils.CexAssetInfo{}, f.cexAssets...), f.tierManifest, witnessModel)
+	if err = w.Run(context.Background()); err != nil {
+		f.t.Fatal(err)
+	}
+	return db, witnessModel
+}
+
+// newProver returns the prover of 2 workers and 2 prefetched batches of the store
+func (f *runFixture) newProver(db *gorm.DB) *Prover {
+	p, err := NewProverWithDB(db, f.tierManifest, &config.Config{
+		TaskQueue:      TaskQueueMemory,
+		ProvingWorkers: 2,
+		PrefetchCount:  2,
+		ZkKeyDir:       f.zkKeyDir,
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return p
+}
+
+// witnessStatuses returns the number of witnesses of every status
+func witnessStatuses(t *testing.T, witnessModel witness.WitnessModel) map[int64]int {
+	height, err := witnessModel.GetLatestBatchWitnessHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[int64]int)
+	for i := int64(0); i <= height; i++ {
+		w, err := witnessModel.GetBatchWitnessByHeight(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses[w.Status]++
+	}
+	return statuses
+}
+
+func keyLoadCount(t *testing.T) uint64 {
+	var m dto.Metric
+	err := utils.KeyLoadDuration.WithLabelValues("4").(prometheus.Histogram).Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets up and proves a circuit")
+	}
+	f := newRunFixture(t)
+	f.setupKeys()
+
+	t.Run("prove", func(t *testing.T) {
+		db, witnessModel := f.newWitnesses("run")
+		p := f.newProver(db)
+		batchesCount := witnessStatuses(t, witnessModel)[witness.StatusPublished]
+		keyLoads := keyLoadCount(t)
+		// the workers prove 2 batches while 2 more are prefetched
+		maxInFlight := 0
+		done := make(chan error, 1)
+		go func() {
+			done <- p.Run(false)
+		}()
+		var err error
+	wait:
+		for {
+			select {
+			case err = <-done:
+				break wait
+			case <-time.After(10 * time.Millisecond):
+				maxInFlight = max(maxInFlight, p.inFlightCount())
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maxInFlight > 4 || maxInFlight <= 2 {
+			t.Errorf("%d batches are in flight, expected 2 proved and at most 2 prefetched", maxInFlight)
+		}
+		if statuses := witnessStatuses(t, witnessModel); statuses[witness.StatusFinished] != batchesCount {
+			t.Errorf("%d of %d witnesses are finished", statuses[witness.StatusFinished], batchesCount)
+		}
+		count, err := p.proofModel.GetRowCounts()
+		if err != nil || int(count) != batchesCount {
+			t.Errorf("%d of %d proofs are written: %v", count, batchesCount, err)
+		}
+		// the workers share the keys of the tier
+		if loads := keyLoadCount(t) - keyLoads; loads != 1 || len(p.residentParams) != 1 {
+			t.Errorf("the keys are loaded %d times", loads)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		db, witnessModel := f.newWitnesses("stop")
+		p := f.newProver(db)
+		done := make(chan error, 1)
+		go func() {
+			done <- p.Run(false)
+		}()
+		for {
+			count, _ := p.proofModel.GetRowCounts()
+			if count > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		p.Stop()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		// the proofs in progress are finished, the prefetched batches are handed back
+		statuses := witnessStatuses(t, witnessModel)
+		queued, _ := p.TaskQueue.Len(4)
+		if p.inFlightCount() != 0 || statuses[witness.StatusReceived] != 0 || statuses[witness.StatusPublished] == 0 ||
+			int(queued) != statuses[witness.StatusPublished] {
+			t.Errorf("unexpected witnesses %v after stop, %d are queued", statuses, queued)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		db, witnessModel := f.newWitnesses("fail")
+		// the batch commitment of the first batch doesn't match its roots
+		w, err := witnessModel.GetBatchWitnessByHeight(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batchWitness := utils.DecodeBatchWitness(w.WitnessData)
+		batchWitness.BatchCommitment = batchWitness.BeforeAccountTreeRoot
+		var buf bytes.Buffer
+		if err = gob.NewEncoder(&buf).Encode(batchWitness); err != nil {
+			t.Fatal(err)
+		}
+		witnessData := base64.StdEncoding.EncodeToString(s2.Encode(nil, buf.Bytes()))
+		err = db.Table(witness.TableNamePrefix).Where("height = ?", 0).Update("witness_data", witnessData).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := f.newProver(db)
+
+		err = p.Run(false)
+		if err == nil || !strings.Contains(err.Error(), "height 0") {
+			t.Fatalf("expected the failure of height 0, got %v", err)
+		}
+		// the first error stops the prover, the other batches in flight are
+		// finished or handed back, the failed one is reclaimed once its lease expires
+		statuses := witnessStatuses(t, witnessModel)
+		queued, _ := p.TaskQueue.Len(4)
+		if p.inFlightCount() != 0 || statuses[witness.StatusReceived] != 1 || statuses[witness.StatusPublished] == 0 ||
+			int(queued) != statuses[witness.StatusPublished] {
+			t.Errorf("unexpected witnesses %v after the failure, %d are queued", statuses, queued)
+		}
+	})
+}
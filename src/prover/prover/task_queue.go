@@ -0,0 +1,244 @@
+package prover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	TaskQueueRedis  = "redis"
+	TaskQueueMysql  = "mysql"
+	TaskQueueMemory = "memory"
+)
+
+// TaskQueue hands out the published batch witnesses to provers, every
+// witness is fetched by only one prover. There is one queue per assets count
+// tier, so that a prover keeps proving the tiers whose keys it has loaded.
+// Tier 0 holds the witnesses of former releases whose tier isn't recorded.
+type TaskQueue interface {
+	// Push queues the heights of published witnesses of the tier
+	Push(assetsCount int, heights []int64) error
+	// Fetch returns the witnesses of the next task from the first tier of
+	// assetsCounts which has one, updates their status from published to
+	// received and records the lease of the prover. It returns
+	// utils.ErrNoTask if the queues of all the tiers are drained.
+	Fetch(assetsCounts []int, lease witness.Lease) ([]*witness.BatchWitness, error)
+	// Len returns the number of tasks left in the queue of the tier
+	Len(assetsCount int) (int64, error)
+}
+
+// NewTaskQueue creates the task queue of the driver, an empty driver means redis
+func NewTaskQueue(driver string, witnessModel witness.WitnessModel, redisCli *redis.Client, dbSuffix string) (TaskQueue, error) {
+	switch driver {
+	case "", TaskQueueRedis:
+		return NewRedisTaskQueue(witnessModel, redisCli, dbSuffix), nil
+	case TaskQueueMysql:
+		return NewMysqlTaskQueue(witnessModel), nil
+	case TaskQueueMemory:
+		return NewMemoryTaskQueue(witnessModel), nil
+	default:
+		return nil, fmt.Errorf("unknown task queue %s, it must be redis, mysql or memory", driver)
+	}
+}
+
+// PushPublishedTasks pushes the heights of all the published witnesses to the queues of their tiers
+func PushPublishedTasks(witnessModel witness.WitnessModel, queue TaskQueue) error {
+	limit := 1024
+	offset := 0
+	for {
+		tasks, err := witnessModel.GetAllBatchTasksByStatus(witness.StatusPublished, limit, offset)
+		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
+			slog.Warn("get witness heights timeout, retry", "err", err)
+			utils.DbRetries.WithLabelValues("get_all_batch_tasks_by_status").Inc()
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err == utils.DbErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tierHeights := make(map[int][]int64)
+		var tiers []int
+		for _, task := range tasks {
+			if _, ok := tierHeights[int(task.AssetsCount)]; !ok {
+				tiers = append(tiers, int(task.AssetsCount))
+			}
+			tierHeights[int(task.AssetsCount)] = append(tierHeights[int(task.AssetsCount)], task.Height)
+		}
+		for _, tier := range tiers {
+			err = queue.Push(tier, tierHeights[tier])
+			if err != nil {
+				return err
+			}
+		}
+		slog.Info("push tasks to queue", "count", len(tasks), "offset", offset)
+		offset += len(tasks)
+	}
+}
+
+func fetchBatchWitnessByHeight(witnessModel witness.WitnessModel, batchHeight int, lease witness.Lease) ([]*witness.BatchWitness, error) {
+	for {
+		blockWitnesses, err := witnessModel.GetAndUpdateBatchesWitnessByHeight(batchHeight, witness.StatusPublished, witness.StatusReceived, lease)
+		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
+			slog.Warn("get batch witness timeout, retry", "err", err)
+			utils.DbRetries.WithLabelValues("get_and_update_batches_witness_by_height").Inc()
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return blockWitnesses, nil
+	}
+}
+
+// RedisTaskQueue is the redis lists por_batch_task_queue_<suffix>_<assetsCount>,
+// which are filled by dbtool -push_task_to_redis. The list of tier 0 is
+// por_batch_task_queue_<suffix> of former releases.
+type RedisTaskQueue struct {
+	witnessModel witness.WitnessModel
+	redisCli     *redis.Client
+	name         string
+}
+
+func NewRedisTaskQueue(witnessModel witness.WitnessModel, redisCli *redis.Client, dbSuffix string) *RedisTaskQueue {
+	return &RedisTaskQueue{
+		witnessModel: witnessModel,
+		redisCli:     redisCli,
+		name:         "por_batch_task_queue_" + dbSuffix,
+	}
+}
+
+func (q *RedisTaskQueue) tierName(assetsCount int) string {
+	if assetsCount == 0 {
+		return q.name
+	}
+	return q.name + "_" + strconv.Itoa(assetsCount)
+}
+
+func (q *RedisTaskQueue) Push(assetsCount int, heights []int64) error {
+	ctx := context.Background()
+	redisPipe := q.redisCli.Pipeline()
+	for _, height := range heights {
+		redisPipe.LPush(ctx, q.tierName(assetsCount), height)
+	}
+	_, err := redisPipe.Exec(ctx)
+	return err
+}
+
+func (q *RedisTaskQueue) Fetch(assetsCounts []int, lease witness.Lease) ([]*witness.BatchWitness, error) {
+	// BRPOP pops from the first non-empty list
+	names := make([]string, len(assetsCounts))
+	for i, assetsCount := range assetsCounts {
+		names[i] = q.tierName(assetsCount)
+	}
+	batchHeightStr, err := q.redisCli.BRPop(context.Background(), 10*time.Second, names...).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, utils.ErrNoTask
+	}
+	if err != nil {
+		return nil, err
+	}
+	batchHeight, err := strconv.Atoi(batchHeightStr[1])
+	if err != nil {
+		return nil, err
+	}
+	return fetchBatchWitnessByHeight(q.witnessModel, batchHeight, lease)
+}
+
+func (q *RedisTaskQueue) Len(assetsCount int) (int64, error) {
+	return q.redisCli.LLen(context.Background(), q.tierName(assetsCount)).Result()
+}
+
+// MysqlTaskQueue uses the witness table as the queue, provers lock the
+// published witnesses with SELECT ... FOR UPDATE SKIP LOCKED
+type MysqlTaskQueue struct {
+	witnessModel witness.WitnessModel
+}
+
+func NewMysqlTaskQueue(witnessModel witness.WitnessModel) *MysqlTaskQueue {
+	return &MysqlTaskQueue{witnessModel: witnessModel}
+}
+
+// Push does nothing, the published witnesses are already in the witness table
+func (q *MysqlTaskQueue) Push(assetsCount int, heights []int64) error {
+	return nil
+}
+
+func (q *MysqlTaskQueue) Fetch(assetsCounts []int, lease witness.Lease) ([]*witness.BatchWitness, error) {
+	for i := 0; i < len(assetsCounts); {
+		blockWitnesses, err := q.witnessModel.GetAndUpdateBatchesWitnessByStatus(witness.StatusPublished, witness.StatusReceived, int64(assetsCounts[i]), 1, lease)
+		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
+			slog.Warn("get batch witness timeout, retry", "err", err)
+			utils.DbRetries.WithLabelValues("get_and_update_batches_witness_by_status").Inc()
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err == utils.DbErrNotFound {
+			i++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return blockWitnesses, nil
+	}
+	return nil, utils.ErrNoTask
+}
+
+func (q *MysqlTaskQueue) Len(assetsCount int) (int64, error) {
+	return q.witnessModel.GetPublishedBatchWitnessCount(int64(assetsCount))
+}
+
+// MemoryTaskQueue is shared by the provers of one process
+type MemoryTaskQueue struct {
+	witnessModel witness.WitnessModel
+	lock         sync.Mutex
+	heights      map[int][]int64
+}
+
+func NewMemoryTaskQueue(witnessModel witness.WitnessModel) *MemoryTaskQueue {
+	return &MemoryTaskQueue{
+		witnessModel: witnessModel,
+		heights:      make(map[int][]int64),
+	}
+}
+
+func (q *MemoryTaskQueue) Push(assetsCount int, heights []int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.heights[assetsCount] = append(q.heights[assetsCount], heights...)
+	return nil
+}
+
+func (q *MemoryTaskQueue) Fetch(assetsCounts []int, lease witness.Lease) ([]*witness.BatchWitness, error) {
+	q.lock.Lock()
+	for _, assetsCount := range assetsCounts {
+		if len(q.heights[assetsCount]) == 0 {
+			continue
+		}
+		batchHeight := q.heights[assetsCount][0]
+		q.heights[assetsCount] = q.heights[assetsCount][1:]
+		q.lock.Unlock()
+		return fetchBatchWitnessByHeight(q.witnessModel, int(batchHeight), lease)
+	}
+	q.lock.Unlock()
+	return nil, utils.ErrNoTask
+}
+
+func (q *MemoryTaskQueue) Len(assetsCount int) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return int64(len(q.heights[assetsCount])), nil
+}
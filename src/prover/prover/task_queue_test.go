@@ -0,0 +1,428 @@
+package prover
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// memoryWitnessModel implements the witness model methods the task queues use
+type memoryWitnessModel struct {
+	witness.WitnessModel
+	lock      sync.Mutex
+	witnesses []*witness.BatchWitness
+}
+
+func (m *memoryWitnessModel) GetAllBatchTasksByStatus(status int64, limit int, offset int) ([]witness.BatchTask, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var tasks []witness.BatchTask
+	for _, w := range m.witnesses {
+		if w.Status == status {
+			tasks = append(tasks, witness.BatchTask{Height: w.Height, AssetsCount: w.AssetsCount})
+		}
+	}
+	if offset >= len(tasks) {
+		return nil, utils.DbErrNotFound
+	}
+	tasks = tasks[offset:]
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
+
+func (m *memoryWitnessModel) GetAndUpdateBatchesWitnessByHeight(height int, beforeStatus, afterStatus int64, lease witness.Lease) ([]*witness.BatchWitness, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, w := range m.witnesses {
+		if w.Height == int64(height) && w.Status == beforeStatus {
+			w.Status = afterStatus
+			w.Lease = lease
+			return []*witness.BatchWitness{w}, nil
+		}
+	}
+	return nil, utils.DbErrNotFound
+}
+
+func (m *memoryWitnessModel) GetAndUpdateExpiredBatchWitness(now int64, lease witness.Lease) (*witness.BatchWitness, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, w := range m.witnesses {
+		if w.Status == witness.StatusReceived && w.Lease.Expiry < now {
+			w.Lease = lease
+			return w, nil
+		}
+	}
+	return nil, utils.DbErrNotFound
+}
+
+func (m *memoryWitnessModel) RenewBatchWitnessLease(height int64, lease witness.Lease) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, w := range m.witnesses {
+		if w.Height == height && w.Status == witness.StatusReceived && w.Lease.Owner == lease.Owner {
+			w.Lease = lease
+			return nil
+		}
+	}
+	return utils.ErrLeaseLost
+}
+
+func (m *memoryWitnessModel) ReleaseBatchWitness(height int64, owner string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, w := range m.witnesses {
+		if w.Height == height && w.Status == witness.StatusReceived && w.Lease.Owner == owner {
+			w.Status = witness.StatusPublished
+			w.Lease = witness.Lease{}
+			return nil
+		}
+	}
+	return utils.ErrLeaseLost
+}
+
+func (m *memoryWitnessModel) FinishBatchWitness(height int64, owner string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, w := range m.witnesses {
+		if w.Height == height && w.Status == witness.StatusReceived && w.Lease.Owner == owner {
+			w.Status = witness.StatusFinished
+			return nil
+		}
+	}
+	return utils.ErrLeaseLost
+}
+
+func (m *memoryWitnessModel) DbNow() (int64, error) {
+	return time.Now().Unix(), nil
+}
+
+func (m *memoryWitnessModel) lease(height int64) witness.Lease {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.witnesses[height].Lease
+}
+
+func TestMemoryTaskQueue(t *testing.T) {
+	witnessModel := &memoryWitnessModel{}
+	for i := 0; i < 3000; i++ {
+		status := int64(witness.StatusPublished)
+		if i%10 == 0 {
+			status = witness.StatusFinished
+		}
+		// the witnesses of tier 0 are generated by former releases
+		assetsCount := []int64{0, 50, 500}[i/1000]
+		witnessModel.witnesses = append(witnessModel.witnesses, &witness.BatchWitness{Height: int64(i), Status: status, AssetsCount: assetsCount})
+	}
+	queue, err := NewTaskQueue(TaskQueueMemory, witnessModel, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PushPublishedTasks(witnessModel, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	fetched := make(map[int64]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				batchWitnesses, err := queue.Fetch([]int{500, 50, 0}, witness.Lease{Owner: "test"})
+				if errors.Is(err, utils.ErrNoTask) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				lock.Lock()
+				for _, w := range batchWitnesses {
+					fetched[w.Height]++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(fetched) != 2700 {
+		t.Fatalf("%d witnesses are fetched, expected 2700", len(fetched))
+	}
+	for height, count := range fetched {
+		if count != 1 || height%10 == 0 {
+			t.Fatalf("witness of height %d is fetched %d times", height, count)
+		}
+	}
+	for _, w := range witnessModel.witnesses {
+		if w.Status == witness.StatusPublished {
+			t.Fatalf("witness of height %d isn't received", w.Height)
+		}
+	}
+
+	// the tasks of the preferred tier go first
+	for _, w := range witnessModel.witnesses {
+		if w.Status == witness.StatusReceived {
+			w.Status = witness.StatusPublished
+		}
+	}
+	err = PushPublishedTasks(witnessModel, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, assetsCount := range []int64{500, 50, 0} {
+		for i := 0; i < 900; i++ {
+			batchWitnesses, err := queue.Fetch([]int{500, 50, 0}, witness.Lease{Owner: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if batchWitnesses[0].AssetsCount != assetsCount {
+				t.Fatalf("witness of %d assets is fetched before the ones of %d assets", batchWitnesses[0].AssetsCount, assetsCount)
+			}
+		}
+	}
+	if _, err = queue.Fetch([]int{500, 50, 0}, witness.Lease{Owner: "test"}); !errors.Is(err, utils.ErrNoTask) {
+		t.Fatalf("expect no task, got %v", err)
+	}
+
+	if _, err = NewTaskQueue("kafka", witnessModel, nil, "test"); err == nil {
+		t.Fatal("unknown task queue is accepted")
+	}
+}
+
+func TestReclaimExpiredLease(t *testing.T) {
+	now := time.Now().Unix()
+	witnessModel := &memoryWitnessModel{witnesses: []*witness.BatchWitness{
+		// received by a crashed prover
+		{Height: 0, Status: witness.StatusReceived, Lease: witness.Lease{Owner: "crashed", Expiry: now - 1}},
+		// being proved by a live prover
+		{Height: 1, Status: witness.StatusReceived, Lease: witness.Lease{Owner: "live", Expiry: now + 60}},
+		{Height: 2, Status: witness.StatusPublished},
+	}}
+	p := &Prover{
+		witnessModel:  witnessModel,
+		TaskQueue:     NewMemoryTaskQueue(witnessModel),
+		LeaseOwner:    newLeaseOwner(),
+		LeaseDuration: 300 * time.Millisecond,
+	}
+	err := PushPublishedTasks(witnessModel, p.TaskQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, height := range []int64{0, 2} {
+		batchWitnesses, err := p.FetchBatchWitness()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batchWitnesses) != 1 || batchWitnesses[0].Height != height {
+			t.Fatalf("expect witness of height %d", height)
+		}
+		if witnessModel.lease(height).Owner != p.LeaseOwner {
+			t.Fatalf("witness of height %d is leased to %s", height, witnessModel.lease(height).Owner)
+		}
+	}
+	if _, err = p.FetchBatchWitness(); !errors.Is(err, utils.ErrNoTask) {
+		t.Fatalf("expect no task, got %v", err)
+	}
+	if witnessModel.lease(1).Owner != "live" {
+		t.Fatal("the lease of a live prover is reclaimed")
+	}
+
+	// the heartbeat keeps the lease from expiring
+	expiry := witnessModel.lease(0).Expiry
+	lost, stop := p.keepLease(0)
+	time.Sleep(1500 * time.Millisecond)
+	if witnessModel.lease(0).Expiry <= expiry {
+		t.Fatal("the lease isn't renewed")
+	}
+	// the renewal signals the lease taken over by another prover
+	witnessModel.lock.Lock()
+	witnessModel.witnesses[0].Lease.Owner = "other"
+	witnessModel.lock.Unlock()
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("the lost lease isn't signalled")
+	}
+	stop()
+	stop()
+}
+
+func TestTaskQueueDepthMetric(t *testing.T) {
+	witnessModel := &memoryWitnessModel{}
+	for i := 0; i < 5; i++ {
+		witnessModel.witnesses = append(witnessModel.witnesses, &witness.BatchWitness{Height: int64(i), Status: witness.StatusPublished, AssetsCount: []int64{50, 500}[i%2]})
+	}
+	p := &Prover{
+		witnessModel:     witnessModel,
+		TaskQueue:        NewMemoryTaskQueue(witnessModel),
+		LeaseOwner:       newLeaseOwner(),
+		LeaseDuration:    time.Minute,
+		AssetsCountTiers: []int{50, 500},
+		residentParams:   make(map[int]*snarkParams),
+	}
+	err := PushPublishedTasks(witnessModel, p.TaskQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.FetchBatchWitness(); err != nil {
+		t.Fatal(err)
+	}
+	if depth := testutil.ToFloat64(utils.TaskQueueDepth.WithLabelValues("50")); depth != 2 {
+		t.Fatalf("task queue depth of tier 50 is %v, expected 2", depth)
+	}
+	if depth := testutil.ToFloat64(utils.TaskQueueDepth.WithLabelValues("500")); depth != 2 {
+		t.Fatalf("task queue depth of tier 500 is %v, expected 2", depth)
+	}
+}
+
+func TestHandBack(t *testing.T) {
+	witnessModel := &memoryWitnessModel{witnesses: []*witness.BatchWitness{
+		{Height: 0, Status: witness.StatusPublished},
+	}}
+	p := &Prover{
+		witnessModel:  witnessModel,
+		TaskQueue:     NewMemoryTaskQueue(witnessModel),
+		LeaseOwner:    newLeaseOwner(),
+		LeaseDuration: time.Minute,
+		stop:          make(chan struct{}),
+		inFlight:      make(map[int64]*witness.BatchWitness),
+	}
+	p.TaskQueue.Push(0, []int64{0})
+	batchWitnesses, err := p.FetchBatchWitness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.addInFlight(batchWitnesses[0])
+	p.Stop()
+	p.Stop()
+	err = p.HandBack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if witnessModel.witnesses[0].Status != witness.StatusPublished || witnessModel.lease(0).Owner != "" {
+		t.Fatal("the witness isn't handed back")
+	}
+	if p.inFlightCount() != 0 {
+		t.Fatal("the handed back witness is still in flight")
+	}
+	// another prover takes the task over
+	other := &Prover{
+		witnessModel:  witnessModel,
+		TaskQueue:     p.TaskQueue,
+		LeaseOwner:    newLeaseOwner(),
+		LeaseDuration: time.Minute,
+	}
+	batchWitnesses, err = other.FetchBatchWitness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batchWitnesses[0].Height != 0 || witnessModel.lease(0).Owner != other.LeaseOwner {
+		t.Fatal("the handed back witness isn't queued again")
+	}
+	// the witness taken over by another prover counts as handed back, and
+	// the failed hand back of one witness doesn't stop the others
+	p.addInFlight(batchWitnesses[0])
+	p.addInFlight(&witness.BatchWitness{Height: 1})
+	p.TaskQueue = failingTaskQueue{}
+	witnessModel.witnesses = append(witnessModel.witnesses, &witness.BatchWitness{Height: 1, Status: witness.StatusReceived, Lease: witness.Lease{Owner: p.LeaseOwner}})
+	err = p.HandBack()
+	if err == nil || errors.Is(err, utils.ErrLeaseLost) {
+		t.Fatalf("expect the push error, got %v", err)
+	}
+	if p.inFlightCount() != 1 || witnessModel.witnesses[1].Status != witness.StatusPublished {
+		t.Fatalf("%d witnesses are in flight, expected the one whose push failed", p.inFlightCount())
+	}
+}
+
+// failingTaskQueue refuses every push
+type failingTaskQueue struct {
+	TaskQueue
+}
+
+func (failingTaskQueue) Push(assetsCount int, heights []int64) error {
+	return errors.New("queue is down")
+}
+
+func TestResidentTiers(t *testing.T) {
+	p := &Prover{
+		AssetsCountTiers: []int{50, 200, 500},
+		MemoryBudget:     10,
+		residentParams:   make(map[int]*snarkParams),
+	}
+	if tiers := p.tierPreference(); fmt.Sprint(tiers) != "[50 200 500 0]" {
+		t.Fatalf("unexpected tier preference %v", tiers)
+	}
+	load := func(assetsCount int, size int64) {
+		p.evictSnarkParams(size)
+		p.residentParams[assetsCount] = &snarkParams{size: size}
+		p.useSnarkParams(assetsCount)
+	}
+	load(500, 4)
+	load(50, 4)
+	if tiers := p.tierPreference(); fmt.Sprint(tiers) != "[50 500 200 0]" {
+		t.Fatalf("unexpected tier preference %v", tiers)
+	}
+	// switching to a resident tier makes it the most recently used one
+	if _, err := p.snarkParamsOf(500); err != nil {
+		t.Fatal(err)
+	}
+	// 200 doesn't fit in the budget with both tiers, the least recently used 50 is evicted
+	load(200, 4)
+	if _, ok := p.residentParams[50]; ok {
+		t.Fatal("the least recently used tier isn't evicted")
+	}
+	if tiers := p.tierPreference(); fmt.Sprint(tiers) != "[200 500 50 0]" {
+		t.Fatalf("unexpected tier preference %v", tiers)
+	}
+
+	// without a budget only the tier in use stays resident
+	p.MemoryBudget = 0
+	load(50, 4)
+	if len(p.residentParams) != 1 || p.residentTiers[0] != 50 {
+		t.Fatalf("resident tiers %v", p.residentTiers)
+	}
+}
+
+func TestSnarkParamsOfWhileLoading(t *testing.T) {
+	resident := &snarkParams{size: 1}
+	p := &Prover{
+		AssetsCountTiers: []int{50, 200},
+		residentParams:   map[int]*snarkParams{50: resident},
+		residentTiers:    []int{50},
+	}
+	// the tier 200 is being loaded by another worker
+	load := &snarkParamsLoad{done: make(chan struct{})}
+	p.loadingParams = map[int]*snarkParamsLoad{200: load}
+	p.loadLock.Lock()
+
+	params, err := p.snarkParamsOf(50)
+	if err != nil || params != resident {
+		t.Fatalf("the resident tier waits for the loading one: %v", err)
+	}
+	waited := make(chan *snarkParams, 1)
+	go func() {
+		params, _ := p.snarkParamsOf(200)
+		waited <- params
+	}()
+	select {
+	case <-waited:
+		t.Fatal("the tier is returned before it is loaded")
+	case <-time.After(10 * time.Millisecond):
+	}
+	load.params = &snarkParams{size: 2}
+	close(load.done)
+	if params := <-waited; params != load.params {
+		t.Fatal("the worker doesn't get the params of the load it waits for")
+	}
+	p.loadLock.Unlock()
+}
@@ -111,8 +111,12 @@ def generate_data(id, num, invalid_num):
                 debt_value += get_debt_value(token_name, vl_token, m_token, pm_token, token2vltiersratio, token2margintiersratio, token2pmtiersratio, token2price)
                 real_content.extend([str(equity), str(0), str(0), str(vl_token), str(m_token), str(pm_token)])
 
-            average_debt_value = debt_value // target_tokens_count
-            for p in range(target_tokens_count):
+            # the debt is spread over the tokens with collateral tiers, a token
+            # without them like shib would be borrowed far beyond the equity
+            # of all the users
+            debt_tokens = [p for p in range(target_tokens_count) if len(token2vltiersratio[token_names[p]]) > 0]
+            average_debt_value = debt_value // len(debt_tokens)
+            for p in debt_tokens:
                 debt_token = get_debt_token_by_value(token_names[p], average_debt_value, token2price)
                 roundPrecision = 8
                 if token_names[p] in SpecialToken:
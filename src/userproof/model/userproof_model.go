@@ -17,6 +17,7 @@ type (
 		GetUserProofById(id string) (*UserProof, error)
 		GetLatestAccountIndex() (uint32, error)
 		GetUserCounts() (int, error)
+		GetTierManifestHash() (string, error)
 	}
 
 	defaultUserProofModel struct {
@@ -34,6 +35,8 @@ type (
 		Assets          string
 		Proof           string
 		Config          string
+		// TierManifestHash is the hash of the tier manifest the accounts are padded with
+		TierManifestHash string
 	}
 
 	UserConfig struct {
@@ -79,7 +82,7 @@ func (m *defaultUserProofModel) GetUserProofByIndex(id uint32) (userproof *UserP
 	userproof = &UserProof{}
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("account_index = ?", id).Find(userproof)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	}
@@ -90,7 +93,7 @@ func (m *defaultUserProofModel) GetUserProofById(id string) (userproof *UserProo
 	userproof = &UserProof{}
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("account_id = ?", id).Find(userproof)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	}
@@ -101,7 +104,7 @@ func (m *defaultUserProofModel) GetLatestAccountIndex() (uint32, error) {
 	var row *UserProof
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Order("account_index desc").Limit(1).Find(&row)
 	if dbTx.Error != nil {
-		return 0, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return 0, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return 0, utils.DbErrNotFound
 	}
@@ -112,7 +115,17 @@ func (m *defaultUserProofModel) GetUserCounts() (int, error) {
 	var count int64 = 0
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Count(&count)
 	if dbTx.Error != nil {
-		return 0, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return 0, utils.ConvertDbErr(dbTx.Error)
 	}
 	return int(count), nil
-}
\ No newline at end of file
+}
+func (m *defaultUserProofModel) GetTierManifestHash() (string, error) {
+	var hash string
+	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Select("tier_manifest_hash").Limit(1).Find(&hash)
+	if dbTx.Error != nil {
+		return "", utils.ConvertDbErr(dbTx.Error)
+	} else if dbTx.RowsAffected == 0 {
+		return "", utils.DbErrNotFound
+	}
+	return hash, nil
+}
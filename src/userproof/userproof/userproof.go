@@ -0,0 +1,395 @@
+package userproof
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/userproof/model"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	bsmt "github.com/bnb-chain/zkbnb-smt"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+)
+
+type AccountLeave struct {
+	hash  []byte
+	index uint32
+}
+
+// ComputeAccountTreeRoot builds the account tree of the padded accounts in
+// memory and returns its root, which must be the root the witness service ends with
+func ComputeAccountTreeRoot(ctx context.Context, accounts utils.AccountSource) ([]byte, error) {
+	accountTree, err := utils.NewAccountTree("memory", "")
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("empty account tree is created", "root", fmt.Sprintf("%x", accountTree.Root()))
+	startTime := time.Now().UnixMilli()
+	tierCounts := accounts.TierCounts()
+	paddingStartIndex := utils.CountAccounts(accounts)
+	// the reader, the hash workers and the tree writer cancel the computation with their error
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	for _, key := range utils.SortedTiers(accounts) {
+		it, err := accounts.Accounts(key)
+		if err != nil {
+			return nil, err
+		}
+		paddingStartIndex, it = utils.PaddingAccountsIterator(it, key, tierCounts[key], paddingStartIndex)
+		slog.Info("users of the tier are loaded", utils.LogKeyAssetsCount, key, "ops", utils.PaddedAccountsCount(key, tierCounts[key]))
+		accountsChan := make(chan *utils.AccountInfo, 1000)
+		chs := make(chan AccountLeave, 1000)
+		cpuCores := runtime.NumCPU()
+		workers := 1
+		if cpuCores > 2 {
+			workers = cpuCores - 2
+		}
+
+		go func() {
+			defer close(accountsChan)
+			err := ReadAccounts(ctx, it, accountsChan)
+			if err != nil {
+				cancel(err)
+			}
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := CalculateAccountHash(ctx, accountsChan, chs)
+				if err != nil {
+					cancel(err)
+				}
+			}()
+		}
+		slog.Debug("account hash workers are started", "workers", workers)
+		quit := make(chan struct{})
+		go func() {
+			err := CalculateAccountTreeRoot(chs, accountTree)
+			if err != nil {
+				cancel(err)
+			}
+			close(quit)
+		}()
+
+		wg.Wait()
+		close(chs)
+		<-quit
+		// the reader quits when the workers are canceled
+		for range accountsChan {
+		}
+		it.Close()
+		err = context.Cause(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	endTime := time.Now().UnixMilli()
+	slog.Info("user account tree is generated", "cost_ms", endTime-startTime, "root", fmt.Sprintf("%x", accountTree.Root()))
+	return accountTree.Root(), nil
+}
+
+// ReadAccounts sends the accounts of it to accounts until it ends
+func ReadAccounts(ctx context.Context, it utils.AccountIterator, accounts chan<- *utils.AccountInfo) error {
+	for {
+		account, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case accounts <- account:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func CalculateAccountHash(ctx context.Context, accounts <-chan *utils.AccountInfo, chs chan<- AccountLeave) error {
+	poseidonHasher := poseidon.NewPoseidon()
+	for account := range accounts {
+		accountHash, err := utils.AccountInfoToHash(account, &poseidonHasher)
+		if err != nil {
+			return err
+		}
+		select {
+		case chs <- AccountLeave{
+			hash:  accountHash,
+			index: account.AccountIndex,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// CalculateAccountTreeRoot sets the account leaves in the tree until the
+// channel is closed, it returns at the first leaf which can't be set
+func CalculateAccountTreeRoot(accountLeaves <-chan AccountLeave, accountTree bsmt.SparseMerkleTree) error {
+	num := 0
+	for accountLeaf := range accountLeaves {
+		err := accountTree.Set(uint64(accountLeaf.index), accountLeaf.hash)
+		if err != nil {
+			return fmt.Errorf("set account %d failed: %s", accountLeaf.index, err.Error())
+		}
+		num++
+		if num%100000 == 0 {
+			slog.Info("accounts are set in tree", "accounts", num)
+		}
+	}
+	return nil
+}
+
+// Generate writes the proofs of the accounts which aren't in the user proof
+// table yet. accountTree is the tree built by the witness service, the
+// accounts are proved in the order of their assets count tiers.
+func Generate(ctx context.Context, accountTree bsmt.SparseMerkleTree, accounts utils.AccountSource,
+	userProofModel model.UserProofModel, tierManifest *utils.TierManifest) error {
+	err := userProofModel.CreateUserProofTable()
+	if err != nil {
+		return fmt.Errorf("create user proof table failed: %s", err.Error())
+	}
+	utils.AccountTreeVersion.Set(float64(accountTree.LatestVersion()))
+	tierCounts := accounts.TierCounts()
+	totalAccountCounts := utils.CountAccounts(accounts)
+	for k, v := range tierCounts {
+		slog.Info("users of the tier are loaded", utils.LogKeyAssetsCount, k, "ops", v)
+	}
+	slog.Info("all users are loaded", "accounts", totalAccountCounts)
+	var currentAccountCounts int
+	for {
+		currentAccountCounts, err = userProofModel.GetUserCounts()
+		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
+			slog.Warn("get user counts timeout, retry", "err", err)
+			utils.DbRetries.WithLabelValues("get_user_counts").Inc()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+		break
+	}
+
+	if err != nil && err != utils.DbErrNotFound {
+		return fmt.Errorf("get user counts failed: %w", err)
+	}
+	if currentAccountCounts > 0 {
+		// the accounts proved so far must be padded with the same tiers
+		hash, err := userProofModel.GetTierManifestHash()
+		if err != nil {
+			return fmt.Errorf("get tier manifest hash of user proofs failed: %w", err)
+		}
+		err = tierManifest.Check(hash)
+		if err != nil {
+			return err
+		}
+	}
+	totalCounts := currentAccountCounts
+	accountTreeRoot := hex.EncodeToString(accountTree.Root())
+	// the worker and the db writer cancel the generation with their error
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	jobs := make(chan Job, 1000)
+	nums := make(chan int, 1)
+	results := make(chan *model.UserProof, 1000)
+	go func() {
+		num, err := worker(ctx, jobs, results, accountTreeRoot, tierManifest.Hash)
+		if err != nil {
+			cancel(err)
+		}
+		nums <- num
+	}()
+	quit := make(chan struct{})
+	go func() {
+		err := WriteDB(results, userProofModel, currentAccountCounts)
+		if err != nil {
+			cancel(err)
+		}
+		close(quit)
+	}()
+	err = pushJobs(ctx, jobs, accountTree, accounts, currentAccountCounts)
+	close(jobs)
+	totalCounts += <-nums
+	slog.Info("user proofs are generated", "total", totalCounts)
+	close(results)
+	<-quit
+	if err != nil {
+		return err
+	}
+	err = context.Cause(ctx)
+	if err != nil {
+		return err
+	}
+
+	if totalCounts != totalAccountCounts {
+		return fmt.Errorf("user proofs count %d mismatch the accounts count %d", totalCounts, totalAccountCounts)
+	}
+	slog.Info("userproof service run finished")
+	return nil
+}
+
+// pushJobs pushes the accounts after the currentAccountCounts proved ones to jobs
+func pushJobs(ctx context.Context, jobs chan<- Job, accountTree bsmt.SparseMerkleTree, accounts utils.AccountSource,
+	currentAccountCounts int) error {
+	tierCounts := accounts.TierCounts()
+	prevAccountCounts := 0
+	for _, k := range utils.SortedTiers(accounts) {
+		if currentAccountCounts >= tierCounts[k]+prevAccountCounts {
+			prevAccountCounts += tierCounts[k]
+			continue
+		}
+		err := pushTierJobs(ctx, jobs, accountTree, accounts, k, currentAccountCounts-prevAccountCounts)
+		if err != nil {
+			return err
+		}
+		prevAccountCounts += tierCounts[k]
+		currentAccountCounts = prevAccountCounts
+	}
+	return nil
+}
+
+// pushTierJobs pushes the accounts of the tier after the first skip ones to jobs
+func pushTierJobs(ctx context.Context, jobs chan<- Job, accountTree bsmt.SparseMerkleTree, accounts utils.AccountSource,
+	assetKey int, skip int) error {
+	it, err := accounts.Accounts(assetKey)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for i := 0; ; i++ {
+		account, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if i < skip {
+			continue
+		}
+		leaf, err := accountTree.Get(uint64(account.AccountIndex), nil)
+		if err != nil {
+			return fmt.Errorf("get account %d failed: %s", account.AccountIndex, err.Error())
+		}
+		proof, err := accountTree.GetProof(uint64(account.AccountIndex))
+		if err != nil {
+			return fmt.Errorf("get proof of account %d failed: %s", account.AccountIndex, err.Error())
+		}
+		select {
+		case jobs <- Job{
+			account: account,
+			proof:   proof,
+			leaf:    leaf,
+		}:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+func WriteDB(results <-chan *model.UserProof, userProofModel model.UserProofModel, currentAccountCounts int) error {
+	index := 0
+	proofs := make([]model.UserProof, 100)
+	num := int(currentAccountCounts)
+	for proof := range results {
+		proofs[index] = *proof
+		index += 1
+		if index%100 == 0 {
+			err := userProofModel.CreateUserProofs(proofs)
+			if err != nil {
+				return fmt.Errorf("create user proofs failed: %s", err.Error())
+			}
+			num += 100
+			utils.UserProofsWritten.Add(100)
+			if num%100000 == 0 {
+				slog.Info("write user proofs to db", "total", num)
+			}
+			index = 0
+		}
+	}
+	proofs = proofs[:index]
+	if index > 0 {
+		slog.Info("write the last user proofs to db", "count", len(proofs))
+		err := userProofModel.CreateUserProofs(proofs)
+		if err != nil {
+			return fmt.Errorf("create user proofs failed: %s", err.Error())
+		}
+		num += index
+		utils.UserProofsWritten.Add(float64(index))
+	}
+	slog.Info("all user proofs are written", "total", num)
+	return nil
+}
+
+type Job struct {
+	account *utils.AccountInfo
+	proof   [][]byte
+	leaf    []byte
+}
+
+func worker(ctx context.Context, jobs <-chan Job, results chan<- *model.UserProof, root string, tierManifestHash string) (int, error) {
+	num := 0
+	for job := range jobs {
+		userProof, err := ConvertAccount(job.account, job.leaf, job.proof, root)
+		if err != nil {
+			return num, err
+		}
+		slog.Debug("user proof is generated", utils.LogKeyAccountIndex, job.account.AccountIndex)
+		userProof.TierManifestHash = tierManifestHash
+		select {
+		case results <- userProof:
+		case <-ctx.Done():
+			return num, ctx.Err()
+		}
+		num += 1
+	}
+	return num, nil
+}
+
+func ConvertAccount(account *utils.AccountInfo, leafHash []byte, proof [][]byte, root string) (*model.UserProof, error) {
+	var userProof model.UserProof
+	var userConfig model.UserConfig
+	userProof.AccountIndex = account.AccountIndex
+	userProof.AccountId = hex.EncodeToString(account.AccountId)
+	userProof.AccountLeafHash = hex.EncodeToString(leafHash)
+	proofSerial, err := json.Marshal(proof)
+	if err != nil {
+		return nil, fmt.Errorf("marshal proof of account %d failed: %s", account.AccountIndex, err.Error())
+	}
+	userProof.Proof = string(proofSerial)
+	assets, err := json.Marshal(account.Assets)
+	if err != nil {
+		return nil, fmt.Errorf("marshal assets of account %d failed: %s", account.AccountIndex, err.Error())
+	}
+	userProof.Assets = string(assets)
+	userProof.TotalDebt = account.TotalDebt.String()
+	userProof.TotalEquity = account.TotalEquity.String()
+	userProof.TotalCollateral = account.TotalCollateral.String()
+
+	userConfig.AccountIndex = account.AccountIndex
+	userConfig.AccountIdHash = hex.EncodeToString(account.AccountId)
+	userConfig.Proof = proof
+	userConfig.Root = root
+	userConfig.Assets = account.Assets
+	userConfig.TotalDebt = account.TotalDebt
+	userConfig.TotalEquity = account.TotalEquity
+	userConfig.TotalCollateral = account.TotalCollateral
+	configSerial, err := json.Marshal(userConfig)
+	if err != nil {
+		return nil, fmt.Errorf("marshal user config of account %d failed: %s", account.AccountIndex, err.Error())
+	}
+	userProof.Config = string(configSerial)
+	return &userProof, nil
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"io"
+	"math/big"
+	"sort"
+)
+
+// AccountSource is the accounts of a round grouped by assets count tier. The
+// witness and userproof services read the accounts of a tier one by one, so
+// a source on disk doesn't need to fit in memory.
+type AccountSource interface {
+	// TierCounts returns the number of accounts of every tier which has accounts
+	TierCounts() map[int]int
+	// Accounts iterates over the accounts of the tier in account index order
+	Accounts(assetsCount int) (AccountIterator, error)
+}
+
+// AccountIterator returns the accounts of a tier one by one
+type AccountIterator interface {
+	// Next returns io.EOF after the last account
+	Next() (*AccountInfo, error)
+	Close() error
+}
+
+// AccountsMap is an AccountSource in memory, as returned by ParseUserDataSet
+type AccountsMap map[int][]AccountInfo
+
+func (m AccountsMap) TierCounts() map[int]int {
+	counts := make(map[int]int, len(m))
+	for k, v := range m {
+		if len(v) > 0 {
+			counts[k] = len(v)
+		}
+	}
+	return counts
+}
+
+func (m AccountsMap) Accounts(assetsCount int) (AccountIterator, error) {
+	return &sliceIterator{accounts: m[assetsCount]}, nil
+}
+
+type sliceIterator struct {
+	accounts []AccountInfo
+	next     int
+}
+
+func (it *sliceIterator) Next() (*AccountInfo, error) {
+	if it.next >= len(it.accounts) {
+		return nil, io.EOF
+	}
+	// the account is copied, so the caller can't change the map
+	account := it.accounts[it.next]
+	it.next++
+	return &account, nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// CountAccounts returns the number of accounts of all the tiers of the source
+func CountAccounts(src AccountSource) int {
+	count := 0
+	for _, v := range src.TierCounts() {
+		count += v
+	}
+	return count
+}
+
+// SortedTiers returns the tiers of the source which have accounts in
+// ascending order, which is the order the accounts are batched in
+func SortedTiers(src AccountSource) []int {
+	keys := make([]int, 0)
+	for k := range src.TierCounts() {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// PaddedAccountsCount returns the number of accounts of the tier after the
+// last batch is padded
+func PaddedAccountsCount(assetKey int, count int) int {
+	opsPerBatch := BatchCreateUserOpsCountsTiers[assetKey]
+	return (count + opsPerBatch - 1) / opsPerBatch * opsPerBatch
+}
+
+// PaddingAccountsIterator returns the count accounts of it followed by the
+// padding accounts of the last batch of the tier, like PaddingAccounts does
+// for a slice. The padding starts at paddingStartIndex, the index after the
+// padding accounts is returned.
+func PaddingAccountsIterator(it AccountIterator, assetKey int, count int, paddingStartIndex int) (int, AccountIterator) {
+	paddingCount := PaddedAccountsCount(assetKey, count) - count
+	return paddingStartIndex + paddingCount, &paddingIterator{
+		AccountIterator: it,
+		assetKey:        assetKey,
+		paddingIndex:    paddingStartIndex,
+		paddingEnd:      paddingStartIndex + paddingCount,
+	}
+}
+
+type paddingIterator struct {
+	AccountIterator
+	assetKey     int
+	paddingIndex int
+	paddingEnd   int
+}
+
+func (it *paddingIterator) Next() (*AccountInfo, error) {
+	account, err := it.AccountIterator.Next()
+	if err != io.EOF {
+		return account, err
+	}
+	if it.paddingIndex >= it.paddingEnd {
+		return nil, io.EOF
+	}
+	account = paddingAccount(it.assetKey, it.paddingIndex)
+	it.paddingIndex++
+	return account, nil
+}
+
+// paddingAccount returns an account without equity and debt which owns the
+// first assetKey assets
+func paddingAccount(assetKey int, index int) *AccountInfo {
+	assets := make([]AccountAsset, assetKey)
+	for j := 0; j < assetKey; j++ {
+		assets[j] = AccountAsset{Index: uint16(j)}
+	}
+	return &AccountInfo{
+		AccountIndex:    uint32(index),
+		TotalEquity:     new(big.Int).SetInt64(0),
+		TotalDebt:       new(big.Int).SetInt64(0),
+		TotalCollateral: new(big.Int).SetInt64(0),
+		Assets:          assets,
+	}
+}
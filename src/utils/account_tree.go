@@ -2,12 +2,14 @@ package utils
 
 import (
 	"fmt"
+	"log/slog"
 	"hash"
 	"time"
 	"encoding/base64"
 
 	bsmt "github.com/bnb-chain/zkbnb-smt"
 	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/bnb-chain/zkbnb-smt/database/leveldb"
 	"github.com/bnb-chain/zkbnb-smt/database/memory"
 	"github.com/bnb-chain/zkbnb-smt/database/redis"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
@@ -17,13 +19,17 @@ var (
 	NilAccountHash []byte
 )
 
+// NewAccountTree opens the account tree on the tree db driver: memory, redis
+// which addr is the kvrocks address, or leveldb which addr is the data directory
 func NewAccountTree(driver string, addr string) (accountTree bsmt.SparseMerkleTree, err error) {
+	db, err := newTreeDB(driver, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newAccountTree(db)
+}
 
-	hasher := bsmt.NewHasherPool(func() hash.Hash {
-		return poseidon.NewPoseidon()
-	})
-
-	var db database.TreeDB
+func newTreeDB(driver string, addr string) (db database.TreeDB, err error) {
 	if driver == "memory" {
 		db = memory.NewMemoryDB()
 	} else if driver == "redis" {
@@ -42,13 +48,35 @@ func NewAccountTree(driver string, addr string) (accountTree bsmt.SparseMerkleTr
 		if err != nil {
 			return nil, err
 		}
+	} else if driver == "leveldb" {
+		if addr == "" {
+			return nil, fmt.Errorf("leveldb tree db needs a data directory")
+		}
+		db, err = leveldb.New(addr, LevelDBCacheSize, LevelDBHandles, false)
+		if err != nil {
+			return nil, fmt.Errorf("open leveldb %s failed: %s", addr, err.Error())
+		}
+	} else {
+		return nil, fmt.Errorf("unknown tree db driver %s", driver)
 	}
+	return db, nil
+}
 
-	accountTree, err = bsmt.NewBNBSparseMerkleTree(hasher, db, AccountTreeDepth, NilAccountHash)
-	if err != nil {
-		return nil, err
+func newAccountTree(db database.TreeDB) (bsmt.SparseMerkleTree, error) {
+	hasher := bsmt.NewHasherPool(func() hash.Hash {
+		return poseidon.NewPoseidon()
+	})
+	return bsmt.NewBNBSparseMerkleTree(hasher, db, uint8(AccountTreeDepth), NilAccountHash)
+}
+
+// EmptyAccountTreeRoot returns the root of the account tree of AccountTreeDepth
+// without any account, every empty leaf is NilAccountHash
+func EmptyAccountTreeRoot() []byte {
+	node := NilAccountHash
+	for i := 0; i < AccountTreeDepth; i++ {
+		node = poseidon.PoseidonBytes(node, node)
 	}
-	return accountTree, nil
+	return node
 }
 
 func VerifyMerkleProof(root []byte, accountIndex uint32, proof [][]byte, node []byte) bool {
@@ -66,7 +94,7 @@ func VerifyMerkleProof(root []byte, accountIndex uint32, proof [][]byte, node []
 			hasher.Write(node)
 		}
 		node = hasher.Sum(nil)
-		fmt.Println("node base64 encode is", base64.StdEncoding.EncodeToString(node))
+		slog.Debug("merkle proof node is computed", LogKeyAccountIndex, accountIndex, "depth", i, "node", base64.StdEncoding.EncodeToString(node))
 		hasher.Reset()
 	}
 	if string(node) != string(root) {
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestLevelDBAccountTree(t *testing.T) {
+	dir := t.TempDir()
+	memoryTree, err := NewAccountTree("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newTreeDB("leveldb", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := newAccountTree(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roots [][]byte
+	for version := 0; version < 3; version++ {
+		for i := 0; i < 4; i++ {
+			leaf := EmptyAccountTreeRoot()
+			leaf[31] = byte(version*4 + i)
+			index := uint64(version*100 + i*7)
+			if err = tree.Set(index, leaf); err != nil {
+				t.Fatal(err)
+			}
+			if err = memoryTree.Set(index, leaf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = tree.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = memoryTree.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+		if string(tree.Root()) != string(memoryTree.Root()) {
+			t.Fatalf("leveldb root %x, memory root %x", tree.Root(), memoryTree.Root())
+		}
+		roots = append(roots, tree.Root())
+	}
+	// uncommitted changes are lost when the witness service restarts
+	if err = tree.Set(1, EmptyAccountTreeRoot()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = newTreeDB("leveldb", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tree, err = newAccountTree(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.LatestVersion() != 3 {
+		t.Fatalf("latest version is %d after reopen", tree.LatestVersion())
+	}
+	if string(tree.Root()) != string(roots[2]) {
+		t.Fatalf("root %x after reopen, expected %x", tree.Root(), roots[2])
+	}
+	if err = tree.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if string(tree.Root()) != string(roots[0]) {
+		t.Fatalf("root %x after rollback, expected %x", tree.Root(), roots[0])
+	}
+
+	if _, err = newTreeDB("unknown", ""); err == nil {
+		t.Fatal("unknown tree db driver is accepted")
+	}
+}
@@ -0,0 +1,462 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// accountsDirMetaFile is written after all the segments of an accounts dir,
+// a dir without it is ingested again
+const accountsDirMetaFile = "accounts.json"
+
+type accountsDirMeta struct {
+	// Sources are the cex assets info and the user files the accounts are ingested from
+	Sources []accountsDirSource
+	// AssetCountsTiers are the tiers the accounts are grouped by
+	AssetCountsTiers []int
+	// Rounding is the policy the amounts are rounded with
+	Rounding RoundingPolicy
+	// Rounded are the amounts the rounding dropped from the valid accounts of
+	// the assets which were rounded
+	Rounded []AssetRounding
+	// TierCounts are the valid accounts of every tier of every user file
+	TierCounts []map[int]int
+	// InvalidErrors are the errors of the invalid rows
+	InvalidErrors []string
+}
+
+type accountsDirSource struct {
+	Name string
+	Size int64
+	// ModTime is the modification time in unix nanoseconds
+	ModTime int64
+}
+
+// AccountsDir is an AccountSource on disk written by IngestUserDataSet. The
+// accounts of every user file and tier are in an s2 compressed segment, which
+// is read one account at a time.
+type AccountsDir struct {
+	dir        string
+	meta       accountsDirMeta
+	offsets    []int
+	tierCounts map[int]int
+}
+
+// IngestUserDataSet reads the user files of dirname row by row and writes the
+// valid accounts to outDir grouped by assets count tier, only a few rows of
+// every file are in memory at once. The tiers must be applied before. If
+// outDir already has the accounts of the same files, tiers and rounding
+// policy, they are reused without reading the files again. The account indexes are the ones of
+// ParseUserDataSet, and *ErrInvalidAccounts is returned with the accounts if
+// some rows are invalid.
+func IngestUserDataSet(ctx context.Context, dirname string, outDir string) (*AccountsDir, []CexAssetInfo, error) {
+	userFileNames, cexAssetInfo, err := parseUserDataSetHeader(dirname)
+	if err != nil {
+		return nil, nil, err
+	}
+	sources, err := statAccountsDirSources(append([]string{filepath.Join(dirname, CexAssetsInfoFile)}, userFileNames...))
+	if err != nil {
+		return nil, nil, err
+	}
+	accounts, err := OpenAccountsDir(outDir)
+	if err == nil && slices.Equal(accounts.meta.Sources, sources) && slices.Equal(accounts.meta.AssetCountsTiers, AssetCountsTiers) &&
+		accounts.meta.Rounding == AmountRounding {
+		slog.Info("accounts are already ingested", "dir", outDir, "accounts", CountAccounts(accounts))
+		logRoundings("amounts of the asset are rounded", accounts.meta.Rounded)
+		return accounts, cexAssetInfo, accounts.invalidAccountsErr()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("accounts dir can't be opened, ingest again", "dir", outDir, "err", err)
+	}
+
+	err = resetAccountsDir(outDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	startTime := time.Now()
+	meta := accountsDirMeta{
+		Sources:          sources,
+		AssetCountsTiers: append([]int{}, AssetCountsTiers...),
+		Rounding:         AmountRounding,
+		TierCounts:       make([]map[int]int, len(userFileNames)),
+	}
+	invalidErrors := make([][]error, len(userFileNames))
+	dropped := make([]roundingTotals, len(userFileNames))
+	// the workers quit if a file fails
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	workersNum := 8
+	var wg sync.WaitGroup
+	for i := 0; i < workersNum; i++ {
+		wg.Add(1)
+		go func(workerId int) {
+			defer wg.Done()
+			for j := workerId; j < len(userFileNames) && ctx.Err() == nil; j += workersNum {
+				counts, fileInvalidErrors, fileDropped, err := ingestUserFile(ctx, outDir, j, userFileNames[j], cexAssetInfo)
+				meta.TierCounts[j], invalidErrors[j], dropped[j] = counts, fileInvalidErrors, fileDropped
+				if err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	err = context.Cause(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	totals := newRoundingTotals(len(cexAssetInfo))
+	for j := range dropped {
+		totals.merge(dropped[j])
+	}
+	meta.Rounded = totals.assets(cexAssetInfo)
+	var allInvalidErrors []error
+	for j := range invalidErrors {
+		allInvalidErrors = append(allInvalidErrors, invalidErrors[j]...)
+		for _, err := range invalidErrors[j] {
+			meta.InvalidErrors = append(meta.InvalidErrors, err.Error())
+		}
+	}
+	err = writeAccountsDirMeta(outDir, &meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	accounts = newAccountsDir(outDir, meta)
+	slog.Info("accounts are ingested", "dir", outDir, "accounts", CountAccounts(accounts), "invalid", len(allInvalidErrors), "cost", time.Since(startTime))
+	logRoundings("amounts of the asset are rounded", meta.Rounded)
+	if len(allInvalidErrors) > 0 {
+		slog.Error("invalid accounts are found", "invalid", len(allInvalidErrors))
+		return accounts, cexAssetInfo, &ErrInvalidAccounts{Errors: allInvalidErrors}
+	}
+	return accounts, cexAssetInfo, nil
+}
+
+// OpenAccountsDir opens the accounts written by IngestUserDataSet
+func OpenAccountsDir(dir string) (*AccountsDir, error) {
+	content, err := os.ReadFile(filepath.Join(dir, accountsDirMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	var meta accountsDirMeta
+	err = json.Unmarshal(content, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s of %s failed: %s", accountsDirMetaFile, dir, err.Error())
+	}
+	return newAccountsDir(dir, meta), nil
+}
+
+func newAccountsDir(dir string, meta accountsDirMeta) *AccountsDir {
+	accounts := &AccountsDir{
+		dir:        dir,
+		meta:       meta,
+		offsets:    make([]int, len(meta.TierCounts)),
+		tierCounts: make(map[int]int),
+	}
+	// the accounts of a file are indexed after the accounts of the files before it
+	offset := 0
+	for j, counts := range meta.TierCounts {
+		accounts.offsets[j] = offset
+		for k, v := range counts {
+			offset += v
+			accounts.tierCounts[k] += v
+		}
+	}
+	return accounts
+}
+
+// Rounded returns the amounts the rounding dropped from the valid accounts of
+// the assets which were rounded
+func (d *AccountsDir) Rounded() []AssetRounding {
+	return d.meta.Rounded
+}
+
+func (d *AccountsDir) TierCounts() map[int]int {
+	counts := make(map[int]int, len(d.tierCounts))
+	for k, v := range d.tierCounts {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (d *AccountsDir) Accounts(assetsCount int) (AccountIterator, error) {
+	return &accountsDirIterator{dir: d, assetKey: assetsCount, file: -1}, nil
+}
+
+// invalidAccountsErr returns the invalid rows of the ingestion, only their
+// messages are kept on disk
+func (d *AccountsDir) invalidAccountsErr() error {
+	if len(d.meta.InvalidErrors) == 0 {
+		return nil
+	}
+	invalidErrors := make([]error, len(d.meta.InvalidErrors))
+	for i, msg := range d.meta.InvalidErrors {
+		invalidErrors[i] = errors.New(msg)
+	}
+	return &ErrInvalidAccounts{Errors: invalidErrors}
+}
+
+type accountsDirIterator struct {
+	dir      *AccountsDir
+	assetKey int
+	// file is the user file whose segment is read, left is the number of its accounts not read yet
+	file    int
+	left    int
+	segment *os.File
+	reader  *bufio.Reader
+}
+
+func (it *accountsDirIterator) Next() (*AccountInfo, error) {
+	for it.left == 0 {
+		err := it.closeSegment()
+		if err != nil {
+			return nil, err
+		}
+		it.file++
+		if it.file >= len(it.dir.meta.TierCounts) {
+			return nil, io.EOF
+		}
+		it.left = it.dir.meta.TierCounts[it.file][it.assetKey]
+		if it.left == 0 {
+			continue
+		}
+		it.segment, err = os.Open(accountsSegmentName(it.dir.dir, it.file, it.assetKey))
+		if err != nil {
+			return nil, err
+		}
+		it.reader = bufio.NewReader(s2.NewReader(it.segment))
+	}
+	account, err := readAccount(it.reader)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %w", it.segment.Name(), err)
+	}
+	account.AccountIndex += uint32(it.dir.offsets[it.file])
+	it.left--
+	return account, nil
+}
+
+func (it *accountsDirIterator) Close() error {
+	return it.closeSegment()
+}
+
+func (it *accountsDirIterator) closeSegment() error {
+	if it.segment == nil {
+		return nil
+	}
+	err := it.segment.Close()
+	it.segment = nil
+	it.reader = nil
+	return err
+}
+
+// ingestUserFile writes the valid accounts of the file to a segment per tier
+// and returns the number of accounts of every tier
+func ingestUserFile(ctx context.Context, outDir string, file int, name string, cexAssetsInfo []CexAssetInfo) (map[int]int, []error, roundingTotals, error) {
+	type segmentWriter struct {
+		f *os.File
+		w *s2.Writer
+	}
+	segments := make(map[int]*segmentWriter)
+	defer func() {
+		for _, s := range segments {
+			s.f.Close()
+		}
+	}()
+	counts := make(map[int]int)
+	var buf []byte
+	invalidErrors, dropped, err := streamUserDataFromCsvFile(ctx, name, cexAssetsInfo, func(assetKey int, account *AccountInfo) error {
+		s := segments[assetKey]
+		if s == nil {
+			f, err := os.Create(accountsSegmentName(outDir, file, assetKey))
+			if err != nil {
+				return err
+			}
+			s = &segmentWriter{f: f, w: s2.NewWriter(f)}
+			segments[assetKey] = s
+		}
+		buf = appendAccount(buf[:0], account)
+		_, err := s.w.Write(buf)
+		if err != nil {
+			return err
+		}
+		counts[assetKey]++
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, s := range segments {
+		err = s.w.Close()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = s.f.Close()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return counts, invalidErrors, dropped, nil
+}
+
+func accountsSegmentName(dir string, file int, assetKey int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d_%d.acc", file, assetKey))
+}
+
+func statAccountsDirSources(names []string) ([]accountsDirSource, error) {
+	sources := make([]accountsDirSource, len(names))
+	for i, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		// the dataset may be moved, only the base names are compared
+		sources[i] = accountsDirSource{
+			Name:    filepath.Base(name),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		}
+	}
+	return sources, nil
+}
+
+// resetAccountsDir removes the meta file first, so that the dir isn't reused
+// if the ingestion is interrupted
+func resetAccountsDir(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, accountsDirMetaFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "*.acc"))
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		err = os.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAccountsDirMeta(dir string, meta *accountsDirMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(dir, accountsDirMetaFile+".tmp")
+	err = os.WriteFile(tmpName, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(dir, accountsDirMetaFile))
+}
+
+// appendAccount encodes the account as uvarints and length prefixed bytes:
+// index, id, total equity, total debt, total collateral, the assets count and
+// the index, equity, debt, loan, margin and portfolio margin of every asset
+func appendAccount(buf []byte, account *AccountInfo) []byte {
+	buf = binary.AppendUvarint(buf, uint64(account.AccountIndex))
+	buf = binary.AppendUvarint(buf, uint64(len(account.AccountId)))
+	buf = append(buf, account.AccountId...)
+	for _, v := range []*big.Int{account.TotalEquity, account.TotalDebt, account.TotalCollateral} {
+		b := v.Bytes()
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(account.Assets)))
+	for _, asset := range account.Assets {
+		buf = binary.AppendUvarint(buf, uint64(asset.Index))
+		buf = binary.AppendUvarint(buf, asset.Equity)
+		buf = binary.AppendUvarint(buf, asset.Debt)
+		buf = binary.AppendUvarint(buf, asset.Loan)
+		buf = binary.AppendUvarint(buf, asset.Margin)
+		buf = binary.AppendUvarint(buf, asset.PortfolioMargin)
+	}
+	return buf
+}
+
+// readAccount decodes an account of appendAccount, io.EOF means there is no account left
+func readAccount(r *bufio.Reader) (*AccountInfo, error) {
+	index, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+	account := &AccountInfo{AccountIndex: uint32(index)}
+	account.AccountId, err = readBytes()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	totals := make([]*big.Int, 3)
+	for i := range totals {
+		b, err := readBytes()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		totals[i] = new(big.Int).SetBytes(b)
+	}
+	account.TotalEquity, account.TotalDebt, account.TotalCollateral = totals[0], totals[1], totals[2]
+	assetsCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if assetsCount > uint64(AssetCounts) {
+		return nil, fmt.Errorf("account %d has %d assets, more than %d", index, assetsCount, AssetCounts)
+	}
+	account.Assets = make([]AccountAsset, assetsCount)
+	for i := range account.Assets {
+		var values [6]uint64
+		for p := range values {
+			values[p], err = binary.ReadUvarint(r)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		}
+		account.Assets[i] = AccountAsset{
+			Index:           uint16(values[0]),
+			Equity:          values[1],
+			Debt:            values[2],
+			Loan:            values[3],
+			Margin:          values[4],
+			PortfolioMargin: values[5],
+		}
+	}
+	return account, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
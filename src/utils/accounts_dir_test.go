@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copyDataSet copies the sample dataset, so that its files can be touched
+func copyDataSet(t *testing.T) string {
+	dir := t.TempDir()
+	names, err := filepath.Glob("../sampledata/*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, filepath.Base(name)), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func readAllAccounts(t *testing.T, src AccountSource, assetKey int) []*AccountInfo {
+	it, err := src.Accounts(assetKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var accounts []*AccountInfo
+	for {
+		account, err := it.Next()
+		if err == io.EOF {
+			return accounts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts = append(accounts, account)
+	}
+}
+
+func TestIngestUserDataSet(t *testing.T) {
+	dataDir := copyDataSet(t)
+	expected, expectedCexAssets, _ := ParseUserDataSet(dataDir)
+	accountsDir := filepath.Join(t.TempDir(), "accounts")
+	accounts, cexAssets, err := IngestUserDataSet(context.Background(), dataDir, accountsDir)
+	var invalidAccounts *ErrInvalidAccounts
+	if !errors.As(err, &invalidAccounts) || len(invalidAccounts.Errors) != 30 {
+		t.Fatalf("expected 30 invalid accounts, got %v", err)
+	}
+	if len(cexAssets) != len(expectedCexAssets) {
+		t.Errorf("expected %d cex assets, got %d", len(expectedCexAssets), len(cexAssets))
+	}
+	if CountAccounts(accounts) != 170 {
+		t.Errorf("expected 170 accounts, got %d", CountAccounts(accounts))
+	}
+	for k, v := range expected {
+		actual := readAllAccounts(t, accounts, k)
+		if len(actual) != len(v) {
+			t.Fatalf("expected %d accounts of tier %d, got %d", len(v), k, len(actual))
+		}
+		for i := range v {
+			a, e := actual[i], &v[i]
+			if a.AccountIndex != e.AccountIndex || string(a.AccountId) != string(e.AccountId) ||
+				a.TotalEquity.Cmp(e.TotalEquity) != 0 || a.TotalDebt.Cmp(e.TotalDebt) != 0 ||
+				a.TotalCollateral.Cmp(e.TotalCollateral) != 0 || len(a.Assets) != len(e.Assets) {
+				t.Fatalf("account %d of tier %d mismatch: %v, expected %v", i, k, a, e)
+			}
+			for p := range e.Assets {
+				if a.Assets[p] != e.Assets[p] {
+					t.Fatalf("asset %d of account %d mismatch: %v, expected %v", p, e.AccountIndex, a.Assets[p], e.Assets[p])
+				}
+			}
+		}
+	}
+
+	// the accounts are reused until a user file changes
+	stale := filepath.Join(accountsDir, "stale.acc")
+	err = os.WriteFile(stale, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = IngestUserDataSet(context.Background(), dataDir, accountsDir)
+	if !errors.As(err, &invalidAccounts) || len(invalidAccounts.Errors) != 30 {
+		t.Fatalf("expected the 30 invalid accounts of the first ingestion, got %v", err)
+	}
+	if _, err = os.Stat(stale); err != nil {
+		t.Errorf("the accounts are ingested again: %v", err)
+	}
+	err = os.Chtimes(filepath.Join(dataDir, "sample_users0.csv"), time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, _, _ = IngestUserDataSet(context.Background(), dataDir, accountsDir)
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("the accounts of the changed files are reused")
+	}
+	if CountAccounts(accounts) != 170 {
+		t.Errorf("expected 170 accounts, got %d", CountAccounts(accounts))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = IngestUserDataSet(ctx, dataDir, t.TempDir())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+}
+
+func TestPaddingAccountsIterator(t *testing.T) {
+	accounts, _, _ := ParseUserDataSet("../sampledata")
+	paddingStartIndex := 170
+	for _, k := range SortedTiers(AccountsMap(accounts)) {
+		it, _ := AccountsMap(accounts).Accounts(k)
+		nextIndex, it := PaddingAccountsIterator(it, k, len(accounts[k]), paddingStartIndex)
+		expectedIndex, expected := PaddingAccounts(append([]AccountInfo{}, accounts[k]...), k, paddingStartIndex)
+		if nextIndex != expectedIndex {
+			t.Errorf("expected the padding of tier %d to end at %d, got %d", k, expectedIndex, nextIndex)
+		}
+		for i := range expected {
+			account, err := it.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if account.AccountIndex != expected[i].AccountIndex || len(account.Assets) != len(expected[i].Assets) {
+				t.Fatalf("account %d of tier %d mismatch", i, k)
+			}
+		}
+		if _, err := it.Next(); err != io.EOF {
+			t.Errorf("expected io.EOF after %d accounts, got %v", len(expected), err)
+		}
+		paddingStartIndex = nextIndex
+	}
+}
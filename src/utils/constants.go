@@ -7,31 +7,51 @@ import (
 
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
-	"gorm.io/hints"
 )
 
 const (
 	// BatchCreateUserOpsCounts = 864
-	AccountTreeDepth         = 28
-	AssetCounts              = 500
-	// TierCount: must be even number, the cex assets commitment will depend on the TierCount/2 parts
-	TierCount				 = 12
+	DefaultAccountTreeDepth  = 28
+	DefaultAssetCounts       = 500
+	DefaultTierCount         = 12
 	R1csBatchSize            = 1000000
+	// LevelDBCacheSize is in megabytes, LevelDBHandles is the number of open files of the leveldb tree db
+	LevelDBCacheSize         = 512
+	LevelDBHandles           = 1024
+	// AssetValueDecimals are the decimals of the usdt values which are summed
+	// up over the assets, the amount decimals and price decimals of every
+	// asset add up to them
+	AssetValueDecimals       = 16
+	// the decimals of the padding assets and of the assets which aren't in AssetTypeForTwoDigits
+	DefaultAmountDecimals    = 8
+	DefaultPriceDecimals     = 8
 )
 
 var (
+	// AccountTreeDepth, AssetCounts and TierCount are the deployment parameters
+	// of the circuits, they are set by TierManifest.Apply
+	AccountTreeDepth              = DefaultAccountTreeDepth
+	AssetCounts                   = DefaultAssetCounts
+	// TierCount: must be even number, the cex assets commitment will depend on the TierCount/2 parts
+	TierCount                     = DefaultTierCount
+	// CommitmentFreeCircuits makes the groth16 circuits hash the commitments
+	// of their range checks and lookups in-circuit, it is set by TierManifest.Apply
+	CommitmentFreeCircuits        = false
+
 	ZeroBigInt                    = new(big.Int).SetInt64(0)
 	OneBigInt                     = new(big.Int).SetInt64(1)
 	PercentageMultiplier          = new(big.Int).SetUint64(100)
 	MaxTierBoundaryValue, _       = new(big.Int).SetString("332306998946228968225951765070086144", 10) // (pow(2,118))
 	Uint64MaxValueBigInt, _       = new(big.Int).SetString("18446744073709551616", 10)
 	Uint64MaxValueBigIntSquare, _ = new(big.Int).SetString("340282366920938463463374607431768211456", 10)
+	Uint64MaxValueBigIntCube, _   = new(big.Int).SetString("6277101735386680763835789423207666416102355444464034512896", 10)
 	Uint8MaxValueBigInt, _        = new(big.Int).SetString("256", 10)
 	Uint16MaxValueBigInt, _       = new(big.Int).SetString("65536", 10)
 	Uint126MaxValueBigInt, _      = new(big.Int).SetString("85070591730234615865843651857942052864", 10)
 	Uint134MaxValueBigInt, _      = new(big.Int).SetString("21778071482940061661655974875633165533184", 10)
 	Uint64MaxValueFr              = new(fr.Element).SetBigInt(Uint64MaxValueBigInt)
 	Uint64MaxValueFrSquare        = new(fr.Element).SetBigInt(Uint64MaxValueBigIntSquare)
+	Uint64MaxValueFrCube          = new(fr.Element).SetBigInt(Uint64MaxValueBigIntCube)
 	Uint8MaxValueFr               = new(fr.Element).SetBigInt(Uint8MaxValueBigInt)
 	Uint16MaxValueFr 			  = new(fr.Element).SetBigInt(Uint16MaxValueBigInt)
 	Uint126MaxValueFr             = new(fr.Element).SetBigInt(Uint126MaxValueBigInt)
@@ -39,6 +59,9 @@ var (
 	MaxTierBoundaryValueFr		  = new(fr.Element).SetBigInt(MaxTierBoundaryValue)
 	PercentageMultiplierFr     	  = new(fr.Element).SetBigInt(PercentageMultiplier)
 
+	// AssetTypeForTwoDigits are the assets with 2 amount decimals and 14 price
+	// decimals when cex_assets_info.csv has no amount_decimals and
+	// price_decimals columns
 	AssetTypeForTwoDigits         = map[string]bool{
 		"BTTC":  true,
 		"bttc":  true,
@@ -85,15 +108,16 @@ var (
 	}
 	// the key is the number of assets user own
 	// the value is the number of batch create user ops
-	BatchCreateUserOpsCountsTiers = map[int]int {
+	// the tiers can be replaced by a tier manifest file, see TierManifest
+	defaultBatchCreateUserOpsCountsTiers = map[int]int {
 		500: 92,
 		50: 700,
 	}
+	BatchCreateUserOpsCountsTiers = make(map[int]int)
 	AssetCountsTiers = make([]int, 0)
 
 	// one Fr element is 252 bits, it contains 16 16-bit elements at most
 	PowersOfSixteenBits           [15]fr.Element
-	MaxExecutionTimeHint         = hints.New("MAX_EXECUTION_TIME(10000)")
 )
 
 func init() {
@@ -102,7 +126,8 @@ func init() {
 		PowersOfSixteenBits[i].SetBigInt(initValue)
 		initValue.Mul(initValue, big.NewInt(65536))
 	}
-	for k := range BatchCreateUserOpsCountsTiers {
+	for k, v := range defaultBatchCreateUserOpsCountsTiers {
+		BatchCreateUserOpsCountsTiers[k] = v
 		AssetCountsTiers = append(AssetCountsTiers, k)
 	}
 	sort.Ints(AssetCountsTiers)
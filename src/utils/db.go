@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+	gormmysql "gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/hints"
+)
+
+// the database drivers of the witness, proof and user proof tables
+const (
+	DbDriverMysql    = "mysql"
+	DbDriverPostgres = "postgres"
+	DbDriverSqlite   = "sqlite"
+)
+
+// MaxExecutionTimeHint limits the execution time of a select on mysql, the
+// other drivers have no per query hint and leave it out
+var MaxExecutionTimeHint = mysqlHint{hints.New("MAX_EXECUTION_TIME(10000)")}
+
+// mysqlHint is an optimizer hint which is only applied on mysql
+type mysqlHint struct {
+	hints.Hints
+}
+
+func (h mysqlHint) ModifyStatement(stmt *gorm.Statement) {
+	if stmt.DB.Dialector.Name() == DbDriverMysql {
+		h.Hints.ModifyStatement(stmt)
+	}
+}
+
+// OpenDB opens the database of the driver, an empty driver means mysql. The
+// data source of sqlite is the database file, the busy timeout and WAL
+// journal are turned on unless it has options, because the prover renews
+// leases while it writes proofs.
+func OpenDB(driver string, dataSource string, opts ...gorm.Option) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case "", DbDriverMysql:
+		dialector = gormmysql.Open(dataSource)
+	case DbDriverPostgres:
+		dialector = postgres.Open(dataSource)
+	case DbDriverSqlite:
+		if !strings.Contains(dataSource, "?") {
+			dataSource += "?_busy_timeout=10000&_journal_mode=WAL"
+		}
+		dialector = sqlite.Open(dataSource)
+	default:
+		return nil, fmt.Errorf("unknown db driver %s, it must be mysql, postgres or sqlite", driver)
+	}
+	return gorm.Open(dialector, opts...)
+}
+
+// ConvertDbErr maps the timeout and interruption errors of every driver to
+// DbErrQueryTimeout and DbErrQueryInterrupted, which the callers retry. The
+// other errors are returned as they are.
+func ConvertDbErr(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_QUERY_INTERRUPTED and ER_QUERY_TIMEOUT
+		if mysqlErr.Number == 1317 {
+			return DbErrQueryInterrupted
+		}
+		if mysqlErr.Number == 3024 {
+			return DbErrQueryTimeout
+		}
+		return err
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// query_canceled is raised by statement_timeout, admin_shutdown by a terminated backend
+		if pgErr.Code == "57014" {
+			return DbErrQueryTimeout
+		}
+		if pgErr.Code == "57P01" {
+			return DbErrQueryInterrupted
+		}
+		return err
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		// the database stays locked by another connection after the busy timeout
+		if sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked {
+			return DbErrQueryTimeout
+		}
+		if sqliteErr.Code == sqlite3.ErrInterrupt {
+			return DbErrQueryInterrupted
+		}
+	}
+	return err
+}
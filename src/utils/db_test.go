@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+	gormmysql "gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMaxExecutionTimeHint(t *testing.T) {
+	mysqlDB, err := gorm.Open(gormmysql.New(gormmysql.Config{DSN: "zkpos:zkpos@tcp(127.0.0.1:3306)/zkpos", SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteDB, err := OpenDB(DbDriverSqlite, filepath.Join(t.TempDir(), "por.db"), &gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var heights []int64
+	stmt := mysqlDB.Clauses(MaxExecutionTimeHint).Table("witness").Select("height").Find(&heights).Statement
+	if !strings.Contains(stmt.SQL.String(), "MAX_EXECUTION_TIME(10000)") {
+		t.Errorf("the hint is left out on mysql: %s", stmt.SQL.String())
+	}
+	stmt = sqliteDB.Clauses(MaxExecutionTimeHint).Table("witness").Select("height").Find(&heights).Statement
+	if strings.Contains(stmt.SQL.String(), "MAX_EXECUTION_TIME") {
+		t.Errorf("the hint is applied on sqlite: %s", stmt.SQL.String())
+	}
+}
+
+func TestOpenDBUnknownDriver(t *testing.T) {
+	_, err := OpenDB("oracle", "")
+	if err == nil {
+		t.Fatal("expected unknown driver error")
+	}
+}
+
+func TestConvertDbErr(t *testing.T) {
+	other := errors.New("other")
+	cases := []struct {
+		err    error
+		expect error
+	}{
+		{&mysql.MySQLError{Number: 1317}, DbErrQueryInterrupted},
+		{&mysql.MySQLError{Number: 3024}, DbErrQueryTimeout},
+		{fmt.Errorf("select: %w", &mysql.MySQLError{Number: 3024}), DbErrQueryTimeout},
+		{&pgconn.PgError{Code: "57014"}, DbErrQueryTimeout},
+		{&pgconn.PgError{Code: "57P01"}, DbErrQueryInterrupted},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, DbErrQueryTimeout},
+		{sqlite3.Error{Code: sqlite3.ErrInterrupt}, DbErrQueryInterrupted},
+		{other, other},
+	}
+	for _, c := range cases {
+		if got := ConvertDbErr(c.err); got != c.expect {
+			t.Errorf("%v: expected %v, got %v", c.err, c.expect, got)
+		}
+	}
+	pgErr := &pgconn.PgError{Code: "23505"}
+	if got := ConvertDbErr(pgErr); got != pgErr {
+		t.Errorf("expected the unique violation as it is, got %v", got)
+	}
+}
@@ -1,10 +1,153 @@
 package utils
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
 
 var (
 	DbErrSqlOperation  = errors.New("unknown sql operation error")
 	DbErrNotFound      = errors.New("sql: no rows in result set")
 	DbErrQueryTimeout  = errors.New("sql: query timeout")
 	DbErrQueryInterrupted = errors.New("sql: query interrupted")
+
+	ErrTierManifestMismatch = errors.New("tier manifest mismatch")
+	ErrTierManifestActive   = errors.New("another tier manifest is active in the process")
+	ErrNoTask               = errors.New("there is no task left in task queue")
+	ErrLeaseLost            = errors.New("the witness lease is held by another prover")
+	ErrBalanceOverflow      = errors.New("overflow for balance")
+	ErrNoUserFile           = errors.New("there is no user file")
+	ErrUnsupportedSchemaVersion = errors.New("unsupported user file schema version")
+	ErrPrecisionLoss        = errors.New("precision loss is rejected")
 )
+
+// the errors of the user data files, Row is the line number in File
+
+// ErrUserFileHeader means a column of the header of a user file doesn't
+// match the schema or cex_assets_info.csv
+type ErrUserFileHeader struct {
+	File          string
+	SchemaVersion int
+	Column        string
+	// Reason is unknown column, duplicate column, missing column or the asset which isn't in cex_assets_info.csv
+	Reason string
+}
+
+func (e *ErrUserFileHeader) Error() string {
+	return fmt.Sprintf("%s: header of schema version %d: column %s: %s", e.File, e.SchemaVersion, e.Column, e.Reason)
+}
+
+// ErrInvalidAccountId means the account id isn't 32 bytes in hex
+type ErrInvalidAccountId struct {
+	File      string
+	Row       int
+	AccountId string
+}
+
+func (e *ErrInvalidAccountId) Error() string {
+	return fmt.Sprintf("%s:%d: account id %q is invalid", e.File, e.Row, e.AccountId)
+}
+
+// ErrInvalidAssetValue means a balance of the asset can't be parsed
+type ErrInvalidAssetValue struct {
+	File      string
+	Row       int
+	AccountId string
+	Symbol    string
+	// Field is equity, debt, loan, margin or portfolio margin
+	Field string
+	Err   error
+}
+
+func (e *ErrInvalidAssetValue) Error() string {
+	return fmt.Sprintf("%s:%d: account %s %s %s data wrong: %s", e.File, e.Row, e.AccountId, e.Symbol, e.Field, e.Err.Error())
+}
+
+func (e *ErrInvalidAssetValue) Unwrap() error {
+	return e.Err
+}
+
+// ErrCollateralExceedsEquity means the loan, margin and portfolio margin of the asset sum to more than its equity
+type ErrCollateralExceedsEquity struct {
+	File       string
+	Row        int
+	AccountId  string
+	Symbol     string
+	Collateral uint64
+	Equity     uint64
+}
+
+func (e *ErrCollateralExceedsEquity) Error() string {
+	return fmt.Sprintf("%s:%d: account %s %s total collateral %d is bigger than equity %d", e.File, e.Row, e.AccountId, e.Symbol, e.Collateral, e.Equity)
+}
+
+// ErrDebtExceedsCollateral means the total debt of the account is bigger than its total collateral
+type ErrDebtExceedsCollateral struct {
+	File       string
+	Row        int
+	AccountId  string
+	Debt       *big.Int
+	Collateral *big.Int
+}
+
+func (e *ErrDebtExceedsCollateral) Error() string {
+	return fmt.Sprintf("%s:%d: account %s total debt %s is bigger than collateral %s", e.File, e.Row, e.AccountId, e.Debt.String(), e.Collateral.String())
+}
+
+// ErrAboveLargestTier means the account has more assets than the largest assets count tier
+type ErrAboveLargestTier struct {
+	File        string
+	Row         int
+	AccountId   string
+	Assets      int
+	LargestTier int
+}
+
+func (e *ErrAboveLargestTier) Error() string {
+	return fmt.Sprintf("%s:%d: account %s has %d assets, more than the largest tier %d", e.File, e.Row, e.AccountId, e.Assets, e.LargestTier)
+}
+
+// ErrInvalidAccounts collects the errors of the invalid rows, the valid
+// accounts are still returned with it. errors.As finds the error of every row.
+type ErrInvalidAccounts struct {
+	Errors []error
+}
+
+func (e *ErrInvalidAccounts) Error() string {
+	msgs := make([]string, 0, 3)
+	for i := 0; i < len(e.Errors) && i < 3; i++ {
+		msgs = append(msgs, e.Errors[i].Error())
+	}
+	if len(e.Errors) > 3 {
+		msgs = append(msgs, "...")
+	}
+	return fmt.Sprintf("%d invalid accounts: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *ErrInvalidAccounts) Unwrap() []error {
+	return e.Errors
+}
+
+// ErrTooManyAssets means the user has more assets than the biggest tier
+type ErrTooManyAssets struct {
+	Assets       int
+	TargetCounts int
+}
+
+func (e *ErrTooManyAssets) Error() string {
+	return fmt.Sprintf("the user has %d assets, which is more than the assets count tier %d", e.Assets, e.TargetCounts)
+}
+
+// ErrCommitmentMismatch means the commitment recomputed from a witness isn't the recorded one
+type ErrCommitmentMismatch struct {
+	// Name is the commitment, e.g. after cex assets commitment
+	Name     string
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *ErrCommitmentMismatch) Error() string {
+	return fmt.Sprintf("%s verify failed: expected %x, actual %x", e.Name, e.Expected, e.Actual)
+}
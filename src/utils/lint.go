@@ -0,0 +1,368 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/bnb-chain/zkbnb-smt/database/leveldb"
+)
+
+// the kinds of the issues of a lint report
+const (
+	LintHeaderMismatch          = "header_mismatch"
+	LintMalformedRow            = "malformed_row"
+	LintInvalidAccountId        = "invalid_account_id"
+	LintDuplicateAccountId      = "duplicate_account_id"
+	LintInvalidValue            = "invalid_value"
+	LintOverflow                = "overflow"
+	LintPrecisionLoss           = "precision_loss"
+	LintCollateralExceedsEquity = "collateral_exceeds_equity"
+	LintDebtExceedsCollateral   = "debt_exceeds_collateral"
+	LintAboveLargestTier        = "above_largest_tier"
+)
+
+// LintMaxIssuesPerKind is the number of issues and warnings of a kind the
+// report keeps, the counts have all of them
+const LintMaxIssuesPerKind = 1000
+
+// LintIssue is a problem of the dataset, Row is the line number in File
+type LintIssue struct {
+	Kind      string
+	File      string `json:",omitempty"`
+	Row       int    `json:",omitempty"`
+	AccountId string `json:",omitempty"`
+	Symbol    string `json:",omitempty"`
+	Message   string
+}
+
+// LintFile is the summary of a user file
+type LintFile struct {
+	Name          string
+	SchemaVersion int
+	Rows          int
+	ValidAccounts int
+}
+
+// LintReport is the result of LintUserDataSet
+type LintReport struct {
+	Dataset string
+	Files   []LintFile
+	// ValidAccounts are the accounts the witness service would create
+	ValidAccounts int
+	// IssueCounts is the number of issues of every kind, Issues are the first
+	// LintMaxIssuesPerKind of them
+	IssueCounts map[string]int
+	Issues      []LintIssue
+	// Warnings are the amounts the rounding policy rounds instead of rejecting,
+	// they don't fail the lint
+	WarningCounts map[string]int
+	Warnings      []LintIssue
+	// Rounding are the assets of which the rounding policy changed the
+	// amounts of the valid accounts
+	RoundingPolicy RoundingPolicy
+	Rounding       []AssetRounding
+}
+
+// Passed reports whether the dataset has no issue
+func (r *LintReport) Passed() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *LintReport) WriteJSON(name string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(content, '\n'), 0644)
+}
+
+// WriteCSV writes the issues and then the warnings, one row per issue
+func (r *LintReport) WriteCSV(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"kind", "file", "row", "account_id", "symbol", "message", "severity"})
+	for severity, issues := range [][]LintIssue{r.Issues, r.Warnings} {
+		for _, issue := range issues {
+			row := ""
+			if issue.Row > 0 {
+				row = strconv.Itoa(issue.Row)
+			}
+			w.Write([]string{issue.Kind, issue.File, row, issue.AccountId, issue.Symbol, issue.Message, []string{"error", "warning"}[severity]})
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type datasetLinter struct {
+	report        *LintReport
+	cexAssetsInfo []CexAssetInfo
+	fileNames     []string
+	// accountRows finds the duplicate ids, it is a temporary leveldb of the
+	// file index and row where every account id is first seen, so the memory
+	// doesn't grow with the accounts
+	accountRows database.TreeDB
+	// totals are the sums of the equity, debt, loan, margin and portfolio margin of every asset
+	totals [][5]*big.Int
+	// dropped are the amounts the rounding dropped from the valid accounts
+	dropped roundingTotals
+}
+
+// LintUserDataSet checks every row of the user files of dirname without
+// stopping at the first problem: the headers, the account ids, duplicate ids
+// across files, the balances, their precision, the collateral of the accounts,
+// the assets count tiers and the overflow of the cex asset totals. The tiers
+// must be applied before. An error is returned only if the dataset can't be
+// read, its problems are the issues of the report.
+func LintUserDataSet(ctx context.Context, dirname string) (*LintReport, error) {
+	userFileNames, cexAssetsInfo, err := parseUserDataSetHeader(dirname)
+	if err != nil {
+		return nil, err
+	}
+	accountRowsDir, err := os.MkdirTemp("", "lint-account-ids-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(accountRowsDir)
+	accountRows, err := leveldb.New(accountRowsDir, LevelDBCacheSize, LevelDBHandles, false)
+	if err != nil {
+		return nil, fmt.Errorf("open leveldb %s failed: %s", accountRowsDir, err.Error())
+	}
+	defer accountRows.Close()
+	l := &datasetLinter{
+		report: &LintReport{
+			Dataset:        dirname,
+			IssueCounts:    make(map[string]int),
+			WarningCounts:  make(map[string]int),
+			RoundingPolicy: AmountRounding,
+		},
+		cexAssetsInfo: cexAssetsInfo,
+		fileNames:     userFileNames,
+		accountRows:   accountRows,
+		totals:        make([][5]*big.Int, len(cexAssetsInfo)),
+		dropped:       newRoundingTotals(len(cexAssetsInfo)),
+	}
+	for i := range l.totals {
+		for p := range l.totals[i] {
+			l.totals[i][p] = new(big.Int)
+		}
+	}
+	for i, name := range userFileNames {
+		err = l.lintFile(ctx, i, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.lintTotals()
+	l.report.Rounding = l.dropped.assets(cexAssetsInfo)
+	return l.report, nil
+}
+
+func (l *datasetLinter) addIssue(issue LintIssue) {
+	l.report.IssueCounts[issue.Kind]++
+	if l.report.IssueCounts[issue.Kind] <= LintMaxIssuesPerKind {
+		l.report.Issues = append(l.report.Issues, issue)
+	}
+}
+
+func (l *datasetLinter) addWarning(issue LintIssue) {
+	l.report.WarningCounts[issue.Kind]++
+	if l.report.WarningCounts[issue.Kind] <= LintMaxIssuesPerKind {
+		l.report.Warnings = append(l.report.Warnings, issue)
+	}
+}
+
+func (l *datasetLinter) lintFile(ctx context.Context, fileIndex int, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<20)
+	summary := LintFile{Name: name}
+	defer func() {
+		l.report.Files = append(l.report.Files, summary)
+	}()
+	schemaVersion, declared, err := readUserFileSchemaVersion(name, r)
+	if err != nil {
+		l.addIssue(LintIssue{Kind: LintHeaderMismatch, File: name, Row: 1, Message: err.Error()})
+		return nil
+	}
+	summary.SchemaVersion = schemaVersion
+	csvReader := csv.NewReader(r)
+	csvReader.ReuseRecord = true
+	header, err := csvReader.Read()
+	if err != nil {
+		l.addIssue(LintIssue{Kind: LintHeaderMismatch, File: name, Message: fmt.Sprintf("read header failed: %s", err.Error())})
+		return nil
+	}
+	columns, err := ParseUserFileHeader(name, schemaVersion, header, l.cexAssetsInfo)
+	if err != nil {
+		// the rows can't be mapped to the assets
+		var headerErr *ErrUserFileHeader
+		for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+			if errors.As(e, &headerErr) {
+				l.addIssue(LintIssue{Kind: LintHeaderMismatch, File: name, Message: fmt.Sprintf("column %s: %s", headerErr.Column, headerErr.Reason)})
+			}
+		}
+		return nil
+	}
+	row := 2
+	if declared {
+		row = 3
+	}
+	for ; ; row++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		summary.Rows++
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			l.addIssue(LintIssue{Kind: LintMalformedRow, File: name, Row: row, Message: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		valid, err := l.lintRow(fileIndex, name, row, record, columns)
+		if err != nil {
+			return err
+		}
+		if valid {
+			summary.ValidAccounts++
+			l.report.ValidAccounts++
+		}
+	}
+	return nil
+}
+
+// lintRow reports the issues of the row and whether its account is valid
+func (l *datasetLinter) lintRow(fileIndex int, name string, row int, record []string, columns *UserFileColumns) (bool, error) {
+	id := record[columns.Id]
+	for j, assetColumns := range columns.Assets {
+		multiplier := amountMultiplier(&l.cexAssetsInfo[j])
+		for p, column := range assetColumns {
+			mode := AmountRounding.fieldMode(p)
+			// the rejected amounts make the row invalid, parseUserRow reports them
+			if mode == RoundingReject || !HasPrecisionLoss(record[column], multiplier) {
+				continue
+			}
+			// the invalid amounts are issues of parseUserRow
+			if _, _, err := ConvertAmountStrToUint64(record[column], multiplier, mode); err != nil {
+				continue
+			}
+			l.addWarning(LintIssue{Kind: LintPrecisionLoss, File: name, Row: row, AccountId: id, Symbol: l.cexAssetsInfo[j].Symbol,
+				Message: fmt.Sprintf("%s %s has more decimals than the multiplier %d keeps, it is rounded %s", userFileAssetFields[p].field, record[column], multiplier, mode)})
+		}
+	}
+	account, dropped, err := parseUserRow(name, row, record, columns, l.cexAssetsInfo)
+	if err != nil {
+		l.addIssue(lintIssueOf(err))
+		return false, nil
+	}
+	first, err := l.accountRows.Get(account.AccountId)
+	if err == nil {
+		l.addIssue(LintIssue{Kind: LintDuplicateAccountId, File: name, Row: row, AccountId: id,
+			Message: fmt.Sprintf("account id is also at %s:%d", l.fileNames[binary.BigEndian.Uint32(first)], binary.BigEndian.Uint32(first[4:]))})
+		return false, nil
+	}
+	if !errors.Is(err, database.ErrDatabaseNotFound) {
+		return false, fmt.Errorf("get account id failed: %s", err.Error())
+	}
+	err = l.accountRows.Set(account.AccountId, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(fileIndex)), uint32(row)))
+	if err != nil {
+		return false, fmt.Errorf("set account id failed: %s", err.Error())
+	}
+	l.dropped.add(dropped)
+	for _, asset := range account.Assets {
+		values := [5]uint64{asset.Equity, asset.Debt, asset.Loan, asset.Margin, asset.PortfolioMargin}
+		for p, v := range values {
+			l.totals[asset.Index][p].Add(l.totals[asset.Index][p], new(big.Int).SetUint64(v))
+		}
+	}
+	return true, nil
+}
+
+// lintTotals reports the cex asset totals the witness can't sum up in uint64
+func (l *datasetLinter) lintTotals() {
+	for j := range l.totals {
+		for p, total := range l.totals[j] {
+			if !total.IsUint64() {
+				l.addIssue(LintIssue{Kind: LintOverflow, Symbol: l.cexAssetsInfo[j].Symbol,
+					Message: fmt.Sprintf("total %s %s of the valid accounts overflows uint64", userFileAssetFields[p].field, total.String())})
+			}
+		}
+	}
+}
+
+// lintIssueOf converts the error of an invalid row to an issue
+func lintIssueOf(err error) LintIssue {
+	issue := LintIssue{Message: err.Error()}
+	switch e := err.(type) {
+	case *ErrInvalidAccountId:
+		issue.Kind, issue.File, issue.Row, issue.AccountId = LintInvalidAccountId, e.File, e.Row, e.AccountId
+	case *ErrInvalidAssetValue:
+		issue.Kind, issue.File, issue.Row, issue.AccountId, issue.Symbol = LintInvalidValue, e.File, e.Row, e.AccountId, e.Symbol
+		if errors.Is(e.Err, ErrBalanceOverflow) {
+			issue.Kind = LintOverflow
+		}
+		if errors.Is(e.Err, ErrPrecisionLoss) {
+			issue.Kind = LintPrecisionLoss
+		}
+	case *ErrCollateralExceedsEquity:
+		issue.Kind, issue.File, issue.Row, issue.AccountId, issue.Symbol = LintCollateralExceedsEquity, e.File, e.Row, e.AccountId, e.Symbol
+	case *ErrDebtExceedsCollateral:
+		issue.Kind, issue.File, issue.Row, issue.AccountId = LintDebtExceedsCollateral, e.File, e.Row, e.AccountId
+	case *ErrAboveLargestTier:
+		issue.Kind, issue.File, issue.Row, issue.AccountId = LintAboveLargestTier, e.File, e.Row, e.AccountId
+	default:
+		issue.Kind = LintInvalidValue
+	}
+	// the message has the position already
+	if issue.File != "" {
+		issue.Message = strings.TrimPrefix(issue.Message, fmt.Sprintf("%s:%d: ", issue.File, issue.Row))
+	}
+	return issue
+}
+
+// SortedIssueKinds returns the kinds of the issues of the report in name order
+func (r *LintReport) SortedIssueKinds() []string {
+	return sortedKinds(r.IssueCounts)
+}
+
+// SortedWarningKinds returns the kinds of the warnings of the report in name order
+func (r *LintReport) SortedWarningKinds() []string {
+	return sortedKinds(r.WarningCounts)
+}
+
+func sortedKinds(counts map[string]int) []string {
+	kinds := make([]string, 0, len(counts))
+	for k := range counts {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
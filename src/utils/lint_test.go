@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintUserDataSet(t *testing.T) {
+	report, err := LintUserDataSet(context.Background(), "../sampledata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ValidAccounts != 170 || len(report.Issues) != 30 || report.Passed() {
+		t.Errorf("expected 170 accounts and 30 issues, got %d and %d", report.ValidAccounts, len(report.Issues))
+	}
+	if report.IssueCounts[LintCollateralExceedsEquity] != 15 || report.IssueCounts[LintDebtExceedsCollateral] != 15 {
+		t.Errorf("unexpected issue counts %v", report.IssueCounts)
+	}
+
+	dir := t.TempDir()
+	cexAssetsInfo, err := os.ReadFile("../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, CexAssetsInfoFile), cexAssetsInfo, 0644)
+	header := "rn,id,e_btc,d_btc,btc,vl_btc,m_btc,pm_btc,e_eth,d_eth,eth,vl_eth,m_eth,pm_eth,e_bnb,d_bnb,bnb,vl_bnb,m_bnb,pm_bnb,e_shib,d_shib,shib,vl_shib,m_shib,pm_shib,total_net_balance_usdt"
+	row := func(id string, btcEquity string) string {
+		return "0," + id + "," + btcEquity + strings.Repeat(",0", 24)
+	}
+	id := strings.Repeat("0", 63)
+	users0 := strings.Join([]string{header,
+		row(id+"1", "1"),
+		row(id+"2", "1.000000001"),
+		row("xyz", "1"),
+		row(id+"3", "-1"),
+		"0," + id + "4,1",
+	}, "\n") + "\n"
+	users1 := strings.Join([]string{header,
+		row(id+"1", "2"),
+		row(id+"5", "100000000000"),
+		row(id+"6", "100000000000"),
+	}, "\n") + "\n"
+	os.WriteFile(filepath.Join(dir, "users0.csv"), []byte(users0), 0644)
+	os.WriteFile(filepath.Join(dir, "users1.csv"), []byte(users1), 0644)
+	os.WriteFile(filepath.Join(dir, "users2.csv"), []byte("id,e_doge\n"+id+"7,1\n"), 0644)
+
+	report, err = LintUserDataSet(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the equity is rounded up, so the precision loss doesn't fail the lint
+	precisionLoss := LintIssue{Kind: LintPrecisionLoss, File: filepath.Join(dir, "users0.csv"), Row: 3, AccountId: id + "2", Symbol: "btc"}
+	if len(report.Warnings) != 1 || report.WarningCounts[LintPrecisionLoss] != 1 || report.IssueCounts[LintPrecisionLoss] != 0 {
+		t.Fatalf("expected the precision loss warning, got %v", report.Warnings)
+	}
+	if warning := report.Warnings[0]; warning.Message == "" {
+		t.Errorf("expected the message of the warning")
+	} else if warning.Message = ""; warning != precisionLoss {
+		t.Errorf("expected warning %v, got %v", precisionLoss, report.Warnings[0])
+	}
+	expected := []LintIssue{
+		{Kind: LintInvalidAccountId, File: filepath.Join(dir, "users0.csv"), Row: 4, AccountId: "xyz"},
+		{Kind: LintInvalidValue, File: filepath.Join(dir, "users0.csv"), Row: 5, AccountId: id + "3", Symbol: "btc"},
+		{Kind: LintMalformedRow, File: filepath.Join(dir, "users0.csv"), Row: 6},
+		{Kind: LintDuplicateAccountId, File: filepath.Join(dir, "users1.csv"), Row: 2, AccountId: id + "1"},
+	}
+	if len(report.Issues) < len(expected) {
+		t.Fatalf("expected at least %d issues, got %v", len(expected), report.Issues)
+	}
+	for i, e := range expected {
+		issue := report.Issues[i]
+		issue.Message = ""
+		if issue != e {
+			t.Errorf("expected issue %v, got %v", e, report.Issues[i])
+		}
+	}
+	if !strings.Contains(report.Issues[3].Message, filepath.Join(dir, "users0.csv")+":2") {
+		t.Errorf("expected the first row of the duplicate id, got %s", report.Issues[3].Message)
+	}
+	// 2 * 100000000000 btc overflows the total equity in uint64
+	if report.IssueCounts[LintOverflow] != 1 || report.IssueCounts[LintHeaderMismatch] != 21 {
+		t.Errorf("unexpected issue counts %v", report.IssueCounts)
+	}
+	if report.ValidAccounts != 4 || len(report.Files) != 3 || report.Files[2].Rows != 0 {
+		t.Errorf("unexpected summary %v", report.Files)
+	}
+
+	name := filepath.Join(dir, "report.json")
+	err = report.WriteJSON(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded LintReport
+	content, _ := os.ReadFile(name)
+	if err = json.Unmarshal(content, &decoded); err != nil || len(decoded.Issues) != len(report.Issues) {
+		t.Errorf("unexpected json report %v", err)
+	}
+	name = filepath.Join(dir, "report.csv")
+	err = report.WriteCSV(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := os.Open(name)
+	records, err := csv.NewReader(f).ReadAll()
+	f.Close()
+	if err != nil || len(records) != len(report.Issues)+2 || records[1][0] != LintInvalidAccountId || records[1][2] != "4" ||
+		records[len(records)-1][0] != LintPrecisionLoss || records[len(records)-1][6] != "warning" {
+		t.Errorf("unexpected csv report %v %v", err, records)
+	}
+}
+
+func TestLintMaxIssuesPerKind(t *testing.T) {
+	dir := t.TempDir()
+	cexAssetsInfo, err := os.ReadFile("../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, CexAssetsInfoFile), cexAssetsInfo, 0644)
+	// one valid account and its duplicates
+	id := strings.Repeat("0", 63) + "1"
+	header := "id,e_btc,d_btc,vl_btc,m_btc,pm_btc,e_eth,d_eth,vl_eth,m_eth,pm_eth,e_bnb,d_bnb,vl_bnb,m_bnb,pm_bnb,e_shib,d_shib,vl_shib,m_shib,pm_shib\n"
+	users := header + strings.Repeat(id+",1"+strings.Repeat(",0", 19)+"\n", LintMaxIssuesPerKind+11)
+	os.WriteFile(filepath.Join(dir, "users.csv"), []byte(users), 0644)
+
+	report, err := LintUserDataSet(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ValidAccounts != 1 || report.IssueCounts[LintDuplicateAccountId] != LintMaxIssuesPerKind+10 ||
+		len(report.Issues) != LintMaxIssuesPerKind || report.Passed() {
+		t.Errorf("unexpected report of %d accounts, %d issues and counts %v", report.ValidAccounts, len(report.Issues), report.IssueCounts)
+	}
+	if last := report.Issues[len(report.Issues)-1]; last.Row != LintMaxIssuesPerKind+2 {
+		t.Errorf("expected the first issues, the last one is at row %d", last.Row)
+	}
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	gnarklogger "github.com/consensys/gnark/logger"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm/logger"
+)
+
+// the fields shared by the logs of all the services, filter a run by them,
+// e.g. jq 'select(.height == 1024)' with the json format
+const (
+	LogKeyService      = "service"
+	LogKeyDbSuffix     = "db_suffix"
+	LogKeyHeight       = "height"
+	LogKeyAccountIndex = "account_index"
+	LogKeyAssetsCount  = "assets_count"
+)
+
+// LogConfig is the logging config of a service
+type LogConfig struct {
+	// Level is debug, info (default), warn or error
+	Level string
+	// Format is text (default) or json
+	Format string
+}
+
+// InitLogger makes the logger of the config the default slog logger of the
+// service, every log carries the service name and the db suffix. The logs of
+// gnark go to the same logger.
+func InitLogger(service string, dbSuffix string, config LogConfig) error {
+	handler, err := newLogHandler(os.Stdout, config)
+	if err != nil {
+		return err
+	}
+	l := slog.New(handler).With(LogKeyService, service)
+	if dbSuffix != "" {
+		l = l.With(LogKeyDbSuffix, dbSuffix)
+	}
+	slog.SetDefault(l)
+	level, _ := parseLogLevel(config.Level)
+	setGnarkLogger(level)
+	return nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %s, it must be debug, info, warn or error", level)
+}
+
+func newLogHandler(w io.Writer, config LogConfig) (slog.Handler, error) {
+	level, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %s, it must be text or json", config.Format)
+	}
+}
+
+// setGnarkLogger makes gnark log to the default slog logger at level, gnark
+// logs to stdout in the zerolog console format otherwise
+func setGnarkLogger(level slog.Level) {
+	zerologLevel := zerolog.InfoLevel
+	switch {
+	case level <= slog.LevelDebug:
+		zerologLevel = zerolog.DebugLevel
+	case level >= slog.LevelError:
+		zerologLevel = zerolog.ErrorLevel
+	case level >= slog.LevelWarn:
+		zerologLevel = zerolog.WarnLevel
+	}
+	gnarklogger.Set(zerolog.New(gnarkLogWriter{}).Level(zerologLevel))
+}
+
+// gnarkLogWriter writes the json events of the gnark zerolog logger to the
+// default slog logger
+type gnarkLogWriter struct{}
+
+func (gnarkLogWriter) Write(p []byte) (int, error) {
+	var event map[string]interface{}
+	err := json.Unmarshal(p, &event)
+	if err != nil {
+		slog.Info(strings.TrimSpace(string(p)), "component", "gnark")
+		return len(p), nil
+	}
+	level := slog.LevelInfo
+	switch event[zerolog.LevelFieldName] {
+	case zerolog.LevelTraceValue, zerolog.LevelDebugValue:
+		level = slog.LevelDebug
+	case zerolog.LevelWarnValue:
+		level = slog.LevelWarn
+	case zerolog.LevelErrorValue, zerolog.LevelFatalValue, zerolog.LevelPanicValue:
+		level = slog.LevelError
+	}
+	message, _ := event[zerolog.MessageFieldName].(string)
+	delete(event, zerolog.LevelFieldName)
+	delete(event, zerolog.MessageFieldName)
+	keys := make([]string, 0, len(event))
+	for key := range event {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []interface{}{"component", "gnark"}
+	for _, key := range keys {
+		args = append(args, key, event[key])
+	}
+	slog.Log(context.Background(), level, message, args...)
+	return len(p), nil
+}
+
+// gormLogWriter writes the sql statements gorm traces to the default slog logger
+type gormLogWriter struct{}
+
+func (gormLogWriter) Printf(format string, args ...interface{}) {
+	slog.Debug(fmt.Sprintf(format, args...), "component", "gorm")
+}
+
+// NewGormLogger traces every sql statement at the debug level, and nothing at
+// the other levels
+func NewGormLogger() logger.Interface {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return logger.Discard
+	}
+	return logger.New(gormLogWriter{}, logger.Config{
+		SlowThreshold:             60 * time.Second, // Slow SQL threshold
+		LogLevel:                  logger.Info,      // Log level
+		IgnoreRecordNotFoundError: true,             // Ignore ErrRecordNotFound error for logger
+		Colorful:                  false,            // Disable color
+	})
+}
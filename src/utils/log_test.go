@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	gnarklogger "github.com/consensys/gnark/logger"
+)
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, LogConfig{Level: "warn", Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := slog.New(handler).With(LogKeyService, "witness", LogKeyDbSuffix, "0")
+	l.Info("save batch to db", LogKeyHeight, 1)
+	if buf.Len() != 0 {
+		t.Fatalf("info log is written at the warn level: %s", buf.String())
+	}
+	l.Warn("get latest witness timeout, retry", LogKeyHeight, 1024, LogKeyAssetsCount, 50)
+	var record map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]interface{}{
+		LogKeyService:     "witness",
+		LogKeyDbSuffix:    "0",
+		LogKeyHeight:      float64(1024),
+		LogKeyAssetsCount: float64(50),
+		"level":           "WARN",
+	} {
+		if record[key] != value {
+			t.Fatalf("%s is %v, expected %v", key, record[key], value)
+		}
+	}
+
+	for _, config := range []LogConfig{{Level: "trace"}, {Format: "xml"}} {
+		if _, err = newLogHandler(&buf, config); err == nil {
+			t.Errorf("invalid log config %v is accepted", config)
+		}
+	}
+}
+
+func TestGnarkLogger(t *testing.T) {
+	var buf bytes.Buffer
+	// the gnark logger filters the levels itself
+	handler, err := newLogHandler(&buf, LogConfig{Level: "debug", Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+	defer gnarklogger.Disable()
+	slog.SetDefault(slog.New(handler))
+
+	setGnarkLogger(slog.LevelInfo)
+	l := gnarklogger.Logger()
+	l.Debug().Str("backend", "groth16").Msg("verifier done")
+	if buf.Len() != 0 {
+		t.Fatalf("gnark debug log is written at the info level: %s", buf.String())
+	}
+	l.Info().Int("nbConstraints", 10).Msg("constraint system solver done")
+	var record map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]interface{}{
+		"msg":           "constraint system solver done",
+		"level":         "INFO",
+		"component":     "gnark",
+		"nbConstraints": float64(10),
+	} {
+		if record[key] != value {
+			t.Fatalf("%s is %v, expected %v", key, record[key], value)
+		}
+	}
+
+	buf.Reset()
+	setGnarkLogger(slog.LevelDebug)
+	l = gnarklogger.Logger()
+	l.Debug().Msg("verifier done")
+	if !strings.Contains(buf.String(), `"level":"DEBUG"`) {
+		t.Fatalf("gnark debug log isn't written at the debug level: %s", buf.String())
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// the metrics of the witness, prover and userproof services, they are
+// exposed on /metrics if the MetricsAddr of the service is configured
+var (
+	WitnessBatchesGenerated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "por_witness_batches_total",
+		Help: "The number of batch witnesses saved to db.",
+	}, []string{"assets_count"})
+	AccountTreeVersion = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "por_account_tree_version",
+		Help: "The latest committed version of the account tree.",
+	})
+	ProofDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "por_prover_proof_duration_seconds",
+		Help:    "The time to generate a batch proof.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"assets_count"})
+	ProofsGenerated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "por_prover_proofs_total",
+		Help: "The number of batch proofs saved to db.",
+	}, []string{"assets_count"})
+	KeyLoadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "por_prover_key_load_duration_seconds",
+		Help:    "The time to load the r1cs, proving key and verifying key of a tier.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"assets_count"})
+	TaskQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "por_prover_task_queue_depth",
+		Help: "The number of tasks left in the task queue of a tier.",
+	}, []string{"assets_count"})
+	DbRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "por_db_retries_total",
+		Help: "The number of db queries retried after a timeout or interruption.",
+	}, []string{"query"})
+	UserProofsWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "por_userproof_proofs_total",
+		Help: "The number of user proofs saved to db.",
+	})
+)
+
+// ServeMetrics serves the metrics on http://addr/metrics in the background,
+// nothing is served if addr is empty
+func ServeMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			slog.Error("serve metrics failed", "addr", addr, "err", err)
+		}
+	}()
+	slog.Info("serve metrics", "addr", addr)
+}
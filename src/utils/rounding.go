@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/shopspring/decimal"
+)
+
+// RoundingMode is how an amount of the user files with more decimals than its
+// asset keeps is rounded
+type RoundingMode string
+
+const (
+	RoundingUp   RoundingMode = "up"
+	RoundingDown RoundingMode = "down"
+	// RoundingReject makes the row of the amount invalid
+	RoundingReject RoundingMode = "reject"
+)
+
+// RoundingPolicy is the rounding mode of every field of the user files. The
+// default never favours the exchange: the equity, which the exchange owes to
+// the users, is rounded up, and the debt and collateral, which are in its
+// favour, are rounded down.
+type RoundingPolicy struct {
+	Equity RoundingMode `json:",omitempty"`
+	Debt   RoundingMode `json:",omitempty"`
+	// Collateral is the loan, margin and portfolio margin collateral
+	Collateral RoundingMode `json:",omitempty"`
+}
+
+// AmountRounding is the rounding policy the user files are parsed with, it is
+// set by TierManifest.Apply
+var AmountRounding = DefaultRoundingPolicy()
+
+func DefaultRoundingPolicy() RoundingPolicy {
+	return RoundingPolicy{Equity: RoundingUp, Debt: RoundingDown, Collateral: RoundingDown}
+}
+
+// init sets the default mode of the fields without one and checks the others
+func (p *RoundingPolicy) init() error {
+	defaultPolicy := DefaultRoundingPolicy()
+	fields := []struct {
+		name  string
+		mode  *RoundingMode
+		value RoundingMode
+	}{
+		{"equity", &p.Equity, defaultPolicy.Equity},
+		{"debt", &p.Debt, defaultPolicy.Debt},
+		{"collateral", &p.Collateral, defaultPolicy.Collateral},
+	}
+	for _, f := range fields {
+		switch *f.mode {
+		case "":
+			*f.mode = f.value
+		case RoundingUp, RoundingDown, RoundingReject:
+		default:
+			return fmt.Errorf("unknown %s rounding mode %s, it must be up, down or reject", f.name, *f.mode)
+		}
+	}
+	return nil
+}
+
+// fieldMode returns the mode of the field of userFileAssetFields
+func (p RoundingPolicy) fieldMode(field int) RoundingMode {
+	switch field {
+	case 0:
+		return p.Equity
+	case 1:
+		return p.Debt
+	}
+	return p.Collateral
+}
+
+// ConvertAmountStrToUint64 converts an amount of the user files to its
+// integer units like ConvertFloatStrToUint64, the decimals beyond the
+// multiplier are rounded by mode. The amount dropped by the rounding is
+// returned in units of the asset, it is negative if the amount is rounded up.
+func ConvertAmountStrToUint64(f string, multiplier int64, mode RoundingMode) (uint64, decimal.Decimal, error) {
+	if f == "0.0" {
+		return 0, decimal.Zero, nil
+	}
+	exact, err := decimal.NewFromString(f)
+	if err != nil {
+		return 0, decimal.Zero, err
+	}
+	if exact.Sign() < 0 {
+		return 0, decimal.Zero, fmt.Errorf("%s is negative", f)
+	}
+	scaled := exact.Mul(decimal.NewFromInt(multiplier))
+	if !scaled.IsInteger() {
+		switch mode {
+		case RoundingUp:
+			scaled = scaled.Ceil()
+		case RoundingReject:
+			return 0, decimal.Zero, fmt.Errorf("%w: %s has more decimals than the multiplier %d keeps", ErrPrecisionLoss, f, multiplier)
+		default:
+			scaled = scaled.Floor()
+		}
+	}
+	num := scaled.BigInt()
+	if !num.IsUint64() {
+		return 0, decimal.Zero, ErrBalanceOverflow
+	}
+	return num.Uint64(), exact.Sub(scaled.Div(decimal.NewFromInt(multiplier))), nil
+}
+
+// AssetRounding is the total amount the rounding dropped from the valid
+// accounts of an asset, in units of the asset. An amount is negative if the
+// field is rounded up.
+type AssetRounding struct {
+	Symbol     string
+	Equity     string
+	Debt       string
+	Collateral string
+}
+
+// droppedAmount is an amount dropped from a field of an asset of a row
+type droppedAmount struct {
+	asset  int
+	field  int
+	amount decimal.Decimal
+}
+
+// roundingTotals are the amounts dropped from the equity, debt and collateral
+// of every asset
+type roundingTotals [][3]decimal.Decimal
+
+func newRoundingTotals(assetsCount int) roundingTotals {
+	return make(roundingTotals, assetsCount)
+}
+
+func (t roundingTotals) add(dropped []droppedAmount) {
+	for _, d := range dropped {
+		t[d.asset][d.field] = t[d.asset][d.field].Add(d.amount)
+	}
+}
+
+func (t roundingTotals) merge(other roundingTotals) {
+	for j := range other {
+		for p := range other[j] {
+			t[j][p] = t[j][p].Add(other[j][p])
+		}
+	}
+}
+
+// assets returns the amounts dropped from the assets which were rounded
+func (t roundingTotals) assets(cexAssetsInfo []CexAssetInfo) []AssetRounding {
+	var res []AssetRounding
+	for j, dropped := range t {
+		if dropped[0].IsZero() && dropped[1].IsZero() && dropped[2].IsZero() {
+			continue
+		}
+		res = append(res, AssetRounding{
+			Symbol:     cexAssetsInfo[j].Symbol,
+			Equity:     dropped[0].String(),
+			Debt:       dropped[1].String(),
+			Collateral: dropped[2].String(),
+		})
+	}
+	return res
+}
+
+// logRoundings logs the amounts dropped from every asset
+func logRoundings(msg string, roundings []AssetRounding) {
+	for _, r := range roundings {
+		slog.Info(msg, "symbol", r.Symbol, "equity", r.Equity, "debt", r.Debt, "collateral", r.Collateral)
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConvertAmountStrToUint64(t *testing.T) {
+	for _, c := range []struct {
+		f        string
+		mode     RoundingMode
+		expected uint64
+		dropped  string
+	}{
+		{"1.23456789", RoundingUp, 123456789, "0"},
+		{"1.234567891", RoundingUp, 123456790, "-0.000000009"},
+		{"1.234567891", RoundingDown, 123456789, "0.000000001"},
+		{"0.000000001", RoundingDown, 0, "0.000000001"},
+		{"0.0", RoundingReject, 0, "0"},
+	} {
+		v, dropped, err := ConvertAmountStrToUint64(c.f, 100000000, c.mode)
+		if err != nil || v != c.expected || dropped.String() != c.dropped {
+			t.Errorf("%s rounded %s: expected %d dropping %s, got %d dropping %s, %v", c.f, c.mode, c.expected, c.dropped, v, dropped.String(), err)
+		}
+	}
+	_, _, err := ConvertAmountStrToUint64("1.234567891", 100000000, RoundingReject)
+	if !errors.Is(err, ErrPrecisionLoss) {
+		t.Errorf("expected precision loss, got %v", err)
+	}
+	_, _, err = ConvertAmountStrToUint64("-0.000000001", 100000000, RoundingDown)
+	if err == nil {
+		t.Error("expected a negative amount to fail")
+	}
+}
+
+func TestRoundingPolicy(t *testing.T) {
+	defer DefaultTierManifest().Apply()
+	name := writeTierManifestForTest(t, `{"Rounding": {"Debt": "reject"}, "Tiers": [
+		{"AssetsCount": 500, "BatchCreateUserOpsCount": 92},
+		{"AssetsCount": 50,  "BatchCreateUserOpsCount": 700}]}`)
+	m, err := LoadTierManifest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the witness and userproof services refuse the data of another policy
+	if m.Hash == DefaultTierManifest().Hash {
+		t.Error("expected the rounding policy in the hash")
+	}
+	if *m.Rounding != (RoundingPolicy{Equity: RoundingUp, Debt: RoundingReject, Collateral: RoundingDown}) {
+		t.Errorf("unexpected rounding policy %v", *m.Rounding)
+	}
+
+	dir := t.TempDir()
+	cexAssetsInfo, err := os.ReadFile("../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, CexAssetsInfoFile), cexAssetsInfo, 0644)
+	header := "id,e_btc,d_btc,vl_btc,m_btc,pm_btc,e_eth,d_eth,vl_eth,m_eth,pm_eth,e_bnb,d_bnb,vl_bnb,m_bnb,pm_bnb,e_shib,d_shib,vl_shib,m_shib,pm_shib"
+	id := strings.Repeat("0", 63)
+	users := strings.Join([]string{header,
+		id + "1,1.000000001,0,0.500000009,0,0" + strings.Repeat(",0", 10) + ",100.001,0,0,0,0",
+		id + "2,1.000000001,0,0,0,0" + strings.Repeat(",0", 10) + ",100.001,0,0,0,0",
+		id + "3,2,1.000000001,1.5,0,0" + strings.Repeat(",0", 15),
+	}, "\n") + "\n"
+	os.WriteFile(filepath.Join(dir, "users.csv"), []byte(users), 0644)
+
+	m.Apply()
+	report, err := LintUserDataSet(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the debt of the third account is rejected, the rounded amounts are warnings
+	if report.ValidAccounts != 2 || report.IssueCounts[LintPrecisionLoss] != 1 || report.WarningCounts[LintPrecisionLoss] != 5 ||
+		report.RoundingPolicy != *m.Rounding {
+		t.Errorf("unexpected report %v", report)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Row != 4 || report.Issues[0].Symbol != "btc" {
+		t.Errorf("unexpected issues %v", report.Issues)
+	}
+	expected := []AssetRounding{
+		{Symbol: "btc", Equity: "-0.000000018", Debt: "0", Collateral: "0.000000009"},
+		{Symbol: "shib", Equity: "-0.018", Debt: "0", Collateral: "0"},
+	}
+	if !slices.Equal(report.Rounding, expected) {
+		t.Errorf("expected rounding %v, got %v", expected, report.Rounding)
+	}
+
+	// the services sum up the same amounts, the ingested ones are kept in accounts.json
+	_, _, rounded, err := ParseUserDataSetWithRounding(context.Background(), dir)
+	if !slices.Equal(rounded, expected) {
+		t.Errorf("expected parsed rounding %v, got %v: %v", expected, rounded, err)
+	}
+	accountsDir := t.TempDir()
+	_, _, err = IngestUserDataSet(context.Background(), dir, accountsDir)
+	var invalidAccounts *ErrInvalidAccounts
+	if !errors.As(err, &invalidAccounts) {
+		t.Fatalf("expected the invalid account, got %v", err)
+	}
+	accounts, err := OpenAccountsDir(accountsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(accounts.Rounded(), expected) {
+		t.Errorf("expected ingested rounding %v, got %v", expected, accounts.Rounded())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
@@ -15,7 +16,7 @@ func GetSecretFromAws(secretId string) (string, error) {
 	config, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
 
 	if err != nil {
-		panic("Couldn't load config!")
+		return "", fmt.Errorf("load aws config failed: %s", err.Error())
 	}
 	conn := secretsmanager.NewFromConfig(config)
 
@@ -30,7 +31,8 @@ func GetSecretFromAws(secretId string) (string, error) {
 	return *result.SecretString, err
 }
 
-// user name can't include ":"
+// GetMysqlSource replaces the password of the mysql data source with the one
+// of the secret, the user name can't include ":"
 func GetMysqlSource(source string, secretId string) (string, error) {
 	value, err := GetSecretFromAws(secretId)
 	if err != nil {
@@ -40,7 +42,7 @@ func GetMysqlSource(source string, secretId string) (string, error) {
 	var result map[string]string
 	err = json.Unmarshal([]byte(value), &result)
 	if err != nil {
-		panic(err.Error())
+		return "", fmt.Errorf("unmarshal secret failed: %s", err.Error())
 	}
 	passwd := result["pg_password"]
 	aIndex := strings.Index(source, ":")
@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// TierInfo is one tier of the batch create user circuit
+type TierInfo struct {
+	// AssetsCount is the max number of assets a user of the tier owns
+	AssetsCount int
+	// BatchCreateUserOpsCount is the number of users created in one batch
+	BatchCreateUserOpsCount int
+}
+
+// TierManifest is the tier table and circuit parameters shared by keygen,
+// witness, prover, userproof and verifier. Hash is stored alongside witnesses
+// and proofs, so a service started with a different manifest refuses the data
+// of another deployment.
+type TierManifest struct {
+	// AccountTreeDepth, AssetCounts and TierCount are the circuit parameters
+	// of the deployment, zero means the default value
+	AccountTreeDepth int `json:",omitempty"`
+	AssetCounts      int `json:",omitempty"`
+	TierCount        int `json:",omitempty"`
+	Tiers            []TierInfo
+	// Rounding is how the amounts of the user files are rounded, nil means
+	// DefaultRoundingPolicy. The witness and userproof services must round
+	// the same way, so it is part of the hash when it is set.
+	Rounding *RoundingPolicy `json:",omitempty"`
+	// CommitmentFree replaces the commitments of the range checks and lookups
+	// of the groth16 circuits with an in-circuit poseidon hash, so that the keys
+	// can be set up by keygen mpcsetup. The circuits get larger.
+	CommitmentFree bool   `json:",omitempty"`
+	Hash           string `json:"-"`
+}
+
+// DefaultTierManifest returns the manifest of the built-in tiers, which is
+// used when no manifest file is configured
+func DefaultTierManifest() *TierManifest {
+	m := &TierManifest{}
+	for k, v := range defaultBatchCreateUserOpsCountsTiers {
+		m.Tiers = append(m.Tiers, TierInfo{AssetsCount: k, BatchCreateUserOpsCount: v})
+	}
+	err := m.init()
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// LoadTierManifest reads the manifest file, an empty name returns the default manifest
+func LoadTierManifest(name string) (*TierManifest, error) {
+	if name == "" {
+		return DefaultTierManifest(), nil
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read tier manifest failed: %s", err.Error())
+	}
+	m := &TierManifest{}
+	err = json.Unmarshal(content, m)
+	if err != nil {
+		return nil, fmt.Errorf("decode tier manifest failed: %s", err.Error())
+	}
+	err = m.init()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// init sorts and checks the tiers, then computes the content hash. The hash
+// only depends on the parameters and tiers, not on the formatting of the file.
+func (m *TierManifest) init() error {
+	if m.AccountTreeDepth == 0 {
+		m.AccountTreeDepth = DefaultAccountTreeDepth
+	}
+	if m.AssetCounts == 0 {
+		m.AssetCounts = DefaultAssetCounts
+	}
+	if m.TierCount == 0 {
+		m.TierCount = DefaultTierCount
+	}
+	// the account index is uint32 and the tree stores 4 levels in one node
+	if m.AccountTreeDepth < 0 || m.AccountTreeDepth > 32 || m.AccountTreeDepth%4 != 0 {
+		return fmt.Errorf("account tree depth %d must be a multiple of 4 and at most 32", m.AccountTreeDepth)
+	}
+	// the circuit packs an asset index into 16 bits
+	if m.AssetCounts < 0 || m.AssetCounts > 65536 {
+		return fmt.Errorf("assets count %d is out of range (0, 65536]", m.AssetCounts)
+	}
+	// two tier ratios are packed into one field element of the cex assets commitment
+	if m.TierCount < 0 || m.TierCount%2 != 0 {
+		return fmt.Errorf("tier count %d must be a positive even number", m.TierCount)
+	}
+	if len(m.Tiers) == 0 {
+		return fmt.Errorf("tier manifest has no tiers")
+	}
+	sort.Slice(m.Tiers, func(i, j int) bool {
+		return m.Tiers[i].AssetsCount < m.Tiers[j].AssetsCount
+	})
+	for i, t := range m.Tiers {
+		if t.AssetsCount <= 0 || t.AssetsCount > m.AssetCounts {
+			return fmt.Errorf("assets count %d of the tier is out of range (0, %d]", t.AssetsCount, m.AssetCounts)
+		}
+		if t.BatchCreateUserOpsCount <= 0 {
+			return fmt.Errorf("batch create user ops count of %d assets tier must be positive", t.AssetsCount)
+		}
+		if i > 0 && m.Tiers[i-1].AssetsCount == t.AssetsCount {
+			return fmt.Errorf("duplicated tier of %d assets", t.AssetsCount)
+		}
+	}
+	if m.Rounding != nil {
+		err := m.Rounding.init()
+		if err != nil {
+			return err
+		}
+	}
+	canonical, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(canonical)
+	m.Hash = hex.EncodeToString(hash[:])
+	return nil
+}
+
+// Apply makes the manifest the circuit parameters, the tier table of
+// BatchCreateUserOpsCountsTiers and AssetCountsTiers, AmountRounding and
+// CommitmentFreeCircuits
+func (m *TierManifest) Apply() {
+	CommitmentFreeCircuits = m.CommitmentFree
+	AmountRounding = DefaultRoundingPolicy()
+	if m.Rounding != nil {
+		AmountRounding = *m.Rounding
+	}
+	AccountTreeDepth = m.AccountTreeDepth
+	AssetCounts = m.AssetCounts
+	TierCount = m.TierCount
+	BatchCreateUserOpsCountsTiers = make(map[int]int, len(m.Tiers))
+	AssetCountsTiers = make([]int, 0, len(m.Tiers))
+	for _, t := range m.Tiers {
+		BatchCreateUserOpsCountsTiers[t.AssetsCount] = t.BatchCreateUserOpsCount
+		AssetCountsTiers = append(AssetCountsTiers, t.AssetsCount)
+	}
+}
+
+// the manifest held by Activate, the rounds of the process which share it
+// count in activeManifestHolders
+var (
+	activeManifestLock    sync.Mutex
+	activeManifestHash    string
+	activeManifestHolders int
+)
+
+// Activate applies the manifest and holds it until release is called, so that
+// the rounds driven from one process don't mix the parameters of different
+// manifests. The holders of the same manifest share it, ErrTierManifestActive
+// is returned while a manifest of another hash is held. Apply doesn't check
+// the held manifest, it is left to the services of a single manifest.
+func (m *TierManifest) Activate() (release func(), err error) {
+	activeManifestLock.Lock()
+	defer activeManifestLock.Unlock()
+	if activeManifestHolders > 0 && activeManifestHash != m.Hash {
+		return nil, fmt.Errorf("%w: %s is held, %s is requested", ErrTierManifestActive, activeManifestHash, m.Hash)
+	}
+	if activeManifestHolders == 0 {
+		m.Apply()
+		activeManifestHash = m.Hash
+	}
+	activeManifestHolders++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			activeManifestLock.Lock()
+			activeManifestHolders--
+			activeManifestLock.Unlock()
+		})
+	}, nil
+}
+
+// OpsCount returns the batch create user ops count of the tier
+func (m *TierManifest) OpsCount(assetsCount int) (int, bool) {
+	for _, t := range m.Tiers {
+		if t.AssetsCount == assetsCount {
+			return t.BatchCreateUserOpsCount, true
+		}
+	}
+	return 0, false
+}
+
+// ZkKeyNames returns the key names of every tier under dir, in the same order as the tiers
+func (m *TierManifest) ZkKeyNames(dir string) []string {
+	names := make([]string, len(m.Tiers))
+	for i, t := range m.Tiers {
+		names[i] = ZkKeyName(t.AssetsCount, t.BatchCreateUserOpsCount)
+		if dir != "" {
+			names[i] = dir + "/" + names[i]
+		}
+	}
+	return names
+}
+
+// AssetsCountTiers returns the assets count of every tier in ascending order
+func (m *TierManifest) AssetsCountTiers() []int {
+	tiers := make([]int, len(m.Tiers))
+	for i, t := range m.Tiers {
+		tiers[i] = t.AssetsCount
+	}
+	return tiers
+}
+
+// Check returns ErrTierManifestMismatch if the hash stored with a witness or
+// proof isn't the hash of the manifest. Rows written before the manifest was
+// introduced have no hash, they were generated with the default tiers.
+func (m *TierManifest) Check(hash string) error {
+	if hash == "" {
+		hash = DefaultTierManifest().Hash
+	}
+	if hash != m.Hash {
+		return fmt.Errorf("%w: expected %s, got %s", ErrTierManifestMismatch, m.Hash, hash)
+	}
+	return nil
+}
+
+// ZkKeyName is the file name prefix of the keys of a tier
+func ZkKeyName(assetsCount int, opsCount int) string {
+	return "zkpor" + strconv.Itoa(assetsCount) + "_" + strconv.Itoa(opsCount)
+}
+
+// AggregationKeyPrefix is the file name prefix of the aggregation keys of the arity
+func AggregationKeyPrefix(arity int) string {
+	return "zkporagg" + strconv.Itoa(arity)
+}
+
+// AggregationLeafKeyName is the file name prefix of the keys of the leaf
+// aggregation circuit of a tier
+func AggregationLeafKeyName(prefix string, assetsCount int) string {
+	return prefix + "_leaf" + strconv.Itoa(assetsCount)
+}
+
+// AggregationNodeKeyName is the file name prefix of the keys of the node
+// aggregation circuit
+func AggregationNodeKeyName(prefix string) string {
+	return prefix + "_node"
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTierManifestForTest(t *testing.T, content string) string {
+	name := filepath.Join(t.TempDir(), "tiers.json")
+	err := os.WriteFile(name, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestLoadTierManifest(t *testing.T) {
+	// the same tiers in another order and format hash the same as the default tiers
+	name := writeTierManifestForTest(t, `{"Tiers": [
+		{"AssetsCount": 500, "BatchCreateUserOpsCount": 92},
+		{"AssetsCount": 50,  "BatchCreateUserOpsCount": 700}]}`)
+	m, err := LoadTierManifest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Hash != DefaultTierManifest().Hash {
+		t.Fatalf("unexpected hash %s", m.Hash)
+	}
+	if m.Tiers[0].AssetsCount != 50 || m.Tiers[1].AssetsCount != 500 {
+		t.Fatalf("tiers are not sorted: %v", m.Tiers)
+	}
+	if names := m.ZkKeyNames("keys"); names[0] != "keys/zkpor50_700" || names[1] != "keys/zkpor500_92" {
+		t.Fatalf("unexpected key names %v", names)
+	}
+	// rows written before the manifest was introduced have no hash
+	if err = m.Check(""); err != nil {
+		t.Fatal(err)
+	}
+
+	name = writeTierManifestForTest(t, `{"Tiers": [{"AssetsCount": 50, "BatchCreateUserOpsCount": 600}]}`)
+	other, err := LoadTierManifest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Check(m.Hash); !errors.Is(err, ErrTierManifestMismatch) {
+		t.Fatalf("expect tier manifest mismatch, got %v", err)
+	}
+	if err = other.Check(""); !errors.Is(err, ErrTierManifestMismatch) {
+		t.Fatalf("expect tier manifest mismatch, got %v", err)
+	}
+}
+
+func TestLoadInvalidTierManifest(t *testing.T) {
+	for _, content := range []string{
+		`{"Tiers": []}`,
+		`{"Tiers": [{"AssetsCount": 0, "BatchCreateUserOpsCount": 10}]}`,
+		`{"Tiers": [{"AssetsCount": 501, "BatchCreateUserOpsCount": 10}]}`,
+		`{"Tiers": [{"AssetsCount": 50, "BatchCreateUserOpsCount": 0}]}`,
+		`{"Tiers": [{"AssetsCount": 50, "BatchCreateUserOpsCount": 10}, {"AssetsCount": 50, "BatchCreateUserOpsCount": 20}]}`,
+		`{"AccountTreeDepth": 30, "Tiers": [{"AssetsCount": 50, "BatchCreateUserOpsCount": 10}]}`,
+		`{"AssetCounts": 40, "Tiers": [{"AssetsCount": 50, "BatchCreateUserOpsCount": 10}]}`,
+		`{"TierCount": 5, "Tiers": [{"AssetsCount": 50, "BatchCreateUserOpsCount": 10}]}`,
+		`{"Rounding": {"Equity": "nearest"}, "Tiers": [{"AssetsCount": 50, "BatchCreateUserOpsCount": 10}]}`,
+	} {
+		_, err := LoadTierManifest(writeTierManifestForTest(t, content))
+		if err == nil {
+			t.Errorf("invalid manifest %s is accepted", content)
+		}
+	}
+}
+
+func TestEmptyAccountTreeRoot(t *testing.T) {
+	defer DefaultTierManifest().Apply()
+	tree, err := NewAccountTree("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(EmptyAccountTreeRoot()) != string(tree.Root()) {
+		t.Fatalf("empty root %x, the tree root is %x", EmptyAccountTreeRoot(), tree.Root())
+	}
+	// the empty root of depth 28 published with the former releases
+	if hex.EncodeToString(EmptyAccountTreeRoot()) != "08696bfcb563a2ee4dde9e1dbd34f68d3f4643df6e3709cdb1855c9f886240c7" {
+		t.Fatalf("unexpected empty root %x", EmptyAccountTreeRoot())
+	}
+
+	m := &TierManifest{AccountTreeDepth: 8, AssetCounts: 20, TierCount: 4, Tiers: []TierInfo{{AssetsCount: 20, BatchCreateUserOpsCount: 3}}}
+	if err = m.init(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Hash == DefaultTierManifest().Hash {
+		t.Fatal("the circuit parameters are not hashed")
+	}
+	m.Apply()
+	tree, err = NewAccountTree("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(EmptyAccountTreeRoot()) != string(tree.Root()) {
+		t.Fatalf("empty root %x, the tree root is %x", EmptyAccountTreeRoot(), tree.Root())
+	}
+	if len(PaddingTierRatios(nil)) != 4 {
+		t.Fatal("tier ratios are not padded to TierCount")
+	}
+}
+
+func TestActivateTierManifest(t *testing.T) {
+	defer DefaultTierManifest().Apply()
+	other, err := LoadTierManifest(writeTierManifestForTest(t, `{"AccountTreeDepth": 8, "AssetCounts": 20, "TierCount": 4,
+		"Tiers": [{"AssetsCount": 10, "BatchCreateUserOpsCount": 2}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := DefaultTierManifest().Activate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rounds of the same manifest share it
+	releaseShared, err := DefaultTierManifest().Activate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	release()
+	if _, err = other.Activate(); !errors.Is(err, ErrTierManifestActive) {
+		t.Fatalf("expected the other manifest to be refused, got %v", err)
+	}
+	if AccountTreeDepth != DefaultAccountTreeDepth {
+		t.Fatalf("the parameters of the held manifest are changed")
+	}
+	releaseShared()
+	releaseOther, err := other.Activate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseOther()
+	if AccountTreeDepth != 8 || AssetCounts != 20 {
+		t.Fatalf("the manifest isn't applied")
+	}
+}
@@ -9,17 +9,22 @@ type TierRatio struct {
 }
 
 type CexAssetInfo struct {
-	TotalEquity               uint64
-	TotalDebt                 uint64
-	BasePrice                 uint64
+	TotalEquity uint64
+	TotalDebt   uint64
+	BasePrice   uint64
+	// AmountDecimals and PriceDecimals are the decimals of the balances and of
+	// BasePrice, they add up to AssetValueDecimals
+	AmountDecimals            uint8
+	PriceDecimals             uint8
 	Symbol                    string
 	Index                     uint32
 	LoanCollateral            uint64
 	MarginCollateral          uint64
 	PortfolioMarginCollateral uint64
-	LoanRatios                [TierCount]TierRatio
-	MarginRatios              [TierCount]TierRatio
-	PortfolioMarginRatios     [TierCount]TierRatio
+	// the ratios are padded to TierCount by PaddingTierRatios
+	LoanRatios            []TierRatio
+	MarginRatios          []TierRatio
+	PortfolioMarginRatios []TierRatio
 }
 
 type AccountAsset struct {
@@ -46,7 +51,8 @@ type CreateUserOperation struct {
 	Assets                []AccountAsset
 	AccountIndex          uint32
 	AccountIdHash         []byte
-	AccountProof          [AccountTreeDepth][]byte
+	// AccountProof has AccountTreeDepth nodes
+	AccountProof [][]byte
 }
 
 type BatchCreateUserWitness struct {
@@ -59,3 +65,20 @@ type BatchCreateUserWitness struct {
 	BeforeCexAssets []CexAssetInfo
 	CreateUserOps   []CreateUserOperation
 }
+
+// AggregatedProof is the serialization of the proof which aggregates all
+// the batch proofs of a round
+type AggregatedProof struct {
+	// ProofInfo is the base64 encoding of the groth16 proof
+	ProofInfo string
+	// the batches are ordered by asset counts tier,
+	// BatchCounts[i] batches belong to AssetsCountTiers[i]
+	AssetsCountTiers          []int
+	BatchCounts               []int
+	BeforeAccountTreeRoot     []byte
+	AfterAccountTreeRoot      []byte
+	BeforeCEXAssetsCommitment []byte
+	AfterCEXAssetsCommitment  []byte
+	// TierManifestHash is the hash of the tier manifest the batches are proved with
+	TierManifestHash string
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UserFileSchemaVersion is the latest schema version of the user files. A
+// user file declares its version in a first line like
+//
+//	#schema_version=1
+//
+// before the header, the files without it are version 1.
+const UserFileSchemaVersion = 1
+
+// the columns of schema version 1, the columns of an asset are named after its
+// symbol in cex_assets_info.csv, e.g. e_btc. The columns may be in any order.
+const (
+	userFileColumnRowNumber = "rn"
+	userFileColumnId        = "id"
+	userFileColumnNetTotal  = "total_net_balance_usdt"
+)
+
+// userFileAssetFields are the prefixes of the columns of an asset which are
+// read and the field names of their errors. The column named after the symbol
+// itself is known but not read.
+var userFileAssetFields = []struct {
+	prefix string
+	field  string
+}{
+	{"e_", "equity"},
+	{"d_", "debt"},
+	{"vl_", "loan"},
+	{"m_", "margin"},
+	{"pm_", "portfolio margin"},
+}
+
+// AssetColumns are the columns of the equity, debt, loan, margin and
+// portfolio margin of an asset in a user file
+type AssetColumns [5]int
+
+// UserFileColumns maps the columns of a user file to the assets of
+// cex_assets_info.csv
+type UserFileColumns struct {
+	SchemaVersion int
+	Id            int
+	// Assets are the columns of every asset in the order of cex_assets_info.csv
+	Assets []AssetColumns
+}
+
+// readUserFileSchemaVersion reads the schema version of a user file, declared
+// is false if its first line doesn't declare one
+func readUserFileSchemaVersion(name string, r *bufio.Reader) (version int, declared bool, err error) {
+	first, err := r.Peek(1)
+	if err != nil || first[0] != '#' {
+		return 1, false, nil
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: read schema version failed: %s", name, err.Error())
+	}
+	value, found := strings.CutPrefix(strings.TrimSpace(line), "#schema_version=")
+	version, err = strconv.Atoi(value)
+	if !found || err != nil {
+		return 0, false, fmt.Errorf("%s: first line %q isn't a schema version like #schema_version=%d", name, strings.TrimSpace(line), UserFileSchemaVersion)
+	}
+	if version < 1 || version > UserFileSchemaVersion {
+		return 0, false, fmt.Errorf("%s: %w %d, the latest one is %d", name, ErrUnsupportedSchemaVersion, version, UserFileSchemaVersion)
+	}
+	return version, true, nil
+}
+
+// ParseUserFileHeader maps the header of a user file to the columns of the
+// assets of cexAssetsInfo, whatever the order of the columns. Every problem of
+// the header is returned as an *ErrUserFileHeader, joined with errors.Join.
+func ParseUserFileHeader(name string, schemaVersion int, header []string, cexAssetsInfo []CexAssetInfo) (*UserFileColumns, error) {
+	assetIndexes := make(map[string]int)
+	for i, asset := range cexAssetsInfo {
+		if asset.Symbol != ReservedAssetSymbol {
+			assetIndexes[asset.Symbol] = i
+		}
+	}
+	columns := &UserFileColumns{
+		SchemaVersion: schemaVersion,
+		Id:            -1,
+		Assets:        make([]AssetColumns, len(assetIndexes)),
+	}
+	for i := range columns.Assets {
+		for p := range columns.Assets[i] {
+			columns.Assets[i][p] = -1
+		}
+	}
+	var errs []error
+	headerErr := func(column string, reason string) {
+		errs = append(errs, &ErrUserFileHeader{File: name, SchemaVersion: schemaVersion, Column: column, Reason: reason})
+	}
+	seen := make(map[string]bool)
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if seen[column] {
+			headerErr(column, "duplicate column")
+			continue
+		}
+		seen[column] = true
+		if column == userFileColumnId {
+			columns.Id = i
+			continue
+		}
+		if _, ok := assetIndexes[column]; ok || column == userFileColumnRowNumber || column == userFileColumnNetTotal {
+			continue
+		}
+		known := false
+		for p, f := range userFileAssetFields {
+			symbol, found := strings.CutPrefix(column, f.prefix)
+			if !found {
+				continue
+			}
+			index, ok := assetIndexes[symbol]
+			if !ok {
+				headerErr(column, fmt.Sprintf("asset %s isn't in %s", symbol, CexAssetsInfoFile))
+			} else {
+				columns.Assets[index][p] = i
+			}
+			known = true
+			break
+		}
+		if !known {
+			headerErr(column, "unknown column")
+		}
+	}
+	if columns.Id < 0 {
+		headerErr(userFileColumnId, "missing column")
+	}
+	for i := range columns.Assets {
+		for p, f := range userFileAssetFields {
+			if columns.Assets[i][p] < 0 {
+				headerErr(f.prefix+cexAssetsInfo[i].Symbol, "missing column")
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return columns, nil
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseUserFileHeader(t *testing.T) {
+	cexAssetsInfo, err := ParseCexAssetInfoFromFile("../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []string{"rn", "id",
+		"e_btc", "d_btc", "btc", "vl_btc", "m_btc", "pm_btc",
+		"e_eth", "d_eth", "eth", "vl_eth", "m_eth", "pm_eth",
+		"e_bnb", "d_bnb", "bnb", "vl_bnb", "m_bnb", "pm_bnb",
+		"e_shib", "d_shib", "shib", "vl_shib", "m_shib", "pm_shib", "total_net_balance_usdt"}
+	columns, err := ParseUserFileHeader("users.csv", 1, header, cexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns.Id != 1 || columns.Assets[3] != (AssetColumns{20, 21, 23, 24, 25}) {
+		t.Errorf("unexpected columns %v", columns)
+	}
+
+	// the assets follow cex_assets_info.csv whatever the column order
+	reordered := append([]string{"id", "pm_shib", "m_shib", "vl_shib", "d_shib", "e_shib"}, header[2:20]...)
+	columns, err = ParseUserFileHeader("users.csv", 1, reordered, cexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns.Id != 0 || columns.Assets[3] != (AssetColumns{5, 4, 3, 2, 1}) || columns.Assets[0][0] != 6 {
+		t.Errorf("unexpected columns %v", columns)
+	}
+
+	broken := append([]string{"ID", "e_doge", "extra", "e_btc"}, header[2:20]...)
+	broken = append(broken, "d_shib", "vl_shib", "m_shib")
+	_, err = ParseUserFileHeader("users.csv", 1, broken, cexAssetsInfo)
+	expected := []string{
+		"column e_doge: asset doge isn't in cex_assets_info.csv",
+		"column extra: unknown column",
+		"column e_btc: duplicate column",
+		"column e_shib: missing column",
+		"column pm_shib: missing column",
+	}
+	for _, e := range expected {
+		if err == nil || !strings.Contains(err.Error(), e) {
+			t.Errorf("expected %q in %v", e, err)
+		}
+	}
+	var headerErr *ErrUserFileHeader
+	if !errors.As(err, &headerErr) || headerErr.File != "users.csv" {
+		t.Errorf("expected header error, got %v", err)
+	}
+}
+
+func TestReadReorderedUserFile(t *testing.T) {
+	cexAssetsInfo, err := ParseCexAssetInfoFromFile("../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _, err := ReadUserDataFromCsvFile("../sampledata/sample_users0.csv", cexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("../sampledata/sample_users0.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(f).ReadAll()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the columns are reversed, and the version is declared
+	for _, record := range records {
+		for i, j := 0, len(record)-1; i < j; i, j = i+1, j-1 {
+			record[i], record[j] = record[j], record[i]
+		}
+	}
+	name := filepath.Join(t.TempDir(), "users.csv")
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.WriteString("#schema_version=1\n")
+	w := csv.NewWriter(out)
+	w.WriteAll(records)
+	out.Close()
+	accounts, invalidCounts, err := ReadUserDataFromCsvFile(name, cexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invalidCounts != 10 {
+		t.Errorf("expected 10 invalid accounts, got %d", invalidCounts)
+	}
+	for k, v := range expected {
+		if len(accounts[k]) != len(v) {
+			t.Fatalf("expected %d accounts of tier %d, got %d", len(v), k, len(accounts[k]))
+		}
+		for i := range v {
+			a, e := accounts[k][i], v[i]
+			if a.AccountIndex != e.AccountIndex || a.TotalEquity.Cmp(e.TotalEquity) != 0 || len(a.Assets) != len(e.Assets) {
+				t.Fatalf("account %d of tier %d mismatch", i, k)
+			}
+			for p := range e.Assets {
+				if a.Assets[p] != e.Assets[p] {
+					t.Fatalf("asset %d of account %d mismatch: %v, expected %v", p, e.AccountIndex, a.Assets[p], e.Assets[p])
+				}
+			}
+		}
+	}
+
+	// the rows are numbered after the version line
+	_, invalidErrors, err := ReadUserDataFromCsvFileContext(context.Background(), name, cexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expectedErrors, _ := ReadUserDataFromCsvFileContext(context.Background(), "../sampledata/sample_users0.csv", cexAssetsInfo)
+	for i := range expectedErrors {
+		if invalidRow(invalidErrors[i]) != invalidRow(expectedErrors[i])+1 {
+			t.Errorf("expected row %d, got %v", invalidRow(expectedErrors[i])+1, invalidErrors[i])
+		}
+	}
+
+	err = os.WriteFile(name, []byte("#schema_version=2\nid\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ReadUserDataFromCsvFile(name, cexAssetsInfo)
+	if !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Errorf("expected unsupported schema version, got %v", err)
+	}
+}
+
+func invalidRow(err error) int {
+	switch e := err.(type) {
+	case *ErrInvalidAccountId:
+		return e.Row
+	case *ErrInvalidAssetValue:
+		return e.Row
+	case *ErrCollateralExceedsEquity:
+		return e.Row
+	case *ErrDebtExceedsCollateral:
+		return e.Row
+	}
+	return 0
+}
@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/csv"
 	"encoding/gob"
@@ -9,18 +11,18 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"log/slog"
 	"math/big"
 	"os"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 	"github.com/shopspring/decimal"
 	"github.com/klauspost/compress/s2"
-	"github.com/go-sql-driver/mysql"
 )
 
 func ConvertTierRatiosToBytes(tiersRatio []TierRatio) [][]byte {
@@ -50,41 +52,39 @@ func ConvertTierRatiosToBytes(tiersRatio []TierRatio) [][]byte {
 	return res
 }
 
-func ConvertAssetInfoToBytes(value any) [][]byte {
-	switch t := value.(type) {
-	case CexAssetInfo:
-		res := make([][]byte, 0, 10)
-		aBigInt := new(big.Int).SetUint64(t.TotalEquity)
-		bBigInt := new(big.Int).SetUint64(t.TotalDebt)
-		cBigInt := new(big.Int).SetUint64(t.BasePrice)
-		aBigInt.Mul(aBigInt, Uint64MaxValueBigIntSquare)
-		bBigInt.Mul(bBigInt, Uint64MaxValueBigInt)
-		aBigInt.Add(aBigInt, bBigInt)
-		resBigInt := new(big.Int).Add(aBigInt, cBigInt)
-		res = append(res, resBigInt.Bytes())
-
-		resBigInt.SetUint64(0)
-		aBigInt.SetUint64(t.LoanCollateral)
-		bBigInt.SetUint64(t.MarginCollateral)
-		cBigInt.SetUint64(t.PortfolioMarginCollateral)
-		aBigInt.Mul(aBigInt, Uint64MaxValueBigIntSquare)
-		bBigInt.Mul(bBigInt, Uint64MaxValueBigInt)
-		aBigInt.Add(aBigInt, bBigInt)
-		resBigInt.Add(cBigInt, aBigInt)
-		res = append(res, resBigInt.Bytes())
-
-		// one tier ratio: boundaryValue take 118 bits, ratio take 8 bits = 126 bits
-		// so two tier ratio take 252 bits, can be stored in one circuit Variable
-		tempRes := ConvertTierRatiosToBytes(t.LoanRatios[:])
-		res = append(res, tempRes...)
-		tempRes = ConvertTierRatiosToBytes(t.MarginRatios[:])
-		res = append(res, tempRes...)
-		tempRes = ConvertTierRatiosToBytes(t.PortfolioMarginRatios[:])
-		res = append(res, tempRes...)
-		return res
-	default:
-		panic("not supported type")
-	}
+func ConvertAssetInfoToBytes(t CexAssetInfo) [][]byte {
+	res := make([][]byte, 0, 10)
+	aBigInt := new(big.Int).SetUint64(t.TotalEquity)
+	bBigInt := new(big.Int).SetUint64(t.TotalDebt)
+	cBigInt := new(big.Int).SetUint64(t.BasePrice)
+	aBigInt.Mul(aBigInt, Uint64MaxValueBigIntSquare)
+	bBigInt.Mul(bBigInt, Uint64MaxValueBigInt)
+	aBigInt.Add(aBigInt, bBigInt)
+	resBigInt := new(big.Int).Add(aBigInt, cBigInt)
+	// the decimals take the 16 bits above the 3 uint64 values
+	dBigInt := new(big.Int).SetUint64(uint64(t.AmountDecimals)<<8 | uint64(t.PriceDecimals))
+	resBigInt.Add(resBigInt, dBigInt.Mul(dBigInt, Uint64MaxValueBigIntCube))
+	res = append(res, resBigInt.Bytes())
+
+	resBigInt.SetUint64(0)
+	aBigInt.SetUint64(t.LoanCollateral)
+	bBigInt.SetUint64(t.MarginCollateral)
+	cBigInt.SetUint64(t.PortfolioMarginCollateral)
+	aBigInt.Mul(aBigInt, Uint64MaxValueBigIntSquare)
+	bBigInt.Mul(bBigInt, Uint64MaxValueBigInt)
+	aBigInt.Add(aBigInt, bBigInt)
+	resBigInt.Add(cBigInt, aBigInt)
+	res = append(res, resBigInt.Bytes())
+
+	// one tier ratio: boundaryValue take 118 bits, ratio take 8 bits = 126 bits
+	// so two tier ratio take 252 bits, can be stored in one circuit Variable
+	tempRes := ConvertTierRatiosToBytes(t.LoanRatios[:])
+	res = append(res, tempRes...)
+	tempRes = ConvertTierRatiosToBytes(t.MarginRatios[:])
+	res = append(res, tempRes...)
+	tempRes = ConvertTierRatiosToBytes(t.PortfolioMarginRatios[:])
+	res = append(res, tempRes...)
+	return res
 }
 
 func SelectAssetValue(expectAssetIndex int, flag int, currentAssetPosition int, assets []AccountAsset) (*big.Int, bool) {
@@ -144,11 +144,10 @@ func GetAssetsCountOfUser(assets []AccountAsset) int {
 	return targetCounts
 }
 
-func PaddingAccountAssets(assets []AccountAsset) (paddingFlattenAssets []uint64) {
+func PaddingAccountAssets(assets []AccountAsset) (paddingFlattenAssets []uint64, err error) {
 	targetCounts := GetAssetsCountOfUser(assets)
 	if targetCounts < len(assets) {
-		fmt.Println("the target counts is ", targetCounts, " the length of assets is ", len(assets))
-		panic("the target counts is less than the length of assets")
+		return nil, &ErrTooManyAssets{Assets: len(assets), TargetCounts: targetCounts}
 	}
 	numOfAssetsFields := 6
 	paddingFlattenAssets = make([]uint64, targetCounts*numOfAssetsFields)
@@ -182,12 +181,15 @@ func PaddingAccountAssets(assets []AccountAsset) (paddingFlattenAssets []uint64)
 		currentAssetIndex += 1
 	}
 
-	return paddingFlattenAssets
+	return paddingFlattenAssets, nil
 }
 
-func ComputeUserAssetsCommitment(hasher *hash.Hash, assets []AccountAsset) []byte {
+func ComputeUserAssetsCommitment(hasher *hash.Hash, assets []AccountAsset) ([]byte, error) {
 	(*hasher).Reset()
-	paddingFlattenAssets := PaddingAccountAssets(assets)
+	paddingFlattenAssets, err := PaddingAccountAssets(assets)
+	if err != nil {
+		return nil, err
+	}
 	targetCounts := GetAssetsCountOfUser(assets)
 	numOfAssetsFields := 6
 	numOfOneField := 3
@@ -217,149 +219,159 @@ func ComputeUserAssetsCommitment(hasher *hash.Hash, assets []AccountAsset) []byt
 		(*hasher).Write(sumBigIntBytes)
 	}
 
-	return (*hasher).Sum(nil)
+	return (*hasher).Sum(nil), nil
 }
 
+// CexAssetsInfoFile is the file of the cex assets info in the directory of the user files
+const CexAssetsInfoFile = "cex_assets_info.csv"
+
 func ParseUserDataSet(dirname string) (map[int][]AccountInfo, []CexAssetInfo, error) {
-	const CEX_ASSET_INFO_FILE string = "cex_assets_info.csv"
-	userFiles, err := os.ReadDir(dirname)
+	return ParseUserDataSetContext(context.Background(), dirname)
+}
+
+// ParseUserDataSetContext parses the cex assets info and the user files of the
+// directory. The valid accounts are returned with *ErrInvalidAccounts if some
+// rows are invalid, and nothing is returned if a file can't be read or ctx is
+// canceled. All the accounts are kept in memory, IngestUserDataSet writes
+// them to disk instead.
+func ParseUserDataSetContext(ctx context.Context, dirname string) (map[int][]AccountInfo, []CexAssetInfo, error) {
+	accounts, cexAssetInfo, _, err := ParseUserDataSetWithRounding(ctx, dirname)
+	return accounts, cexAssetInfo, err
+}
+
+// ParseUserDataSetWithRounding is ParseUserDataSetContext which also returns
+// the amounts the rounding dropped from the valid accounts of every asset
+func ParseUserDataSetWithRounding(ctx context.Context, dirname string) (map[int][]AccountInfo, []CexAssetInfo, []AssetRounding, error) {
+	userFileNames, cexAssetInfo, err := parseUserDataSetHeader(dirname)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	accountInfo := make(map[int][]AccountInfo)
-	var cexAssetInfo []CexAssetInfo
-
 	workersNum := 8
-	userFileNames := make([]string, 0)
-
 	type UserParseRes struct {
-		accounts map[int][]AccountInfo
-		invalidAccNum int
+		accounts      map[int][]AccountInfo
+		invalidErrors []error
+		dropped       roundingTotals
+		err           error
 	}
 	results := make([]chan UserParseRes, workersNum)
 	for i := 0; i < workersNum; i++ {
 		results[i] = make(chan UserParseRes, 1)
 	}
 
-	for _, userFile := range userFiles {
-		if !strings.Contains(userFile.Name(), ".csv") {
-			continue
-		}
-		if userFile.Name() == CEX_ASSET_INFO_FILE {
-			continue
-		}
-
-		userFileNames = append(userFileNames, filepath.Join(dirname, userFile.Name()))
-	}
-	assetIndexes, err := ParseAssetIndexFromUserFile(userFileNames[0])
-	if err != nil {
-		return nil, nil, err
-	}
-
-	cexAssetInfo, err = ParseCexAssetInfoFromFile(filepath.Join(dirname, CEX_ASSET_INFO_FILE), assetIndexes)
-	if err != nil {
-		return nil, nil, err
-	}
-
+	// the workers quit if a file fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for i := 0; i < workersNum; i++ {
 		go func(workerId int) {
 			for j := workerId; j < len(userFileNames); j += workersNum {
-				if j >= len(userFileNames) {
-					break
-				}
-				tmpAccountInfo, invalidAccountNum, err := ReadUserDataFromCsvFile(userFileNames[j], cexAssetInfo)
-				if err != nil {
-					panic(err.Error())
-				}
-				results[workerId] <- UserParseRes{
-					accounts: tmpAccountInfo,
-					invalidAccNum: invalidAccountNum,
+				tmpAccountInfo, invalidErrors, dropped, err := readUserDataFromCsvFile(ctx, userFileNames[j], cexAssetInfo)
+				select {
+				case results[workerId] <- UserParseRes{
+					accounts:      tmpAccountInfo,
+					invalidErrors: invalidErrors,
+					dropped:       dropped,
+					err:           err,
+				}:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}(i)
 	}
 
-	gcQuitChan := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-time.After(time.Second * 10):
-				runtime.GC()
-			case <-gcQuitChan:
-				return
+	var invalidErrors []error
+	dropped := newRoundingTotals(len(cexAssetInfo))
+	for i := 0; i < len(userFileNames); i++ {
+		var res UserParseRes
+		select {
+		case res = <-results[i%workersNum]:
+		case <-ctx.Done():
+			return nil, nil, nil, ctx.Err()
+		}
+		if res.err != nil {
+			return nil, nil, nil, res.err
+		}
+		invalidErrors = append(invalidErrors, res.invalidErrors...)
+		dropped.merge(res.dropped)
+		if i != 0 {
+			currentAccountIndex := 0
+			for _, v := range accountInfo {
+				currentAccountIndex += len(v)
 			}
-		}
-	}()
-
-	quit := make(chan bool)
-	totalInvalidAccountNum := 0
-	go func() {
-		for i := 0; i < len(userFileNames); i++ {
-			res := <-results[i%workersNum]
-			totalInvalidAccountNum += res.invalidAccNum
-			if i != 0 {
-				currentAccountIndex := 0
-				for _, v := range accountInfo {
-					currentAccountIndex += len(v)
-				}
-				for _, v := range res.accounts {
-					for k := 0; k < len(v); k++ {
-						v[k].AccountIndex += uint32(currentAccountIndex)
-					}
+			for _, v := range res.accounts {
+				for k := 0; k < len(v); k++ {
+					v[k].AccountIndex += uint32(currentAccountIndex)
 				}
 			}
-			for k, v := range res.accounts {
-				if accountInfo[k] == nil {
-					accountInfo[k] = make([]AccountInfo, 0, len(v))
-				}
-				accountInfo[k] = append(accountInfo[k], v...)
+		}
+		for k, v := range res.accounts {
+			if accountInfo[k] == nil {
+				accountInfo[k] = make([]AccountInfo, 0, len(v))
 			}
+			accountInfo[k] = append(accountInfo[k], v...)
 		}
-		quit <- true
-	}()
-	<-quit
-	gcQuitChan <- true
-	if totalInvalidAccountNum > 0 {
-		fmt.Println("the total invalid account number is ", totalInvalidAccountNum)
-		return accountInfo, cexAssetInfo, errors.New("invalid account data")
 	}
-	return accountInfo, cexAssetInfo, nil
+	roundings := dropped.assets(cexAssetInfo)
+	logRoundings("amounts of the asset are rounded", roundings)
+	if len(invalidErrors) > 0 {
+		slog.Error("invalid accounts are found", "invalid", len(invalidErrors))
+		return accountInfo, cexAssetInfo, roundings, &ErrInvalidAccounts{Errors: invalidErrors}
+	}
+	return accountInfo, cexAssetInfo, roundings, nil
 }
 
-func SafeAdd(a uint64, b uint64) (c uint64) {
-	c = a + b
-	if c < a {
-		panic("overflow for balance")
+// parseUserDataSetHeader returns the user files of the directory in name
+// order and the cex assets info
+func parseUserDataSetHeader(dirname string) ([]string, []CexAssetInfo, error) {
+	userFiles, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, nil, err
 	}
-	return c
-}
+	userFileNames := make([]string, 0)
+	for _, userFile := range userFiles {
+		if !strings.Contains(userFile.Name(), ".csv") {
+			continue
+		}
+		if userFile.Name() == CexAssetsInfoFile {
+			continue
+		}
 
-func ParseAssetIndexFromUserFile(userFilename string) ([]string, error) {
-	f, err := os.Open(userFilename)
+		userFileNames = append(userFileNames, filepath.Join(dirname, userFile.Name()))
+	}
+	if len(userFileNames) == 0 {
+		return nil, nil, fmt.Errorf("%w in %s", ErrNoUserFile, dirname)
+	}
+	cexAssetInfo, err := ParseCexAssetInfoFromFile(filepath.Join(dirname, CexAssetsInfoFile))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
-	csvReader := csv.NewReader(f)
-	data, err := csvReader.Read()
+	return userFileNames, cexAssetInfo, nil
+}
+
+// SafeAdd panics on overflow, the callers which handle the overflow use CheckedAdd
+func SafeAdd(a uint64, b uint64) (c uint64) {
+	c, err := CheckedAdd(a, b)
 	if err != nil {
-		return nil, err
+		panic(err.Error())
 	}
-	// 3: rn, id, total_net_balance
-	// 6: equity_assetA, debt_assetA, assetA, assetA_loan, assetA_margin, assetA_portfolio_margin
-	assetCounts := (len(data) - 3) / 6
-	cexAssetsList := make([]string, assetCounts)
+	return c
+}
 
-	for i := 0; i < assetCounts; i++ {
-		cexAssetsList[i] = strings.ToLower(data[i*6+4])
+// CheckedAdd returns ErrBalanceOverflow on overflow
+func CheckedAdd(a uint64, b uint64) (c uint64, err error) {
+	c = a + b
+	if c < a {
+		return 0, ErrBalanceOverflow
 	}
-	return cexAssetsList, nil
+	return c, nil
 }
 
-func PaddingTierRatios(tiersRatio []TierRatio) (res [TierCount]TierRatio) {
+func PaddingTierRatios(tiersRatio []TierRatio) (res []TierRatio) {
 	if len(tiersRatio) > TierCount {
 		panic("the length of tiers ratio is bigger than TierCount")
 	}
+	res = make([]TierRatio, TierCount)
 	for i := 0; i < TierCount; i++ {
 		if i < len(tiersRatio) {
 			res[i] = tiersRatio[i]
@@ -379,14 +391,17 @@ func PaddingTierRatios(tiersRatio []TierRatio) (res [TierCount]TierRatio) {
 	return res
 }
 
-func ParseTiersRatioFromStr(tiersRatioEnc string) ([TierCount]TierRatio, error) {
+func ParseTiersRatioFromStr(tiersRatioEnc string) ([]TierRatio, error) {
 	tiersRatioEnc = strings.Trim(tiersRatioEnc, "[]")
 	if len(tiersRatioEnc) == 0 {
 		return PaddingTierRatios([]TierRatio{}), nil
 	}
 	tiersRatioStrs := strings.Split(tiersRatioEnc, ",")
+	if len(tiersRatioStrs) > TierCount {
+		return PaddingTierRatios([]TierRatio{}), fmt.Errorf("%d tiers ratio is more than TierCount %d", len(tiersRatioStrs), TierCount)
+	}
 	tiersRatio := make([]TierRatio, 0, 10)
-	valueMultiplier := new(big.Int).SetUint64(10000000000000000)
+	valueMultiplier := new(big.Int).SetUint64(uint64(decimalsMultiplier(AssetValueDecimals)))
 	for i := 0; i < len(tiersRatioStrs); i += 1 {
 		tmpTierRatio := strings.Split(strings.Trim(tiersRatioStrs[i], " "), ":")
 		rangeValues := strings.Split(tmpTierRatio[0], "-")
@@ -444,7 +459,22 @@ func CalculatePrecomputedValue(tiersRatio []TierRatio) {
 	}
 }
 
-func ParseCexAssetInfoFromFile(name string, assetIndexes []string) ([]CexAssetInfo, error) {
+// ReservedAssetSymbol is the symbol of the padding assets after the assets
+// of cex_assets_info.csv
+const ReservedAssetSymbol = "reserved"
+
+// the optional columns of cex_assets_info.csv, the assets of a file without
+// them have the decimals of AssetTypeForTwoDigits
+const (
+	cexAssetsColumnAmountDecimals = "amount_decimals"
+	cexAssetsColumnPriceDecimals  = "price_decimals"
+)
+
+// ParseCexAssetInfoFromFile parses the cex assets info, the assets are indexed
+// in the order of their rows and padded to AssetCounts. The first 5 columns
+// are the symbol, the usdt price and the loan, margin and portfolio margin tier
+// ratios, the amount_decimals and price_decimals columns may follow them.
+func ParseCexAssetInfoFromFile(name string) ([]CexAssetInfo, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -455,209 +485,295 @@ func ParseCexAssetInfoFromFile(name string, assetIndexes []string) ([]CexAssetIn
 	if err != nil {
 		return nil, err
 	}
-	cexAssets2Info := make(map[string]CexAssetInfo)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s is empty", name)
+	}
+	amountDecimalsColumn, priceDecimalsColumn := -1, -1
+	for i, column := range data[0] {
+		switch strings.ToLower(strings.TrimSpace(column)) {
+		case cexAssetsColumnAmountDecimals:
+			amountDecimalsColumn = i
+		case cexAssetsColumnPriceDecimals:
+			priceDecimalsColumn = i
+		}
+	}
+	if len(data[0]) < 5 || (amountDecimalsColumn < 0) != (priceDecimalsColumn < 0) {
+		return nil, fmt.Errorf("%s must have the symbol, price and tier ratio columns, and both %s and %s columns or none",
+			name, cexAssetsColumnAmountDecimals, cexAssetsColumnPriceDecimals)
+	}
 	data = data[1:]
+	if len(data) > AssetCounts {
+		slog.Error("the number of assets is bigger than AssetCounts", "assets", len(data), "asset_counts", AssetCounts)
+		return nil, errors.New("cex asset data wrong")
+	}
+	cexAssetsInfo := make([]CexAssetInfo, AssetCounts)
+	symbols := make(map[string]bool)
 	for i := 0; i < len(data); i++ {
-		if len(data[i]) != 5 {
-			fmt.Println("cex asset data wrong:", data[i])
-			return nil, errors.New("cex asset data wrong")
-		}
 		tmpCexAssetInfo := CexAssetInfo{
-			Symbol: strings.ToLower(data[i][0]),
-		}
-		multiplier := int64(100000000)
-		if AssetTypeForTwoDigits[tmpCexAssetInfo.Symbol] {
-			multiplier = 100000000000000
+			Symbol:         strings.ToLower(strings.TrimSpace(data[i][0])),
+			AmountDecimals: DefaultAmountDecimals,
+			PriceDecimals:  DefaultPriceDecimals,
+		}
+		// the columns of the user files are mapped to the assets by symbol
+		if symbols[tmpCexAssetInfo.Symbol] || tmpCexAssetInfo.Symbol == ReservedAssetSymbol {
+			slog.Error("cex asset symbol is duplicate or reserved", "symbol", data[i][0])
+			return nil, fmt.Errorf("cex asset %s is duplicate or reserved", tmpCexAssetInfo.Symbol)
+		}
+		symbols[tmpCexAssetInfo.Symbol] = true
+		if amountDecimalsColumn >= 0 {
+			tmpCexAssetInfo.AmountDecimals, tmpCexAssetInfo.PriceDecimals, err = parseAssetDecimals(data[i][amountDecimalsColumn], data[i][priceDecimalsColumn])
+			if err != nil {
+				slog.Error("asset decimals wrong", "symbol", data[i][0], "err", err)
+				return nil, fmt.Errorf("cex asset %s: %s", tmpCexAssetInfo.Symbol, err.Error())
+			}
+		} else if AssetTypeForTwoDigits[tmpCexAssetInfo.Symbol] {
+			tmpCexAssetInfo.AmountDecimals, tmpCexAssetInfo.PriceDecimals = 2, 14
 		}
-		tmpCexAssetInfo.BasePrice, err = ConvertFloatStrToUint64(data[i][1], multiplier)
+		tmpCexAssetInfo.BasePrice, err = ConvertFloatStrToUint64(data[i][1], decimalsMultiplier(tmpCexAssetInfo.PriceDecimals))
 		if err != nil {
-			fmt.Println("asset data wrong:", data[i][0], err.Error())
+			slog.Error("asset data wrong", "symbol", data[i][0], "err", err)
 			return nil, err
 		}
 		tmpCexAssetInfo.LoanRatios, err = ParseTiersRatioFromStr(data[i][2])
 		if err != nil {
-			fmt.Println("parse loan tiers ratio failed:", data[i][2], err.Error())
+			slog.Error("parse loan tiers ratio failed", "symbol", data[i][0], "ratios", data[i][2], "err", err)
 			return nil, err
 		}
 		tmpCexAssetInfo.MarginRatios, err = ParseTiersRatioFromStr(data[i][3])
 		if err != nil {
-			fmt.Println("parse margin tiers ratio failed:", data[i][3], err.Error())
+			slog.Error("parse margin tiers ratio failed", "symbol", data[i][0], "ratios", data[i][3], "err", err)
 			return nil, err
 		}
 		tmpCexAssetInfo.PortfolioMarginRatios, err = ParseTiersRatioFromStr(data[i][4])
 		if err != nil {
-			fmt.Println("parse portfolio margin tiers ratio failed:", data[i][4], err.Error())
+			slog.Error("parse portfolio margin tiers ratio failed", "symbol", data[i][0], "ratios", data[i][4], "err", err)
 			return nil, err
 		}
 
-		cexAssets2Info[tmpCexAssetInfo.Symbol] = tmpCexAssetInfo
+		tmpCexAssetInfo.Index = uint32(i)
+		cexAssetsInfo[i] = tmpCexAssetInfo
+	}
+	for i := len(data); i < AssetCounts; i++ {
+		cexAssetsInfo[i] = paddingCexAsset(i)
 	}
+	return cexAssetsInfo, nil
 
-	cexAssetsInfo := make([]CexAssetInfo, AssetCounts)
+}
 
-	if len(assetIndexes) != len(cexAssets2Info) {
-		fmt.Println("the length of asset indexes is not equal to the length of cex assets info")
-		return nil, errors.New("cex asset data wrong")
+// paddingCexAsset returns the reserved asset of the index, it has no price
+func paddingCexAsset(index int) CexAssetInfo {
+	return CexAssetInfo{
+		Symbol:                ReservedAssetSymbol,
+		BasePrice:             0,
+		AmountDecimals:        DefaultAmountDecimals,
+		PriceDecimals:         DefaultPriceDecimals,
+		LoanRatios:            PaddingTierRatios([]TierRatio{}),
+		MarginRatios:          PaddingTierRatios([]TierRatio{}),
+		PortfolioMarginRatios: PaddingTierRatios([]TierRatio{}),
+		Index:                 uint32(index),
+	}
+}
+
+// parseAssetDecimals parses the decimals of an asset, the usdt value of a
+// balance has AssetValueDecimals decimals whatever the asset, so they must add
+// up to it
+func parseAssetDecimals(amount string, price string) (uint8, uint8, error) {
+	amountDecimals, err := strconv.ParseUint(strings.TrimSpace(amount), 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid %s %q", cexAssetsColumnAmountDecimals, amount)
 	}
-	for i := 0; i < len(assetIndexes); i++ {
-		cexAssetsInfo[i] = cexAssets2Info[assetIndexes[i]]
-		cexAssetsInfo[i].Index = uint32(i)
+	priceDecimals, err := strconv.ParseUint(strings.TrimSpace(price), 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid %s %q", cexAssetsColumnPriceDecimals, price)
 	}
-	for i := len(assetIndexes); i < AssetCounts; i++ {
-		cexAssetsInfo[i] = CexAssetInfo{
-			Symbol:                "reserved",
-			BasePrice:             0,
-			LoanRatios:            PaddingTierRatios([]TierRatio{}),
-			MarginRatios:          PaddingTierRatios([]TierRatio{}),
-			PortfolioMarginRatios: PaddingTierRatios([]TierRatio{}),
-			Index:                 uint32(i),
-		}
+	if amountDecimals+priceDecimals != AssetValueDecimals {
+		return 0, 0, fmt.Errorf("%s %d and %s %d must add up to %d", cexAssetsColumnAmountDecimals, amountDecimals,
+			cexAssetsColumnPriceDecimals, priceDecimals, AssetValueDecimals)
 	}
-	return cexAssetsInfo, nil
+	return uint8(amountDecimals), uint8(priceDecimals), nil
+}
 
+// decimalsMultiplier returns 10^decimals
+func decimalsMultiplier(decimals uint8) int64 {
+	multiplier := int64(1)
+	for i := uint8(0); i < decimals; i++ {
+		multiplier *= 10
+	}
+	return multiplier
 }
 
 func ReadUserDataFromCsvFile(name string, cexAssetsInfo []CexAssetInfo) (map[int][]AccountInfo, int, error) {
+	accounts, invalidErrors, err := ReadUserDataFromCsvFileContext(context.Background(), name, cexAssetsInfo)
+	return accounts, len(invalidErrors), err
+}
+
+// ReadUserDataFromCsvFileContext returns the valid accounts of the user file
+// and the errors of the invalid rows, a malformed row doesn't fail the file
+func ReadUserDataFromCsvFileContext(ctx context.Context, name string, cexAssetsInfo []CexAssetInfo) (map[int][]AccountInfo, []error, error) {
+	accounts, invalidErrors, _, err := readUserDataFromCsvFile(ctx, name, cexAssetsInfo)
+	return accounts, invalidErrors, err
+}
+
+func readUserDataFromCsvFile(ctx context.Context, name string, cexAssetsInfo []CexAssetInfo) (map[int][]AccountInfo, []error, roundingTotals, error) {
+	accounts := make(map[int][]AccountInfo)
+	invalidErrors, dropped, err := streamUserDataFromCsvFile(ctx, name, cexAssetsInfo, func(assetKey int, account *AccountInfo) error {
+		accounts[assetKey] = append(accounts[assetKey], *account)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return accounts, invalidErrors, dropped, nil
+}
+
+// StreamUserDataFromCsvFile reads the user file row by row and passes every
+// valid account to handle with the assets count tier it belongs to, the
+// account indexes start at 0 in every file. Only the current row is kept in
+// memory, handle must copy the account if it keeps it. The errors of the
+// invalid rows and the amounts the rounding dropped from the valid accounts
+// are returned, the file fails if handle returns an error.
+func StreamUserDataFromCsvFile(ctx context.Context, name string, cexAssetsInfo []CexAssetInfo,
+	handle func(assetKey int, account *AccountInfo) error) ([]error, []AssetRounding, error) {
+	invalidErrors, dropped, err := streamUserDataFromCsvFile(ctx, name, cexAssetsInfo, handle)
+	if err != nil {
+		return nil, nil, err
+	}
+	return invalidErrors, dropped.assets(cexAssetsInfo), nil
+}
+
+func streamUserDataFromCsvFile(ctx context.Context, name string, cexAssetsInfo []CexAssetInfo,
+	handle func(assetKey int, account *AccountInfo) error) ([]error, roundingTotals, error) {
 	f, err := os.Open(name)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 	defer f.Close()
-	csvReader := csv.NewReader(f)
-	data, err := csvReader.ReadAll()
+	r := bufio.NewReaderSize(f, 1<<20)
+	schemaVersion, declared, err := readUserFileSchemaVersion(name, r)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
+	}
+	csvReader := csv.NewReader(r)
+	csvReader.ReuseRecord = true
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("%s is empty", name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	columns, err := ParseUserFileHeader(name, schemaVersion, header, cexAssetsInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the rows are after the header and the schema version line
+	firstRow := 2
+	if declared {
+		firstRow = 3
 	}
 	accountIndex := 0
-	accounts := make(map[int][]AccountInfo)
-	// rn, id,
-	// equity_assetA, debt_assetA, assetA, assetA_loan, assetA_margin, assetA_portfolio_margin,
-	// equity_assetB, debt_assetB, assetB, assetB_loan, assetB_margin, assetA_portfolio_margin,
-	// ......
-	assetCounts := (len(data[0]) - 3) / 6
-	data = data[1:]
-	invalidCounts := 0
-	for i := 0; i < len(data); i++ {
-		invalidAccountFlag := false
-		var account AccountInfo
-		assets := make([]AccountAsset, 0, 8)
-		account.TotalEquity = new(big.Int).SetInt64(0)
-		account.TotalDebt = new(big.Int).SetInt64(0)
-		account.TotalCollateral = new(big.Int).SetInt64(0)
-		// first element of data[i] is ID. we use accountIndex instead
+	validAccountNum := 0
+	var invalidErrors []error
+	totals := newRoundingTotals(len(cexAssetsInfo))
+	for row := firstRow; ; row++ {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		account, dropped, invalidErr := parseUserRow(name, row, record, columns, cexAssetsInfo)
+		if invalidErr != nil {
+			invalidErrors = append(invalidErrors, invalidErr)
+			slog.Warn("account data wrong", "file", name, "row", row, "account_id", record[columns.Id], "err", invalidErr)
+			continue
+		}
+		// first element of the row is ID. we use accountIndex instead
 		account.AccountIndex = uint32(accountIndex)
-		accountId, err := hex.DecodeString(data[i][1])
-		if err != nil || len(accountId) != 32 {
-			panic("accountId is invalid: " + data[i][1])
-		}
-		account.AccountId = new(fr.Element).SetBytes(accountId).Marshal()
-		var tmpAsset AccountAsset
-		for j := 0; j < assetCounts; j++ {
-			multiplier := int64(100000000)
-			if AssetTypeForTwoDigits[cexAssetsInfo[j].Symbol] {
-				multiplier = 100
-			}
-			equity, err := ConvertFloatStrToUint64(data[i][j*6+2], multiplier)
-			if err != nil {
-				fmt.Println("the symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "equity data wrong:", err.Error())
-				invalidCounts += 1
-				invalidAccountFlag = true
-				break
-			}
-
-			debt, err := ConvertFloatStrToUint64(data[i][j*6+3], multiplier)
-			if err != nil {
-				fmt.Println("the debt symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "debt data wrong:", err.Error())
-				invalidCounts += 1
-				invalidAccountFlag = true
-				break
-			}
-
-			loan, err := ConvertFloatStrToUint64(data[i][j*6+5], multiplier)
-			if err != nil {
-				fmt.Println("the loan symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "loan data wrong:", err.Error())
-				invalidCounts += 1
-				invalidAccountFlag = true
-				break
-			}
-
-			margin, err := ConvertFloatStrToUint64(data[i][j*6+6], multiplier)
-			if err != nil {
-				fmt.Println("the margin symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "margin data wrong:", err.Error())
-				invalidCounts += 1
-				invalidAccountFlag = true
-				break
-			}
+		accountIndex += 1
+		err = handle(GetAssetsCountOfUser(account.Assets), account)
+		if err != nil {
+			return nil, nil, err
+		}
+		totals.add(dropped)
+		validAccountNum += 1
+	}
+	slog.Info("user file is parsed", "file", name, "valid", validAccountNum, "invalid", len(invalidErrors))
+	return invalidErrors, totals, nil
+}
 
-			portfolioMargin, err := ConvertFloatStrToUint64(data[i][j*6+7], multiplier)
+// parseUserRow returns the account of a row of a user file and the amounts
+// the rounding dropped from it, or the error which makes the row invalid
+func parseUserRow(name string, row int, record []string, columns *UserFileColumns, cexAssetsInfo []CexAssetInfo) (*AccountInfo, []droppedAmount, error) {
+	id := record[columns.Id]
+	accountId, err := hex.DecodeString(id)
+	if err != nil || len(accountId) != 32 {
+		return nil, nil, &ErrInvalidAccountId{File: name, Row: row, AccountId: id}
+	}
+	account := &AccountInfo{
+		AccountId:       new(fr.Element).SetBytes(accountId).Marshal(),
+		TotalEquity:     new(big.Int),
+		TotalDebt:       new(big.Int),
+		TotalCollateral: new(big.Int),
+	}
+	assets := make([]AccountAsset, 0, 8)
+	var dropped []droppedAmount
+	value := new(big.Int)
+	for j, assetColumns := range columns.Assets {
+		multiplier := amountMultiplier(&cexAssetsInfo[j])
+		var values [5]uint64
+		for p, column := range assetColumns {
+			var amount decimal.Decimal
+			values[p], amount, err = ConvertAmountStrToUint64(record[column], multiplier, AmountRounding.fieldMode(p))
 			if err != nil {
-				fmt.Println("the portfolio margin symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "portfolio margin data wrong:", err.Error())
-				invalidCounts += 1
-				invalidAccountFlag = true
-				break
+				return nil, nil, &ErrInvalidAssetValue{File: name, Row: row, AccountId: id, Symbol: cexAssetsInfo[j].Symbol, Field: userFileAssetFields[p].field, Err: err}
 			}
-
-			if equity != 0 || debt != 0 {
-				tmpAsset.Index = uint16(j)
-				tmpAsset.Equity = equity
-				tmpAsset.Debt = debt
-				tmpAsset.Loan = loan
-				tmpAsset.Margin = margin
-				tmpAsset.PortfolioMargin = portfolioMargin
-				assets = append(assets, tmpAsset)
-				assetTotalCollateral := SafeAdd(tmpAsset.Loan, tmpAsset.Margin)
-				assetTotalCollateral = SafeAdd(assetTotalCollateral, tmpAsset.PortfolioMargin)
-				if assetTotalCollateral > tmpAsset.Equity {
-					fmt.Println("account", data[i][1], "data wrong: total collateral is bigger than equity", assetTotalCollateral, tmpAsset.Equity)
-					invalidCounts += 1
-					invalidAccountFlag = true
-					break
-				}
-
-				account.TotalEquity = account.TotalEquity.Add(account.TotalEquity,
-					new(big.Int).Mul(new(big.Int).SetUint64(tmpAsset.Equity), new(big.Int).SetUint64(cexAssetsInfo[j].BasePrice)))
-				account.TotalDebt = account.TotalDebt.Add(account.TotalDebt,
-					new(big.Int).Mul(new(big.Int).SetUint64(tmpAsset.Debt), new(big.Int).SetUint64(cexAssetsInfo[j].BasePrice)))
-
-				account.TotalCollateral = account.TotalCollateral.Add(account.TotalCollateral,
-					CalculateAssetValueForCollateral(loan, margin, portfolioMargin, &cexAssetsInfo[j]))
+			if !amount.IsZero() {
+				dropped = append(dropped, droppedAmount{asset: j, field: min(p, 2), amount: amount})
 			}
 		}
-
-		if !invalidAccountFlag {
-			account.Assets = assets
-			if account.TotalCollateral.Cmp(account.TotalDebt) >= 0 {
-				accountIndex += 1
-				for p := 0; p < len(AssetCountsTiers); p++ {
-					if len(account.Assets) <= AssetCountsTiers[p] {
-						if accounts[AssetCountsTiers[p]] == nil {
-							accounts[AssetCountsTiers[p]] = make([]AccountInfo, 0, len(data))
-						}
-						accounts[AssetCountsTiers[p]] = append(accounts[AssetCountsTiers[p]], account)
-						break
-					}
-				}
-			} else {
-				invalidCounts += 1
-				fmt.Println("account", data[i][1], "data wrong: total debt is bigger than collateral:", account.TotalDebt, account.TotalCollateral)
-			}
+		asset := AccountAsset{
+			Index:           uint16(j),
+			Equity:          values[0],
+			Debt:            values[1],
+			Loan:            values[2],
+			Margin:          values[3],
+			PortfolioMargin: values[4],
 		}
-		if i%100000 == 0 {
-			runtime.GC()
+		if asset.Equity == 0 && asset.Debt == 0 {
+			continue
+		}
+		assetTotalCollateral, err := CheckedAdd(asset.Loan, asset.Margin)
+		if err == nil {
+			assetTotalCollateral, err = CheckedAdd(assetTotalCollateral, asset.PortfolioMargin)
 		}
+		if err != nil {
+			return nil, nil, &ErrInvalidAssetValue{File: name, Row: row, AccountId: id, Symbol: cexAssetsInfo[j].Symbol, Field: "collateral", Err: err}
+		}
+		if assetTotalCollateral > asset.Equity {
+			return nil, nil, &ErrCollateralExceedsEquity{File: name, Row: row, AccountId: id, Symbol: cexAssetsInfo[j].Symbol, Collateral: assetTotalCollateral, Equity: asset.Equity}
+		}
+		assets = append(assets, asset)
+		basePrice := new(big.Int).SetUint64(cexAssetsInfo[j].BasePrice)
+		account.TotalEquity.Add(account.TotalEquity, value.Mul(value.SetUint64(asset.Equity), basePrice))
+		account.TotalDebt.Add(account.TotalDebt, value.Mul(value.SetUint64(asset.Debt), basePrice))
+		account.TotalCollateral.Add(account.TotalCollateral,
+			CalculateAssetValueForCollateral(asset.Loan, asset.Margin, asset.PortfolioMargin, &cexAssetsInfo[j]))
 	}
-	fmt.Println("The invalid accounts number is ", invalidCounts)
-	validAccountNum := 0
-	for _, v := range accounts {
-		validAccountNum += len(v)
+	account.Assets = assets
+	if account.TotalCollateral.Cmp(account.TotalDebt) < 0 {
+		return nil, nil, &ErrDebtExceedsCollateral{File: name, Row: row, AccountId: id, Debt: account.TotalDebt, Collateral: account.TotalCollateral}
 	}
-	fmt.Println("The valid accounts number is ", validAccountNum)
-	return accounts, invalidCounts, nil
+	// the accounts are batched by the smallest tier of at least their assets count
+	largestTier := AssetCountsTiers[len(AssetCountsTiers)-1]
+	if len(assets) > largestTier {
+		return nil, nil, &ErrAboveLargestTier{File: name, Row: row, AccountId: id, Assets: len(assets), LargestTier: largestTier}
+	}
+	return account, dropped, nil
 }
 
 func CalculateAssetValueForCollateral(loan uint64, margin uint64, portfolioMargin uint64, cexAssetInfo *CexAssetInfo) *big.Int {
@@ -699,6 +815,21 @@ func CalculateAssetValueViaTiersRatio(collateralValue *big.Int, tiersRatio []Tie
 	return res
 }
 
+// amountMultiplier returns the multiplier of the balances of the asset in the user files
+func amountMultiplier(asset *CexAssetInfo) int64 {
+	return decimalsMultiplier(asset.AmountDecimals)
+}
+
+// HasPrecisionLoss reports whether f has more decimals than the multiplier
+// keeps, ConvertFloatStrToUint64 drops them
+func HasPrecisionLoss(f string, multiplier int64) bool {
+	numFloat, err := decimal.NewFromString(f)
+	if err != nil {
+		return false
+	}
+	return !numFloat.Mul(decimal.NewFromInt(multiplier)).IsInteger()
+}
+
 func ConvertFloatStrToUint64(f string, multiplier int64) (uint64, error) {
 	if f == "0.0" {
 		return 0, nil
@@ -709,8 +840,11 @@ func ConvertFloatStrToUint64(f string, multiplier int64) (uint64, error) {
 	}
 	numFloat = numFloat.Mul(decimal.NewFromInt(multiplier))
 	numBigInt := numFloat.BigInt()
+	if numBigInt.Sign() < 0 {
+		return 0, fmt.Errorf("%s is negative", f)
+	}
 	if !numBigInt.IsUint64() {
-		return 0, errors.New("overflow uint64")
+		return 0, ErrBalanceOverflow
 	}
 	num := numBigInt.Uint64()
 	return num, nil
@@ -720,19 +854,19 @@ func DecodeBatchWitness(data string) *BatchCreateUserWitness {
 	var witnessForCircuit BatchCreateUserWitness
 	b, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
-		fmt.Println("deserialize batch witness failed: ", err.Error())
+		slog.Error("deserialize batch witness failed", "err", err)
 		return nil
 	}
 	uncompressedData, err := s2.Decode(nil, b)
 	if err != nil {
-		fmt.Println("uncompress batch witness failed: ", err.Error())
+		slog.Error("uncompress batch witness failed", "err", err)
 		return nil
 	}
 	unserializeBuf := bytes.NewBuffer(uncompressedData)
 	dec := gob.NewDecoder(unserializeBuf)
 	err = dec.Decode(&witnessForCircuit)
 	if err != nil {
-		fmt.Println("unmarshal batch witness failed: ", err.Error())
+		slog.Error("unmarshal batch witness failed", "err", err)
 		return nil
 	}
 	for i := 0; i < len(witnessForCircuit.CreateUserOps); i++ {
@@ -756,24 +890,44 @@ func DecodeBatchWitness(data string) *BatchCreateUserWitness {
 	return &witnessForCircuit
 }
 
-func AccountInfoToHash(account *AccountInfo, hasher *hash.Hash) []byte {
-	assetCommitment := ComputeUserAssetsCommitment(hasher, account.Assets)
+func AccountInfoToHash(account *AccountInfo, hasher *hash.Hash) ([]byte, error) {
+	assetCommitment, err := ComputeUserAssetsCommitment(hasher, account.Assets)
+	if err != nil {
+		return nil, fmt.Errorf("account %d: %w", account.AccountIndex, err)
+	}
 	(*hasher).Reset()
 	// compute new account leaf node hash
 	accountHash := poseidon.PoseidonBytes(account.AccountId, account.TotalEquity.Bytes(), account.TotalDebt.Bytes(), account.TotalCollateral.Bytes(), assetCommitment)
-	return accountHash
+	return accountHash, nil
 }
 
-func RecoverAfterCexAssets(witness *BatchCreateUserWitness) []CexAssetInfo {
+// RecoverAfterCexAssets adds the assets of the users of the witness to its
+// before cex assets, and checks them against its after cex assets commitment
+func RecoverAfterCexAssets(witness *BatchCreateUserWitness) ([]CexAssetInfo, error) {
 	cexAssets := witness.BeforeCexAssets
 	for i := 0; i < len(witness.CreateUserOps); i++ {
 		for j := 0; j < len(witness.CreateUserOps[i].Assets); j++ {
 			asset := &witness.CreateUserOps[i].Assets[j]
-			cexAssets[asset.Index].TotalEquity = SafeAdd(cexAssets[asset.Index].TotalEquity, asset.Equity)
-			cexAssets[asset.Index].TotalDebt = SafeAdd(cexAssets[asset.Index].TotalDebt, asset.Debt)
-			cexAssets[asset.Index].LoanCollateral = SafeAdd(cexAssets[asset.Index].LoanCollateral, asset.Loan)
-			cexAssets[asset.Index].MarginCollateral = SafeAdd(cexAssets[asset.Index].MarginCollateral, asset.Margin)
-			cexAssets[asset.Index].PortfolioMarginCollateral = SafeAdd(cexAssets[asset.Index].PortfolioMarginCollateral, asset.PortfolioMargin)
+			if int(asset.Index) >= len(cexAssets) {
+				return nil, fmt.Errorf("asset index %d of account %d is out of the cex assets", asset.Index, witness.CreateUserOps[i].AccountIndex)
+			}
+			cexAsset := &cexAssets[asset.Index]
+			for _, v := range []struct {
+				total *uint64
+				value uint64
+			}{
+				{&cexAsset.TotalEquity, asset.Equity},
+				{&cexAsset.TotalDebt, asset.Debt},
+				{&cexAsset.LoanCollateral, asset.Loan},
+				{&cexAsset.MarginCollateral, asset.Margin},
+				{&cexAsset.PortfolioMarginCollateral, asset.PortfolioMargin},
+			} {
+				total, err := CheckedAdd(*v.total, v.value)
+				if err != nil {
+					return nil, fmt.Errorf("%s of account %d: %w", cexAsset.Symbol, witness.CreateUserOps[i].AccountIndex, err)
+				}
+				*v.total = total
+			}
 		}
 	}
 	// sanity check
@@ -786,23 +940,16 @@ func RecoverAfterCexAssets(witness *BatchCreateUserWitness) []CexAssetInfo {
 	}
 	cexCommitment := hasher.Sum(nil)
 	if string(cexCommitment) != string(witness.AfterCEXAssetsCommitment) {
-		panic("after cex commitment verify failed")
+		return nil, &ErrCommitmentMismatch{Name: "after cex assets commitment", Expected: witness.AfterCEXAssetsCommitment, Actual: cexCommitment}
 	}
-	return cexAssets
+	return cexAssets, nil
 }
 
 func ComputeCexAssetsCommitment(cexAssetsInfo []CexAssetInfo) []byte {
 	hasher := poseidon.NewPoseidon()
 	emptyCexAssets := make([]CexAssetInfo, AssetCounts-len(cexAssetsInfo))
 	for i := len(cexAssetsInfo); i < AssetCounts; i++ {
-		emptyCexAssets[i-len(cexAssetsInfo)] = CexAssetInfo{
-			Symbol:                "reserved",
-			BasePrice:             0,
-			LoanRatios:            PaddingTierRatios([]TierRatio{}),
-			MarginRatios:          PaddingTierRatios([]TierRatio{}),
-			PortfolioMarginRatios: PaddingTierRatios([]TierRatio{}),
-			Index:                 uint32(i),
-		}
+		emptyCexAssets[i-len(cexAssetsInfo)] = paddingCexAsset(i)
 	}
 	cexAssetsInfo = append(cexAssetsInfo, emptyCexAssets...)
 	for i := 0; i < len(cexAssetsInfo); i++ {
@@ -815,41 +962,10 @@ func ComputeCexAssetsCommitment(cexAssetsInfo []CexAssetInfo) []byte {
 }
 
 func PaddingAccounts(accounts []AccountInfo, assetKey int, paddingStartIndex int) (int, []AccountInfo) {
-	opsPerBatch := BatchCreateUserOpsCountsTiers[assetKey]
-	batchCounts := (len(accounts) + opsPerBatch - 1) / opsPerBatch
-	paddingAccountCounts := batchCounts*opsPerBatch - len(accounts)
+	paddingAccountCounts := PaddedAccountsCount(assetKey, len(accounts)) - len(accounts)
 	for i := 0; i < paddingAccountCounts; i++ {
-		assets := make([]AccountAsset, assetKey)
-		for j := 0; j < assetKey; j++ {
-			assets[j] = AccountAsset{
-				Index:           uint16(j),
-				Equity:          0,
-				Debt:            0,
-				Loan:            0,
-				Margin:          0,
-				PortfolioMargin: 0,
-			}
-		}
-		accounts = append(accounts, AccountInfo{
-			AccountIndex:    uint32(paddingStartIndex),
-			TotalEquity:     new(big.Int).SetInt64(0),
-			TotalDebt:       new(big.Int).SetInt64(0),
-			TotalCollateral: new(big.Int).SetInt64(0),
-			Assets:          assets,
-		})
+		accounts = append(accounts, *paddingAccount(assetKey, paddingStartIndex))
 		paddingStartIndex += 1
 	}
 	return paddingStartIndex, accounts
 }
-
-func ConvertMysqlErrToDbErr(err error) error {
-	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
-		if mysqlErr.Number == 1317 {
-			return DbErrQueryInterrupted
-		}
-		if mysqlErr.Number == 3024 {
-			return DbErrQueryTimeout
-		}
-	}
-	return err
-}
\ No newline at end of file
@@ -2,6 +2,8 @@ package utils
 
 import (
 	// "encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 
@@ -12,19 +14,32 @@ import (
 	"testing"
 )
 
+// ComputeAssetsCommitmentForTest pads the assets of the user to its tier
+// with the zero assets of the lowest unused indexes and hashes the index,
+// equity, debt, loan, margin and portfolio margin of every asset
 func ComputeAssetsCommitmentForTest(userAssets []AccountAsset) []byte {
-	nEles := (AssetCounts*5 + 2) / 3
-	flattenUserAssets := make([]uint64, 3*nEles)
-	for i := 0; i < AssetCounts; i++ {
-		flattenUserAssets[5*i] = userAssets[i].Equity
-		flattenUserAssets[5*i+1] = userAssets[i].Debt
-		flattenUserAssets[5*i+2] = userAssets[i].Loan
-		flattenUserAssets[5*i+3] = userAssets[i].Margin
-		flattenUserAssets[5*i+4] = userAssets[i].PortfolioMargin
+	targetCounts := GetAssetsCountOfUser(userAssets)
+	assetsByIndex := make(map[uint16]AccountAsset, len(userAssets))
+	for _, asset := range userAssets {
+		assetsByIndex[asset.Index] = asset
+	}
+	flattenUserAssets := make([]uint64, 0, 6*targetCounts)
+	paddingCounts := targetCounts - len(userAssets)
+	for i := 0; len(flattenUserAssets) < 6*targetCounts; i++ {
+		asset, ok := assetsByIndex[uint16(i)]
+		if !ok {
+			if paddingCounts == 0 {
+				continue
+			}
+			paddingCounts--
+			asset = AccountAsset{Index: uint16(i)}
+		}
+		flattenUserAssets = append(flattenUserAssets, uint64(asset.Index), asset.Equity, asset.Debt,
+			asset.Loan, asset.Margin, asset.PortfolioMargin)
 	}
 
 	hasher := poseidon.NewPoseidon()
-	for i := 0; i < nEles; i++ {
+	for i := 0; i < len(flattenUserAssets)/3; i++ {
 		aBigInt := new(big.Int).SetUint64(flattenUserAssets[3*i])
 		bBigInt := new(big.Int).SetUint64(flattenUserAssets[3*i+1])
 		cBigInt := new(big.Int).SetUint64(flattenUserAssets[3*i+2])
@@ -39,7 +54,6 @@ func ComputeAssetsCommitmentForTest(userAssets []AccountAsset) []byte {
 }
 
 func TestComputeUserAssetsCommitment(t *testing.T) {
-	userAssets := make([]AccountAsset, AssetCounts)
 	testUserAssets1 := make([]AccountAsset, 10)
 	for i := 0; i < 10; i++ {
 		testUserAssets1[i].Index = uint16(3 * i)
@@ -48,67 +62,57 @@ func TestComputeUserAssetsCommitment(t *testing.T) {
 		testUserAssets1[i].Loan = uint64(i*10 + 100)
 		testUserAssets1[i].Margin = uint64(i*10 + 100)
 		testUserAssets1[i].PortfolioMargin = uint64(i*10 + 100)
-
-		userAssets[testUserAssets1[i].Index].Equity = testUserAssets1[i].Equity
-		userAssets[testUserAssets1[i].Index].Debt = testUserAssets1[i].Debt
-		userAssets[testUserAssets1[i].Index].Loan = testUserAssets1[i].Loan
-		userAssets[testUserAssets1[i].Index].Margin = testUserAssets1[i].Margin
-		userAssets[testUserAssets1[i].Index].PortfolioMargin = testUserAssets1[i].PortfolioMargin
-	}
-	for i := 0; i < AssetCounts; i++ {
-		userAssets[i].Index = uint16(i)
 	}
-	expectHash := ComputeAssetsCommitmentForTest(userAssets)
+	expectHash := ComputeAssetsCommitmentForTest(testUserAssets1)
 
 	hasher := poseidon.NewPoseidon()
 	hasher.Reset()
-	actualHash := ComputeUserAssetsCommitment(&hasher, testUserAssets1)
+	actualHash, err := ComputeUserAssetsCommitment(&hasher, testUserAssets1)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if string(expectHash) != string(actualHash) {
 		t.Errorf("not match: %x:%x\n", expectHash, actualHash)
 	}
 
 	// case 2
-	userAssets = make([]AccountAsset, AssetCounts)
-	for i := 0; i < AssetCounts; i++ {
-		userAssets[i].Index = uint16(i)
-	}
 	for i := 0; i < 10; i++ {
 		testUserAssets1[i].Index = uint16(3*i) + 2
-		testUserAssets1[i].Equity = uint64(i*10 + 1000)
-		testUserAssets1[i].Debt = uint64(i*10 + 500)
-		testUserAssets1[i].Loan = uint64(i*10 + 100)
-		testUserAssets1[i].Margin = uint64(i*10 + 100)
-		testUserAssets1[i].PortfolioMargin = uint64(i*10 + 100)
-
-		userAssets[testUserAssets1[i].Index].Equity = testUserAssets1[i].Equity
-		userAssets[testUserAssets1[i].Index].Debt = testUserAssets1[i].Debt
-		userAssets[testUserAssets1[i].Index].Loan = testUserAssets1[i].Loan
-		userAssets[testUserAssets1[i].Index].Margin = testUserAssets1[i].Margin
-		userAssets[testUserAssets1[i].Index].PortfolioMargin = testUserAssets1[i].PortfolioMargin
 	}
-
-	expectHash = ComputeAssetsCommitmentForTest(userAssets)
+	expectHash = ComputeAssetsCommitmentForTest(testUserAssets1)
 
 	hasher.Reset()
-	actualHash = ComputeUserAssetsCommitment(&hasher, testUserAssets1)
+	actualHash, err = ComputeUserAssetsCommitment(&hasher, testUserAssets1)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if string(expectHash) != string(actualHash) {
 		t.Errorf("not match: %x:%x\n", expectHash, actualHash)
 	}
 
-	// case 2
-	userAssets = make([]AccountAsset, AssetCounts)
-	for i := 0; i < AssetCounts; i++ {
+	// case 3: the user has every asset of the largest tier
+	userAssets := make([]AccountAsset, AssetCountsTiers[len(AssetCountsTiers)-1])
+	for i := 0; i < len(userAssets); i++ {
 		userAssets[i].Index = uint16(i)
 		userAssets[i].Equity = uint64(i*10 + 1000)
 		userAssets[i].Debt = uint64(i*10 + 500)
 	}
 	expectHash = ComputeAssetsCommitmentForTest(userAssets)
 	hasher.Reset()
-	actualHash = ComputeUserAssetsCommitment(&hasher, userAssets)
+	actualHash, err = ComputeUserAssetsCommitment(&hasher, userAssets)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if string(expectHash) != string(actualHash) {
 		t.Errorf("not match: %x:%x\n", expectHash, actualHash)
 	}
 
+	// a user with more assets than the largest tier has no commitment
+	_, err = ComputeUserAssetsCommitment(&hasher, make([]AccountAsset, len(userAssets)+1))
+	var tooManyAssets *ErrTooManyAssets
+	if !errors.As(err, &tooManyAssets) {
+		t.Errorf("expected too many assets, got %v", err)
+	}
 }
 
 func TestParseUserDataSet(t *testing.T) {
@@ -152,6 +156,51 @@ func TestParseUserDataSet(t *testing.T) {
 
 }
 
+func TestParseUserDataSetErrors(t *testing.T) {
+	accounts, _, err := ParseUserDataSetContext(context.Background(), "../sampledata")
+	var invalidAccounts *ErrInvalidAccounts
+	if !errors.As(err, &invalidAccounts) {
+		t.Fatalf("expected invalid accounts error, got %v", err)
+	}
+	if len(invalidAccounts.Errors) != 30 {
+		t.Errorf("expected 30 invalid accounts, got %d", len(invalidAccounts.Errors))
+	}
+	totalNum := 0
+	for _, v := range accounts {
+		totalNum += len(v)
+	}
+	if totalNum != 170 {
+		t.Errorf("expected 170 valid accounts, got %d", totalNum)
+	}
+	for _, e := range invalidAccounts.Errors {
+		var debtErr *ErrDebtExceedsCollateral
+		var collateralErr *ErrCollateralExceedsEquity
+		var valueErr *ErrInvalidAssetValue
+		var idErr *ErrInvalidAccountId
+		switch {
+		case errors.As(e, &debtErr):
+			if debtErr.File == "" || debtErr.Row < 2 {
+				t.Errorf("no position in %v", e)
+			}
+		case errors.As(e, &collateralErr), errors.As(e, &valueErr), errors.As(e, &idErr):
+		default:
+			t.Errorf("unexpected error type %T: %v", e, e)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = ParseUserDataSetContext(ctx, "../sampledata")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+
+	_, _, err = ParseUserDataSet(t.TempDir())
+	if !errors.Is(err, ErrNoUserFile) {
+		t.Errorf("expected no user file, got %v", err)
+	}
+}
+
 func TestParseCexAssetInfoFromFile(t *testing.T) {
 	cf, err := os.Open("./cex_assets_info.csv")
 	if err != nil {
@@ -163,15 +212,10 @@ func TestParseCexAssetInfoFromFile(t *testing.T) {
 	if err != nil {
 		t.Error(err.Error())
 	}
-	data = data[1:]
-	assetIndexes := make([]string, len(data))
-	for i, d := range data {
-		assetIndexes[i] = d[0]
-	}
-	fmt.Println("assetIndexes: ", len(assetIndexes))
-	cexAssetsInfo, err := ParseCexAssetInfoFromFile("./cex_assets_info.csv", assetIndexes)
+	fmt.Println("assets: ", len(data)-1)
+	cexAssetsInfo, err := ParseCexAssetInfoFromFile("./cex_assets_info.csv")
 	if err != nil {
-		t.Errorf("error: %s\n", err.Error())
+		t.Fatalf("error: %s\n", err.Error())
 	}
 	actualAssetsCount := 0
 	for _, v := range cexAssetsInfo {
@@ -182,5 +226,64 @@ func TestParseCexAssetInfoFromFile(t *testing.T) {
 	if actualAssetsCount != 326 {
 		t.Errorf("error: %d\n", actualAssetsCount)
 	}
+	// the assets are indexed in the order of the rows, the file has no decimals columns
+	for i := 0; i < len(data)-1; i++ {
+		if cexAssetsInfo[i].Symbol != data[i+1][0] || cexAssetsInfo[i].Index != uint32(i) {
+			t.Fatalf("asset %d is %s of index %d", i, cexAssetsInfo[i].Symbol, cexAssetsInfo[i].Index)
+		}
+		if int(cexAssetsInfo[i].AmountDecimals)+int(cexAssetsInfo[i].PriceDecimals) != AssetValueDecimals {
+			t.Fatalf("the decimals of %s don't add up to %d", cexAssetsInfo[i].Symbol, AssetValueDecimals)
+		}
+	}
 	fmt.Println("cexAssetsInfo: ", cexAssetsInfo[0].PortfolioMarginRatios)
 }
+
+func TestCexAssetDecimals(t *testing.T) {
+	// the files without the decimals columns keep the decimals of AssetTypeForTwoDigits
+	cexAssetsInfo, err := ParseCexAssetInfoFromFile("../sampledata/cex_assets_info.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cexAssetsInfo[0].AmountDecimals != 8 || cexAssetsInfo[0].PriceDecimals != 8 ||
+		cexAssetsInfo[3].AmountDecimals != 2 || cexAssetsInfo[3].PriceDecimals != 14 || cexAssetsInfo[4].AmountDecimals != DefaultAmountDecimals {
+		t.Errorf("unexpected decimals %v", cexAssetsInfo[:5])
+	}
+
+	name := t.TempDir() + "/cex_assets_info.csv"
+	write := func(content string) {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("symbol,usdt_price,loan_tiers_ratio,margin_tiers_ratio,portfolio_tiers_ratio,amount_decimals,price_decimals\n" +
+		"btc,65100.22,[],[],[],8,8\nshib,0.0000123,[],[],[],0,16\n")
+	cexAssetsInfo, err = ParseCexAssetInfoFromFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cexAssetsInfo[1].AmountDecimals != 0 || cexAssetsInfo[1].BasePrice != 123000000000 || cexAssetsInfo[0].BasePrice != 6510022000000 {
+		t.Errorf("unexpected assets %v", cexAssetsInfo[:2])
+	}
+	if amountMultiplier(&cexAssetsInfo[1]) != 1 || amountMultiplier(&cexAssetsInfo[0]) != 100000000 {
+		t.Errorf("unexpected amount multipliers")
+	}
+	// the decimals are committed with the asset
+	withoutDecimals := cexAssetsInfo[0]
+	withoutDecimals.AmountDecimals, withoutDecimals.PriceDecimals = 0, 0
+	a, b := ConvertAssetInfoToBytes(cexAssetsInfo[0])[0], ConvertAssetInfoToBytes(withoutDecimals)[0]
+	diff := new(big.Int).Sub(new(big.Int).SetBytes(a), new(big.Int).SetBytes(b))
+	if diff.Cmp(new(big.Int).Mul(big.NewInt(8<<8|8), Uint64MaxValueBigIntCube)) != 0 {
+		t.Errorf("unexpected commitment of the decimals %s", diff.String())
+	}
+
+	write("symbol,usdt_price,loan_tiers_ratio,margin_tiers_ratio,portfolio_tiers_ratio,amount_decimals,price_decimals\nbtc,65100.22,[],[],[],8,9\n")
+	_, err = ParseCexAssetInfoFromFile(name)
+	if err == nil {
+		t.Error("expected decimals which don't add up to AssetValueDecimals to fail")
+	}
+	write("symbol,usdt_price,loan_tiers_ratio,margin_tiers_ratio,portfolio_tiers_ratio,amount_decimals\nbtc,65100.22,[],[],[],8\n")
+	_, err = ParseCexAssetInfoFromFile(name)
+	if err == nil {
+		t.Error("expected a missing price_decimals column to fail")
+	}
+}
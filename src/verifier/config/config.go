@@ -7,9 +7,20 @@ import (
 
 type Config struct {
 	ProofTable    string
-	ZkKeyName     []string
-	AssetsCountTiers []int
+	// TierManifest is the tier manifest file shared by all the services
+	TierManifest  string
+	// ZkKeyDir is the directory of the verifying keys of the tiers of the manifest
+	ZkKeyDir      string
 	CexAssetsInfo []utils.CexAssetInfo
+	// ProvingSystem is groth16 (default) or plonk
+	ProvingSystem string
+	// ProofTarget must match the prover config the batch proofs were generated with
+	ProofTarget string
+	// AggregationKeyName is the prefix of the aggregation keys, the node verifying key verifies the aggregated proof
+	AggregationKeyName  string
+	AggregatedProofFile string
+	// Log is the level and format of the logs, the verification results are always printed
+	Log utils.LogConfig
 }
 
 type UserConfig struct {
@@ -1,48 +1,41 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"math/big"
 	"os"
-	"strconv"
-	"runtime"
-	"sync"
+	"strings"
 
 	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/pkg/por"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/config"
-	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/verifier"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
-	"github.com/consensys/gnark/backend/groth16"
-	"github.com/consensys/gnark/frontend"
-	"github.com/gocarina/gocsv"
 )
 
-func LoadVerifyingKey(vkFileName string) (groth16.VerifyingKey, error) {
-	vkFile, err := os.ReadFile(vkFileName)
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(vkFile)
-	vk := groth16.NewVerifyingKey(ecc.BN254)
-	_, err = vk.ReadFrom(buf)
-	if err != nil {
-		return nil, err
-	}
-	return vk, nil
-}
-
-
 func main() {
 	userFlag := flag.Bool("user", false, "flag which indicates user proof verification")
 	hashFlag := flag.Bool("hash", false, "flag which indicates hash command")
+	aggregationFlag := flag.Bool("aggregation", false, "flag which indicates aggregated proof verification")
+	calldataBatch := flag.Int64("calldata", -1, "print the Solidity verifier calldata of the batch proof")
+	reportFile := flag.String("report", "", "write a machine-readable verification report to the json file")
+	tierManifestFile := flag.String("tiers", "", "tier manifest file of the user proof, the built-in tiers are used if it is empty")
 	flag.Parse()
 	if *userFlag {
+		tierManifest, err := utils.LoadTierManifest(*tierManifestFile)
+		if err != nil {
+			panic(err.Error())
+		}
+		tierManifest.Apply()
+
 		userConfig := &config.UserConfig{}
 		content, err := ioutil.ReadFile("config/user_config.json")
 		if err != nil {
@@ -68,7 +61,10 @@ func main() {
 
 		// padding user assets
 		hasher := poseidon.NewPoseidon()
-		assetCommitment := utils.ComputeUserAssetsCommitment(&hasher, userConfig.Assets)
+		assetCommitment, err := utils.ComputeUserAssetsCommitment(&hasher, userConfig.Assets)
+		if err != nil {
+			panic(err.Error())
+		}
 		hasher.Reset()
 		// compute new account leaf node hash
 		accountIdHash, err := hex.DecodeString(userConfig.AccountIdHash)
@@ -115,200 +111,142 @@ func main() {
 			panic(err.Error())
 		}
 
-		f, err := os.Open(verifierConfig.ProofTable)
+		err = utils.InitLogger("verifier", "", verifierConfig.Log)
 		if err != nil {
 			panic(err.Error())
 		}
-		defer f.Close()
-		// index 4: proof_info, index 5: cex_asset_list_commitments
-		// index 6: account_tree_roots, index 7: batch_commitment
-		// index 8: batch_number
-		type Proof struct {
-			BatchNumber        int64    `csv:"batch_number"`
-			ZkProof            string   `csv:"proof_info"`
-			CexAssetCommitment []string `csv:"cex_asset_list_commitments"`
-			AccountTreeRoots   []string `csv:"account_tree_roots"`
-			BatchCommitment    string   `csv:"batch_commitment"`
-			AssetsCount        int      `csv:"assets_count"`
-		}
-		tmpProofs := []*Proof{}
 
-		err = gocsv.UnmarshalFile(f, &tmpProofs)
+		tierManifest, err := utils.LoadTierManifest(verifierConfig.TierManifest)
 		if err != nil {
 			panic(err.Error())
 		}
+		tierManifest.Apply()
+		slog.Info("tier manifest is loaded", "hash", tierManifest.Hash)
 
-		proofs := make([]Proof, len(tmpProofs))
-		for i := 0; i < len(tmpProofs); i++ {
-			proofs[tmpProofs[i].BatchNumber] = *tmpProofs[i]
-		}
-
-		prevCexAssetListCommitments := make([][]byte, 2)
-		prevAccountTreeRoots := make([][]byte, 2)
-		// depth-28 empty account tree root
-		emptyAccountTreeRoot, err := hex.DecodeString("08696bfcb563a2ee4dde9e1dbd34f68d3f4643df6e3709cdb1855c9f886240c7")
-		if err != nil {
-			fmt.Println("wrong empty empty account tree root")
+		if *calldataBatch >= 0 {
+			printSolidityCalldata(verifierConfig, tierManifest, *calldataBatch)
 			return
 		}
-		prevAccountTreeRoots[1] = emptyAccountTreeRoot
-		// according to asset price info to compute
-		cexAssetsInfo := make([]utils.CexAssetInfo, len(verifierConfig.CexAssetsInfo))
-		for i := 0; i < len(verifierConfig.CexAssetsInfo); i++ {
-			cexAssetsInfo[verifierConfig.CexAssetsInfo[i].Index] = verifierConfig.CexAssetsInfo[i]
-			if verifierConfig.CexAssetsInfo[i].TotalEquity < verifierConfig.CexAssetsInfo[i].TotalDebt {
-				fmt.Printf("%s asset equity %d less then debt %d\n", verifierConfig.CexAssetsInfo[i].Symbol, verifierConfig.CexAssetsInfo[i].TotalEquity, verifierConfig.CexAssetsInfo[i].TotalDebt)
-				panic("invalid cex asset info")
+
+		if *aggregationFlag {
+			emptyAccountTreeRoot, emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm, err := verifier.ExpectedCommitments(verifierConfig.CexAssetsInfo)
+			if err != nil {
+				panic(err.Error())
 			}
+			aggregatedProof, err := verifier.ReadAggregatedProof(verifierConfig.AggregatedProofFile)
+			if err != nil {
+				panic(err.Error())
+			}
+			err = tierManifest.Check(aggregatedProof.TierManifestHash)
+			if err != nil {
+				fmt.Println(verifier.FailureTierManifest + ": " + err.Error())
+				fmt.Println("Aggregated proof verify failed!!!")
+				os.Exit(1)
+			}
+			err = verifier.VerifyAggregatedProof(utils.AggregationNodeKeyName(verifierConfig.AggregationKeyName)+".vk", aggregatedProof,
+				emptyAccountTreeRoot, emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm)
+			if err != nil {
+				fmt.Println(err.Error())
+				fmt.Println("Aggregated proof verify failed!!!")
+				os.Exit(1)
+			}
+			fmt.Printf("account merkle tree root is %x\n", aggregatedProof.AfterAccountTreeRoot)
+			fmt.Println("Aggregated proof verify passed!!!")
+			return
 		}
-		emptyCexAssetsInfo := make([]utils.CexAssetInfo, len(cexAssetsInfo))
-		copy(emptyCexAssetsInfo, cexAssetsInfo)
-		for i := 0; i < len(emptyCexAssetsInfo); i++ {
-			emptyCexAssetsInfo[i].TotalDebt = 0
-			emptyCexAssetsInfo[i].TotalEquity = 0
-			emptyCexAssetsInfo[i].LoanCollateral = 0
-			emptyCexAssetsInfo[i].MarginCollateral = 0
-			emptyCexAssetsInfo[i].PortfolioMarginCollateral = 0
-		}
-		emptyCexAssetListCommitment := utils.ComputeCexAssetsCommitment(emptyCexAssetsInfo)
-		expectFinalCexAssetsInfoComm := utils.ComputeCexAssetsCommitment(cexAssetsInfo)
-		prevCexAssetListCommitments[1] = emptyCexAssetListCommitment
-		var finalCexAssetsInfoComm []byte
-		var accountTreeRoot []byte
 
-		workersNum := 16
-		if runtime.NumCPU() > workersNum {
-			workersNum = runtime.NumCPU()
-		}
-		averageProofCount := (len(proofs) + workersNum - 1) / workersNum
-		
-		type ProofMetaData struct {
-			accountTreeRoots [][]byte
-			cexAssetListCommitments [][]byte
-		}
-		type SafeProofMap struct {
-			sync.Mutex
-			proofMap map[int]ProofMetaData
+		proofs, err := verifier.ReadProofTable(verifierConfig.ProofTable)
+		if err != nil {
+			panic(err.Error())
 		}
-		safeProofMap := &SafeProofMap{proofMap: make(map[int]ProofMetaData)}
-		var wg sync.WaitGroup
-		for i := 0; i < workersNum; i++ {
-			wg.Add(1)
-			go func(index int) {
-				defer wg.Done()
-				var vk groth16.VerifyingKey
-				currentAssetCountsTier := 0
-				startIndex := index * averageProofCount
-				endIndex := (index + 1) * averageProofCount
-				if endIndex > len(proofs) {
-					endIndex = len(proofs)
-				}
-				for j := startIndex; j < endIndex; j++ {
-					batchNumber := int(proofs[j].BatchNumber)
-					// first deserialize proof
-					proof := groth16.NewProof(ecc.BN254)
-					var bufRaw bytes.Buffer
-					proofRaw, err := base64.StdEncoding.DecodeString(proofs[j].ZkProof)
-					if err != nil {
-						fmt.Println("decode proof failed:", batchNumber)
-						panic("verify proof " + strconv.Itoa(batchNumber) + " failed")
-					}
-					bufRaw.Write(proofRaw)
-					proof.ReadFrom(&bufRaw)
-					// deserialize cex asset list commitment and account tree root
-					cexAssetListCommitments := make([][]byte, 2)
-					accountTreeRoots := make([][]byte, 2)
-
-					for p := 0; p < len(proofs[j].CexAssetCommitment); p++ {
-						cexAssetListCommitments[p], err = base64.StdEncoding.DecodeString(proofs[j].CexAssetCommitment[p])
-						if err != nil {
-							fmt.Println("decode cex asset commitment failed")
-							panic(err.Error())
-						}
-					}
-					for p := 0; p < len(proofs[j].AccountTreeRoots); p++ {
-						accountTreeRoots[p], err = base64.StdEncoding.DecodeString(proofs[j].AccountTreeRoots[p])
-						if err != nil {
-							fmt.Println("decode account tree root failed")
-							panic(err.Error())
-						}
-					}
-					// verify the public input is correctly computed by cex asset list and account tree root
-					poseidonHasher := poseidon.NewPoseidon()
-					poseidonHasher.Write(accountTreeRoots[0])
-					poseidonHasher.Write(accountTreeRoots[1])
-					poseidonHasher.Write(cexAssetListCommitments[0])
-					poseidonHasher.Write(cexAssetListCommitments[1])
-					expectHash := poseidonHasher.Sum(nil)
-					actualHash, err := base64.StdEncoding.DecodeString(proofs[j].BatchCommitment)
-					if err != nil {
-						fmt.Println("decode batch commitment failed", batchNumber)
-						panic("verify proof " + strconv.Itoa(batchNumber) + " failed")
-					}
-					if string(expectHash) != string(actualHash) {
-						fmt.Println("public input verify failed ", batchNumber)
-						fmt.Printf("%x:%x\n", expectHash, actualHash)
-						panic("verify proof " + strconv.Itoa(batchNumber) + " failed")
-					}
-					safeProofMap.Lock()
-					safeProofMap.proofMap[int(batchNumber)] = ProofMetaData{accountTreeRoots: accountTreeRoots, cexAssetListCommitments: cexAssetListCommitments}
-					safeProofMap.Unlock()
-					verifyWitness := circuit.NewVerifyBatchCreateUserCircuit(actualHash)
-					vWitness, err := frontend.NewWitness(verifyWitness, ecc.BN254.ScalarField(), frontend.PublicOnly())
-					if err != nil {
-						panic(err.Error())
-					}
-					if proofs[j].AssetsCount != currentAssetCountsTier {
-						index := -1
-						for p := 0; p < len(verifierConfig.AssetsCountTiers); p++ {
-							if verifierConfig.AssetsCountTiers[p] == proofs[j].AssetsCount {
-								index = p
-								break
-							}
-						}
-						if index == -1 {
-							panic("invalid asset counts tier")
-						}
-						vk, err = LoadVerifyingKey(verifierConfig.ZkKeyName[index] + ".vk")
-						if err != nil {
-							panic(err.Error())
-						}
-						currentAssetCountsTier = proofs[j].AssetsCount
-					}
-					err = groth16.Verify(proof, vk, vWitness)
-					if err != nil {
-						fmt.Println("proof verify failed:", batchNumber, err.Error())
-						return
-					} else {
-						fmt.Println("proof verify success", batchNumber)
-					}
-				}
-
-			}(i)
+		report, err := por.VerifyRound(context.Background(), proofs, por.VerifyOptions{
+			TierManifest:  tierManifest,
+			ZkKeyDir:      verifierConfig.ZkKeyDir,
+			ProvingSystem: verifierConfig.ProvingSystem,
+			ProofTarget:   verifierConfig.ProofTarget,
+			CexAssets:     verifierConfig.CexAssetsInfo,
+		})
+		if err != nil {
+			panic(err.Error())
 		}
-
-		wg.Wait()
-		for batchNumber := 0; batchNumber < len(proofs); batchNumber++ {
-			proofData, ok := safeProofMap.proofMap[batchNumber]
-			if !ok {
-				panic("proof data not found: " + strconv.Itoa(batchNumber))
-			}
-			if string(proofData.accountTreeRoots[0]) != string(prevAccountTreeRoots[1]) {
-				panic("account tree root not match: " + strconv.Itoa(batchNumber))
+		report.ProofTable = verifierConfig.ProofTable
+		if *reportFile != "" {
+			err = report.WriteToFile(*reportFile)
+			if err != nil {
+				fmt.Println("write verification report failed:", err.Error())
+				os.Exit(1)
 			}
-			if string(proofData.cexAssetListCommitments[0]) != string(prevCexAssetListCommitments[1]) {
-				panic("cex asset list commitment not match: " + strconv.Itoa(batchNumber))
+			fmt.Println("verification report is written to", *reportFile)
+		}
+		if report.Verdict != verifier.VerdictPassed {
+			fmt.Println("the following", len(report.Failures), "checks failed:")
+			for _, failure := range report.Failures {
+				fmt.Println(failure.Error())
 			}
-			prevAccountTreeRoots = proofData.accountTreeRoots
-			prevCexAssetListCommitments = proofData.cexAssetListCommitments
-			accountTreeRoot = proofData.accountTreeRoots[1]
-			finalCexAssetsInfoComm = proofData.cexAssetListCommitments[1]
+			fmt.Println("Proofs verify failed!!!")
+			os.Exit(1)
 		}
+		fmt.Printf("account merkle tree root is %s\n", report.AccountTreeRoot)
+		fmt.Println("All proofs verify passed!!!")
+	}
+}
 
-		if string(finalCexAssetsInfoComm) != string(expectFinalCexAssetsInfoComm) {
-			panic("Final Cex Assets Info Not Match")
+// printSolidityCalldata prints the calldata of the batch proof, which is
+// verified with the solidity proof target first: the exported verifier
+// rejects the proofs of another target whose commitments are hashed differently
+func printSolidityCalldata(verifierConfig *config.Config, tierManifest *utils.TierManifest, batchNumber int64) {
+	if verifierConfig.ProofTarget != circuit.ProofTargetSolidity {
+		fmt.Printf("calldata needs the proofs of ProofTarget %s, the config has %q\n", circuit.ProofTargetSolidity, verifierConfig.ProofTarget)
+		os.Exit(1)
+	}
+	provingSystem, err := circuit.NewProvingSystem(verifierConfig.ProvingSystem)
+	if err != nil {
+		panic(err.Error())
+	}
+	v, err := verifier.NewVerifier(provingSystem, tierManifest.ZkKeyNames(verifierConfig.ZkKeyDir), tierManifest.AssetsCountTiers())
+	if err != nil {
+		panic(err.Error())
+	}
+	v.TierManifest = tierManifest
+	v.VerifierOptions, err = provingSystem.VerifierOptions(circuit.ProofTargetSolidity)
+	if err != nil {
+		panic(err.Error())
+	}
+	proofs, err := verifier.ReadProofTable(verifierConfig.ProofTable)
+	if err != nil {
+		panic(err.Error())
+	}
+	for _, p := range proofs {
+		if p.BatchNumber != batchNumber {
+			continue
 		}
-		fmt.Printf("account merkle tree root is %x\n", accountTreeRoot)
-		fmt.Println("All proofs verify passed!!!")
+		if res := v.VerifyBatch(p); !res.Passed() {
+			fmt.Println("the proof doesn't verify with the solidity proof target:", res.Failure.Error())
+			os.Exit(1)
+		}
+		calldata, err := verifier.NewSolidityCalldata(p)
+		if err != nil {
+			fmt.Println("convert proof to calldata failed:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("function:", calldata.Signature())
+		fmt.Println("proof:", formatUint256Array(calldata.Proof[:]))
+		if len(calldata.Commitments) > 0 {
+			fmt.Println("commitments:", formatUint256Array(calldata.Commitments))
+			fmt.Println("commitmentPok:", formatUint256Array(calldata.CommitmentPok[:]))
+		}
+		fmt.Println("input:", formatUint256Array(calldata.Input))
+		fmt.Printf("calldata: 0x%x\n", calldata.Pack())
+		return
+	}
+	fmt.Println("batch", batchNumber, "is not in the proof table")
+	os.Exit(1)
+}
+
+func formatUint256Array(values []*big.Int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = "0x" + v.Text(16)
 	}
+	return "[" + strings.Join(s, ",") + "]"
 }
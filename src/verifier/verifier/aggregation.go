@@ -0,0 +1,76 @@
+package verifier
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+)
+
+func ReadAggregatedProof(name string) (*utils.AggregatedProof, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var aggregatedProof utils.AggregatedProof
+	err = json.Unmarshal(content, &aggregatedProof)
+	if err != nil {
+		return nil, err
+	}
+	return &aggregatedProof, nil
+}
+
+// VerifyAggregatedProof checks that the aggregated proof starts from the empty
+// account tree and cex assets, ends at the expected cex assets commitment and
+// is valid against the node aggregation verifying key.
+func VerifyAggregatedProof(vkFileName string, aggregatedProof *utils.AggregatedProof,
+	emptyAccountTreeRoot, emptyCexAssetsCommitment, expectFinalCexAssetsCommitment []byte) error {
+	if !bytes.Equal(aggregatedProof.BeforeAccountTreeRoot, emptyAccountTreeRoot) {
+		return fmt.Errorf("%s: the first account tree root %x is not the empty root %x",
+			FailureChainMismatch, aggregatedProof.BeforeAccountTreeRoot, emptyAccountTreeRoot)
+	}
+	if !bytes.Equal(aggregatedProof.BeforeCEXAssetsCommitment, emptyCexAssetsCommitment) {
+		return fmt.Errorf("%s: the first cex assets commitment %x is not the empty commitment %x",
+			FailureChainMismatch, aggregatedProof.BeforeCEXAssetsCommitment, emptyCexAssetsCommitment)
+	}
+	if !bytes.Equal(aggregatedProof.AfterCEXAssetsCommitment, expectFinalCexAssetsCommitment) {
+		return fmt.Errorf("%s: the final cex assets commitment %x is not the expected %x",
+			FailureFinalCommitment, aggregatedProof.AfterCEXAssetsCommitment, expectFinalCexAssetsCommitment)
+	}
+	vk, err := LoadVerifyingKey(vkFileName)
+	if err != nil {
+		return err
+	}
+	proofBytes, err := base64.StdEncoding.DecodeString(aggregatedProof.ProofInfo)
+	if err != nil {
+		return fmt.Errorf("%s: %s", FailureDecode, err.Error())
+	}
+	proof := groth16.NewProof(ecc.BN254)
+	_, err = proof.ReadFrom(bytes.NewReader(proofBytes))
+	if err != nil {
+		return fmt.Errorf("%s: %s", FailureDecode, err.Error())
+	}
+	// the child nodes were verified against the key whose digest is in the commitment
+	nodeKeyDigest, err := circuit.VerifyingKeyDigest(vk)
+	if err != nil {
+		return fmt.Errorf("%s: %s", FailurePublicInput, err.Error())
+	}
+	commitment := circuit.AggregateNodeCommitment(aggregatedProof.BeforeAccountTreeRoot, aggregatedProof.AfterAccountTreeRoot,
+		aggregatedProof.BeforeCEXAssetsCommitment, aggregatedProof.AfterCEXAssetsCommitment, nodeKeyDigest)
+	vWitness, err := frontend.NewWitness(circuit.NewVerifyAggregateCircuit(commitment), ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return fmt.Errorf("%s: %s", FailurePublicInput, err.Error())
+	}
+	err = groth16.Verify(proof, vk, vWitness, circuit.RecursionVerifierOptions())
+	if err != nil {
+		return fmt.Errorf("%s: %s", FailurePairing, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package verifier
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16_bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"golang.org/x/crypto/sha3"
+)
+
+// SolidityCalldata is the arguments of verifyProof of the Solidity verifier
+// exported from a batch create user verifying key
+type SolidityCalldata struct {
+	Proof         [8]*big.Int
+	Commitments   []*big.Int
+	CommitmentPok [2]*big.Int
+	// Input only has the batch commitment
+	Input []*big.Int
+}
+
+// NewSolidityCalldata converts a row of the proof table to the arguments of
+// verifyProof. The proof must be generated with the solidity proof target.
+func NewSolidityCalldata(p *Proof) (*SolidityCalldata, error) {
+	if p.ProvingSystem != "" && p.ProvingSystem != circuit.ProvingSystemGroth16 {
+		return nil, fmt.Errorf("calldata is only supported for groth16 proofs, the proof is generated by %s", p.ProvingSystem)
+	}
+	proofBytes, err := base64.StdEncoding.DecodeString(p.ZkProof)
+	if err != nil {
+		return nil, err
+	}
+	proof := groth16.NewProof(ecc.BN254)
+	_, err = proof.ReadFrom(bytes.NewReader(proofBytes))
+	if err != nil {
+		return nil, err
+	}
+	batchCommitment, err := base64.StdEncoding.DecodeString(p.BatchCommitment)
+	if err != nil {
+		return nil, err
+	}
+	bn254Proof, ok := proof.(*groth16_bn254.Proof)
+	if !ok {
+		return nil, fmt.Errorf("proof is not a bn254 groth16 proof")
+	}
+
+	var c SolidityCalldata
+	// the Solidity verifier expects the coordinates of G2 points in (a1, a0) order
+	c.Proof[0] = bn254Proof.Ar.X.BigInt(new(big.Int))
+	c.Proof[1] = bn254Proof.Ar.Y.BigInt(new(big.Int))
+	c.Proof[2] = bn254Proof.Bs.X.A1.BigInt(new(big.Int))
+	c.Proof[3] = bn254Proof.Bs.X.A0.BigInt(new(big.Int))
+	c.Proof[4] = bn254Proof.Bs.Y.A1.BigInt(new(big.Int))
+	c.Proof[5] = bn254Proof.Bs.Y.A0.BigInt(new(big.Int))
+	c.Proof[6] = bn254Proof.Krs.X.BigInt(new(big.Int))
+	c.Proof[7] = bn254Proof.Krs.Y.BigInt(new(big.Int))
+	for i := 0; i < len(bn254Proof.Commitments); i++ {
+		c.Commitments = append(c.Commitments,
+			bn254Proof.Commitments[i].X.BigInt(new(big.Int)),
+			bn254Proof.Commitments[i].Y.BigInt(new(big.Int)))
+	}
+	c.CommitmentPok[0] = bn254Proof.CommitmentPok.X.BigInt(new(big.Int))
+	c.CommitmentPok[1] = bn254Proof.CommitmentPok.Y.BigInt(new(big.Int))
+	c.Input = []*big.Int{new(big.Int).SetBytes(batchCommitment)}
+	return &c, nil
+}
+
+// Signature is the verifyProof function signature the calldata is encoded for
+func (c *SolidityCalldata) Signature() string {
+	signature := "verifyProof(uint256[8],"
+	if len(c.Commitments) > 0 {
+		signature += "uint256[" + strconv.Itoa(len(c.Commitments)) + "],uint256[2],"
+	}
+	return signature + "uint256[" + strconv.Itoa(len(c.Input)) + "])"
+}
+
+// Pack returns the abi encoded call of verifyProof. All the arguments are
+// fixed size arrays, so they are encoded in place after the selector.
+func (c *SolidityCalldata) Pack() []byte {
+	hasher := sha3.NewLegacyKeccak256()
+	hasher.Write([]byte(c.Signature()))
+	calldata := hasher.Sum(nil)[:4]
+
+	words := c.Proof[:]
+	if len(c.Commitments) > 0 {
+		words = append(append(words, c.Commitments...), c.CommitmentPok[:]...)
+	}
+	words = append(words, c.Input...)
+	for _, w := range words {
+		calldata = append(calldata, w.FillBytes(make([]byte, 32))...)
+	}
+	return calldata
+}
@@ -0,0 +1,324 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16_bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	stdposeidon "github.com/consensys/gnark/std/hash/poseidon"
+	"github.com/consensys/gnark/std/rangecheck"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/compiler"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// solidityTestCircuit has the same public input as BatchCreateUserCircuit and
+// uses a range check, so its proofs carry a commitment as well
+type solidityTestCircuit struct {
+	BatchCommitment frontend.Variable `gnark:",public"`
+	Values          [4]frontend.Variable
+}
+
+func (c solidityTestCircuit) Define(api frontend.API) error {
+	rangeChecker := rangecheck.New(api)
+	for i := 0; i < len(c.Values); i++ {
+		rangeChecker.Check(c.Values[i], 64)
+	}
+	api.AssertIsEqual(c.BatchCommitment, stdposeidon.Poseidon(api, c.Values[0], c.Values[1], c.Values[2], c.Values[3]))
+	return nil
+}
+
+func generateSolidityTestProof(t *testing.T) (*Proof, groth16.VerifyingKey) {
+	ccs, pk, vk := setupSolidityTestCircuit(t)
+	return proveSolidityTestCircuit(t, ccs, pk, circuit.ProofTargetSolidity), vk
+}
+
+func setupSolidityTestCircuit(t *testing.T) (constraint.ConstraintSystem, groth16.ProvingKey, groth16.VerifyingKey) {
+	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &solidityTestCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ccs, pk, vk
+}
+
+func proveSolidityTestCircuit(t *testing.T, ccs constraint.ConstraintSystem, pk groth16.ProvingKey, proofTarget string) *Proof {
+	values := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)}
+	batchCommitment := poseidon.PoseidonBytes(values[0].Bytes(), values[1].Bytes(), values[2].Bytes(), values[3].Bytes())
+	assignment := &solidityTestCircuit{BatchCommitment: batchCommitment}
+	for i := 0; i < len(values); i++ {
+		assignment.Values[i] = values[i]
+	}
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proverOpts, err := circuit.ProverOptions(proofTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := groth16.Prove(ccs, pk, w, proverOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = proof.WriteRawTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Proof{
+		ZkProof:         base64.StdEncoding.EncodeToString(buf.Bytes()),
+		BatchCommitment: base64.StdEncoding.EncodeToString(batchCommitment),
+	}
+}
+
+func TestSolidityCalldataPack(t *testing.T) {
+	p, _ := generateSolidityTestProof(t)
+	calldata, err := NewSolidityCalldata(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calldata.Signature() != "verifyProof(uint256[8],uint256[2],uint256[2],uint256[1])" {
+		t.Fatalf("unexpected signature %s", calldata.Signature())
+	}
+	verifierAbi, err := abi.JSON(strings.NewReader(`[{"type":"function","name":"verifyProof","stateMutability":"view","inputs":[
+		{"name":"proof","type":"uint256[8]"},{"name":"commitments","type":"uint256[2]"},
+		{"name":"commitmentPok","type":"uint256[2]"},{"name":"input","type":"uint256[1]"}],"outputs":[]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := verifierAbi.Pack("verifyProof", calldata.Proof,
+		[2]*big.Int{calldata.Commitments[0], calldata.Commitments[1]}, calldata.CommitmentPok, [1]*big.Int{calldata.Input[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(calldata.Pack(), expected) {
+		t.Fatalf("calldata mismatch\n%x\n%x", calldata.Pack(), expected)
+	}
+}
+
+// TestSolidityVerifierInEVM checks the calldata of a proof in an in-process
+// EVM. The checks of the exported Solidity verifier always run on the bn254
+// precompiles, and the exported verifier itself is deployed and called if solc
+// is installed.
+func TestSolidityVerifierInEVM(t *testing.T) {
+	ccs, pk, vk := setupSolidityTestCircuit(t)
+	p := proveSolidityTestCircuit(t, ccs, pk, circuit.ProofTargetSolidity)
+	key, _ := crypto.GenerateKey()
+	auth, _ := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+	alloc := types.GenesisAlloc{auth.From: {Balance: new(big.Int).Lsh(big.NewInt(1), 100)}}
+	backend := simulated.NewBackend(alloc, simulated.WithBlockGasLimit(30_000_000))
+	defer backend.Close()
+	client := backend.Client()
+	calldata, err := NewSolidityCalldata(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongInput := *calldata
+	wrongInput.Input = []*big.Int{new(big.Int).Add(calldata.Input[0], big.NewInt(1))}
+
+	t.Run("precompiles", func(t *testing.T) {
+		v := &precompileVerifier{client: client, vk: vk.(*groth16_bn254.VerifyingKey)}
+		err := v.verify(calldata.Pack())
+		if err != nil {
+			t.Fatalf("valid proof is rejected: %s", err.Error())
+		}
+		if err = v.verify(wrongInput.Pack()); err == nil {
+			t.Fatal("proof with a wrong batch commitment is accepted")
+		}
+		// a proof of the native target hashes its commitment differently
+		native := proveSolidityTestCircuit(t, ccs, pk, circuit.ProofTargetNative)
+		nativeCalldata, err := NewSolidityCalldata(native)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = v.verify(nativeCalldata.Pack()); err == nil {
+			t.Fatal("proof of the native target is accepted")
+		}
+	})
+
+	t.Run("contract", func(t *testing.T) {
+		if _, err := exec.LookPath("solc"); err != nil {
+			t.Skip("solc is not installed")
+		}
+		dir := t.TempDir()
+		solFile := filepath.Join(dir, "verifier.sol")
+		f, err := os.Create(solFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = vk.ExportSolidity(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("solc", "--optimize", "--combined-json", "abi,bin", solFile).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contracts, err := compiler.ParseCombinedJSON(out, "", "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		contract, ok := contracts[solFile+":Verifier"]
+		if !ok {
+			t.Fatal("Verifier contract is not compiled")
+		}
+		address, _, _, err := bind.DeployContract(auth, abi.ABI{}, common.FromHex(contract.Code), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.Commit()
+
+		_, err = client.CallContract(context.Background(), ethereum.CallMsg{To: &address, Data: calldata.Pack()}, nil)
+		if err != nil {
+			t.Fatalf("valid proof is rejected: %s", err.Error())
+		}
+		_, err = client.CallContract(context.Background(), ethereum.CallMsg{To: &address, Data: wrongInput.Pack()}, nil)
+		if err == nil {
+			t.Fatal("proof with a wrong batch commitment is accepted")
+		}
+	})
+}
+
+var (
+	precompileAdd     = common.BytesToAddress([]byte{6})
+	precompileMul     = common.BytesToAddress([]byte{7})
+	precompilePairing = common.BytesToAddress([]byte{8})
+)
+
+// precompileVerifier runs the checks of the Solidity verifier exported from vk
+// with the bn254 precompiles of the EVM, in the same order and on the same
+// words of the calldata
+type precompileVerifier struct {
+	client simulated.Client
+	vk     *groth16_bn254.VerifyingKey
+}
+
+func (v *precompileVerifier) call(to common.Address, words ...*big.Int) ([]*big.Int, error) {
+	var data []byte
+	for _, w := range words {
+		data = append(data, w.FillBytes(make([]byte, 32))...)
+	}
+	out, err := v.client.CallContract(context.Background(), ethereum.CallMsg{To: &to, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*big.Int, len(out)/32)
+	for i := range res {
+		res[i] = new(big.Int).SetBytes(out[32*i : 32*i+32])
+	}
+	return res, nil
+}
+
+// pairing checks that the product of the pairings of the G1 and G2 points is 1
+func (v *precompileVerifier) pairing(words ...*big.Int) error {
+	res, err := v.call(precompilePairing, words...)
+	if err != nil {
+		return err
+	}
+	if len(res) != 1 || res[0].Cmp(big.NewInt(1)) != 0 {
+		return fmt.Errorf("pairing check failed")
+	}
+	return nil
+}
+
+func (v *precompileVerifier) verify(calldata []byte) error {
+	commitmentsCount := len(v.vk.PublicAndCommitmentCommitted)
+	inputCount := len(v.vk.G1.K) - 1 - commitmentsCount
+	signature := fmt.Sprintf("verifyProof(uint256[8],uint256[%d],uint256[2],uint256[%d])", 2*commitmentsCount, inputCount)
+	if commitmentsCount != 1 || !bytes.Equal(calldata[:4], crypto.Keccak256([]byte(signature))[:4]) {
+		return fmt.Errorf("calldata isn't for %s", signature)
+	}
+	var words []*big.Int
+	for i := 4; i+32 <= len(calldata); i += 32 {
+		words = append(words, new(big.Int).SetBytes(calldata[i:i+32]))
+	}
+	if len(words) != 8+2*commitmentsCount+2+inputCount {
+		return fmt.Errorf("calldata has %d words", len(words))
+	}
+	proof, commitment, commitmentPok, input := words[:8:8], words[8:10:10], words[10:12:12], words[12:]
+	for _, w := range input {
+		if w.Cmp(fr.Modulus()) >= 0 {
+			return fmt.Errorf("public input is not in the field")
+		}
+	}
+
+	// the public input of the commitment is hashed with the committed public inputs
+	hashed := append(commitment[0].FillBytes(make([]byte, 32)), commitment[1].FillBytes(make([]byte, 32))...)
+	for _, j := range v.vk.PublicAndCommitmentCommitted[0] {
+		hashed = append(hashed, input[j-1].FillBytes(make([]byte, 32))...)
+	}
+	publicCommitment := new(big.Int).Mod(new(big.Int).SetBytes(crypto.Keccak256(hashed)), fr.Modulus())
+
+	cmtKey := v.vk.CommitmentKeys[0]
+	err := v.pairing(append(append(append(commitment, g2Words(&cmtKey.GSigma)...), commitmentPok...), g2Words(&cmtKey.G)...)...)
+	if err != nil {
+		return fmt.Errorf("commitment is invalid: %s", err.Error())
+	}
+
+	// the public input MSM starts with the constant term and the commitment
+	acc, err := v.call(precompileAdd, append(g1Words(&v.vk.G1.K[0]), commitment...)...)
+	if err != nil {
+		return err
+	}
+	for i, s := range append(append([]*big.Int{}, input...), publicCommitment) {
+		term, err := v.call(precompileMul, append(g1Words(&v.vk.G1.K[i+1]), s)...)
+		if err != nil {
+			return err
+		}
+		acc, err = v.call(precompileAdd, append(acc, term...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	var deltaNeg, betaNeg, gammaNeg bn254.G2Affine
+	deltaNeg.Neg(&v.vk.G2.Delta)
+	betaNeg.Neg(&v.vk.G2.Beta)
+	gammaNeg.Neg(&v.vk.G2.Gamma)
+	pairs := append([]*big.Int{}, proof[:6]...)
+	pairs = append(append(pairs, proof[6:8]...), g2Words(&deltaNeg)...)
+	pairs = append(append(pairs, g1Words(&v.vk.G1.Alpha)...), g2Words(&betaNeg)...)
+	pairs = append(append(pairs, acc...), g2Words(&gammaNeg)...)
+	err = v.pairing(pairs...)
+	if err != nil {
+		return fmt.Errorf("proof is invalid: %s", err.Error())
+	}
+	return nil
+}
+
+func g1Words(p *bn254.G1Affine) []*big.Int {
+	return []*big.Int{p.X.BigInt(new(big.Int)), p.Y.BigInt(new(big.Int))}
+}
+
+// g2Words returns the coordinates of p in the (a1, a0) order of the precompile
+func g2Words(p *bn254.G2Affine) []*big.Int {
+	return []*big.Int{p.X.A1.BigInt(new(big.Int)), p.X.A0.BigInt(new(big.Int)),
+		p.Y.A1.BigInt(new(big.Int)), p.Y.A0.BigInt(new(big.Int))}
+}
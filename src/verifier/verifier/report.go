@@ -0,0 +1,115 @@
+package verifier
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+)
+
+const (
+	VerdictPassed = "passed"
+	VerdictFailed = "failed"
+
+	BatchStatusPassed  = "passed"
+	BatchStatusFailed  = "failed"
+	BatchStatusMissing = "missing"
+)
+
+type BatchReport struct {
+	BatchNumber int64
+	AssetsCount int
+	Status      string
+	Failure     *Failure `json:",omitempty"`
+	// BatchCommitment is the commitment recomputed by the verifier
+	BatchCommitment         string
+	AccountTreeRoots        []string
+	CexAssetListCommitments []string
+	// chain continuity with the previous batch, or with the empty
+	// account tree root and cex assets commitment for the first batch
+	ChainChecked               bool
+	AccountTreeRootChained     bool
+	CexAssetsCommitmentChained bool
+}
+
+// Report is the machine-readable result of a batch proofs verification.
+// It contains no timestamp, so that two reports of the same round are
+// byte-for-byte identical.
+type Report struct {
+	Verdict                     string
+	ProofTable                  string
+	VerifyingKeys               []VerifyingKeyInfo
+	Batches                     []BatchReport
+	AccountTreeRoot             string
+	CexAssetsCommitment         string
+	ExpectedCexAssetsCommitment string
+	Failures                    []*Failure
+}
+
+func encodeHexList(values [][]byte) []string {
+	res := make([]string, len(values))
+	for i := 0; i < len(values); i++ {
+		res[i] = hex.EncodeToString(values[i])
+	}
+	return res
+}
+
+func NewReport(result *Result, proofTable string, verifyingKeys []VerifyingKeyInfo) *Report {
+	report := &Report{
+		Verdict:                     VerdictPassed,
+		ProofTable:                  proofTable,
+		VerifyingKeys:               verifyingKeys,
+		Batches:                     make([]BatchReport, len(result.Batches)),
+		AccountTreeRoot:             hex.EncodeToString(result.AccountTreeRoot),
+		CexAssetsCommitment:         hex.EncodeToString(result.CexAssetsCommitment),
+		ExpectedCexAssetsCommitment: hex.EncodeToString(result.ExpectedCexAssetsCommitment),
+		Failures:                    result.Failures,
+	}
+	if !result.Passed() {
+		report.Verdict = VerdictFailed
+	}
+	if report.VerifyingKeys == nil {
+		report.VerifyingKeys = []VerifyingKeyInfo{}
+	}
+	if report.Failures == nil {
+		report.Failures = []*Failure{}
+	}
+	for i, b := range result.Batches {
+		if b == nil {
+			report.Batches[i] = BatchReport{
+				BatchNumber: int64(i),
+				Status:      BatchStatusMissing,
+			}
+			continue
+		}
+		status := BatchStatusPassed
+		if !b.Passed() || (b.ChainChecked && !(b.AccountTreeRootChained && b.CexAssetsCommitmentChained)) {
+			status = BatchStatusFailed
+		}
+		report.Batches[i] = BatchReport{
+			BatchNumber:                b.BatchNumber,
+			AssetsCount:                b.AssetsCount,
+			Status:                     status,
+			Failure:                    b.Failure,
+			BatchCommitment:            hex.EncodeToString(b.BatchCommitment),
+			AccountTreeRoots:           encodeHexList(b.AccountTreeRoots),
+			CexAssetListCommitments:    encodeHexList(b.CexAssetListCommitments),
+			ChainChecked:               b.ChainChecked,
+			AccountTreeRootChained:     b.AccountTreeRootChained,
+			CexAssetsCommitmentChained: b.CexAssetsCommitmentChained,
+		}
+	}
+	return report
+}
+
+// Passed reports whether every check of the round passed
+func (r *Report) Passed() bool {
+	return r.Verdict == VerdictPassed
+}
+
+func (r *Report) WriteToFile(name string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(content, '\n'), 0644)
+}
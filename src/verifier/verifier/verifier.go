@@ -0,0 +1,451 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/gocarina/gocsv"
+)
+
+// failure kinds reported for a batch proof
+const (
+	FailureDecode          = "decode_error"
+	FailurePublicInput     = "public_input_mismatch"
+	FailurePairing         = "pairing_failure"
+	FailureMissingBatch    = "missing_batch"
+	FailureDuplicateBatch  = "duplicate_batch"
+	FailureUnknownTier     = "unknown_assets_tier"
+	FailureChainMismatch   = "chain_mismatch"
+	FailureFinalCommitment = "final_cex_commitment_mismatch"
+	FailureTierManifest    = "tier_manifest_mismatch"
+)
+
+// Proof is one row of the exported proof table.
+// index 4: proof_info, index 5: cex_asset_list_commitments
+// index 6: account_tree_roots, index 7: batch_commitment
+// index 8: batch_number
+type Proof struct {
+	BatchNumber        int64    `csv:"batch_number"`
+	ZkProof            string   `csv:"proof_info"`
+	CexAssetCommitment []string `csv:"cex_asset_list_commitments"`
+	AccountTreeRoots   []string `csv:"account_tree_roots"`
+	BatchCommitment    string   `csv:"batch_commitment"`
+	AssetsCount        int      `csv:"assets_count"`
+	ProvingSystem      string   `csv:"proving_system"`
+	TierManifestHash   string   `csv:"tier_manifest_hash"`
+}
+
+type Failure struct {
+	BatchNumber int64
+	Kind        string
+	Message     string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("batch %d: %s: %s", f.BatchNumber, f.Kind, f.Message)
+}
+
+type BatchResult struct {
+	BatchNumber             int64
+	AssetsCount             int
+	AccountTreeRoots        [][]byte
+	CexAssetListCommitments [][]byte
+	// BatchCommitment is recomputed from the account tree roots
+	// and cex asset list commitments of the batch
+	BatchCommitment []byte
+	Failure         *Failure
+	// ChainChecked is false when the previous batch is missing or can't be decoded
+	ChainChecked               bool
+	AccountTreeRootChained     bool
+	CexAssetsCommitmentChained bool
+}
+
+func (b *BatchResult) Passed() bool {
+	return b.Failure == nil
+}
+
+type Result struct {
+	// Batches is indexed by batch number, missing batches are nil
+	Batches                     []*BatchResult
+	Failures                    []*Failure
+	AccountTreeRoot             []byte
+	CexAssetsCommitment         []byte
+	ExpectedCexAssetsCommitment []byte
+}
+
+func (r *Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+type VerifyingKeyInfo struct {
+	AssetsCount int
+	KeyFile     string
+	// Sha256 is the hex encoded sha256 digest of the verifying key file
+	Sha256 string
+}
+
+type Verifier struct {
+	provingSystem    circuit.ProvingSystem
+	verifyingKeys    map[int]circuit.VerifyingKey
+	VerifyingKeyInfo []VerifyingKeyInfo
+	WorkersNum       int
+	// VerifierOptions are passed to the proving system for every batch proof
+	VerifierOptions []backend.VerifierOption
+	// TierManifest is checked against the tier manifest hash of every batch
+	// proof if it is set
+	TierManifest *utils.TierManifest
+}
+
+func LoadVerifyingKey(vkFileName string) (groth16.VerifyingKey, error) {
+	vkFile, err := os.ReadFile(vkFileName)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(vkFile)
+	vk := groth16.NewVerifyingKey(ecc.BN254)
+	_, err = vk.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	return vk, nil
+}
+
+func NewVerifier(provingSystem circuit.ProvingSystem, zkKeyNames []string, assetsCountTiers []int) (*Verifier, error) {
+	if len(zkKeyNames) != len(assetsCountTiers) {
+		return nil, fmt.Errorf("asset tiers and asset tier names should have the same length")
+	}
+	workersNum := 16
+	if runtime.NumCPU() > workersNum {
+		workersNum = runtime.NumCPU()
+	}
+	v := &Verifier{
+		provingSystem: provingSystem,
+		verifyingKeys: make(map[int]circuit.VerifyingKey),
+		WorkersNum:    workersNum,
+	}
+	for i := 0; i < len(assetsCountTiers); i++ {
+		vkFileName := zkKeyNames[i] + ".vk"
+		vkFile, err := os.ReadFile(vkFileName)
+		if err != nil {
+			return nil, fmt.Errorf("load verifying key of %d assets tier failed: %s", assetsCountTiers[i], err.Error())
+		}
+		vk := provingSystem.NewVerifyingKey()
+		_, err = vk.ReadFrom(bytes.NewReader(vkFile))
+		if err != nil {
+			return nil, fmt.Errorf("load verifying key of %d assets tier failed: %s", assetsCountTiers[i], err.Error())
+		}
+		v.verifyingKeys[assetsCountTiers[i]] = vk
+		digest := sha256.Sum256(vkFile)
+		v.VerifyingKeyInfo = append(v.VerifyingKeyInfo, VerifyingKeyInfo{
+			AssetsCount: assetsCountTiers[i],
+			KeyFile:     vkFileName,
+			Sha256:      hex.EncodeToString(digest[:]),
+		})
+	}
+	return v, nil
+}
+
+func ReadProofTable(name string) ([]*Proof, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	proofs := []*Proof{}
+	err = gocsv.UnmarshalFile(f, &proofs)
+	if err != nil {
+		return nil, err
+	}
+	return proofs, nil
+}
+
+// VerifyBatch checks the public input and the zk proof of a single batch.
+// It never stops at the first error: the returned result carries the
+// decoded commitments whenever they are available, together with the failure.
+func (v *Verifier) VerifyBatch(p *Proof) *BatchResult {
+	res := &BatchResult{
+		BatchNumber: p.BatchNumber,
+		AssetsCount: p.AssetsCount,
+	}
+	fail := func(kind string, format string, a ...any) *BatchResult {
+		res.Failure = &Failure{
+			BatchNumber: p.BatchNumber,
+			Kind:        kind,
+			Message:     fmt.Sprintf(format, a...),
+		}
+		return res
+	}
+
+	// deserialize cex asset list commitment and account tree root
+	if len(p.CexAssetCommitment) != 2 || len(p.AccountTreeRoots) != 2 {
+		return fail(FailureDecode, "expect 2 cex asset list commitments and 2 account tree roots, got %d and %d",
+			len(p.CexAssetCommitment), len(p.AccountTreeRoots))
+	}
+	cexAssetListCommitments := make([][]byte, 2)
+	accountTreeRoots := make([][]byte, 2)
+	var err error
+	for i := 0; i < 2; i++ {
+		cexAssetListCommitments[i], err = base64.StdEncoding.DecodeString(p.CexAssetCommitment[i])
+		if err != nil {
+			return fail(FailureDecode, "decode cex asset commitment failed: %s", err.Error())
+		}
+		accountTreeRoots[i], err = base64.StdEncoding.DecodeString(p.AccountTreeRoots[i])
+		if err != nil {
+			return fail(FailureDecode, "decode account tree root failed: %s", err.Error())
+		}
+	}
+	res.AccountTreeRoots = accountTreeRoots
+	res.CexAssetListCommitments = cexAssetListCommitments
+
+	// verify the public input is correctly computed by cex asset list and account tree root
+	poseidonHasher := poseidon.NewPoseidon()
+	poseidonHasher.Write(accountTreeRoots[0])
+	poseidonHasher.Write(accountTreeRoots[1])
+	poseidonHasher.Write(cexAssetListCommitments[0])
+	poseidonHasher.Write(cexAssetListCommitments[1])
+	expectHash := poseidonHasher.Sum(nil)
+	res.BatchCommitment = expectHash
+	actualHash, err := base64.StdEncoding.DecodeString(p.BatchCommitment)
+	if err != nil {
+		return fail(FailureDecode, "decode batch commitment failed: %s", err.Error())
+	}
+	if !bytes.Equal(expectHash, actualHash) {
+		return fail(FailurePublicInput, "expect batch commitment %x, got %x", expectHash, actualHash)
+	}
+
+	if v.TierManifest != nil {
+		err = v.TierManifest.Check(p.TierManifestHash)
+		if err != nil {
+			return fail(FailureTierManifest, "%s", err.Error())
+		}
+	}
+	// proofs generated before plonk is supported have no proving system
+	if p.ProvingSystem != "" && p.ProvingSystem != v.provingSystem.Name() {
+		return fail(FailureDecode, "proof is generated by %s, expect %s", p.ProvingSystem, v.provingSystem.Name())
+	}
+	proofRaw, err := base64.StdEncoding.DecodeString(p.ZkProof)
+	if err != nil {
+		return fail(FailureDecode, "decode proof failed: %s", err.Error())
+	}
+	proof := v.provingSystem.NewProof()
+	_, err = proof.ReadFrom(bytes.NewReader(proofRaw))
+	if err != nil {
+		return fail(FailureDecode, "deserialize proof failed: %s", err.Error())
+	}
+
+	vk, ok := v.verifyingKeys[p.AssetsCount]
+	if !ok {
+		return fail(FailureUnknownTier, "no verifying key for %d assets tier", p.AssetsCount)
+	}
+	verifyWitness := circuit.NewVerifyBatchCreateUserCircuit(actualHash)
+	vWitness, err := frontend.NewWitness(verifyWitness, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return fail(FailurePublicInput, "construct public witness failed: %s", err.Error())
+	}
+	err = v.provingSystem.Verify(proof, vk, vWitness, v.VerifierOptions...)
+	if err != nil {
+		return fail(FailurePairing, "%s", err.Error())
+	}
+	return res
+}
+
+// ExpectedCommitments returns the empty account tree root, the empty cex
+// assets commitment and the cex assets commitment the last batch must end
+// with according to the published cex assets info. The tier manifest must be
+// applied first, the root and commitments depend on its parameters.
+func ExpectedCommitments(cexAssets []utils.CexAssetInfo) (emptyAccountTreeRoot, emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm []byte, err error) {
+	emptyAccountTreeRoot = utils.EmptyAccountTreeRoot()
+	if len(cexAssets) > utils.AssetCounts {
+		return nil, nil, nil, fmt.Errorf("the number of cex assets %d is bigger than AssetCounts %d of the tier manifest", len(cexAssets), utils.AssetCounts)
+	}
+	// according to asset price info to compute
+	cexAssetsInfo := make([]utils.CexAssetInfo, len(cexAssets))
+	for i := 0; i < len(cexAssets); i++ {
+		info := cexAssets[i]
+		if len(info.LoanRatios) > utils.TierCount || len(info.MarginRatios) > utils.TierCount || len(info.PortfolioMarginRatios) > utils.TierCount {
+			return nil, nil, nil, fmt.Errorf("invalid cex asset info: %s asset has more than %d tier ratios of a collateral type", info.Symbol, utils.TierCount)
+		}
+		// the missing ratios are padded like the ones of cex_assets_info.csv
+		info.LoanRatios = utils.PaddingTierRatios(info.LoanRatios)
+		info.MarginRatios = utils.PaddingTierRatios(info.MarginRatios)
+		info.PortfolioMarginRatios = utils.PaddingTierRatios(info.PortfolioMarginRatios)
+		if int(info.AmountDecimals)+int(info.PriceDecimals) != utils.AssetValueDecimals {
+			return nil, nil, nil, fmt.Errorf("invalid cex asset info: %s asset amount decimals %d and price decimals %d don't add up to %d",
+				info.Symbol, info.AmountDecimals, info.PriceDecimals, utils.AssetValueDecimals)
+		}
+		if int(info.Index) >= len(cexAssetsInfo) {
+			return nil, nil, nil, fmt.Errorf("invalid cex asset info: %s asset index %d is out of range", info.Symbol, info.Index)
+		}
+		cexAssetsInfo[info.Index] = info
+		if info.TotalEquity < info.TotalDebt {
+			return nil, nil, nil, fmt.Errorf("invalid cex asset info: %s asset equity %d less then debt %d", info.Symbol, info.TotalEquity, info.TotalDebt)
+		}
+	}
+	emptyCexAssetsInfo := make([]utils.CexAssetInfo, len(cexAssetsInfo))
+	copy(emptyCexAssetsInfo, cexAssetsInfo)
+	for i := 0; i < len(emptyCexAssetsInfo); i++ {
+		emptyCexAssetsInfo[i].TotalDebt = 0
+		emptyCexAssetsInfo[i].TotalEquity = 0
+		emptyCexAssetsInfo[i].LoanCollateral = 0
+		emptyCexAssetsInfo[i].MarginCollateral = 0
+		emptyCexAssetsInfo[i].PortfolioMarginCollateral = 0
+	}
+	emptyCexAssetListCommitment = utils.ComputeCexAssetsCommitment(emptyCexAssetsInfo)
+	expectFinalCexAssetsInfoComm = utils.ComputeCexAssetsCommitment(cexAssetsInfo)
+	return emptyAccountTreeRoot, emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm, nil
+}
+
+// VerifyBatchProofs verifies every batch of the proof table, then checks that
+// the account tree roots and cex asset list commitments chain from the empty
+// values to the expected final cex assets commitment. All failures are collected
+// so that the caller can report them at once.
+func (v *Verifier) VerifyBatchProofs(proofs []*Proof, emptyAccountTreeRoot []byte,
+	emptyCexAssetsCommitment []byte, expectFinalCexAssetsCommitment []byte) *Result {
+	result, _ := v.VerifyBatchProofsContext(context.Background(), proofs, emptyAccountTreeRoot, emptyCexAssetsCommitment, expectFinalCexAssetsCommitment)
+	return result
+}
+
+// VerifyBatchProofsContext is VerifyBatchProofs which stops verifying the
+// batches when ctx is canceled, no result is returned then
+func (v *Verifier) VerifyBatchProofsContext(ctx context.Context, proofs []*Proof, emptyAccountTreeRoot []byte,
+	emptyCexAssetsCommitment []byte, expectFinalCexAssetsCommitment []byte) (*Result, error) {
+	result := &Result{
+		ExpectedCexAssetsCommitment: expectFinalCexAssetsCommitment,
+	}
+	if len(proofs) == 0 {
+		result.Failures = append(result.Failures, &Failure{
+			BatchNumber: -1,
+			Kind:        FailureMissingBatch,
+			Message:     "proof table is empty",
+		})
+		return result, nil
+	}
+
+	batchResults := make([]*BatchResult, len(proofs))
+	jobs := make(chan int, len(proofs))
+	for i := 0; i < len(proofs); i++ {
+		jobs <- i
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < v.WorkersNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				batchResults[j] = v.VerifyBatch(proofs[j])
+				if batchResults[j].Passed() {
+					slog.Info("proof verify success", utils.LogKeyHeight, proofs[j].BatchNumber)
+				} else {
+					slog.Warn("proof verify failed", utils.LogKeyHeight, proofs[j].BatchNumber, "err", batchResults[j].Failure)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// the batches are numbered from 0 without gaps, so a batch number out of
+	// the proof table range is a failure, and it can't size the result
+	maxBatchNumber := int64(len(proofs) - 1)
+	result.Batches = make([]*BatchResult, len(proofs))
+	for _, r := range batchResults {
+		if r.Failure != nil {
+			result.Failures = append(result.Failures, r.Failure)
+		}
+		if r.BatchNumber < 0 || r.BatchNumber > maxBatchNumber {
+			result.Failures = append(result.Failures, &Failure{
+				BatchNumber: r.BatchNumber,
+				Kind:        FailureDecode,
+				Message:     fmt.Sprintf("invalid batch number, the proof table has %d batches", len(proofs)),
+			})
+			continue
+		}
+		if result.Batches[r.BatchNumber] != nil {
+			result.Failures = append(result.Failures, &Failure{
+				BatchNumber: r.BatchNumber,
+				Kind:        FailureDuplicateBatch,
+				Message:     "batch number appears more than once in proof table",
+			})
+			continue
+		}
+		result.Batches[r.BatchNumber] = r
+	}
+
+	prevAccountTreeRoot := emptyAccountTreeRoot
+	prevCexAssetsCommitment := emptyCexAssetsCommitment
+	for batchNumber := int64(0); batchNumber <= maxBatchNumber; batchNumber++ {
+		r := result.Batches[batchNumber]
+		if r == nil {
+			result.Failures = append(result.Failures, &Failure{
+				BatchNumber: batchNumber,
+				Kind:        FailureMissingBatch,
+				Message:     "proof data not found",
+			})
+			prevAccountTreeRoot, prevCexAssetsCommitment = nil, nil
+			continue
+		}
+		if r.AccountTreeRoots == nil {
+			// the batch can't be decoded, the failure is already recorded
+			prevAccountTreeRoot, prevCexAssetsCommitment = nil, nil
+			continue
+		}
+		// the link to an undecodable or missing batch can't be checked
+		if prevAccountTreeRoot != nil {
+			r.ChainChecked = true
+			r.AccountTreeRootChained = bytes.Equal(r.AccountTreeRoots[0], prevAccountTreeRoot)
+			r.CexAssetsCommitmentChained = bytes.Equal(r.CexAssetListCommitments[0], prevCexAssetsCommitment)
+		}
+		if r.ChainChecked && !r.AccountTreeRootChained {
+			result.Failures = append(result.Failures, &Failure{
+				BatchNumber: batchNumber,
+				Kind:        FailureChainMismatch,
+				Message:     fmt.Sprintf("account tree root not match: expect %x, got %x", prevAccountTreeRoot, r.AccountTreeRoots[0]),
+			})
+		}
+		if r.ChainChecked && !r.CexAssetsCommitmentChained {
+			result.Failures = append(result.Failures, &Failure{
+				BatchNumber: batchNumber,
+				Kind:        FailureChainMismatch,
+				Message:     fmt.Sprintf("cex asset list commitment not match: expect %x, got %x", prevCexAssetsCommitment, r.CexAssetListCommitments[0]),
+			})
+		}
+		prevAccountTreeRoot = r.AccountTreeRoots[1]
+		prevCexAssetsCommitment = r.CexAssetListCommitments[1]
+	}
+	result.AccountTreeRoot = prevAccountTreeRoot
+	result.CexAssetsCommitment = prevCexAssetsCommitment
+
+	if !bytes.Equal(result.CexAssetsCommitment, expectFinalCexAssetsCommitment) {
+		result.Failures = append(result.Failures, &Failure{
+			BatchNumber: maxBatchNumber,
+			Kind:        FailureFinalCommitment,
+			Message:     fmt.Sprintf("expect final cex assets commitment %x, got %x", expectFinalCexAssetsCommitment, result.CexAssetsCommitment),
+		})
+	}
+	sort.SliceStable(result.Failures, func(i, j int) bool {
+		return result.Failures[i].BatchNumber < result.Failures[j].BatchNumber
+	})
+	return result, nil
+}
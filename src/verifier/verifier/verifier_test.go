@@ -0,0 +1,264 @@
+package verifier
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/config"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test/unsafekzg"
+)
+
+func groth16System(t *testing.T) circuit.ProvingSystem {
+	provingSystem, err := circuit.NewProvingSystem(circuit.ProvingSystemGroth16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provingSystem
+}
+
+func constructProofRow(batchNumber int64, beforeRoot, afterRoot, beforeCex, afterCex []byte) *Proof {
+	commitment := poseidon.PoseidonBytes(beforeRoot, afterRoot, beforeCex, afterCex)
+	return &Proof{
+		BatchNumber:        batchNumber,
+		ZkProof:            base64.StdEncoding.EncodeToString([]byte("invalid proof")),
+		CexAssetCommitment: []string{base64.StdEncoding.EncodeToString(beforeCex), base64.StdEncoding.EncodeToString(afterCex)},
+		AccountTreeRoots:   []string{base64.StdEncoding.EncodeToString(beforeRoot), base64.StdEncoding.EncodeToString(afterRoot)},
+		BatchCommitment:    base64.StdEncoding.EncodeToString(commitment),
+		AssetsCount:        50,
+	}
+}
+
+func TestVerifyBatchProofsCollectsFailures(t *testing.T) {
+	roots := [][]byte{{0}, {1}, {2}, {3}, {4}}
+	cexCommitments := [][]byte{{10}, {11}, {12}, {13}, {14}}
+	proofs := []*Proof{
+		constructProofRow(0, roots[0], roots[1], cexCommitments[0], cexCommitments[1]),
+		constructProofRow(1, roots[1], roots[2], cexCommitments[1], cexCommitments[2]),
+		// batch 2 is missing, batch 3 has a wrong batch commitment
+		constructProofRow(3, roots[3], roots[4], cexCommitments[3], cexCommitments[4]),
+		// a batch number beyond the proof table is rejected, not allocated
+		constructProofRow(1<<40, roots[4], roots[4], cexCommitments[4], cexCommitments[4]),
+	}
+	proofs[2].BatchCommitment = proofs[0].BatchCommitment
+
+	v, err := NewVerifier(groth16System(t), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := v.VerifyBatchProofs(proofs, roots[0], cexCommitments[0], cexCommitments[4])
+	if result.Passed() {
+		t.Fatal("verification should fail")
+	}
+	kinds := make(map[int64][]string)
+	for _, f := range result.Failures {
+		kinds[f.BatchNumber] = append(kinds[f.BatchNumber], f.Kind)
+	}
+	// every batch is checked even though the first one fails
+	if len(kinds[0]) != 1 || kinds[0][0] != FailureDecode {
+		t.Errorf("batch 0: unexpected failures %v", kinds[0])
+	}
+	if len(kinds[1]) != 1 || kinds[1][0] != FailureDecode {
+		t.Errorf("batch 1: unexpected failures %v", kinds[1])
+	}
+	if len(kinds[2]) != 1 || kinds[2][0] != FailureMissingBatch {
+		t.Errorf("batch 2: unexpected failures %v", kinds[2])
+	}
+	if len(kinds[3]) != 1 || kinds[3][0] != FailurePublicInput {
+		t.Errorf("batch 3: unexpected failures %v", kinds[3])
+	}
+	if kinds[1<<40][len(kinds[1<<40])-1] != FailureDecode || len(result.Batches) != len(proofs) {
+		t.Errorf("batch 1<<40: unexpected failures %v", kinds[1<<40])
+	}
+	if string(result.AccountTreeRoot) != string(roots[4]) {
+		t.Errorf("unexpected final account tree root %x", result.AccountTreeRoot)
+	}
+}
+
+func TestVerifyBatchTierManifestMismatch(t *testing.T) {
+	p := constructProofRow(0, []byte{0}, []byte{1}, []byte{10}, []byte{11})
+	p.TierManifestHash = "another manifest"
+	v, err := NewVerifier(groth16System(t), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.TierManifest = utils.DefaultTierManifest()
+	res := v.VerifyBatch(p)
+	if res.Passed() || res.Failure.Kind != FailureTierManifest {
+		t.Fatalf("unexpected result %v", res.Failure)
+	}
+}
+
+func TestVerifyBatchProofsChainMismatch(t *testing.T) {
+	proofs := []*Proof{
+		constructProofRow(0, []byte{0}, []byte{1}, []byte{10}, []byte{11}),
+		constructProofRow(1, []byte{5}, []byte{6}, []byte{11}, []byte{12}),
+	}
+	v, err := NewVerifier(groth16System(t), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := v.VerifyBatchProofs(proofs, []byte{0}, []byte{10}, []byte{13})
+	chainFailures := 0
+	finalFailures := 0
+	for _, f := range result.Failures {
+		if f.Kind == FailureChainMismatch {
+			chainFailures++
+		}
+		if f.Kind == FailureFinalCommitment {
+			finalFailures++
+		}
+	}
+	if chainFailures != 1 || finalFailures != 1 {
+		t.Errorf("unexpected failures %v", result.Failures)
+	}
+}
+
+func TestExpectedCommitmentsOfSampleConfig(t *testing.T) {
+	content, err := os.ReadFile("../config/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifierConfig := &config.Config{}
+	if err = json.Unmarshal(content, verifierConfig); err != nil {
+		t.Fatal(err)
+	}
+	tierManifest, err := utils.LoadTierManifest(filepath.Join("..", verifierConfig.TierManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tierManifest.Apply()
+	defer utils.DefaultTierManifest().Apply()
+
+	// the sample assets have no tier ratios, they are padded
+	_, _, expected, err := ExpectedCommitments(verifierConfig.CexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := make([]utils.CexAssetInfo, len(verifierConfig.CexAssetsInfo))
+	copy(padded, verifierConfig.CexAssetsInfo)
+	for i := range padded {
+		padded[i].LoanRatios = utils.PaddingTierRatios(nil)
+		padded[i].MarginRatios = utils.PaddingTierRatios(nil)
+		padded[i].PortfolioMarginRatios = utils.PaddingTierRatios(nil)
+	}
+	if !bytes.Equal(expected, utils.ComputeCexAssetsCommitment(padded)) {
+		t.Fatal("the commitment isn't the one of the padded assets")
+	}
+
+	verifierConfig.CexAssetsInfo[0].LoanRatios = make([]utils.TierRatio, utils.TierCount+1)
+	if _, _, _, err = ExpectedCommitments(verifierConfig.CexAssetsInfo); err == nil {
+		t.Fatal("expected the assets with too many tier ratios to be refused")
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	proofs := []*Proof{
+		constructProofRow(0, []byte{0}, []byte{1}, []byte{10}, []byte{11}),
+		constructProofRow(2, []byte{2}, []byte{3}, []byte{12}, []byte{13}),
+		// the duplicate keeps the table 3 rows long while batch 1 is missing
+		constructProofRow(0, []byte{0}, []byte{1}, []byte{10}, []byte{11}),
+	}
+	v, err := NewVerifier(groth16System(t), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := v.VerifyBatchProofs(proofs, []byte{0}, []byte{10}, []byte{13})
+	report := NewReport(result, "proof.csv", v.VerifyingKeyInfo)
+	if report.Verdict != VerdictFailed {
+		t.Errorf("unexpected verdict %s", report.Verdict)
+	}
+	if len(report.Batches) != 3 {
+		t.Fatalf("unexpected batches count %d", len(report.Batches))
+	}
+	if report.Batches[1].Status != BatchStatusMissing {
+		t.Errorf("unexpected status of batch 1: %s", report.Batches[1].Status)
+	}
+	if !report.Batches[0].ChainChecked || !report.Batches[0].AccountTreeRootChained {
+		t.Errorf("batch 0 should chain to the empty account tree root")
+	}
+	if report.Batches[2].ChainChecked {
+		t.Errorf("batch 2 follows a missing batch and can't be chain checked")
+	}
+	if report.AccountTreeRoot != "03" || report.CexAssetsCommitment != "0d" {
+		t.Errorf("unexpected final values %s %s", report.AccountTreeRoot, report.CexAssetsCommitment)
+	}
+}
+
+func TestVerifyBatchPlonkProof(t *testing.T) {
+	plonkSystem, err := circuit.NewProvingSystem(circuit.ProvingSystemPlonk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// solidityTestCircuit hashes its values like the batch commitment, so the
+	// values are the roots and commitments of the proof row
+	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), plonkSystem.NewBuilder(), &solidityTestCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs, srsLagrange, err := unsafekzg.NewSRS(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := plonkSystem.Setup(ccs, srs, srsLagrange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := constructProofRow(0, []byte{1}, []byte{2}, []byte{3}, []byte{4})
+	row.ProvingSystem = circuit.ProvingSystemPlonk
+	batchCommitment, _ := base64.StdEncoding.DecodeString(row.BatchCommitment)
+	assignment := &solidityTestCircuit{
+		BatchCommitment: batchCommitment,
+		Values:          [4]frontend.Variable{1, 2, 3, 4},
+	}
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := plonkSystem.Prove(ccs, pk, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = proof.WriteRawTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row.ZkProof = base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	zkKeyName := filepath.Join(t.TempDir(), "zkpor50_1")
+	vkFile, err := os.Create(zkKeyName + ".vk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vk.WriteTo(vkFile)
+	vkFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewVerifier(plonkSystem, []string{zkKeyName}, []int{50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := v.VerifyBatch(row); !res.Passed() {
+		t.Fatalf("plonk proof should pass: %s", res.Failure.Error())
+	}
+
+	// the proof is rejected by a verifier configured with another proving system
+	groth16Verifier, err := NewVerifier(groth16System(t), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := groth16Verifier.VerifyBatch(row); res.Passed() || res.Failure.Kind != FailureDecode {
+		t.Fatalf("plonk proof should fail to decode in groth16 verifier")
+	}
+}
@@ -1,10 +1,25 @@
 package config
 
+import "github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+
 type Config struct {
+	// DbDriver is mysql (default), postgres or sqlite, MysqlDataSource is the data source of the driver
+	DbDriver        string
 	MysqlDataSource string
 	UserDataFile    string
-	DbSuffix        string
-	TreeDB          struct {
+	// AccountsDir is the directory the user files are ingested to, the accounts
+	// are read from there instead of memory if it is set. The witness and
+	// userproof services can share it, the ingested accounts are reused as
+	// long as the user files and the tiers are the same.
+	AccountsDir string
+	DbSuffix    string
+	// TierManifest is the tier manifest file shared by all the services
+	TierManifest string
+	// MetricsAddr is the address the prometheus metrics are served on, e.g. :9100, nothing is served if it is empty
+	MetricsAddr string
+	// Log is the level and format of the logs
+	Log    utils.LogConfig
+	TreeDB struct {
 		Driver string
 		Option struct {
 			Addr string
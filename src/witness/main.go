@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 
+	"github.com/binance/zkmerkle-proof-of-solvency/pkg/por"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/config"
-	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
 )
 
 func main() {
@@ -31,23 +33,40 @@ func main() {
 		witnessConfig.MysqlDataSource = s
 	}
 
-	accounts, cexAssetsInfo, err := utils.ParseUserDataSet(witnessConfig.UserDataFile)
+	err = utils.InitLogger("witness", witnessConfig.DbSuffix, witnessConfig.Log)
 	if err != nil {
 		panic(err.Error())
 	}
-	accountTree, err := utils.NewAccountTree(witnessConfig.TreeDB.Driver, witnessConfig.TreeDB.Option.Addr)
+	utils.ServeMetrics(witnessConfig.MetricsAddr)
+
+	tierManifest, err := utils.LoadTierManifest(witnessConfig.TierManifest)
 	if err != nil {
 		panic(err.Error())
 	}
-	fmt.Println("account tree init height is ", accountTree.LatestVersion())
-	fmt.Printf("account tree root is %x\n", accountTree.Root())
+	tierManifest.Apply()
+	slog.Info("tier manifest is loaded", "hash", tierManifest.Hash)
 
-	totalAccountNum := 0
-	for k, v := range accounts {
-		totalAccountNum += len(v)
-		fmt.Println("the asset counts of user is ", k, "total ops number is ", len(v))
-	}
-	witnessService := witness.NewWitness(accountTree, uint32(totalAccountNum), accounts, cexAssetsInfo, witnessConfig)
-	witnessService.Run()
-	fmt.Println("witness service run finished...")
+	var dataset *por.Dataset
+	if witnessConfig.AccountsDir != "" {
+		dataset, err = por.IngestDataset(context.Background(), witnessConfig.UserDataFile, witnessConfig.AccountsDir, tierManifest)
+	} else {
+		dataset, err = por.ParseDataset(context.Background(), witnessConfig.UserDataFile, tierManifest)
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	accountTree, err := utils.NewAccountTree(witnessConfig.TreeDB.Driver, witnessConfig.TreeDB.Option.Addr)
+	if err != nil {
+		panic(err.Error())
+	}
+	slog.Info("account tree is opened", "version", accountTree.LatestVersion(), "root", fmt.Sprintf("%x", accountTree.Root()))
+	store, err := por.OpenStoreWithDriver(witnessConfig.DbDriver, witnessConfig.MysqlDataSource, witnessConfig.DbSuffix)
+	if err != nil {
+		panic(err.Error())
+	}
+	err = por.BuildWitnesses(context.Background(), store, accountTree, dataset)
+	if err != nil {
+		panic(err.Error())
+	}
+	slog.Info("witness service run finished")
 }
@@ -2,25 +2,22 @@ package witness
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/gob"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"log/slog"
 	"runtime"
-	"sort"
+	"strconv"
 	"sync/atomic"
 	"time"
 
 	"sync"
 
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
-	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/config"
 	bsmt "github.com/bnb-chain/zkbnb-smt"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 	"github.com/klauspost/compress/s2"
 )
 
@@ -28,59 +25,60 @@ type Witness struct {
 	accountTree              bsmt.SparseMerkleTree
 	totalOpsNumber           uint32
 	witnessModel             WitnessModel
-	ops                      map[int][]utils.AccountInfo
+	accounts                 utils.AccountSource
 	cexAssets                []utils.CexAssetInfo
-	db                       *gorm.DB
 	ch                       chan BatchWitness
 	quit                     chan int
-	accountHashChan          map[int][]chan []byte
 	currentBatchNumber       int64
 	batchNumberMappingKeys   []int
 	batchNumberMappingValues []int
+	tierManifest             *utils.TierManifest
 }
 
-func NewWitness(accountTree bsmt.SparseMerkleTree, totalOpsNumber uint32,
-	ops map[int][]utils.AccountInfo, cexAssets []utils.CexAssetInfo,
-	config *config.Config) *Witness {
-	newLogger := logger.New(
-		log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
-		logger.Config{
-			SlowThreshold:             60 * time.Second, // Slow SQL threshold
-			LogLevel:                  logger.Silent,    // Log level
-			IgnoreRecordNotFoundError: true,             // Ignore ErrRecordNotFound error for logger
-			Colorful:                  false,            // Disable color
-		},
-	)
-	db, err := gorm.Open(mysql.Open(config.MysqlDataSource), &gorm.Config{
-		Logger: newLogger,
-	})
-	if err != nil {
-		panic(err.Error())
-	}
+// accountsBatch is the accounts of a batch and their hashes
+type accountsBatch struct {
+	accounts []*utils.AccountInfo
+	hashes   [][]byte
+}
 
+// NewWitness returns the witness service of the accounts, the padding
+// accounts are indexed from totalOpsNumber
+func NewWitness(accountTree bsmt.SparseMerkleTree, totalOpsNumber uint32,
+	accounts utils.AccountSource, cexAssets []utils.CexAssetInfo,
+	tierManifest *utils.TierManifest, witnessModel WitnessModel) *Witness {
 	return &Witness{
 		accountTree:        accountTree,
 		totalOpsNumber:     totalOpsNumber,
-		witnessModel:       NewWitnessModel(db, config.DbSuffix),
-		ops:                ops,
+		witnessModel:       witnessModel,
+		accounts:           accounts,
 		cexAssets:          cexAssets,
 		ch:                 make(chan BatchWitness, 100),
 		quit:               make(chan int, 1),
 		currentBatchNumber: 0,
-		accountHashChan:    make(map[int][]chan []byte),
+		tierManifest:       tierManifest,
 	}
 }
 
-func (w *Witness) Run() {
+// Run generates the witnesses of the batches after the latest one in db. It
+// returns when all the witnesses are written or ctx is canceled, the account
+// tree is rolled back to the latest witness in db when it runs again.
+func (w *Witness) Run(ctx context.Context) error {
 	// create table first
-	w.witnessModel.CreateBatchWitnessTable()
+	err := w.witnessModel.CreateBatchWitnessTable()
+	if err != nil {
+		return fmt.Errorf("create witness table failed: %s", err.Error())
+	}
 	var latestWitness *BatchWitness
-	var err error
 	for {
 		latestWitness, err = w.witnessModel.GetLatestBatchWitness()
 		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
-			fmt.Println("get latest witness timeout, retry...:", err.Error())
-			time.Sleep(1 * time.Second)
+			slog.Warn("get latest witness timeout, retry", "err", err)
+			utils.DbRetries.WithLabelValues("get_latest_witness").Inc()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(1 * time.Second):
+			}
 			continue
 		}
 		break
@@ -90,246 +88,338 @@ func (w *Witness) Run() {
 		height = -1
 	}
 	if err != nil && err != utils.DbErrNotFound {
-		panic(err.Error())
+		return fmt.Errorf("get latest witness failed: %w", err)
 	}
 	if err == nil {
+		// the witnesses generated so far must be batched with the same tiers
+		err = w.tierManifest.Check(latestWitness.TierManifestHash)
+		if err != nil {
+			return err
+		}
 		height = latestWitness.Height
-		w.cexAssets = w.GetCexAssets(latestWitness)
+		w.cexAssets, err = w.GetCexAssets(latestWitness)
+		if err != nil {
+			return err
+		}
 	}
 	batchNumber := w.GetBatchNumber()
 	if height == int64(batchNumber)-1 {
-		fmt.Println("already generate all accounts witness")
-		return
+		slog.Info("already generate all accounts witness")
+		return nil
 	}
 	w.currentBatchNumber = height
-	fmt.Println("latest height is ", height)
+	slog.Info("latest witness is found", utils.LogKeyHeight, height)
 
 	// tree version
 	if w.accountTree.LatestVersion() > bsmt.Version(height+1) {
 		rollbackVersion := bsmt.Version(height + 1)
 		err = w.accountTree.Rollback(rollbackVersion)
 		if err != nil {
-			fmt.Println("rollback failed ", rollbackVersion, err.Error())
-			panic("rollback failed")
-		} else {
-			fmt.Printf("rollback to %x\n", w.accountTree.Root())
+			return fmt.Errorf("rollback account tree to version %d failed: %s", rollbackVersion, err.Error())
 		}
+		slog.Info("account tree is rolled back", "version", rollbackVersion, "root", fmt.Sprintf("%x", w.accountTree.Root()))
 	} else if w.accountTree.LatestVersion() < bsmt.Version(height+1) {
-		panic("account tree version is less than current height")
+		return fmt.Errorf("account tree version %d is less than current height %d", w.accountTree.LatestVersion(), height)
 	} else {
-		fmt.Println("normal starting...")
+		slog.Info("normal starting")
 	}
+	utils.AccountTreeVersion.Set(float64(w.accountTree.LatestVersion()))
 
-	w.PaddingAccounts()
+	// the loaders and the db writer cancel the run with their error
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go w.WriteBatchWitnessToDB(cancel)
 
-	poseidonHasher := poseidon.NewPoseidon()
-	go w.WriteBatchWitnessToDB()
-	for k := range w.ops {
-		w.accountHashChan[k] = make([]chan []byte, utils.BatchCreateUserOpsCountsTiers[k])
-		for p := 0; p < utils.BatchCreateUserOpsCountsTiers[k]; p++ {
-			w.accountHashChan[k][p] = make(chan []byte, 1)
+	tierCounts := w.accounts.TierCounts()
+	startBatchNum := 0
+	paddingStartIndex := int(w.totalOpsNumber)
+	recoveredBatchNum := int(height)
+	for p, k := range w.batchNumberMappingKeys {
+		endBatchNum := w.batchNumberMappingValues[p]
+		var it utils.AccountIterator
+		tierPaddingStartIndex := paddingStartIndex
+		paddingStartIndex += utils.PaddedAccountsCount(k, tierCounts[k]) - tierCounts[k]
+		if endBatchNum-1 <= recoveredBatchNum {
+			startBatchNum = endBatchNum
+			continue
+		}
+		it, err = w.accounts.Accounts(k)
+		if err != nil {
+			cancel(fmt.Errorf("read accounts of %d assets tier failed: %s", k, err.Error()))
+			break
+		}
+		_, it = utils.PaddingAccountsIterator(it, k, tierCounts[k], tierPaddingStartIndex)
+		// the next batch is read and hashed while the tree is updated with the current one
+		batches := make(chan accountsBatch, 1)
+		go func(startBatchNum int, endBatchNum int) {
+			defer close(batches)
+			err := w.loadBatches(ctx, k, it, startBatchNum, endBatchNum, recoveredBatchNum, batches)
+			if err != nil {
+				cancel(fmt.Errorf("load accounts of %d assets tier failed: %w", k, err))
+			}
+		}(startBatchNum, endBatchNum)
+		firstBatchNum := startBatchNum
+		if recoveredBatchNum+1 > firstBatchNum {
+			firstBatchNum = recoveredBatchNum + 1
+		}
+		for i := firstBatchNum; i < endBatchNum; i++ {
+			batch, ok := <-batches
+			if !ok {
+				err = context.Cause(ctx)
+				break
+			}
+			var witness BatchWitness
+			witness, err = w.generateBatchWitness(k, i, batch)
+			if err != nil {
+				break
+			}
+			select {
+			case w.ch <- witness:
+			case <-ctx.Done():
+				err = context.Cause(ctx)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			cancel(err)
+		}
+		// the loader quits after the tier or when the run is canceled
+		for range batches {
 		}
+		it.Close()
+		if err != nil {
+			break
+		}
+		startBatchNum = endBatchNum
 	}
 
+	close(w.ch)
+	<-w.quit
+	err = context.Cause(ctx)
+	if err != nil {
+		return err
+	}
+	// fmt.Println("cex assets info is ", w.cexAssets)
+	slog.Info("witness run finished", "root", fmt.Sprintf("%x", w.accountTree.Root()))
+	return nil
+}
+
+// loadBatches reads the accounts of the batches of a tier from it and hashes
+// them, the batches up to recoveredBatchNum are skipped without hashing. Only
+// the batches in the channel are kept in memory.
+func (w *Witness) loadBatches(ctx context.Context, assetKey int, it utils.AccountIterator, startBatchNum int, endBatchNum int,
+	recoveredBatchNum int, batches chan<- accountsBatch) error {
+	userOpsPerBatch := utils.BatchCreateUserOpsCountsTiers[assetKey]
 	cpuCores := runtime.NumCPU()
 	workersNum := 1
 	if cpuCores > 2 {
 		workersNum = cpuCores - 2
 	}
-
-	userOpsPerBatch := 0
-	startBatchNum := 0
-	recoveredBatchNum := int(height)
-	for p, k := range w.batchNumberMappingKeys {
+	averageCount := (userOpsPerBatch + workersNum - 1) / workersNum
+	for j := startBatchNum; j < endBatchNum; j++ {
+		batch := accountsBatch{
+			accounts: make([]*utils.AccountInfo, userOpsPerBatch),
+			hashes:   make([][]byte, userOpsPerBatch),
+		}
+		for i := 0; i < userOpsPerBatch; i++ {
+			account, err := it.Next()
+			if err == io.EOF {
+				return fmt.Errorf("the accounts of batch %d are missing", j)
+			}
+			if err != nil {
+				return err
+			}
+			batch.accounts[i] = account
+		}
+		if j <= recoveredBatchNum {
+			continue
+		}
 		var wg sync.WaitGroup
-		endBatchNum := w.batchNumberMappingValues[p]
-		userOpsPerBatch = utils.BatchCreateUserOpsCountsTiers[k]
-		averageCount := userOpsPerBatch/workersNum + 1
-		for i := 0; i < workersNum; i++ {
+		errs := make([]error, workersNum)
+		for i := 0; i < workersNum && i*averageCount < userOpsPerBatch; i++ {
 			wg.Add(1)
 			go func(index int) {
 				defer wg.Done()
-				for j := startBatchNum; j < endBatchNum; j++ {
-					if j <= recoveredBatchNum {
-						continue
-					}
-					if index*averageCount >= userOpsPerBatch {
-						break
-					}
-					lowAccountIndex := index*averageCount + (j-startBatchNum)*userOpsPerBatch
-					highAccountIndex := averageCount + lowAccountIndex
-					if highAccountIndex > (j-startBatchNum+1)*userOpsPerBatch {
-						highAccountIndex = (j - startBatchNum + 1) * userOpsPerBatch
+				poseidonHasher := poseidon.NewPoseidon()
+				for p := index * averageCount; p < (index+1)*averageCount && p < userOpsPerBatch; p++ {
+					batch.hashes[p], errs[index] = utils.AccountInfoToHash(batch.accounts[p], &poseidonHasher)
+					if errs[index] != nil {
+						return
 					}
-					currentAccountIndex := (j - startBatchNum) * userOpsPerBatch
-					// fmt.Printf("worker num: %d, lowAccountInde: %d, highAccountIndex: %d, current: %d\n", index, lowAccountIndex, highAccountIndex, currentAccountIndex)
-					w.ComputeAccountHash(k, uint32(lowAccountIndex), uint32(highAccountIndex), uint32(currentAccountIndex))
 				}
 			}(i)
 		}
-		for i := startBatchNum; i < endBatchNum; i++ {
-			if i <= recoveredBatchNum {
-				continue
-			}
-			batchCreateUserWit := &utils.BatchCreateUserWitness{
-				BeforeAccountTreeRoot: w.accountTree.Root(),
-				BeforeCexAssets:       make([]utils.CexAssetInfo, utils.AssetCounts),
-				CreateUserOps:         make([]utils.CreateUserOperation, userOpsPerBatch),
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
 			}
+		}
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
 
-			copy(batchCreateUserWit.BeforeCexAssets[:], w.cexAssets[:])
-			for j := 0; j < len(w.cexAssets); j++ {
-				commitments := utils.ConvertAssetInfoToBytes(w.cexAssets[j])
-				for p := 0; p < len(commitments); p++ {
-					poseidonHasher.Write(commitments[p])
-				}
-			}
-			batchCreateUserWit.BeforeCEXAssetsCommitment = poseidonHasher.Sum(nil)
-			poseidonHasher.Reset()
+// generateBatchWitness creates the users of the batch in the account tree and
+// commits the tree
+func (w *Witness) generateBatchWitness(assetKey int, batchNum int, batch accountsBatch) (BatchWitness, error) {
+	userOpsPerBatch := len(batch.accounts)
+	poseidonHasher := poseidon.NewPoseidon()
+	batchCreateUserWit := &utils.BatchCreateUserWitness{
+		BeforeAccountTreeRoot: w.accountTree.Root(),
+		BeforeCexAssets:       make([]utils.CexAssetInfo, utils.AssetCounts),
+		CreateUserOps:         make([]utils.CreateUserOperation, userOpsPerBatch),
+	}
 
-			relativeBatchNum := i - startBatchNum
-			for j := relativeBatchNum * userOpsPerBatch; j < (relativeBatchNum+1)*userOpsPerBatch; j++ {
-				w.ExecuteBatchCreateUser(k, uint32(j), uint32(relativeBatchNum*userOpsPerBatch), batchCreateUserWit)
-			}
-			for j := 0; j < len(w.cexAssets); j++ {
-				commitments := utils.ConvertAssetInfoToBytes(w.cexAssets[j])
-				for p := 0; p < len(commitments); p++ {
-					poseidonHasher.Write(commitments[p])
-				}
-			}
-			batchCreateUserWit.AfterCEXAssetsCommitment = poseidonHasher.Sum(nil)
-			poseidonHasher.Reset()
-			batchCreateUserWit.AfterAccountTreeRoot = w.accountTree.Root()
+	copy(batchCreateUserWit.BeforeCexAssets[:], w.cexAssets[:])
+	for j := 0; j < len(w.cexAssets); j++ {
+		commitments := utils.ConvertAssetInfoToBytes(w.cexAssets[j])
+		for p := 0; p < len(commitments); p++ {
+			poseidonHasher.Write(commitments[p])
+		}
+	}
+	batchCreateUserWit.BeforeCEXAssetsCommitment = poseidonHasher.Sum(nil)
+	poseidonHasher.Reset()
 
-			// compute batch commitment
-			batchCreateUserWit.BatchCommitment = poseidon.PoseidonBytes(batchCreateUserWit.BeforeAccountTreeRoot,
-				batchCreateUserWit.AfterAccountTreeRoot,
-				batchCreateUserWit.BeforeCEXAssetsCommitment,
-				batchCreateUserWit.AfterCEXAssetsCommitment)
-			// bz, err := json.Marshal(batchCreateUserWit)
-			var serializeBuf bytes.Buffer
-			enc := gob.NewEncoder(&serializeBuf)
-			err := enc.Encode(batchCreateUserWit)
-			if err != nil {
-				panic(err.Error())
-			}
-			// startTime := time.Now()
-			buf := serializeBuf.Bytes()
-			compressedBuf := s2.Encode(nil, buf)
-			// endTime := time.Now()
-			// fmt.Println("compress time is ", endTime.Sub(startTime), " len of compressed buf is ", len(buf), len(compressedBuf))
-			witness := BatchWitness{
-				Height:      int64(i),
-				WitnessData: base64.StdEncoding.EncodeToString(compressedBuf),
-				Status:      StatusPublished,
-			}
-			accPrunedVersion := bsmt.Version(atomic.LoadInt64(&w.currentBatchNumber) + 1)
-			ver, err := w.accountTree.Commit(&accPrunedVersion)
-			if err != nil {
-				fmt.Println("ver is ", ver)
-				panic(err.Error())
-			}
-			// fmt.Printf("ver is %d account tree root is %x\n", ver, w.accountTree.Root())
-			w.ch <- witness
+	for j := 0; j < userOpsPerBatch; j++ {
+		err := w.ExecuteBatchCreateUser(batch.accounts[j], batch.hashes[j], j, batchCreateUserWit)
+		if err != nil {
+			return BatchWitness{}, err
+		}
+	}
+	for j := 0; j < len(w.cexAssets); j++ {
+		commitments := utils.ConvertAssetInfoToBytes(w.cexAssets[j])
+		for p := 0; p < len(commitments); p++ {
+			poseidonHasher.Write(commitments[p])
 		}
-		wg.Wait()
-		startBatchNum = endBatchNum
 	}
+	batchCreateUserWit.AfterCEXAssetsCommitment = poseidonHasher.Sum(nil)
+	poseidonHasher.Reset()
+	batchCreateUserWit.AfterAccountTreeRoot = w.accountTree.Root()
 
-	close(w.ch)
-	<-w.quit
-	// fmt.Println("cex assets info is ", w.cexAssets)
-	fmt.Printf("witness run finished, the account tree root is %x\n", w.accountTree.Root())
+	// compute batch commitment
+	batchCreateUserWit.BatchCommitment = poseidon.PoseidonBytes(batchCreateUserWit.BeforeAccountTreeRoot,
+		batchCreateUserWit.AfterAccountTreeRoot,
+		batchCreateUserWit.BeforeCEXAssetsCommitment,
+		batchCreateUserWit.AfterCEXAssetsCommitment)
+	// bz, err := json.Marshal(batchCreateUserWit)
+	var serializeBuf bytes.Buffer
+	enc := gob.NewEncoder(&serializeBuf)
+	err := enc.Encode(batchCreateUserWit)
+	if err != nil {
+		return BatchWitness{}, fmt.Errorf("encode witness of height %d failed: %s", batchNum, err.Error())
+	}
+	// startTime := time.Now()
+	buf := serializeBuf.Bytes()
+	compressedBuf := s2.Encode(nil, buf)
+	// endTime := time.Now()
+	// fmt.Println("compress time is ", endTime.Sub(startTime), " len of compressed buf is ", len(buf), len(compressedBuf))
+	witness := BatchWitness{
+		Height:           int64(batchNum),
+		WitnessData:      base64.StdEncoding.EncodeToString(compressedBuf),
+		Status:           StatusPublished,
+		TierManifestHash: w.tierManifest.Hash,
+		AssetsCount:      int64(assetKey),
+	}
+	accPrunedVersion := bsmt.Version(atomic.LoadInt64(&w.currentBatchNumber) + 1)
+	ver, err := w.accountTree.Commit(&accPrunedVersion)
+	if err != nil {
+		return BatchWitness{}, fmt.Errorf("commit account tree of height %d failed: %s", batchNum, err.Error())
+	}
+	slog.Debug("account tree is committed", utils.LogKeyHeight, batchNum, utils.LogKeyAssetsCount, assetKey, "version", ver, "root", fmt.Sprintf("%x", w.accountTree.Root()))
+	utils.AccountTreeVersion.Set(float64(ver))
+	return witness, nil
 }
 
-func (w *Witness) GetCexAssets(wit *BatchWitness) []utils.CexAssetInfo {
+func (w *Witness) GetCexAssets(wit *BatchWitness) ([]utils.CexAssetInfo, error) {
 	witness := utils.DecodeBatchWitness(wit.WitnessData)
 	if witness == nil {
-		panic("decode invalid witness data")
+		return nil, fmt.Errorf("decode invalid witness data of height %d", wit.Height)
+	}
+	cexAssetsInfo, err := utils.RecoverAfterCexAssets(witness)
+	if err != nil {
+		return nil, err
 	}
-	cexAssetsInfo := utils.RecoverAfterCexAssets(witness)
-	fmt.Println("recover cex assets successfully")
-	return cexAssetsInfo
+	slog.Info("recover cex assets successfully", utils.LogKeyHeight, wit.Height)
+	return cexAssetsInfo, nil
 }
 
-func (w *Witness) WriteBatchWitnessToDB() {
+// WriteBatchWitnessToDB writes the witnesses generated by Run, the run is
+// canceled if a witness can't be written
+func (w *Witness) WriteBatchWitnessToDB(cancel context.CancelCauseFunc) {
+	defer func() {
+		w.quit <- 0
+	}()
 	datas := make([]BatchWitness, 1)
 	for witness := range w.ch {
 		datas[0] = witness
 		err := w.witnessModel.CreateBatchWitness(datas)
 		if err != nil {
-			panic("create batch witness failed " + err.Error())
+			cancel(fmt.Errorf("create batch witness of height %d failed: %s", witness.Height, err.Error()))
+			return
 		}
 		atomic.StoreInt64(&w.currentBatchNumber, witness.Height)
+		utils.WitnessBatchesGenerated.WithLabelValues(strconv.FormatInt(witness.AssetsCount, 10)).Inc()
+		slog.Debug("save batch to db", utils.LogKeyHeight, witness.Height, utils.LogKeyAssetsCount, witness.AssetsCount)
 		if witness.Height%100 == 0 {
-			fmt.Println("save batch ", witness.Height, " to db")
+			slog.Info("save batch to db", utils.LogKeyHeight, witness.Height, utils.LogKeyAssetsCount, witness.AssetsCount)
 		}
 	}
-	w.quit <- 0
 }
 
-func (w *Witness) ComputeAccountHash(key int, accountIndex uint32, highAccountIndex uint32, currentIndex uint32) {
-	poseidonHasher := poseidon.NewPoseidon()
-	for i := accountIndex; i < highAccountIndex; i++ {
-		w.accountHashChan[key][i-currentIndex] <- utils.AccountInfoToHash(&w.ops[key][i], &poseidonHasher)
-	}
-}
-
-func (w *Witness) ExecuteBatchCreateUser(assetKey int, accountIndex uint32, currentAccountIndex uint32, batchCreateUserWit *utils.BatchCreateUserWitness) {
-	index := accountIndex - currentAccountIndex
-	account := w.ops[assetKey][accountIndex]
+// ExecuteBatchCreateUser sets the account at index of the batch in the tree
+// and adds its assets to the cex assets
+func (w *Witness) ExecuteBatchCreateUser(account *utils.AccountInfo, accountHash []byte, index int, batchCreateUserWit *utils.BatchCreateUserWitness) error {
 	batchCreateUserWit.CreateUserOps[index].BeforeAccountTreeRoot = w.accountTree.Root()
 	accountProof, err := w.accountTree.GetProof(uint64(account.AccountIndex))
 	if err != nil {
-		panic(err.Error())
+		return fmt.Errorf("get proof of account %d failed: %s", account.AccountIndex, err.Error())
 	}
-	copy(batchCreateUserWit.CreateUserOps[index].AccountProof[:], accountProof[:])
+	batchCreateUserWit.CreateUserOps[index].AccountProof = make([][]byte, utils.AccountTreeDepth)
+	copy(batchCreateUserWit.CreateUserOps[index].AccountProof, accountProof)
 	for p := 0; p < len(account.Assets); p++ {
 		// update cexAssetInfo
-		w.cexAssets[account.Assets[p].Index].TotalEquity = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].TotalEquity, account.Assets[p].Equity)
-		w.cexAssets[account.Assets[p].Index].TotalDebt = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].TotalDebt, account.Assets[p].Debt)
-		w.cexAssets[account.Assets[p].Index].LoanCollateral = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].LoanCollateral, account.Assets[p].Loan)
-		w.cexAssets[account.Assets[p].Index].MarginCollateral = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].MarginCollateral, account.Assets[p].Margin)
-		w.cexAssets[account.Assets[p].Index].PortfolioMarginCollateral = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].PortfolioMarginCollateral, account.Assets[p].PortfolioMargin)
+		cexAsset := w.cexAssets[account.Assets[p].Index]
+		var errs [5]error
+		cexAsset.TotalEquity, errs[0] = utils.CheckedAdd(cexAsset.TotalEquity, account.Assets[p].Equity)
+		cexAsset.TotalDebt, errs[1] = utils.CheckedAdd(cexAsset.TotalDebt, account.Assets[p].Debt)
+		cexAsset.LoanCollateral, errs[2] = utils.CheckedAdd(cexAsset.LoanCollateral, account.Assets[p].Loan)
+		cexAsset.MarginCollateral, errs[3] = utils.CheckedAdd(cexAsset.MarginCollateral, account.Assets[p].Margin)
+		cexAsset.PortfolioMarginCollateral, errs[4] = utils.CheckedAdd(cexAsset.PortfolioMarginCollateral, account.Assets[p].PortfolioMargin)
+		for _, err := range errs {
+			if err != nil {
+				return fmt.Errorf("account %d total %s: %w", account.AccountIndex, cexAsset.Symbol, err)
+			}
+		}
+		w.cexAssets[account.Assets[p].Index] = cexAsset
 	}
 	// update account tree
-	accountHash := <-w.accountHashChan[assetKey][index]
 	err = w.accountTree.Set(uint64(account.AccountIndex), accountHash)
 	// fmt.Printf("account index %d, hash: %x\n", account.AccountIndex, accountHash)
 	if err != nil {
-		panic(err.Error())
+		return fmt.Errorf("set account %d failed: %s", account.AccountIndex, err.Error())
 	}
 	batchCreateUserWit.CreateUserOps[index].AfterAccountTreeRoot = w.accountTree.Root()
 	batchCreateUserWit.CreateUserOps[index].AccountIndex = account.AccountIndex
 	batchCreateUserWit.CreateUserOps[index].AccountIdHash = account.AccountId
 	batchCreateUserWit.CreateUserOps[index].Assets = account.Assets
+	return nil
 }
 
 func (w *Witness) GetBatchNumber() int {
 	b := 0
-	keys := make([]int, 0)
-	for k := range w.ops {
-		keys = append(keys, k)
-	}
-	sort.Ints(keys)
-	w.batchNumberMappingKeys = keys
-	w.batchNumberMappingValues = make([]int, len(keys))
-	for i, k := range keys {
-		opsPerBatch := utils.BatchCreateUserOpsCountsTiers[k]
-		b += (len(w.ops[k]) + opsPerBatch - 1) / opsPerBatch
+	tierCounts := w.accounts.TierCounts()
+	w.batchNumberMappingKeys = utils.SortedTiers(w.accounts)
+	w.batchNumberMappingValues = make([]int, len(w.batchNumberMappingKeys))
+	for i, k := range w.batchNumberMappingKeys {
+		b += utils.PaddedAccountsCount(k, tierCounts[k]) / utils.BatchCreateUserOpsCountsTiers[k]
 		w.batchNumberMappingValues[i] = b
 	}
 	return b
 }
-
-func (w *Witness) PaddingAccounts() {
-	keys := make([]int, 0)
-	for k := range w.ops {
-		keys = append(keys, k)
-	}
-	sort.Ints(keys)
-	paddingStartIndex := int(w.totalOpsNumber)
-	for _, k := range keys {
-		paddingStartIndex, w.ops[k] = utils.PaddingAccounts(w.ops[k], k, paddingStartIndex)
-	}
-}
@@ -29,8 +29,16 @@ type (
 		GetLatestBatchWitness() (witness *BatchWitness, err error)
 		GetLatestBatchWitnessByStatus(status int64) (witness *BatchWitness, err error)
 		GetAllBatchHeightsByStatus(status int64, limit int, offset int) (witnessHeights []int64, err error)
-		GetAndUpdateBatchesWitnessByStatus(beforeStatus, afterStatus int64, count int32) (witness [](*BatchWitness), err error)
-		GetAndUpdateBatchesWitnessByHeight(height int, beforeStatus, afterStatus int64) (witness [](*BatchWitness), err error)
+		GetAllBatchTasksByStatus(status int64, limit int, offset int) (tasks []BatchTask, err error)
+		GetAndUpdateBatchesWitnessByStatus(beforeStatus, afterStatus int64, assetsCount int64, count int32, lease Lease) (witness [](*BatchWitness), err error)
+		GetAndUpdateBatchesWitnessByHeight(height int, beforeStatus, afterStatus int64, lease Lease) (witness [](*BatchWitness), err error)
+		GetAndUpdateExpiredBatchWitness(now int64, lease Lease) (witness *BatchWitness, err error)
+		RenewBatchWitnessLease(height int64, lease Lease) error
+		ReleaseBatchWitness(height int64, owner string) error
+		FinishBatchWitness(height int64, owner string) error
+		DbNow() (now int64, err error)
+		GetReceivedBatchWitnessCount() (count int64, err error)
+		GetPublishedBatchWitnessCount(assetsCount int64) (count int64, err error)
 		CreateBatchWitness(witness []BatchWitness) error
 		GetRowCounts() (count []int64, err error)
 	}
@@ -45,6 +53,28 @@ type (
 		Height      int64 `gorm:"index:idx_height,unique"`
 		WitnessData string
 		Status      int64 `gorm:"index"`
+		// TierManifestHash is the hash of the tier manifest the witness is generated with
+		TierManifestHash string
+		// AssetsCount is the tier of the batch, it is NULL for the witnesses of
+		// former releases, they are the tier 0
+		AssetsCount int64 `gorm:"index"`
+		// Lease is held by the prover which received the witness
+		Lease Lease `gorm:"embedded;embeddedPrefix:lease_"`
+	}
+
+	// BatchTask is the height and tier of a witness to prove
+	BatchTask struct {
+		Height      int64
+		AssetsCount int64
+	}
+
+	// Lease of a received witness, the prover renews Heartbeat and Expiry
+	// while proving. Once the lease expires, another prover reclaims the
+	// witness. Heartbeat and Expiry are unix seconds.
+	Lease struct {
+		Owner     string
+		Heartbeat int64
+		Expiry    int64 `gorm:"index"`
 	}
 )
 
@@ -71,7 +101,7 @@ func (m *defaultWitnessModel) GetLatestBatchWitnessHeight() (batchNumber int64,
 	var height int64
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Select("height").Order("height desc").Limit(1).Find(&height)
 	if dbTx.Error != nil {
-		return 0, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return 0, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return 0, utils.DbErrNotFound
 	}
@@ -80,9 +110,9 @@ func (m *defaultWitnessModel) GetLatestBatchWitnessHeight() (batchNumber int64,
 
 func (m *defaultWitnessModel) GetLatestBatchWitness() (witness *BatchWitness, err error) {
 	var height int64
-	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Debug().Select("height").Order("height desc").Limit(1).Find(&height)
+	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Select("height").Order("height desc").Limit(1).Find(&height)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	}
@@ -93,68 +123,188 @@ func (m *defaultWitnessModel) GetLatestBatchWitness() (witness *BatchWitness, er
 func (m *defaultWitnessModel) GetLatestBatchWitnessByStatus(status int64) (witness *BatchWitness, err error) {
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Unscoped().Where("status = ?", status).Limit(1).Find(&witness)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	}
 	return witness, nil
 }
 
-func (m *defaultWitnessModel) GetAndUpdateBatchesWitnessByStatus(beforeStatus, afterStatus int64, count int32) (witness [](*BatchWitness), err error) {
+// GetAndUpdateBatchesWitnessByStatus updates the status of at most count witnesses of the assets count tier
+func (m *defaultWitnessModel) GetAndUpdateBatchesWitnessByStatus(beforeStatus, afterStatus int64, assetsCount int64, count int32, lease Lease) (witness [](*BatchWitness), err error) {
 	
 	err = m.DB.Table(m.table).Transaction(func(tx *gorm.DB) error {
-		// dbTx := tx.Where("status = ?", beforeStatus).Limit(int(count)).Clauses(clause.Locking{Strength: "UPDATE",  Options: "SKIP LOCKED"}).Find(&witness)
-		dbTx := tx.Clauses(utils.MaxExecutionTimeHint).Debug().Where("status = ?", beforeStatus).Order("height asc").Limit(int(count)).Clauses(clause.Locking{Strength: "UPDATE", }).Find(&witness)
+		// the witnesses locked by other provers are skipped
+		dbTx := tx.Clauses(utils.MaxExecutionTimeHint).Where("status = ? and "+assetsCountCondition(assetsCount), beforeStatus, assetsCount).Order("height asc").Limit(int(count)).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Find(&witness)
 
 		if dbTx.Error != nil {
-			return utils.ConvertMysqlErrToDbErr(dbTx.Error)
+			return utils.ConvertDbErr(dbTx.Error)
 		} else if dbTx.RowsAffected == 0 {
 			return utils.DbErrNotFound
 		}
 
-		updateObject := make(map[string]interface{})
+		updateObject := leaseUpdateObject(lease)
 		for _, w := range witness {
 			updateObject["Status"] = afterStatus
-			dbTx := tx.Debug().Where("height = ?", w.Height).Updates(&updateObject)
+			dbTx := tx.Where("height = ?", w.Height).Updates(&updateObject)
 
 			if dbTx.Error != nil {
 				return dbTx.Error
 			}
+			w.Status = afterStatus
+			w.Lease = lease
 		}
 		return nil
 	})
 	return witness, err
 }
 
-func (m *defaultWitnessModel) GetAndUpdateBatchesWitnessByHeight(height int, beforeStatus, afterStatus int64) (witness [](*BatchWitness), err error) {
+func (m *defaultWitnessModel) GetAndUpdateBatchesWitnessByHeight(height int, beforeStatus, afterStatus int64, lease Lease) (witness [](*BatchWitness), err error) {
 	err = m.DB.Table(m.table).Transaction(func(tx *gorm.DB) error {
 		// dbTx := tx.Where("status = ?", beforeStatus).Limit(int(count)).Clauses(clause.Locking{Strength: "UPDATE",  Options: "SKIP LOCKED"}).Find(&witness)
 		dbTx := tx.Clauses(utils.MaxExecutionTimeHint).Where("height = ? and status = ?", height, beforeStatus).Order("height asc").Find(&witness)
 
 		if dbTx.Error != nil {
-			return utils.ConvertMysqlErrToDbErr(dbTx.Error)
+			return utils.ConvertDbErr(dbTx.Error)
 		} else if dbTx.RowsAffected == 0 {
 			return utils.DbErrNotFound
 		}
 
-		updateObject := make(map[string]interface{})
+		updateObject := leaseUpdateObject(lease)
 		for _, w := range witness {
 			updateObject["Status"] = afterStatus
-			dbTx := tx.Debug().Where("height = ?", w.Height).Updates(&updateObject)
+			dbTx := tx.Where("height = ?", w.Height).Updates(&updateObject)
 
 			if dbTx.Error != nil {
 				return dbTx.Error
 			}
+			w.Status = afterStatus
+			w.Lease = lease
 		}
 		return nil
 	})
 	return witness, err
 }
 
+// GetAndUpdateExpiredBatchWitness takes over a received witness whose lease
+// expired before now, the witnesses received before leases were recorded
+// have a NULL expiry and are taken over too
+func (m *defaultWitnessModel) GetAndUpdateExpiredBatchWitness(now int64, lease Lease) (witness *BatchWitness, err error) {
+	err = m.DB.Table(m.table).Transaction(func(tx *gorm.DB) error {
+		dbTx := tx.Clauses(utils.MaxExecutionTimeHint).Where("status = ? and (lease_expiry IS NULL or lease_expiry < ?)", StatusReceived, now).Order("height asc").Limit(1).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Find(&witness)
+		if dbTx.Error != nil {
+			return utils.ConvertDbErr(dbTx.Error)
+		} else if dbTx.RowsAffected == 0 {
+			return utils.DbErrNotFound
+		}
+		dbTx = tx.Where("height = ?", witness.Height).Updates(leaseUpdateObject(lease))
+		if dbTx.Error != nil {
+			return dbTx.Error
+		}
+		witness.Lease = lease
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return witness, nil
+}
+
+// RenewBatchWitnessLease extends the lease of a received witness, it returns
+// utils.ErrLeaseLost if the witness is no longer leased to lease.Owner
+func (m *defaultWitnessModel) RenewBatchWitnessLease(height int64, lease Lease) error {
+	dbTx := m.DB.Table(m.table).Where("height = ? and status = ? and lease_owner = ?", height, StatusReceived, lease.Owner).Updates(leaseUpdateObject(lease))
+	if dbTx.Error != nil {
+		return utils.ConvertDbErr(dbTx.Error)
+	} else if dbTx.RowsAffected == 0 {
+		return utils.ErrLeaseLost
+	}
+	return nil
+}
+
+// ReleaseBatchWitness hands a received witness back to the published status,
+// it returns utils.ErrLeaseLost if the witness is no longer leased to owner
+func (m *defaultWitnessModel) ReleaseBatchWitness(height int64, owner string) error {
+	updateObject := leaseUpdateObject(Lease{})
+	updateObject["Status"] = StatusPublished
+	dbTx := m.DB.Table(m.table).Where("height = ? and status = ? and lease_owner = ?", height, StatusReceived, owner).Updates(updateObject)
+	if dbTx.Error != nil {
+		return utils.ConvertDbErr(dbTx.Error)
+	} else if dbTx.RowsAffected == 0 {
+		return utils.ErrLeaseLost
+	}
+	return nil
+}
+
+// FinishBatchWitness updates a received witness to the finished status, it
+// returns utils.ErrLeaseLost if the witness is no longer leased to owner
+func (m *defaultWitnessModel) FinishBatchWitness(height int64, owner string) error {
+	dbTx := m.DB.Table(m.table).Where("height = ? and status = ? and lease_owner = ?", height, StatusReceived, owner).Updates(map[string]interface{}{
+		"status":     StatusFinished,
+		"updated_at": time.Now(),
+	})
+	if dbTx.Error != nil {
+		return utils.ConvertDbErr(dbTx.Error)
+	} else if dbTx.RowsAffected == 0 {
+		return utils.ErrLeaseLost
+	}
+	return nil
+}
+
+// DbNow returns the unix seconds of the database clock. The leases are
+// stamped and expired by it, so the clocks of the provers may be skewed.
+func (m *defaultWitnessModel) DbNow() (now int64, err error) {
+	query := "SELECT UNIX_TIMESTAMP()"
+	switch m.DB.Dialector.Name() {
+	case utils.DbDriverSqlite:
+		query = "SELECT CAST(strftime('%s', 'now') AS INTEGER)"
+	case utils.DbDriverPostgres:
+		query = "SELECT CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT)"
+	}
+	dbTx := m.DB.Raw(query).Scan(&now)
+	if dbTx.Error != nil {
+		return 0, utils.ConvertDbErr(dbTx.Error)
+	}
+	return now, nil
+}
+
+func (m *defaultWitnessModel) GetReceivedBatchWitnessCount() (count int64, err error) {
+	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("status = ?", StatusReceived).Count(&count)
+	if dbTx.Error != nil {
+		return 0, utils.ConvertDbErr(dbTx.Error)
+	}
+	return count, nil
+}
+
+func (m *defaultWitnessModel) GetPublishedBatchWitnessCount(assetsCount int64) (count int64, err error) {
+	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("status = ? and "+assetsCountCondition(assetsCount), StatusPublished, assetsCount).Count(&count)
+	if dbTx.Error != nil {
+		return 0, utils.ConvertDbErr(dbTx.Error)
+	}
+	return count, nil
+}
+
+// assetsCountCondition matches the witnesses of the assets count tier, the
+// tier 0 also matches the witnesses of former releases with a NULL tier
+func assetsCountCondition(assetsCount int64) string {
+	if assetsCount == 0 {
+		return "(assets_count = ? or assets_count IS NULL)"
+	}
+	return "assets_count = ?"
+}
+
+func leaseUpdateObject(lease Lease) map[string]interface{} {
+	return map[string]interface{}{
+		"lease_owner":     lease.Owner,
+		"lease_heartbeat": lease.Heartbeat,
+		"lease_expiry":    lease.Expiry,
+	}
+}
+
 func (m *defaultWitnessModel) GetBatchWitnessByHeight(height int64) (witness *BatchWitness, err error) {
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("height = ?", height).Limit(1).Find(&witness)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	}
@@ -177,15 +327,25 @@ func (m *defaultWitnessModel) CreateBatchWitness(witness []BatchWitness) error {
 }
 
 func (m *defaultWitnessModel) GetAllBatchHeightsByStatus(status int64, limit int, offset int) (witnessHeights []int64, err error) {
-	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Debug().Select("height").Where("status = ?", status).Offset(offset).Limit(limit).Find(&witnessHeights)
+	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Select("height").Where("status = ?", status).Offset(offset).Limit(limit).Find(&witnessHeights)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	} else if dbTx.RowsAffected == 0 {
 		return nil, utils.DbErrNotFound
 	}
 	return witnessHeights, nil
 }
 
+func (m *defaultWitnessModel) GetAllBatchTasksByStatus(status int64, limit int, offset int) (tasks []BatchTask, err error) {
+	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Select("height, assets_count").Where("status = ?", status).Order("height asc").Offset(offset).Limit(limit).Find(&tasks)
+	if dbTx.Error != nil {
+		return nil, utils.ConvertDbErr(dbTx.Error)
+	} else if dbTx.RowsAffected == 0 {
+		return nil, utils.DbErrNotFound
+	}
+	return tasks, nil
+}
+
 func (m *defaultWitnessModel) UpdateBatchWitnessStatus(witness *BatchWitness, status int64) error {
 	dbTx := m.DB.Table(m.table).Where("height = ?", witness.Height).Updates(BatchWitness{
 		Model: gorm.Model{
@@ -200,28 +360,28 @@ func (m *defaultWitnessModel) GetRowCounts() (counts []int64, err error) {
 	var count int64
 	dbTx := m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Count(&count)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	}
 	counts = append(counts, count)
 	var publishedCount int64
 
-	dbTx = m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Debug().Where("status = ?", StatusPublished).Count(&publishedCount)
+	dbTx = m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("status = ?", StatusPublished).Count(&publishedCount)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	}
 	counts = append(counts, publishedCount)
 
 	var pendingCount int64
-	dbTx = m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Debug().Where("status = ?", StatusReceived).Count(&pendingCount)
+	dbTx = m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("status = ?", StatusReceived).Count(&pendingCount)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	}
 	counts = append(counts, pendingCount)
 
 	var finishedCount int64
-	dbTx = m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Debug().Where("status = ?", StatusFinished).Count(&finishedCount)
+	dbTx = m.DB.Clauses(utils.MaxExecutionTimeHint).Table(m.table).Where("status = ?", StatusFinished).Count(&finishedCount)
 	if dbTx.Error != nil {
-		return nil, utils.ConvertMysqlErrToDbErr(dbTx.Error)
+		return nil, utils.ConvertDbErr(dbTx.Error)
 	}
 	counts = append(counts, finishedCount)
 	return counts, nil
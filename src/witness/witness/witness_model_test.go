@@ -0,0 +1,167 @@
+package witness
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestWitnessModelSqlite(t *testing.T) {
+	db, err := utils.OpenDB(utils.DbDriverSqlite, filepath.Join(t.TempDir(), "por.db"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	witnessModel := NewWitnessModel(db, "_test")
+	err = witnessModel.CreateBatchWitnessTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = witnessModel.GetLatestBatchWitness()
+	if err != utils.DbErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	witnesses := make([]BatchWitness, 3)
+	for i := range witnesses {
+		witnesses[i] = BatchWitness{Height: int64(i), WitnessData: "data", Status: StatusPublished, AssetsCount: 4}
+	}
+	err = witnessModel.CreateBatchWitness(witnesses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, err := witnessModel.GetLatestBatchWitnessHeight()
+	if err != nil || height != 2 {
+		t.Fatalf("expected latest height 2, got %d %v", height, err)
+	}
+
+	// the locking clause and the mysql hint are left out by sqlite
+	lease := Lease{Owner: "prover-a", Heartbeat: 100, Expiry: 400}
+	received, err := witnessModel.GetAndUpdateBatchesWitnessByStatus(StatusPublished, StatusReceived, 4, 2, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 || received[0].Height != 0 || received[1].Height != 1 {
+		t.Fatalf("expected the witnesses of height 0 and 1, got %d", len(received))
+	}
+	count, err := witnessModel.GetPublishedBatchWitnessCount(4)
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 published witness, got %d %v", count, err)
+	}
+	err = witnessModel.ReleaseBatchWitness(0, "prover-b")
+	if err != utils.ErrLeaseLost {
+		t.Fatalf("expected lease lost, got %v", err)
+	}
+	err = witnessModel.RenewBatchWitnessLease(1, Lease{Owner: "prover-a", Heartbeat: 200, Expiry: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := witnessModel.GetAndUpdateExpiredBatchWitness(500, Lease{Owner: "prover-b", Heartbeat: 500, Expiry: 800})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Height != 0 || expired.Lease.Owner != "prover-b" {
+		t.Fatalf("expected prover-b to take over height 0, got %d %s", expired.Height, expired.Lease.Owner)
+	}
+	err = witnessModel.ReleaseBatchWitness(0, "prover-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = witnessModel.GetPublishedBatchWitnessCount(4)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 published witnesses, got %d %v", count, err)
+	}
+
+	// only the lease owner finishes the witness
+	if err = witnessModel.FinishBatchWitness(1, "prover-b"); err != utils.ErrLeaseLost {
+		t.Fatalf("expected lease lost, got %v", err)
+	}
+	if err = witnessModel.FinishBatchWitness(1, "prover-a"); err != nil {
+		t.Fatal(err)
+	}
+	finished, err := witnessModel.GetBatchWitnessByHeight(1)
+	if err != nil || finished.Status != StatusFinished {
+		t.Fatalf("expected the witness of height 1 to be finished, got %v", err)
+	}
+	now, err := witnessModel.DbNow()
+	if err != nil || now < time.Now().Unix()-60 || now > time.Now().Unix()+60 {
+		t.Fatalf("unexpected database clock %d %v", now, err)
+	}
+}
+
+// legacyBatchWitness is the witness row of the releases before the leases
+// and the tiers were recorded
+type legacyBatchWitness struct {
+	gorm.Model
+	Height      int64 `gorm:"index:idx_height,unique"`
+	WitnessData string
+	Status      int64 `gorm:"index"`
+}
+
+// newLegacyWitnessModel creates the witness table of a former release with
+// the rows, then migrates it like an upgraded witness service does
+func newLegacyWitnessModel(t *testing.T, rows []legacyBatchWitness) WitnessModel {
+	db, err := utils.OpenDB(utils.DbDriverSqlite, filepath.Join(t.TempDir(), "por.db"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Table(TableNamePrefix + "_test").AutoMigrate(legacyBatchWitness{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Table(TableNamePrefix + "_test").Create(rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	witnessModel := NewWitnessModel(db, "_test")
+	if err = witnessModel.CreateBatchWitnessTable(); err != nil {
+		t.Fatal(err)
+	}
+	return witnessModel
+}
+
+func TestWitnessModelReclaimsLegacyReceivedWitness(t *testing.T) {
+	witnessModel := newLegacyWitnessModel(t, []legacyBatchWitness{
+		{Height: 0, WitnessData: "data", Status: StatusReceived},
+	})
+	expired, err := witnessModel.GetAndUpdateExpiredBatchWitness(100, Lease{Owner: "prover-a", Heartbeat: 100, Expiry: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Height != 0 || expired.Lease.Owner != "prover-a" {
+		t.Fatalf("expected prover-a to take over height 0, got %d %s", expired.Height, expired.Lease.Owner)
+	}
+	if _, err = witnessModel.GetAndUpdateExpiredBatchWitness(200, Lease{Owner: "prover-b"}); err != utils.DbErrNotFound {
+		t.Fatalf("expected the leased witness to be kept, got %v", err)
+	}
+}
+
+func TestWitnessModelSchedulesLegacyPublishedWitness(t *testing.T) {
+	witnessModel := newLegacyWitnessModel(t, []legacyBatchWitness{
+		{Height: 0, WitnessData: "data", Status: StatusPublished},
+		{Height: 1, WitnessData: "data", Status: StatusPublished},
+	})
+	count, err := witnessModel.GetPublishedBatchWitnessCount(0)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 published witnesses of tier 0, got %d %v", count, err)
+	}
+	tasks, err := witnessModel.GetAllBatchTasksByStatus(StatusPublished, 10, 0)
+	if err != nil || len(tasks) != 2 || tasks[0].AssetsCount != 0 {
+		t.Fatalf("expected 2 tasks of tier 0, got %v %v", tasks, err)
+	}
+	received, err := witnessModel.GetAndUpdateBatchesWitnessByStatus(StatusPublished, StatusReceived, 0, 1, Lease{Owner: "prover-a", Expiry: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].Height != 0 || received[0].AssetsCount != 0 {
+		t.Fatalf("expected the witness of height 0, got %d", len(received))
+	}
+	count, err = witnessModel.GetPublishedBatchWitnessCount(0)
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 published witness of tier 0, got %d %v", count, err)
+	}
+}